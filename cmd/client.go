@@ -0,0 +1,102 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sapcc/vcf-automation/pkg/client"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// clientConfig is the local client config file, by default
+// ~/.config/automation/client.yaml. Its values are overridden by env
+// variables and flags.
+type clientConfig struct {
+	Server string `yaml:"server"`
+	Token  string `yaml:"token"`
+}
+
+// addClientFlags adds the flags of commands that talk to a running server.
+// The flags are bound when the command runs, so that commands can share the
+// viper keys.
+func addClientFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String("server", "", "automation server url (default http://localhost:8080)")
+	cmd.PersistentFlags().String("token", "", "api token of the automation server")
+	cmd.PersistentFlags().String("client-config", "", "client config file (default ~/.config/automation/client.yaml)")
+	cmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag("server", cmd.Flags().Lookup("server"))
+		viper.BindPFlag("token", cmd.Flags().Lookup("token"))
+		viper.BindPFlag("client_config", cmd.Flags().Lookup("client-config"))
+		if err := readClientConfig(); err != nil {
+			logErrorAndExit(err)
+		}
+	}
+}
+
+func readClientConfig() error {
+	viper.SetDefault("server", "http://localhost:8080")
+	fpath := viper.GetString("client_config")
+	if fpath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		fpath = path.Join(home, ".config", "automation", "client.yaml")
+		if _, err := os.Stat(fpath); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return fmt.Errorf("client config: %v", err)
+	}
+	cfg := clientConfig{}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("client config %s: %v", fpath, err)
+	}
+	if cfg.Server != "" {
+		viper.SetDefault("server", cfg.Server)
+	}
+	if cfg.Token != "" {
+		viper.SetDefault("token", cfg.Token)
+	}
+	return nil
+}
+
+func newClient() *client.Client {
+	c := client.New(viper.GetString("server"))
+	c.Token = viper.GetString("token")
+	return c
+}
+
+// parseStackArg splits <project>/<stack>
+func parseStackArg(s string) (project, stackName string) {
+	p := strings.SplitN(s, "/", 2)
+	if len(p) != 2 || p[0] == "" || p[1] == "" {
+		logErrorAndExit(fmt.Errorf("stack %q is not of the form <project>/<stack>", s))
+	}
+	return p[0], p[1]
+}
@@ -0,0 +1,127 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	configOutput   string
+	configDiffLive bool
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect configuration files",
+}
+
+var effectiveConfigCmd = &cobra.Command{
+	Use:   "effective [config_file_path]",
+	Short: "Show the merged configuration",
+	Long: `automation config effective:
+
+Read automation's yaml configuration file, merge it with the configuration
+files it extends, and print the result together with the file each value came
+from.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := stack.ReadConfig(args[0])
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		var b []byte
+		switch configOutput {
+		case "yaml":
+			b, err = yaml.Marshal(cfg.Effective())
+		case "json":
+			b, err = json.MarshalIndent(cfg.Effective(), "", "  ")
+		default:
+			err = fmt.Errorf("output format %q not supported", configOutput)
+		}
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		fmt.Println(string(b))
+	},
+}
+
+var diffConfigCmd = &cobra.Command{
+	Use:   "diff <old_config_file> <new_config_file> | --live <config_file>",
+	Short: "Show the pulumi config changes between two configurations",
+	Long: `automation config diff:
+
+Compute the pulumi config that each configuration file sets on its stack and
+print the differences key by key. Values holding json are compared value by
+value. With --live the config of the existing stack is compared with the
+config the file would set. Secret values are redacted, credentials missing in
+the environment are shown as the name of their env variable. The stack is not
+changed.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if configDiffLive {
+			return cobra.ExactArgs(1)(cmd, args)
+		}
+		return cobra.ExactArgs(2)(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		newCfg, err := stack.ReadConfig(args[len(args)-1])
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		newMap, err := stack.DesiredConfig(newCfg)
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		var oldMap auto.ConfigMap
+		if configDiffLive {
+			live, project, err := stack.LiveConfig(context.Background(), newCfg, projectRoot())
+			if err != nil {
+				logErrorAndExit(err)
+			}
+			oldMap = live
+			newMap = stack.QualifyConfig(newMap, project)
+			fmt.Printf("--- %s (live)\n+++ %s\n", newCfg.StackName, args[0])
+		} else {
+			oldCfg, err := stack.ReadConfig(args[0])
+			if err != nil {
+				logErrorAndExit(err)
+			}
+			if oldMap, err = stack.DesiredConfig(oldCfg); err != nil {
+				logErrorAndExit(err)
+			}
+			fmt.Printf("--- %s\n+++ %s\n", args[0], args[1])
+		}
+		printConfigChanges(stack.DiffConfigMaps(oldMap, newMap))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(effectiveConfigCmd)
+	configCmd.AddCommand(diffConfigCmd)
+	diffConfigCmd.Flags().BoolVar(&configDiffLive, "live", false, "compare with the config of the existing stack")
+	effectiveConfigCmd.Flags().StringVarP(&configOutput, "output", "o", "yaml", "output format: yaml or json")
+}
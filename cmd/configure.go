@@ -21,11 +21,9 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"path"
 
-	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/sapcc/vcf-automation/pkg/settings"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var configureCmd = &cobra.Command{
@@ -39,24 +37,7 @@ extension) with respect to the default configuration directory.`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := context.Background()
-		workdir := viper.GetString("work_dir")
-		projectRoot := viper.GetString("project_root")
-		if projectRoot == "" {
-			projectRoot = path.Join(workdir, "projects")
-		}
-		cfg, err := stack.ReadConfig(args[0])
-		if err != nil {
-			logErrorAndExit(err)
-		}
-		c, err := stack.NewController(cfg, projectRoot)
-		if err != nil {
-			logErrorAndExit(err)
-		}
-		err = c.InitStack(ctx)
-		if err != nil {
-			logErrorAndExit(err)
-		}
-		err = c.ConfigureStack(ctx)
+		c, err := newConfiguredController(ctx, args[0])
 		if err != nil {
 			logErrorAndExit(err)
 		}
@@ -67,3 +48,8 @@ extension) with respect to the default configuration directory.`,
 func init() {
 	rootCmd.AddCommand(configureCmd)
 }
+
+// projectRoot returns the directory of the pulumi projects
+func projectRoot() string {
+	return settings.Get().ProjectRoot
+}
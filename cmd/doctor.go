@@ -0,0 +1,79 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sapcc/vcf-automation/pkg/doctor"
+	"github.com/sapcc/vcf-automation/pkg/gitsource"
+	"github.com/sapcc/vcf-automation/pkg/settings"
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor [config_file...]",
+	Short: "Check the prerequisites of the stacks",
+	Long: `automation doctor:
+
+Check the environment the stacks are deployed from: the pulumi cli, backend
+and passphrase, the project directories, runtimes and provider plugins of the
+configured project types, and the config, credentials and ssh key pair of each
+config file. Without arguments all config files of the config directory are
+checked. Failed checks are printed with a hint and make the command exit
+with 1. Warnings, e.g. for a plugin installed at other versions than the
+pinned one, are printed with a hint only.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		s := settings.Get()
+		o := doctor.Options{ProjectRoot: s.ProjectRoot, ConfigDir: s.ConfigDir, ConfigFiles: args, PluginCacheDir: s.PluginCacheDir}
+		if s.ConfigGitURL != "" {
+			o.ConfigDir = gitsource.New(s.ConfigGitURL, s.ConfigGitBranch, s.ConfigGitSubdir, s.ConfigGitCheckout).ConfigDir()
+		}
+		if len(args) == 0 {
+			// a missing config directory is reported by the checks
+			o.ConfigFiles, _ = stack.ConfigFiles(o.ConfigDir)
+		} else {
+			o.ConfigDir = ""
+		}
+		r := doctor.Run(context.Background(), o)
+		printOutput(cmd, r, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			for _, c := range r.Checks {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", strings.ToUpper(c.Status), c.Name, c.Target, c.Message)
+				if c.Hint != "" {
+					fmt.Fprintf(w, "\t\t\thint: %s\n", c.Hint)
+				}
+			}
+			w.Flush()
+		})
+		if !r.OK {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+	doctorCmd.Flags().StringP("output", "o", "table", "output format: table, json or yaml")
+}
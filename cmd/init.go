@@ -0,0 +1,195 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sapcc/vcf-automation/pkg/scaffold"
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var (
+	initOpts   scaffold.Options
+	initType   string
+	initOutput string
+	initForce  bool
+)
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create a new stack config",
+	Long: `automation init:
+
+Create the config of a new vcf/management, vcf/workload or esxi stack. Values
+not given as flags are asked for on a terminal. Gateways, the addresses of the
+sddc manager, vcenter and nsx-t, and the esxi node addresses are derived from
+the network cidrs. The config is validated before it is written.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		p := newPrompter()
+		o := &initOpts
+		o.ProjectType = stack.ProjectType(p.ask("project type (vcf/management, vcf/workload, esxi)", initType, ""))
+		o.StackName = p.ask("stack name", o.StackName, "")
+		o.Region = p.ask("openstack region", o.Region, "")
+		o.Domain = p.ask("openstack domain", o.Domain, "")
+		o.Tenant = p.ask("openstack project", o.Tenant, "")
+		switch o.ProjectType {
+		case stack.ProjectVCFManagement, stack.ProjectVCFWorkload:
+			o.ManagementCIDR = p.ask("management network cidr", o.ManagementCIDR, "")
+			o.DeploymentCIDR = p.ask("deployment network cidr", o.DeploymentCIDR, "")
+			o.DNSZone = p.ask("dns zone", o.DNSZone, "")
+			o.ExternalNetwork = p.ask("external network", o.ExternalNetwork, "")
+			o.PublicRouter = p.ask("public router", o.PublicRouter, "")
+			o.HelperImage = p.ask("helper vm image", o.HelperImage, "")
+			o.HelperFlavor = p.ask("helper vm flavor", o.HelperFlavor, "")
+		case stack.ProjectEsxi:
+			o.NodeCIDR = p.ask("node network cidr", o.NodeCIDR, "")
+			o.StorageCIDR = p.ask("storage network cidr", o.StorageCIDR, "")
+		default:
+			if o.ProjectType != "" {
+				logErrorAndExit(fmt.Errorf("project type %q: %v", o.ProjectType, stack.ErrNotSupported))
+			}
+		}
+		o.EsxiImage = p.ask("esxi image", o.EsxiImage, "")
+		o.EsxiFlavor = p.ask("esxi flavor", o.EsxiFlavor, "")
+		nodes := ""
+		if o.Nodes > 0 {
+			nodes = strconv.Itoa(o.Nodes)
+		}
+		nodes = p.ask("number of esxi nodes", nodes, strconv.Itoa(scaffold.DefaultNodes(o.ProjectType)))
+		if len(p.missing) > 0 {
+			logErrorAndExit(fmt.Errorf("not set: %s", strings.Join(p.missing, ", ")))
+		}
+		n, err := strconv.Atoi(nodes)
+		if err != nil {
+			logErrorAndExit(fmt.Errorf("number of esxi nodes: %v", err))
+		}
+		o.Nodes = n
+
+		b, err := scaffold.Render(*o)
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		fpath := initOutput
+		if fpath == "" {
+			fpath = o.StackName + ".yaml"
+		}
+		if _, err := os.Stat(fpath); err == nil && !initForce {
+			logErrorAndExit(fmt.Errorf("%s exists, use --force to overwrite", fpath))
+		}
+		if err := writeValidatedConfig(fpath, b); err != nil {
+			logErrorAndExit(err)
+		}
+		fmt.Printf("config written to %s\n", fpath)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(initCmd)
+	f := initCmd.Flags()
+	f.StringVar(&initType, "type", "", "project type: vcf/management, vcf/workload or esxi")
+	f.StringVar(&initOpts.StackName, "stack", "", "stack name")
+	f.StringVar(&initOpts.Region, "region", "", "openstack region")
+	f.StringVar(&initOpts.Domain, "domain", "", "openstack domain")
+	f.StringVar(&initOpts.Tenant, "tenant", "", "openstack project")
+	f.StringVar(&initOpts.ManagementCIDR, "management-cidr", "", "cidr of the management network (vcf)")
+	f.StringVar(&initOpts.DeploymentCIDR, "deployment-cidr", "", "cidr of the deployment network (vcf)")
+	f.StringVar(&initOpts.DNSZone, "dns-zone", "", "dns zone of the stack (vcf)")
+	f.StringVar(&initOpts.ExternalNetwork, "external-network", "", "name of the external network (vcf)")
+	f.StringVar(&initOpts.PublicRouter, "public-router", "", "name of the public router (vcf)")
+	f.StringVar(&initOpts.HelperImage, "helper-image", "", "image of the helper vm (vcf)")
+	f.StringVar(&initOpts.HelperFlavor, "helper-flavor", "", "flavor of the helper vm (vcf)")
+	f.StringVar(&initOpts.NodeCIDR, "node-cidr", "", "cidr of the node network (esxi)")
+	f.StringVar(&initOpts.StorageCIDR, "storage-cidr", "", "cidr of the storage network (esxi)")
+	f.StringVar(&initOpts.EsxiImage, "esxi-image", "", "image of the esxi nodes")
+	f.StringVar(&initOpts.EsxiFlavor, "esxi-flavor", "", "flavor of the esxi nodes")
+	f.IntVar(&initOpts.Nodes, "nodes", 0, "number of esxi nodes (default 4 for vcf/management, 3 otherwise)")
+	f.StringVarP(&initOutput, "output", "o", "", "config file (default <stack>.yaml)")
+	f.BoolVar(&initForce, "force", false, "overwrite an existing config file")
+}
+
+// writeValidatedConfig writes the config to a temporary file next to fpath,
+// reads and validates it like the server does, and renames it to fpath
+func writeValidatedConfig(fpath string, b []byte) error {
+	tmp := fpath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	cfg, err := stack.ReadConfig(tmp)
+	if err != nil {
+		return err
+	}
+	if err := stack.ValidateConfig(cfg); err != nil {
+		return fmt.Errorf("generated config is invalid: %v", err)
+	}
+	return os.Rename(tmp, fpath)
+}
+
+// prompter asks for values on a terminal. Without terminal, missing values
+// without default are collected.
+type prompter struct {
+	in          *bufio.Reader
+	interactive bool
+	missing     []string
+}
+
+func newPrompter() *prompter {
+	interactive := term.IsTerminal(int(os.Stdin.Fd()))
+	return &prompter{in: bufio.NewReader(os.Stdin), interactive: interactive}
+}
+
+// ask returns value if set, otherwise asks for it
+func (p *prompter) ask(label, value, def string) string {
+	if value != "" {
+		return value
+	}
+	if !p.interactive {
+		if def == "" {
+			p.missing = append(p.missing, label)
+		}
+		return def
+	}
+	for {
+		if def != "" {
+			fmt.Printf("%s [%s]: ", label, def)
+		} else {
+			fmt.Printf("%s: ", label)
+		}
+		line, err := p.in.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" {
+			line = def
+		}
+		if line != "" || err != nil {
+			if line == "" {
+				p.missing = append(p.missing, label)
+			}
+			return line
+		}
+	}
+}
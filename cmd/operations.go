@@ -0,0 +1,215 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/spf13/cobra"
+)
+
+// exit codes of the stack operation commands
+const (
+	exitNoChanges = 0
+	exitFailure   = 1
+	exitChanges   = 2
+)
+
+var (
+	operationJSON bool
+	destroyYes    bool
+	selection     stack.Selection
+)
+
+// operationSummary is printed by the stack operation commands with --json
+type operationSummary struct {
+	Operation string         `json:"operation"`
+	Project   string         `json:"project"`
+	Stack     string         `json:"stack"`
+	Changes   map[string]int `json:"changes,omitempty"`
+	Changed   bool           `json:"changed"`
+	Duration  string         `json:"duration"`
+	Error     string         `json:"error,omitempty"`
+}
+
+type operation func(ctx context.Context, c *stack.Controller) (map[string]int, error)
+
+var previewCmd = newOperationCmd("preview", "Preview the changes to the stack",
+	func(ctx context.Context, c *stack.Controller) (map[string]int, error) {
+		res, err := c.PreviewStack(ctx)
+		changes := make(map[string]int)
+		for op, n := range res.ChangeSummary {
+			changes[string(op)] = n
+		}
+		return changes, err
+	})
+
+var upCmd = newOperationCmd("up", "Create or update the resources of the stack",
+	func(ctx context.Context, c *stack.Controller) (map[string]int, error) {
+		res, err := c.UpdateStackSelection(ctx, selectionOf(stack.RunUpdate))
+		return resourceChanges(res.Summary), err
+	})
+
+var refreshCmd = newOperationCmd("refresh", "Refresh the stack state from the cloud",
+	func(ctx context.Context, c *stack.Controller) (map[string]int, error) {
+		res, err := c.RefreshStackSelection(ctx, selectionOf(stack.RunRefresh))
+		return resourceChanges(res.Summary), err
+	})
+
+var destroyCmd = newOperationCmd("destroy", "Delete all resources of the stack",
+	func(ctx context.Context, c *stack.Controller) (map[string]int, error) {
+		if !destroyYes {
+			return nil, fmt.Errorf("destroy deletes all resources of the stack, confirm with --yes")
+		}
+		res, err := c.DestroyStack(ctx)
+		return resourceChanges(res.Summary), err
+	})
+
+// newOperationCmd creates the command running op once on the stack of a
+// config file.
+func newOperationCmd(name, short string, op operation) *cobra.Command {
+	return &cobra.Command{
+		Use:   fmt.Sprintf("%s [config_file_path]", name),
+		Short: short,
+		Long: fmt.Sprintf(`automation %s:
+
+%s once, without starting the server. The stack is initialized and
+configured from the configuration file first. Progress is streamed to the
+terminal, or to stderr with --json.
+
+Exit codes: %d no changes, %d changes (applied, or pending for preview), %d failure.`,
+			name, short, exitNoChanges, exitChanges, exitFailure),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			os.Exit(runOperation(name, args[0], op))
+		},
+	}
+}
+
+func runOperation(name, cfgpath string, op operation) int {
+	ctx := context.Background()
+	start := time.Now()
+	summary := operationSummary{Operation: name}
+	var progress io.Writer = os.Stdout
+	if operationJSON {
+		progress = os.Stderr
+	}
+
+	c, err := newConfiguredController(ctx, cfgpath)
+	if c != nil {
+		summary.Project, summary.Stack = string(c.ProjectType), c.StackName
+	}
+	if err == nil {
+		c.SetProgressWriter(progress)
+		summary.Changes, err = op(ctx, c)
+	}
+	summary.Duration = time.Since(start).Round(time.Second).String()
+	for k, n := range summary.Changes {
+		if k != "same" && n > 0 {
+			summary.Changed = true
+		}
+	}
+	code := exitNoChanges
+	if summary.Changed {
+		code = exitChanges
+	}
+	if err != nil {
+		summary.Error = err.Error()
+		code = exitFailure
+	}
+
+	if operationJSON {
+		b, _ := json.MarshalIndent(summary, "", "  ")
+		fmt.Println(string(b))
+		return code
+	}
+	if err != nil {
+		fmt.Println("ERROR", err)
+		return code
+	}
+	fmt.Printf("%s of stack %s in project %s finished in %s: %v\n",
+		name, summary.Stack, summary.Project, summary.Duration, summary.Changes)
+	return code
+}
+
+// newConfiguredController creates the controller of the config file, and
+// initializes and configures its stack. The controller is returned as soon as
+// it is created, also if initializing or configuring fails.
+func newConfiguredController(ctx context.Context, cfgpath string) (*stack.Controller, error) {
+	cfg, err := stack.ReadConfig(cfgpath)
+	if err != nil {
+		return nil, err
+	}
+	c, err := stack.NewController(cfg, projectRoot())
+	if err != nil {
+		return nil, err
+	}
+	if err = c.InitStack(ctx); err != nil {
+		return c, err
+	}
+	if err = c.ConfigureStack(ctx); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// selectionOf returns the selection of the --target, --replace and --exclude
+// flags for operation, nil if no resources are selected
+func selectionOf(operation string) *stack.Selection {
+	if len(selection.Targets) == 0 && len(selection.Replace) == 0 && len(selection.Exclude) == 0 {
+		return nil
+	}
+	sel := selection
+	sel.Operation = operation
+	return &sel
+}
+
+// addSelectionFlags adds the flags selecting the resources of operation
+func addSelectionFlags(cmd *cobra.Command, sel *stack.Selection, operation string) {
+	cmd.Flags().StringArrayVar(&sel.Targets, "target", nil, "urn or name pattern of a resource to "+operation+", may be repeated")
+	cmd.Flags().StringArrayVar(&sel.Exclude, "exclude", nil, "urn or name pattern of a resource to leave out, may be repeated")
+	if operation == stack.RunUpdate {
+		cmd.Flags().StringArrayVar(&sel.Replace, "replace", nil, "urn or name pattern of a resource to replace, may be repeated")
+		cmd.Flags().BoolVar(&sel.TargetDependents, "target-dependents", false, "update the resources depending on the targets too")
+	}
+}
+
+func resourceChanges(s auto.UpdateSummary) map[string]int {
+	if s.ResourceChanges == nil {
+		return map[string]int{}
+	}
+	return *s.ResourceChanges
+}
+
+func init() {
+	for _, c := range []*cobra.Command{previewCmd, upCmd, refreshCmd, destroyCmd} {
+		c.Flags().BoolVar(&operationJSON, "json", false, "print a json summary to stdout")
+		rootCmd.AddCommand(c)
+	}
+	destroyCmd.Flags().BoolVar(&destroyYes, "yes", false, "confirm deleting all resources of the stack")
+	addSelectionFlags(upCmd, &selection, stack.RunUpdate)
+	addSelectionFlags(refreshCmd, &selection, stack.RunRefresh)
+}
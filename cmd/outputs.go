@@ -0,0 +1,71 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/spf13/cobra"
+)
+
+var (
+	outputsFormat string
+	outputsReveal bool
+)
+
+var outputsCmd = &cobra.Command{
+	Use:   "outputs <config_file>",
+	Short: "Print the outputs of a stack",
+	Long: `automation outputs:
+
+Print the outputs of the stack of a config file, with their full values:
+
+  json    a json object (default)
+  yaml    a yaml map
+  dotenv  NAME="value" lines, e.g. for docker --env-file
+  flat    path=value lines of all leaf values, e.g. for grep or shell loops
+
+Secret values are masked unless --reveal is given.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newInitializedController(args[0])
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		o, err := c.GetOutputs()
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		if !outputsReveal {
+			o = o.Masked()
+		}
+		b, err := stack.FormatOutputs(o, outputsFormat)
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		fmt.Print(string(b))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(outputsCmd)
+	outputsCmd.Flags().StringVarP(&outputsFormat, "output", "o", stack.OutputsJSON, "output format: json, yaml, dotenv or flat")
+	outputsCmd.Flags().BoolVar(&outputsReveal, "reveal", false, "print the values of secret outputs")
+}
@@ -0,0 +1,67 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/spf13/cobra"
+)
+
+var renderReveal bool
+
+var renderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Render files generated by the stacks without deploying",
+}
+
+var renderCloudBuilderCmd = &cobra.Command{
+	Use:   "cloud-builder <config_file>",
+	Short: "Render the cloud builder payload of a vcf/management stack",
+	Long: `automation render cloud-builder:
+
+Render the payload for VMware Cloud Builder from the effective config and the
+template of the vcf project, as the vcf program does after a deployment, and
+validate it. OpenStack is not accessed. The vmware password is masked unless
+--reveal is given. An invalid payload is printed and the command exits with
+1.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := stack.ReadConfig(args[0])
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		b, err := stack.RenderCloudBuilder(cfg, projectRoot(), renderReveal)
+		if b != nil {
+			fmt.Println(string(b))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(renderCmd)
+	renderCmd.AddCommand(renderCloudBuilderCmd)
+	renderCloudBuilderCmd.Flags().BoolVar(&renderReveal, "reveal", false, "show the vmware password")
+}
@@ -0,0 +1,129 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/sapcc/vcf-automation/pkg/settings"
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/spf13/cobra"
+)
+
+var (
+	resourcesFilter stack.ResourceFilter
+	resourcesAll    bool
+)
+
+var resourcesCmd = &cobra.Command{
+	Use:   "resources [config_file...]",
+	Short: "Show the resource tree of stacks",
+	Long: `automation resources:
+
+Show the resources in the state of the stacks as a tree, with their ids and
+key outputs such as ip addresses. --type, --name and --urn select resources by
+a substring, --query by a substring of the name, urn, id or a key output.
+With --all the stacks of all config files in the config directory are
+searched, e.g. for the stack owning a port or an ip address:
+
+    automation resources --all --query 10.180.0.11`,
+	Run: func(cmd *cobra.Command, args []string) {
+		files := args
+		if resourcesAll {
+			l, err := stack.ConfigFiles(settings.Get().ConfigDir)
+			if err != nil {
+				logErrorAndExit(err)
+			}
+			files = append(files, l...)
+		}
+		if len(files) == 0 {
+			logErrorAndExit(fmt.Errorf("config file or --all required"))
+		}
+		l := make([]stack.StackResources, 0)
+		for _, f := range files {
+			sr := readStackResources(context.Background(), f)
+			if sr.Error == "" && len(sr.Resources) == 0 && len(files) > 1 {
+				continue
+			}
+			l = append(l, sr)
+		}
+		if len(files) == 1 {
+			if l[0].Error != "" {
+				logErrorAndExit(fmt.Errorf(l[0].Error))
+			}
+			printOutput(cmd, l[0].Resources, func() {
+				stack.WriteResourceTable(os.Stdout, l[0].Resources)
+			})
+			return
+		}
+		printOutput(cmd, l, func() {
+			for i, sr := range l {
+				if i > 0 {
+					fmt.Println()
+				}
+				fmt.Printf("# %s/%s (%s)\n", sr.Project, sr.Stack, sr.ConfigFile)
+				if sr.Error != "" {
+					fmt.Println("ERROR", sr.Error)
+					continue
+				}
+				stack.WriteResourceTable(os.Stdout, sr.Resources)
+			}
+		})
+	},
+}
+
+// readStackResources reads the filtered resource tree of the stack of the
+// config file
+func readStackResources(ctx context.Context, fpath string) stack.StackResources {
+	sr := stack.StackResources{ConfigFile: fpath, Resources: []*stack.ResourceNode{}}
+	cfg, err := stack.ReadConfig(fpath)
+	if err != nil {
+		sr.Error = err.Error()
+		return sr
+	}
+	sr.Project, sr.Stack = cfg.GetProjectStackName()
+	c, err := stack.NewController(cfg, projectRoot())
+	if err == nil {
+		err = c.InitStack(ctx)
+	}
+	if err != nil {
+		sr.Error = err.Error()
+		return sr
+	}
+	res, err := c.Resources(ctx)
+	if err != nil {
+		sr.Error = err.Error()
+		return sr
+	}
+	sr.Resources = stack.FilterResources(res, resourcesFilter)
+	return sr
+}
+
+func init() {
+	rootCmd.AddCommand(resourcesCmd)
+	f := resourcesCmd.Flags()
+	f.StringVar(&resourcesFilter.Type, "type", "", "resource type substring, e.g. networking/port")
+	f.StringVar(&resourcesFilter.Name, "name", "", "resource name substring")
+	f.StringVar(&resourcesFilter.URN, "urn", "", "resource urn substring")
+	f.StringVarP(&resourcesFilter.Query, "query", "q", "", "substring of name, urn, id or key outputs")
+	f.BoolVar(&resourcesAll, "all", false, "search the stacks of all config files in the config directory")
+	f.StringP("output", "o", "table", "output format: table, json or yaml")
+}
@@ -0,0 +1,149 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+var revisionsCmd = &cobra.Command{
+	Use:   "revisions",
+	Short: "Inspect and roll back the configurations applied to a stack",
+	Long: `automation revisions:
+
+Query the revisions of a stack from a running automation server. A revision is
+recorded whenever the server applies a changed configuration to a stack. The
+stack is given as <project>/<stack>, e.g. vcf/vcf-01-management.`,
+}
+
+var revisionsListCmd = &cobra.Command{
+	Use:   "list <project>/<stack>",
+	Short: "List revisions, oldest first",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		project, stackName := parseStackArg(args[0])
+		revs, err := newClient().ListRevisions(project, stackName)
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "REVISION\tTIMESTAMP\tTRIGGER\tSOURCE")
+		for _, r := range revs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", shortID(r.ID), r.Timestamp.Format(time.RFC3339), r.Trigger, r.Source)
+		}
+		w.Flush()
+	},
+}
+
+var revisionsShowCmd = &cobra.Command{
+	Use:   "show <project>/<stack> <revision>",
+	Short: "Show the configuration of a revision",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		project, stackName := parseStackArg(args[0])
+		rev, err := newClient().GetRevision(project, stackName, args[1])
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		b, err := yaml.Marshal(rev)
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		fmt.Print(string(b))
+	},
+}
+
+var revisionsDiffCmd = &cobra.Command{
+	Use:   "diff <project>/<stack> <from> [<to>]",
+	Short: "Show the configuration changes between two revisions",
+	Long: `automation revisions diff:
+
+Compare the configuration of revision <from> with revision <to>, or with the
+latest revision if <to> is not given.`,
+	Args: cobra.RangeArgs(2, 3),
+	Run: func(cmd *cobra.Command, args []string) {
+		project, stackName := parseStackArg(args[0])
+		to := ""
+		if len(args) == 3 {
+			to = args[2]
+		}
+		d, err := newClient().DiffRevisions(project, stackName, args[1], to)
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		fmt.Printf("--- %s\n+++ %s\n", shortID(d.From), shortID(d.To))
+		printConfigChanges(d.Changes)
+	},
+}
+
+var revisionsRollbackCmd = &cobra.Command{
+	Use:   "rollback <project>/<stack> <revision>",
+	Short: "Re-apply the configuration of a revision",
+	Long: `automation revisions rollback:
+
+Apply the configuration of an earlier revision to the stack controller and
+trigger a stack update. The configuration file is not changed; the next
+reload applies the configuration file again.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		project, stackName := parseStackArg(args[0])
+		msg, err := newClient().Rollback(project, stackName, args[1])
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		fmt.Print(msg)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(revisionsCmd)
+	revisionsCmd.AddCommand(revisionsListCmd)
+	revisionsCmd.AddCommand(revisionsShowCmd)
+	revisionsCmd.AddCommand(revisionsDiffCmd)
+	revisionsCmd.AddCommand(revisionsRollbackCmd)
+
+	addClientFlags(revisionsCmd)
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func printConfigChanges(changes []stack.ConfigChange) {
+	for _, c := range changes {
+		switch c.Kind {
+		case stack.ChangeAdded:
+			fmt.Printf("+ %s: %v\n", c.Path, c.New)
+		case stack.ChangeRemoved:
+			fmt.Printf("- %s: %v\n", c.Path, c.Old)
+		default:
+			fmt.Printf("~ %s: %v -> %v\n", c.Path, c.Old, c.New)
+		}
+	}
+}
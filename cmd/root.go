@@ -22,10 +22,13 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/sapcc/vcf-automation/pkg/settings"
+	"github.com/sapcc/vcf-automation/pkg/version"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
+var settingsFile string
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "autmoation",
@@ -49,16 +52,26 @@ func Execute() {
 
 func init() {
 	cobra.OnInitialize(initConfig)
+	rootCmd.Version = version.Get()
 
-	rootCmd.PersistentFlags().String("workdir", "", "work directory")
-	viper.BindPFlag("workdir", rootCmd.PersistentFlags().Lookup("workdir"))
+	f := rootCmd.PersistentFlags()
+	f.StringVar(&settingsFile, "settings", os.Getenv("AUTOMATION_SETTINGS"), "settings file ($AUTOMATION_SETTINGS)")
+	f.String("workdir", "", "work directory")
+	f.String("log-level", "", "log level: trace, debug, info, warn or error (default info)")
+	f.String("log-format", "", "log format: text or json (default text)")
+	settings.BindFlag("work_dir", f.Lookup("workdir"))
+	settings.BindFlag("log_level", f.Lookup("log-level"))
+	settings.BindFlag("log_format", f.Lookup("log-format"))
 }
 
-// initConfig reads in config file and ENV variables if set.
+// initConfig loads the settings from the settings file, the environment and
+// the flags and configures the logger.
 func initConfig() {
-	// read in environment variables that match
-	viper.SetEnvPrefix("automation")
-	viper.AutomaticEnv()
+	s, err := settings.Load(settingsFile)
+	if err != nil {
+		logErrorAndExit(err)
+	}
+	s.ConfigureLogging()
 }
 
 func logErrorAndExit(e error) {
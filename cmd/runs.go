@@ -0,0 +1,144 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sapcc/vcf-automation/pkg/runlog"
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/spf13/cobra"
+)
+
+var runsFilter runlog.Filter
+
+var runsCmd = &cobra.Command{
+	Use:   "runs",
+	Short: "Query the records of the stack operations",
+	Long: `automation runs:
+
+The steps of every preview, refresh, update and destroy are recorded per
+resource from the events of the pulumi engine: the operation, its start and
+end, its status and the diagnostic messages. The records are kept in
+$AUTOMATION_RUN_DIR, the latest $AUTOMATION_RUN_KEEP runs per stack. A run id
+may be given as a unique prefix or as latest.`,
+}
+
+var runsListCmd = &cobra.Command{
+	Use:   "list <config_file>",
+	Short: "List the runs of a stack, newest first",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newRunsController(args[0])
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		l, err := c.Runs()
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		printOutput(cmd, l, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tKIND\tSTART\tDURATION\tSTATUS\tFAILED")
+			for _, r := range l {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", r.ID, r.Kind, r.Start.Local().Format("2006-01-02 15:04:05"),
+					r.End.Sub(r.Start).Round(time.Second), r.Status, len(r.Failed))
+			}
+			w.Flush()
+		})
+	},
+}
+
+var runsShowCmd = &cobra.Command{
+	Use:   "show <config_file> [run]",
+	Short: "Show the resource operations of a run (default latest)",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newRunsController(args[0])
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		id := "latest"
+		if len(args) > 1 {
+			id = args[1]
+		}
+		run, err := c.GetRun(id, runsFilter)
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		printOutput(cmd, run, func() { printRun(run) })
+	},
+}
+
+func printRun(run *runlog.Run) {
+	fmt.Printf("run %s: %s %s, %s in %s\n", run.ID, run.Kind, run.Status,
+		run.Start.Local().Format("2006-01-02 15:04:05"), run.End.Sub(run.Start).Round(time.Second))
+	if run.Commit != "" {
+		fmt.Printf("commit: %s\n", run.Commit)
+	}
+	if run.Error != "" {
+		fmt.Printf("error: %s\n", run.Error)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tOP\tDURATION\tURN")
+	for _, o := range run.Operations {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", o.Status, o.Op, o.Duration().Round(time.Second), o.URN)
+	}
+	w.Flush()
+	for _, o := range run.Operations {
+		if len(o.Diagnostics) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s:\n", o.URN)
+		for _, d := range o.Diagnostics {
+			fmt.Printf("  %s: %s\n", d.Severity, d.Message)
+		}
+	}
+	if len(run.Diagnostics) > 0 {
+		fmt.Println()
+		for _, d := range run.Diagnostics {
+			fmt.Printf("%s: %s\n", d.Severity, d.Message)
+		}
+	}
+}
+
+// newRunsController creates the controller of the config file without
+// initializing its stack; the run records are read from the local store
+func newRunsController(cfgpath string) (*stack.Controller, error) {
+	cfg, err := stack.ReadConfig(cfgpath)
+	if err != nil {
+		return nil, err
+	}
+	return stack.NewController(cfg, projectRoot())
+}
+
+func init() {
+	rootCmd.AddCommand(runsCmd)
+	runsCmd.AddCommand(runsListCmd, runsShowCmd)
+	for _, c := range []*cobra.Command{runsListCmd, runsShowCmd} {
+		c.Flags().StringP("output", "o", "table", "output format: table, json or yaml")
+	}
+	runsShowCmd.Flags().StringVar(&runsFilter.Status, "status", "", "only operations with status running, succeeded or failed")
+	runsShowCmd.Flags().StringVar(&runsFilter.Op, "op", "", "only operations of type op, e.g. create or update")
+	runsShowCmd.Flags().StringVar(&runsFilter.URN, "urn", "", "only operations of resources whose urn contains urn")
+	runsShowCmd.Flags().StringVar(&runsFilter.Type, "type", "", "only operations of resources whose type contains type")
+}
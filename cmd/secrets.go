@@ -0,0 +1,192 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/sapcc/vcf-automation/pkg/settings"
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/spf13/cobra"
+)
+
+var (
+	secretsNewKeyFile string
+	secretsNewKeyEnv  string
+	secretsGenerate   bool
+	secretsAll        bool
+)
+
+var secretsCmd = &cobra.Command{
+	Use:   "secrets",
+	Short: "Manage the secrets key of a stack",
+}
+
+var secretsRotateCmd = &cobra.Command{
+	Use:   "rotate <config_file> | --all",
+	Short: "Re-encrypt the secrets of a stack with a new key",
+	Long: `automation secrets rotate:
+
+Re-encrypt the secrets in the stack config and the state with a new key. The
+current key is taken from the secrets provider of the config, the new key from
+--new-key-file or from the env variable --new-key-env. With --generate a
+random key is written to --new-key-file, which must not exist.
+
+The state and the stack settings are backed up to
+$AUTOMATION_STATE_BACKUP_DIR (default <work dir>/state-backups) first. After
+re-encrypting, the stack is verified to decrypt with the new key; if it does
+not, the backups are restored. Afterwards point secrets.keyFile of the config
+to the new key file, or replace PULUMI_CONFIG_PASSPHRASE by the new key.
+
+The stacks using the passphrase provider share PULUMI_CONFIG_PASSPHRASE. A
+single one of them can only be rotated to a key file (--new-key-file), after
+which its config must switch to the keyfile provider. With --all every stack
+of the config directory using the passphrase provider is rotated. If the rotation of one
+stack fails, the stacks rotated before are restored from their backups, so
+all stacks keep the current key.
+
+The rotation is refused while the controller of a stack is running on the
+server given by --server.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if secretsAll == (len(args) == 1) {
+			return fmt.Errorf("requires a config file or --all")
+		}
+		return cobra.MaximumNArgs(1)(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		var newKey string
+		var err error
+		switch {
+		case secretsNewKeyFile != "" && secretsNewKeyEnv != "":
+			err = fmt.Errorf("--new-key-file and --new-key-env are exclusive")
+		case secretsGenerate && secretsNewKeyFile == "":
+			err = fmt.Errorf("--generate requires --new-key-file")
+		case secretsGenerate:
+			newKey, err = stack.GenerateKeyFile(secretsNewKeyFile)
+		case secretsNewKeyFile != "":
+			newKey, err = stack.ReadKeyFile(secretsNewKeyFile)
+		case secretsNewKeyEnv != "":
+			if newKey = os.Getenv(secretsNewKeyEnv); newKey == "" {
+				err = fmt.Errorf("env variable %s not set", secretsNewKeyEnv)
+			}
+		default:
+			err = fmt.Errorf("--new-key-file or --new-key-env not set")
+		}
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		files := args
+		if secretsAll {
+			if files, err = passphraseConfigFiles(); err != nil {
+				logErrorAndExit(err)
+			}
+		} else if err := checkSingleRotation(args[0]); err != nil {
+			logErrorAndExit(err)
+		}
+		cs := make([]*stack.Controller, 0, len(files))
+		for _, f := range files {
+			c, err := newInitializedController(f)
+			if err != nil {
+				logErrorAndExit(fmt.Errorf("%s: %v", f, err))
+			}
+			if err := stackStopped(c); err != nil {
+				logErrorAndExit(err)
+			}
+			cs = append(cs, c)
+		}
+		var rots []*stack.Rotation
+		if secretsAll {
+			rots, err = stack.RotateAllSecrets(context.Background(), cs, newKey, stateBackupDir())
+		} else {
+			var r *stack.Rotation
+			r, err = cs[0].RotateSecrets(context.Background(), newKey, stateBackupDir())
+			rots = append(rots, r)
+		}
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		for i, r := range rots {
+			project, stackName := cs[i].GetProjectStackName()
+			fmt.Printf("%s/%s: re-encrypted %d config and %d state secrets\n", project, stackName, r.ConfigValues, r.StateValues)
+			fmt.Printf("%s/%s: backups written to %s and %s\n", project, stackName, r.StateBackup, r.SettingsBackup)
+		}
+		switch {
+		case !secretsAll && secretsNewKeyFile != "":
+			fmt.Printf("set secrets.provider of %s to %s and secrets.keyFile to %s\n", args[0], stack.SecretsKeyFile, secretsNewKeyFile)
+		case !secretsAll:
+			fmt.Printf("write the value of %s to the key file of %s\n", secretsNewKeyEnv, args[0])
+		case secretsNewKeyFile != "":
+			fmt.Printf("set PULUMI_CONFIG_PASSPHRASE to the content of %s\n", secretsNewKeyFile)
+		default:
+			fmt.Printf("set PULUMI_CONFIG_PASSPHRASE to the value of %s\n", secretsNewKeyEnv)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(secretsCmd)
+	secretsCmd.AddCommand(secretsRotateCmd)
+
+	addClientFlags(secretsCmd)
+	f := secretsRotateCmd.Flags()
+	f.StringVar(&secretsNewKeyFile, "new-key-file", "", "file with the new key")
+	f.StringVar(&secretsNewKeyEnv, "new-key-env", "", "env variable with the new key")
+	f.BoolVar(&secretsGenerate, "generate", false, "generate a new key into --new-key-file")
+	f.BoolVar(&secretsAll, "all", false, "rotate all stacks using the passphrase provider")
+}
+
+// checkSingleRotation returns an error if rotating the stack of cfgpath alone
+// would break the other stacks: a stack of the passphrase provider shares its
+// key with all of them, so it can only leave them for a key file of its own.
+func checkSingleRotation(cfgpath string) error {
+	cfg, err := stack.ReadConfig(cfgpath)
+	if err != nil {
+		return err
+	}
+	if p := cfg.Secrets.Provider; (p == "" || p == stack.SecretsPassphrase) && secretsNewKeyFile == "" {
+		return fmt.Errorf("stack %s shares PULUMI_CONFIG_PASSPHRASE with all %s stacks: rotate it to a key file with --new-key-file, or rotate all of them with --all",
+			cfg.StackName, stack.SecretsPassphrase)
+	}
+	return nil
+}
+
+// passphraseConfigFiles returns the config files in the config directory
+// whose stacks use the passphrase secrets provider
+func passphraseConfigFiles() ([]string, error) {
+	l, err := stack.ConfigFiles(settings.Get().ConfigDir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(l))
+	for _, f := range l {
+		cfg, err := stack.ReadConfig(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		if p := cfg.Secrets.Provider; p == "" || p == stack.SecretsPassphrase {
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no stack uses the %s secrets provider", stack.SecretsPassphrase)
+	}
+	return files, nil
+}
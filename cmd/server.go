@@ -20,27 +20,22 @@ package cmd
 
 import (
 	"github.com/sapcc/vcf-automation/pkg/server"
+	"github.com/sapcc/vcf-automation/pkg/settings"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
-var port int
-
 // serveCmd represents the serve command
 var serveCmd = &cobra.Command{
 	Use:   "server",
 	Short: "start server",
 	Long:  `start server`,
 	Run: func(cmd *cobra.Command, args []string) {
-		server.Run(port)
+		server.Run(settings.Get())
 	},
 }
 
 func init() {
-	viper.SetEnvPrefix("automation")
-	viper.SetDefault("port", 8080)
-	viper.AutomaticEnv()
-
 	rootCmd.AddCommand(serveCmd)
-	serveCmd.Flags().IntVarP(&port, "port", "p", viper.GetInt("port"), "server port")
+	serveCmd.Flags().IntP("port", "p", 8080, "server port ($AUTOMATION_PORT)")
+	settings.BindFlag("port", serveCmd.Flags().Lookup("port"))
 }
@@ -0,0 +1,61 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/sapcc/vcf-automation/pkg/settings"
+	"github.com/spf13/cobra"
+)
+
+var settingsCmd = &cobra.Command{
+	Use:   "settings",
+	Short: "Inspect the settings of automation",
+}
+
+var settingsShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the effective settings",
+	Long: `automation settings show:
+
+Show the settings read from the settings file (--settings), the environment
+and the flags, with the environment variable of each setting and the source
+of its value: flag, env, file or default. Secrets are masked.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		l := settings.Get().Show()
+		printOutput(cmd, l, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "KEY\tVALUE\tSOURCE\tENV")
+			for _, s := range l {
+				fmt.Fprintf(w, "%s\t%v\t%s\t%s\n", s.Key, s.Value, s.Source, s.Env)
+			}
+			w.Flush()
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(settingsCmd)
+	settingsCmd.AddCommand(settingsShowCmd)
+	settingsShowCmd.Flags().StringP("output", "o", "table", "output format: table, json or yaml")
+}
@@ -0,0 +1,151 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/spf13/cobra"
+)
+
+var (
+	snapshotsYes   bool
+	snapshotsForce bool
+)
+
+var snapshotsCmd = &cobra.Command{
+	Use:   "snapshots",
+	Short: "List, compare and restore state snapshots",
+	Long: `automation snapshots:
+
+The deployment of a stack is saved to the snapshot store before every update.
+Snapshots are kept according to $AUTOMATION_SNAPSHOT_KEEP and
+$AUTOMATION_SNAPSHOT_MAX_AGE. A snapshot id may be given as a unique prefix or
+as latest.`,
+}
+
+var snapshotsListCmd = &cobra.Command{
+	Use:   "list <config_file>",
+	Short: "List the snapshots of a stack, newest first",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newInitializedController(args[0])
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		l, err := c.Snapshots(context.Background())
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		printOutput(cmd, l, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tCREATED\tVERSION\tREASON\tSIZE")
+			for _, s := range l {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\n", s.ID, s.Created.Format("2006-01-02 15:04:05"), s.Version, s.Reason, s.Size)
+			}
+			w.Flush()
+		})
+	},
+}
+
+var snapshotsDiffCmd = &cobra.Command{
+	Use:   "diff <config_file> <snapshot>",
+	Short: "Show the resource changes restoring a snapshot would make",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newInitializedController(args[0])
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		_, changes, err := c.DiffSnapshot(context.Background(), args[1])
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		printOutput(cmd, changes, func() { printResourceChanges(changes) })
+	},
+}
+
+var snapshotsRestoreCmd = &cobra.Command{
+	Use:   "restore <config_file> <snapshot>",
+	Short: "Restore a snapshot into a stopped stack",
+	Long: `automation snapshots restore:
+
+Show the resource changes restoring the snapshot would make and, confirmed
+with --yes, import the snapshot into the stack. The current deployment is
+backed up to $AUTOMATION_STATE_BACKUP_DIR first. The restore is refused while
+the server runs the controller of the stack or cannot be reached, unless
+--force is given.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		c, err := newInitializedController(args[0])
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		if !snapshotsForce {
+			checkStackStopped(c)
+		}
+		snap, changes, err := c.DiffSnapshot(ctx, args[1])
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		fmt.Printf("snapshot %s (update %d, %s)\n", snap.ID, snap.Version, snap.Created.Format("2006-01-02 15:04:05"))
+		printResourceChanges(changes)
+		if !snapshotsYes {
+			logErrorAndExit(fmt.Errorf("review the changes and confirm the restore with --yes"))
+		}
+		_, backup, err := c.RestoreSnapshot(ctx, snap.ID, stateBackupDir())
+		if backup != "" {
+			fmt.Printf("current state backed up to %s\n", backup)
+		}
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		fmt.Printf("restored snapshot %s into stack %s\n", snap.ID, c.StackName)
+	},
+}
+
+func printResourceChanges(changes []stack.ResourceChange) {
+	if len(changes) == 0 {
+		fmt.Println("no resource changes")
+		return
+	}
+	signs := map[string]string{stack.ResourceCreate: "+", stack.ResourceDelete: "-", stack.ResourceUpdate: "~"}
+	for _, ch := range changes {
+		fmt.Printf("%s %s\n", signs[ch.Op], ch.URN)
+		for _, f := range ch.Fields {
+			fmt.Printf("    %s\n", f)
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(snapshotsCmd)
+	snapshotsCmd.AddCommand(snapshotsListCmd, snapshotsDiffCmd, snapshotsRestoreCmd)
+	for _, c := range []*cobra.Command{snapshotsListCmd, snapshotsDiffCmd} {
+		c.Flags().StringP("output", "o", "table", "output format: table, json or yaml")
+	}
+	snapshotsRestoreCmd.Flags().BoolVar(&snapshotsYes, "yes", false, "confirm the restore")
+	snapshotsRestoreCmd.Flags().BoolVar(&snapshotsForce, "force", false, "do not check whether the server runs the controller")
+	addClientFlags(snapshotsRestoreCmd)
+}
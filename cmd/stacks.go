@@ -0,0 +1,363 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+var stacksCmd = &cobra.Command{
+	Use:   "stacks",
+	Short: "Query and control the stacks of a running automation server",
+	Long: `automation stacks:
+
+Query and control the stack controllers of a running automation server. The
+server url and api token are taken from the --server and --token flags, the
+AUTOMATION_SERVER and AUTOMATION_TOKEN env variables, or the client config
+file, in this order. The stack is given as <project>/<stack>, e.g.
+vcf/vcf-01-management.`,
+}
+
+var stacksListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List stacks and the state of their controllers",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ss, err := newClient().ListStacks()
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		printOutput(cmd, ss, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "STACK\tSTATUS\tSTATE\tSINCE\tERROR\tREVISION")
+			for _, s := range ss {
+				fmt.Fprintf(w, "%s/%s\t%s\t%s\t%s\t%t\t%s\n", s.Project, s.Stack, s.Status, s.State,
+					since(s.StateSince), s.HasError, shortID(s.Revision))
+			}
+			w.Flush()
+		})
+	},
+}
+
+var stacksStatusCmd = &cobra.Command{
+	Use:   "status <project>/<stack>",
+	Short: "Show the status of a stack controller",
+	Long: `automation stacks status:
+
+Show the status of a stack controller. With --watch the status is polled
+until the controller is Idle or Failed; the command exits with 1 if the
+controller failed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		project, stackName := parseStackArg(args[0])
+		watch, _ := cmd.Flags().GetBool("watch")
+		interval, _ := cmd.Flags().GetDuration("interval")
+		c := newClient()
+		last := ""
+		for {
+			s, err := c.StackStatus(project, stackName)
+			if err != nil {
+				logErrorAndExit(err)
+			}
+			if !watch {
+				printOutput(cmd, s, func() {
+					w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+					fmt.Fprintf(w, "Stack:\t%s/%s\n", s.Project, s.Stack)
+					fmt.Fprintf(w, "Config:\t%s\n", s.ConfigFile)
+					fmt.Fprintf(w, "Revision:\t%s\n", shortID(s.Revision))
+					if s.Commit != "" {
+						fmt.Fprintf(w, "Commit:\t%s\n", shortID(s.Commit))
+					}
+					fmt.Fprintf(w, "Status:\t%s\n", s.Status)
+					fmt.Fprintf(w, "State:\t%s (%s)\n", s.State, since(s.StateSince))
+					fmt.Fprintf(w, "Error:\t%t\n", s.HasError)
+					if s.Lock != nil {
+						for _, h := range s.Lock.Holders {
+							fmt.Fprintf(w, "Locked:\tby %s\n", h)
+						}
+					}
+					for _, p := range s.Plugins {
+						fmt.Fprintf(w, "Plugin:\t%s (%s)", p.Plugin, p.Status)
+						if p.Status == stack.PluginMismatch {
+							fmt.Fprintf(w, ", installed %s", strings.Join(p.Installed, ", "))
+						}
+						fmt.Fprintln(w)
+					}
+					w.Flush()
+				})
+				return
+			}
+			if s.State != last {
+				fmt.Printf("%s %s/%s %s\n", s.StateSince.Local().Format(time.RFC3339), s.Project, s.Stack, s.State)
+				last = s.State
+			}
+			switch s.State {
+			case stack.StateIdle:
+				return
+			case stack.StateFailed:
+				if msg, err := c.StackError(project, stackName); err == nil {
+					fmt.Println(msg)
+				}
+				os.Exit(1)
+			}
+			time.Sleep(interval)
+		}
+	},
+}
+
+var stacksErrorCmd = &cobra.Command{
+	Use:   "error <project>/<stack>",
+	Short: "Show the last error of a stack controller",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		project, stackName := parseStackArg(args[0])
+		msg, err := newClient().StackError(project, stackName)
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		fmt.Println(msg)
+	},
+}
+
+var stacksOutputsCmd = &cobra.Command{
+	Use:   "outputs <project>/<stack>",
+	Short: "Show the outputs of a stack",
+	Long: `automation stacks outputs:
+
+Show the outputs of a stack as json, yaml, dotenv or flat key=value lines.
+Secret values are masked unless --reveal is given and the server requires an
+api token.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		project, stackName := parseStackArg(args[0])
+		format, _ := cmd.Flags().GetString("output")
+		reveal, _ := cmd.Flags().GetBool("reveal")
+		o, err := newClient().StackOutputs(project, stackName, format, reveal)
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		fmt.Print(o)
+	},
+}
+
+var stacksHistoryCmd = &cobra.Command{
+	Use:   "history <project>/<stack>",
+	Short: "Show the update history of a stack",
+	Long: `automation stacks history:
+
+Show the Pulumi update history of a stack, newest first. The updates started
+by the controller show what triggered them, who called the api, the config
+file, the hash of the effective config, the commit of the config repository
+and the version of the automation binary.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		project, stackName := parseStackArg(args[0])
+		pageSize, _ := cmd.Flags().GetInt("page-size")
+		page, _ := cmd.Flags().GetInt("page")
+		h, err := newClient().History(project, stackName, pageSize, page)
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		printOutput(cmd, h, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "VERSION\tKIND\tRESULT\tSTART\tTRIGGER\tCALLER\tCONFIG\tCOMMIT\tAUTOMATION")
+			for _, u := range h {
+				p := u.Provenance
+				if p == nil {
+					p = &stack.Provenance{}
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", u.Version, u.Kind, u.Result, u.StartTime,
+					p.Trigger, p.Caller, shortID(p.ConfigHash), shortID(p.Commit), p.Version)
+			}
+			w.Flush()
+		})
+	},
+}
+
+var stacksRefreshCmd = newStackSelectionCmd(stack.RunRefresh, "Refresh selected resources of a running stack")
+var stacksUpdateCmd = newStackSelectionCmd(stack.RunUpdate, "Update or replace selected resources of a running stack")
+
+// newStackSelectionCmd creates the command triggering operation on the
+// resources selected by its flags
+func newStackSelectionCmd(operation, short string) *cobra.Command {
+	sel := &stack.Selection{Operation: operation}
+	cmd := &cobra.Command{
+		Use:   operation + " <project>/<stack>",
+		Short: short,
+		Long: fmt.Sprintf(`automation stacks %s:
+
+%s. Resources are selected by urn or by name, in which
+* matches any characters, and must exist in the stack state. With --exclude
+only, all resources but the excluded ones are selected, so no new resources
+are created. The %s is run by the controller loop after the running operation
+and recorded in the history; the selected urns are printed.`, operation, short, operation),
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			project, stackName := parseStackArg(args[0])
+			res, err := newClient().Select(project, stackName, sel)
+			if err != nil {
+				logErrorAndExit(err)
+			}
+			fmt.Printf("%s of stack %s/%s triggered\n", operation, project, stackName)
+			for _, u := range res.Targets {
+				fmt.Println("target ", u)
+			}
+			for _, u := range res.Replace {
+				fmt.Println("replace", u)
+			}
+		},
+	}
+	addSelectionFlags(cmd, sel, operation)
+	return cmd
+}
+
+var stacksUnlockCmd = &cobra.Command{
+	Use:   "unlock <project>/<stack>",
+	Short: "Remove the stale lock of a stack",
+	Long: `automation stacks unlock:
+
+Cancel the operation holding the lock of a stack, e.g. an update of a killed
+server, which makes every later operation fail. The lock is only removed if
+its holder is not a running process of the server host and no other
+automation replica uses the backend; --force skips these checks. With
+--refresh the stack is refreshed afterwards.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		project, stackName := parseStackArg(args[0])
+		refresh, _ := cmd.Flags().GetBool("refresh")
+		force, _ := cmd.Flags().GetBool("force")
+		res, err := newClient().Unlock(project, stackName, refresh, force)
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		for _, h := range res.Removed {
+			fmt.Printf("removed lock of %s\n", h)
+		}
+		if res.Refreshed {
+			fmt.Printf("stack %s/%s refreshed: %v\n", project, stackName, res.Changes)
+		}
+	},
+}
+
+var stacksStartCmd = newStackActionCmd("start", "Start the controller loop of a stack")
+var stacksStopCmd = newStackActionCmd("stop", "Stop the controller loop of a stack")
+var stacksReloadCmd = newStackActionCmd("reload", "Reload the config of a stack and trigger an update")
+
+func newStackActionCmd(action, short string) *cobra.Command {
+	return &cobra.Command{
+		Use:   action + " <project>/<stack>",
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			project, stackName := parseStackArg(args[0])
+			c := newClient()
+			var msg string
+			var err error
+			switch action {
+			case "start":
+				msg, err = c.Start(project, stackName)
+			case "stop":
+				msg, err = c.Stop(project, stackName)
+			case "reload":
+				msg, err = c.Reload(project, stackName)
+			}
+			if err != nil {
+				logErrorAndExit(err)
+			}
+			fmt.Print(msg)
+		},
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(stacksCmd)
+	stacksCmd.AddCommand(stacksListCmd)
+	stacksCmd.AddCommand(stacksStatusCmd)
+	stacksCmd.AddCommand(stacksErrorCmd)
+	stacksCmd.AddCommand(stacksOutputsCmd)
+	stacksCmd.AddCommand(stacksHistoryCmd)
+	stacksCmd.AddCommand(stacksStartCmd)
+	stacksCmd.AddCommand(stacksStopCmd)
+	stacksCmd.AddCommand(stacksReloadCmd)
+	stacksCmd.AddCommand(stacksRefreshCmd)
+	stacksCmd.AddCommand(stacksUpdateCmd)
+	stacksCmd.AddCommand(stacksUnlockCmd)
+
+	addClientFlags(stacksCmd)
+	for _, c := range []*cobra.Command{stacksListCmd, stacksStatusCmd, stacksHistoryCmd} {
+		c.Flags().StringP("output", "o", "table", "output format: table, json or yaml")
+	}
+	stacksOutputsCmd.Flags().StringP("output", "o", "json", "output format: json, yaml, dotenv or flat")
+	stacksOutputsCmd.Flags().Bool("reveal", false, "show the values of secret outputs")
+	stacksHistoryCmd.Flags().Int("page-size", 0, "number of updates per page, 0 for all")
+	stacksHistoryCmd.Flags().Int("page", 1, "page to show")
+	stacksUnlockCmd.Flags().Bool("refresh", false, "refresh the stack after removing the lock")
+	stacksUnlockCmd.Flags().Bool("force", false, "remove the lock without checking that it is stale")
+	stacksStatusCmd.Flags().BoolP("watch", "w", false, "poll until the controller is Idle or Failed")
+	stacksStatusCmd.Flags().Duration("interval", 5*time.Second, "poll interval of --watch")
+}
+
+// printOutput prints v in the format of the --output flag, table prints the
+// table format
+func printOutput(cmd *cobra.Command, v interface{}, table func()) {
+	format, _ := cmd.Flags().GetString("output")
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		fmt.Println(string(b))
+	case "yaml":
+		// go through json, so that yaml uses the json field names
+		j, err := json.Marshal(v)
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		var m interface{}
+		if err := yaml.Unmarshal(j, &m); err != nil {
+			logErrorAndExit(err)
+		}
+		b, err := yaml.Marshal(m)
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		fmt.Print(string(b))
+	case "table", "":
+		table()
+	default:
+		logErrorAndExit(fmt.Errorf("output format %q not supported", format))
+	}
+}
+
+func since(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Round(time.Second).String()
+}
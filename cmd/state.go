@@ -0,0 +1,189 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/sapcc/vcf-automation/pkg/settings"
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/spf13/cobra"
+)
+
+var (
+	stateFile         string
+	stateChecksum     string
+	stateSkipChecksum bool
+	stateRemote       bool
+	stateForce        bool
+)
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Export and import the state of a stack",
+	Long: `automation state:
+
+Export and import the deployment of a stack, e.g. to move a stack to another
+backend or to repair its state by hand. The stack is given by its config file,
+or as <project>/<stack> with --remote to go through a running server.`,
+}
+
+var stateExportCmd = &cobra.Command{
+	Use:   "export <config_file>|<project>/<stack>",
+	Short: "Export the state of a stack",
+	Long: `automation state export:
+
+Export the deployment of a stack. With --file the state is written to the
+file and its sha256 checksum to <file>.sha256, otherwise the state is written
+to stdout and the checksum to stderr.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var b []byte
+		var err error
+		if stateRemote {
+			project, stackName := parseStackArg(args[0])
+			b, err = newClient().ExportState(project, stackName)
+		} else {
+			var c *stack.Controller
+			if c, err = newInitializedController(args[0]); err == nil {
+				b, err = c.ExportState(context.Background())
+			}
+		}
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		if stateFile == "" {
+			fmt.Println(string(b))
+			fmt.Fprintf(os.Stderr, "sha256: %s\n", stack.StateChecksum(b))
+			return
+		}
+		if err := stack.WriteStateFile(stateFile, b); err != nil {
+			logErrorAndExit(err)
+		}
+		fmt.Printf("state written to %s, checksum to %s.sha256\n", stateFile, stateFile)
+	},
+}
+
+var stateImportCmd = &cobra.Command{
+	Use:   "import <config_file>|<project>/<stack>",
+	Short: "Replace the state of a stack",
+	Long: `automation state import:
+
+Replace the deployment of a stack with the state in --file. The state is
+verified against --checksum, or against <file>.sha256 as written by export;
+--skip-checksum imports a state that was edited by hand. The current state is
+backed up to $AUTOMATION_STATE_BACKUP_DIR (default <work dir>/state-backups)
+first.
+
+The import is refused while the controller of the stack is running on the
+server given by --server, or if the server cannot be reached; --force skips
+this check. With --remote the server imports the state, using
+its own backup directory.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if stateFile == "" {
+			logErrorAndExit(fmt.Errorf("--file not set"))
+		}
+		var b []byte
+		var err error
+		if stateSkipChecksum {
+			b, err = ioutil.ReadFile(stateFile)
+		} else {
+			b, err = stack.ReadStateFile(stateFile, stateChecksum)
+		}
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		if stateRemote {
+			project, stackName := parseStackArg(args[0])
+			msg, err := newClient().ImportState(project, stackName, b)
+			if err != nil {
+				logErrorAndExit(err)
+			}
+			fmt.Print(msg)
+			return
+		}
+		c, err := newInitializedController(args[0])
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		if !stateForce {
+			checkStackStopped(c)
+		}
+		backup, err := c.ImportState(context.Background(), b, stateBackupDir())
+		if err != nil {
+			logErrorAndExit(err)
+		}
+		fmt.Printf("state imported, backup written to %s\n", backup)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(stateCmd)
+	stateCmd.AddCommand(stateExportCmd)
+	stateCmd.AddCommand(stateImportCmd)
+
+	addClientFlags(stateCmd)
+	stateCmd.PersistentFlags().BoolVar(&stateRemote, "remote", false, "export or import through the server")
+	stateCmd.PersistentFlags().StringVarP(&stateFile, "file", "f", "", "state file")
+	stateImportCmd.Flags().StringVar(&stateChecksum, "checksum", "", "sha256 checksum of the state file")
+	stateImportCmd.Flags().BoolVar(&stateSkipChecksum, "skip-checksum", false, "do not verify the checksum of the state file")
+	stateImportCmd.Flags().BoolVar(&stateForce, "force", false, "do not check whether the server runs the controller")
+}
+
+func newInitializedController(cfgpath string) (*stack.Controller, error) {
+	cfg, err := stack.ReadConfig(cfgpath)
+	if err != nil {
+		return nil, err
+	}
+	c, err := stack.NewController(cfg, projectRoot())
+	if err != nil {
+		return nil, err
+	}
+	return c, c.InitStack(context.Background())
+}
+
+// checkStackStopped exits if the server runs the controller of the stack or
+// cannot be reached.
+func checkStackStopped(c *stack.Controller) {
+	if err := stackStopped(c); err != nil {
+		logErrorAndExit(fmt.Errorf("%v (--force skips the check)", err))
+	}
+}
+
+// stackStopped returns an error if the server runs the controller of the
+// stack, or if it cannot be checked because the server cannot be reached.
+func stackStopped(c *stack.Controller) error {
+	project, stackName := c.GetProjectStackName()
+	s, err := newClient().StackStatus(project, stackName)
+	if err != nil {
+		return fmt.Errorf("cannot check whether the controller of stack %s/%s is running: %v", project, stackName, err)
+	}
+	if s.Status == "running" {
+		return fmt.Errorf("controller of stack %s/%s is running, stop it first", project, stackName)
+	}
+	return nil
+}
+
+func stateBackupDir() string {
+	return settings.Get().StateBackupDir
+}
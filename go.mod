@@ -3,13 +3,19 @@ module github.com/sapcc/vcf-automation
 go 1.15
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/golang/protobuf v1.4.3
 	github.com/gorilla/mux v1.8.0
-	github.com/imdario/mergo v0.3.12
 	github.com/pulumi/pulumi-openstack/sdk/v3 v3.1.0
 	github.com/pulumi/pulumi/pkg/v3 v3.2.0
 	github.com/pulumi/pulumi/sdk/v3 v3.2.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.1.1
+	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.7.1
+	gocloud.dev v0.22.0
+	golang.org/x/term v0.0.0-20201117132131-f5c789dd3221
+	google.golang.org/grpc v1.34.0
+	gopkg.in/src-d/go-git.v4 v4.13.1
 	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,257 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sapcc/vcf-automation/pkg/revision"
+	"github.com/sapcc/vcf-automation/pkg/server"
+	"github.com/sapcc/vcf-automation/pkg/stack"
+)
+
+// Client talks to the API of a running automation server
+type Client struct {
+	URL string
+	// Token is sent as bearer token if set
+	Token string
+	// Caller identifies the user in the provenance of the stack operations
+	// triggered by the client, user@host by default
+	Caller string
+	http   *http.Client
+}
+
+func New(serverURL string) *Client {
+	return &Client{
+		URL:    strings.TrimSuffix(serverURL, "/"),
+		Caller: stack.LocalCaller(),
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *Client) ListStacks() ([]server.StackSummary, error) {
+	ss := make([]server.StackSummary, 0)
+	err := c.getJSON("/vcf", nil, &ss)
+	return ss, err
+}
+
+func (c *Client) StackStatus(project, stack string) (*server.StackSummary, error) {
+	s := server.StackSummary{}
+	err := c.getJSON(stackPath(project, stack, "status"), nil, &s)
+	return &s, err
+}
+
+func (c *Client) StackError(project, stack string) (string, error) {
+	return c.getText(stackPath(project, stack, "error"), nil)
+}
+
+// StackOutputs returns the outputs encoded in format, see
+// stack.FormatOutputs. Secret values are only revealed if the server requires
+// an api token.
+func (c *Client) StackOutputs(project, stack, format string, reveal bool) (string, error) {
+	q := url.Values{}
+	q.Set("format", format)
+	if reveal {
+		q.Set("reveal", "true")
+	}
+	return c.getText(stackPath(project, stack, "outputs"), q)
+}
+
+func (c *Client) Start(project, stack string) (string, error) {
+	return c.getText(stackPath(project, stack, "start"), nil)
+}
+
+func (c *Client) Stop(project, stack string) (string, error) {
+	return c.getText(stackPath(project, stack, "stop"), nil)
+}
+
+func (c *Client) Reload(project, stack string) (string, error) {
+	return c.getText(stackPath(project, stack, "reload"), nil)
+}
+
+// ExportState returns the deployment of the stack and verifies it against
+// the checksum sent by the server
+func (c *Client) ExportState(project, stackName string) ([]byte, error) {
+	p := stackPath(project, stackName, "state", "export")
+	resp, b, err := c.do(http.MethodGet, p, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := stack.VerifyStateChecksum(b, resp.Header.Get(server.ChecksumHeader)); err != nil {
+		return nil, fmt.Errorf("%s: %v", p, err)
+	}
+	return b, nil
+}
+
+// ImportState replaces the deployment of the stopped stack with state b
+func (c *Client) ImportState(project, stackName string, b []byte) (string, error) {
+	h := http.Header{}
+	h.Set(server.ChecksumHeader, stack.StateChecksum(b))
+	h.Set("Content-Type", "application/json")
+	_, msg, err := c.do(http.MethodPost, stackPath(project, stackName, "state", "import"), nil, h, b)
+	return string(msg), err
+}
+
+// History returns the update history of the stack, the complete history if
+// pageSize is 0
+func (c *Client) History(project, stackName string, pageSize, page int) ([]stack.UpdateRecord, error) {
+	q := url.Values{}
+	if pageSize > 0 {
+		q.Set("page-size", fmt.Sprint(pageSize))
+		q.Set("page", fmt.Sprint(page))
+	}
+	h := make([]stack.UpdateRecord, 0)
+	err := c.getJSON(stackPath(project, stackName, "history"), q, &h)
+	return h, err
+}
+
+// Select triggers operation of sel on the selected resources of the running
+// stack and returns the urns the selection resolved to
+func (c *Client) Select(project, stackName string, sel *stack.Selection) (*stack.ResolvedSelection, error) {
+	q := url.Values{"target": sel.Targets, "replace": sel.Replace, "exclude": sel.Exclude}
+	if sel.TargetDependents {
+		q.Set("target-dependents", "true")
+	}
+	_, b, err := c.do(http.MethodPost, stackPath(project, stackName, sel.Operation), q, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res := stack.ResolvedSelection{}
+	err = json.Unmarshal(b, &res)
+	return &res, err
+}
+
+// Unlock cancels the operation holding the stale lock of the stack and
+// refreshes it afterwards if refresh is set. force skips the checks that the
+// lock is stale.
+func (c *Client) Unlock(project, stackName string, refresh, force bool) (*stack.Unlock, error) {
+	q := url.Values{}
+	if refresh {
+		q.Set("refresh", "true")
+	}
+	if force {
+		q.Set("force", "true")
+	}
+	_, b, err := c.do(http.MethodPost, stackPath(project, stackName, "unlock"), q, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res := stack.Unlock{}
+	err = json.Unmarshal(b, &res)
+	return &res, err
+}
+
+func (c *Client) ListRevisions(project, stack string) ([]revision.Revision, error) {
+	revs := make([]revision.Revision, 0)
+	err := c.getJSON(stackPath(project, stack, "revisions"), nil, &revs)
+	return revs, err
+}
+
+func (c *Client) GetRevision(project, stack, id string) (*revision.Revision, error) {
+	rev := revision.Revision{}
+	err := c.getJSON(stackPath(project, stack, "revisions", id), nil, &rev)
+	return &rev, err
+}
+
+func (c *Client) DiffRevisions(project, stack, from, to string) (*revision.Diff, error) {
+	q := url.Values{}
+	q.Set("from", from)
+	if to != "" {
+		q.Set("to", to)
+	}
+	d := revision.Diff{}
+	err := c.getJSON(stackPath(project, stack, "revisions", "diff"), q, &d)
+	return &d, err
+}
+
+func (c *Client) Rollback(project, stack, id string) (string, error) {
+	_, msg, err := c.do(http.MethodPost, stackPath(project, stack, "revisions", id, "rollback"), nil, nil, nil)
+	return string(msg), err
+}
+
+func (c *Client) getJSON(p string, q url.Values, out interface{}) error {
+	b, err := c.get(p, q)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+func (c *Client) getText(p string, q url.Values) (string, error) {
+	b, err := c.get(p, q)
+	return string(b), err
+}
+
+func (c *Client) get(p string, q url.Values) ([]byte, error) {
+	_, b, err := c.do(http.MethodGet, p, q, nil, nil)
+	return b, err
+}
+
+func (c *Client) do(method, p string, q url.Values, h http.Header, body []byte) (*http.Response, []byte, error) {
+	u := c.URL + p
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.Caller != "" {
+		req.Header.Set(server.CallerHeader, c.Caller)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// the server encodes error messages as json string
+		var msg string
+		if json.Unmarshal(b, &msg) != nil {
+			msg = strings.TrimSpace(string(b))
+		}
+		return nil, nil, fmt.Errorf("%s: %s", p, msg)
+	}
+	return resp, b, nil
+}
+
+func stackPath(project, stack string, elem ...string) string {
+	p := []string{"", url.PathEscape(project), url.PathEscape(stack)}
+	for _, e := range elem {
+		p = append(p, url.PathEscape(e))
+	}
+	return strings.Join(p, "/")
+}
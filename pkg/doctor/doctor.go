@@ -0,0 +1,450 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+// Package doctor checks the prerequisites of the stacks: the pulumi cli and
+// backend, the secrets passphrase, the project directories and runtimes, the
+// provider plugins, and for each config file the config, the credentials and
+// the ssh key pair.
+package doctor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/sapcc/vcf-automation/pkg/stack/vcf"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	StatusPass = "pass"
+	StatusWarn = "warn"
+	StatusFail = "fail"
+	StatusSkip = "skip"
+)
+
+// commandTimeout limits the commands run by the checks
+const commandTimeout = 30 * time.Second
+
+// Check is the result of a single check. Target is the project or the config
+// file checked, empty for checks of the environment.
+type Check struct {
+	Name    string `json:"name"`
+	Target  string `json:"target,omitempty"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+type Report struct {
+	OK     bool    `json:"ok"`
+	Checks []Check `json:"checks"`
+}
+
+// Options select what is checked
+type Options struct {
+	ProjectRoot string
+	ConfigDir   string
+	ConfigFiles []string
+	// PluginCacheDir holds plugin archives for installs without network
+	PluginCacheDir string
+}
+
+type doctor struct {
+	Options
+	checks []Check
+	// plugins are the installed resource plugins, nil if unknown
+	plugins map[string][]string
+}
+
+// Run runs all checks. Projects are checked for the project types of the
+// config files.
+func Run(ctx context.Context, o Options) Report {
+	d := &doctor{Options: o}
+	d.checkPulumi(ctx)
+	d.checkBackend()
+	d.checkPassphrase()
+	d.checkDir("project root", o.ProjectRoot, "create it or set AUTOMATION_PROJECT_ROOT")
+	if o.ConfigDir != "" {
+		d.checkDir("config directory", o.ConfigDir, "create it or set AUTOMATION_CONFIG_DIR")
+	}
+
+	configs := make(map[string]*stack.Config)
+	projects := make(map[string]bool)
+	for _, f := range o.ConfigFiles {
+		cfg, err := stack.ReadConfig(f)
+		if err == nil {
+			err = stack.ValidateConfig(cfg)
+		}
+		if err != nil {
+			d.fail("config", f, err.Error(), "fix the config file; `automation config effective` shows the merged config")
+			continue
+		}
+		d.pass("config", f, string(cfg.ProjectType))
+		configs[f] = cfg
+		project, _ := cfg.GetProjectStackName()
+		projects[project] = true
+	}
+	for _, p := range sortedKeys(projects) {
+		d.checkProject(ctx, p)
+	}
+	for _, f := range o.ConfigFiles {
+		if cfg, ok := configs[f]; ok {
+			d.checkCredentials(f, cfg)
+			d.checkKeypair(f, cfg)
+			d.checkSecretsKey(f, cfg)
+		}
+	}
+
+	r := Report{OK: true, Checks: d.checks}
+	for _, c := range d.checks {
+		if c.Status == StatusFail {
+			r.OK = false
+		}
+	}
+	return r
+}
+
+func (d *doctor) add(status, name, target, msg, hint string) {
+	d.checks = append(d.checks, Check{Name: name, Target: target, Status: status, Message: msg, Hint: hint})
+}
+
+func (d *doctor) pass(name, target, msg string) {
+	d.add(StatusPass, name, target, msg, "")
+}
+
+func (d *doctor) warn(name, target, msg, hint string) {
+	d.add(StatusWarn, name, target, msg, hint)
+}
+
+func (d *doctor) fail(name, target, msg, hint string) {
+	d.add(StatusFail, name, target, msg, hint)
+}
+
+func (d *doctor) skip(name, target, msg string) {
+	d.add(StatusSkip, name, target, msg, "")
+}
+
+func (d *doctor) checkPulumi(ctx context.Context) {
+	if _, err := exec.LookPath("pulumi"); err != nil {
+		d.fail("pulumi cli", "", "pulumi not found in PATH", "install the pulumi cli and add it to PATH")
+		return
+	}
+	out, err := run(ctx, "", "pulumi", "version")
+	if err != nil {
+		d.fail("pulumi cli", "", err.Error(), "reinstall the pulumi cli")
+		return
+	}
+	d.pass("pulumi cli", "", out)
+
+	out, err = run(ctx, "", "pulumi", "plugin", "ls", "--json")
+	if err != nil {
+		return
+	}
+	var plugins []struct {
+		Name    string `json:"name"`
+		Kind    string `json:"kind"`
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(out), &plugins); err != nil {
+		return
+	}
+	d.plugins = make(map[string][]string)
+	for _, p := range plugins {
+		if p.Kind == "resource" {
+			d.plugins[p.Name] = append(d.plugins[p.Name], p.Version)
+		}
+	}
+}
+
+func (d *doctor) checkBackend() {
+	backend := os.Getenv("PULUMI_BACKEND_URL")
+	hint := "set PULUMI_BACKEND_URL, e.g. file:///pulumi/automation/etc or s3://<bucket>"
+	if backend == "" {
+		d.fail("PULUMI_BACKEND_URL", "", "not set", hint)
+		return
+	}
+	u, err := url.Parse(backend)
+	if err != nil {
+		d.fail("PULUMI_BACKEND_URL", "", err.Error(), hint)
+		return
+	}
+	switch u.Scheme {
+	case "file":
+		dir := u.Path
+		if u.Host != "" && u.Host != "localhost" {
+			dir = u.Host + u.Path
+		}
+		if f, err := os.Stat(dir); err != nil || !f.IsDir() {
+			d.fail("PULUMI_BACKEND_URL", "", fmt.Sprintf("directory %s does not exist", dir), "create the directory or mount the state volume")
+			return
+		}
+		d.pass("PULUMI_BACKEND_URL", "", backend)
+	case "s3", "azblob", "gs", "http", "https":
+		d.pass("PULUMI_BACKEND_URL", "", fmt.Sprintf("%s (access not verified)", backend))
+	default:
+		d.fail("PULUMI_BACKEND_URL", "", fmt.Sprintf("unsupported scheme %q", u.Scheme), hint)
+	}
+}
+
+func (d *doctor) checkPassphrase() {
+	if os.Getenv("PULUMI_CONFIG_PASSPHRASE") != "" {
+		d.pass("PULUMI_CONFIG_PASSPHRASE", "", "set")
+		return
+	}
+	if f := os.Getenv("PULUMI_CONFIG_PASSPHRASE_FILE"); f != "" {
+		if _, err := ioutil.ReadFile(f); err != nil {
+			d.fail("PULUMI_CONFIG_PASSPHRASE", "", err.Error(), "make PULUMI_CONFIG_PASSPHRASE_FILE readable")
+			return
+		}
+		d.pass("PULUMI_CONFIG_PASSPHRASE", "", "set by PULUMI_CONFIG_PASSPHRASE_FILE")
+		return
+	}
+	d.fail("PULUMI_CONFIG_PASSPHRASE", "", "not set", "set PULUMI_CONFIG_PASSPHRASE from the secret the stacks were created with")
+}
+
+func (d *doctor) checkDir(name, dir, hint string) {
+	if f, err := os.Stat(dir); err != nil || !f.IsDir() {
+		d.fail(name, "", fmt.Sprintf("directory %s does not exist", dir), hint)
+		return
+	}
+	d.pass(name, "", dir)
+}
+
+// projectSettings are the parts of Pulumi.yaml used by the checks. The
+// runtime is either a name or an object with name and options.
+type projectSettings struct {
+	Name    string      `yaml:"name"`
+	Runtime interface{} `yaml:"runtime"`
+}
+
+func (p projectSettings) runtime() (name, virtualenv string) {
+	switch r := p.Runtime.(type) {
+	case string:
+		return r, ""
+	case map[interface{}]interface{}:
+		name = fmt.Sprint(r["name"])
+		if o, ok := r["options"].(map[interface{}]interface{}); ok && o["virtualenv"] != nil {
+			virtualenv = fmt.Sprint(o["virtualenv"])
+		}
+	}
+	return
+}
+
+func (d *doctor) checkProject(ctx context.Context, project string) {
+	dir := path.Join(d.ProjectRoot, project)
+	b, err := ioutil.ReadFile(path.Join(dir, "Pulumi.yaml"))
+	if err != nil {
+		d.fail("project directory", project, fmt.Sprintf("%s/Pulumi.yaml not readable", dir),
+			fmt.Sprintf("copy the project %s to %s or set AUTOMATION_PROJECT_ROOT", project, d.ProjectRoot))
+		return
+	}
+	var ps projectSettings
+	if err := yaml.Unmarshal(b, &ps); err != nil {
+		d.fail("project directory", project, fmt.Sprintf("Pulumi.yaml: %v", err), "fix Pulumi.yaml of the project")
+		return
+	}
+	d.pass("project directory", project, dir)
+
+	switch name, venv := ps.runtime(); {
+	case stack.IsInlineProject(project):
+		d.pass("runtime", project, "inline program built into the binary")
+	case name == "python":
+		d.checkPython(ctx, project, dir, venv)
+	case name == "go":
+		if _, err := exec.LookPath("go"); err != nil {
+			d.fail("runtime", project, "go not found in PATH", "install the go toolchain")
+		} else {
+			d.pass("runtime", project, "go")
+		}
+	default:
+		d.skip("runtime", project, fmt.Sprintf("runtime %q not checked", name))
+	}
+
+	for _, plugin := range stack.ProjectPlugins(project) {
+		name := "plugin " + plugin.Name
+		if d.plugins == nil {
+			d.skip(name, project, "installed plugins unknown")
+			continue
+		}
+		hint := fmt.Sprintf("pulumi plugin install resource %s v%s", plugin.Name, plugin.Version)
+		if d.PluginCacheDir != "" {
+			archive := stack.PluginArchive(d.PluginCacheDir, plugin)
+			if _, err := os.Stat(archive); err == nil {
+				hint += " --file " + archive
+			} else {
+				hint = fmt.Sprintf("put %s into the plugin cache, or %s", path.Base(archive), hint)
+			}
+		}
+		switch st := stack.CheckPlugin(plugin, d.plugins[plugin.Name]); st.Status {
+		case stack.PluginOK:
+			d.pass(name, project, "v"+plugin.Version)
+		case stack.PluginMismatch:
+			// the pins are advisory, see stack.ensurePlugins
+			d.warn(name, project, fmt.Sprintf("requires v%s, installed %s", plugin.Version, strings.Join(st.Installed, ", ")), hint)
+		default:
+			d.fail(name, project, fmt.Sprintf("requires v%s, not installed", plugin.Version), hint)
+		}
+	}
+}
+
+// checkPython checks that the interpreter of the project, from the virtual
+// environment if configured, imports the modules in requirements.txt
+func (d *doctor) checkPython(ctx context.Context, project, dir, venv string) {
+	python := ""
+	if venv != "" {
+		if !filepath.IsAbs(venv) {
+			venv = path.Join(dir, venv)
+		}
+		python = path.Join(venv, "bin", "python")
+		if _, err := os.Stat(python); err != nil {
+			d.fail("runtime", project, fmt.Sprintf("virtualenv %s has no python", venv),
+				fmt.Sprintf("python3 -m venv %s && %s/bin/pip install -r %s/requirements.txt", venv, venv, dir))
+			return
+		}
+	} else {
+		for _, p := range []string{"python3", "python"} {
+			if _, err := exec.LookPath(p); err == nil {
+				python = p
+				break
+			}
+		}
+		if python == "" {
+			d.fail("runtime", project, "python not found in PATH", "install python 3")
+			return
+		}
+	}
+	d.pass("runtime", project, python)
+
+	modules, err := requirements(path.Join(dir, "requirements.txt"))
+	if err != nil || len(modules) == 0 {
+		return
+	}
+	script := "import importlib.util, sys\n" +
+		"print(' '.join(m for m in sys.argv[1:] if importlib.util.find_spec(m) is None))"
+	out, err := run(ctx, dir, python, append([]string{"-c", script}, modules...)...)
+	if err != nil {
+		d.fail("python modules", project, err.Error(), "")
+		return
+	}
+	if out != "" {
+		d.fail("python modules", project, "missing "+out,
+			fmt.Sprintf("%s -m pip install -r %s/requirements.txt", python, dir))
+		return
+	}
+	d.pass("python modules", project, strings.Join(modules, ", "))
+}
+
+// requirements returns the module names of the packages in a requirements
+// file, e.g. pulumi_openstack for pulumi-openstack>=3.0.0
+func requirements(fpath string) ([]string, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var modules []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "-") {
+			continue
+		}
+		if i := strings.IndexAny(line, "<>=!~;[ "); i >= 0 {
+			line = line[:i]
+		}
+		modules = append(modules, strings.ReplaceAll(strings.ToLower(line), "-", "_"))
+	}
+	return modules, s.Err()
+}
+
+func (d *doctor) checkCredentials(f string, cfg *stack.Config) {
+	if err := stack.ValidateCredentials(cfg); err != nil {
+		d.fail("credentials", f, err.Error(), "set the env variable from the secrets of the deployment")
+		return
+	}
+	d.pass("credentials", f, "set")
+}
+
+// checkSecretsKey checks that the key file of the keyfile secrets provider
+// is readable; the passphrase provider is checked for all configs
+func (d *doctor) checkSecretsKey(f string, cfg *stack.Config) {
+	if cfg.Secrets.Provider != stack.SecretsKeyFile {
+		return
+	}
+	if _, err := stack.ReadKeyFile(cfg.Secrets.KeyFile); err != nil {
+		d.fail("secrets key", f, err.Error(), "mount the key file at "+cfg.Secrets.KeyFile+" or set secrets.keyFile")
+		return
+	}
+	d.pass("secrets key", f, cfg.Secrets.KeyFile)
+}
+
+// checkKeypair checks that the vcf program can read the ssh key pair
+func (d *doctor) checkKeypair(f string, cfg *stack.Config) {
+	decoded, err := cfg.DecodeProps()
+	if err != nil {
+		d.fail("ssh key pair", f, err.Error(), "")
+		return
+	}
+	props, ok := decoded.(*vcf.StackProps)
+	if !ok {
+		return
+	}
+	public, private := props.KeypairFile.Files()
+	for _, k := range []string{private, public} {
+		if _, err := ioutil.ReadFile(k); err != nil {
+			d.fail("ssh key pair", f, err.Error(),
+				"mount the key pair at "+path.Dir(k)+" or set props.stack.keypairFile")
+			return
+		}
+	}
+	d.pass("ssh key pair", f, private)
+}
+
+// run runs a command and returns its trimmed output
+func run(ctx context.Context, dir, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,152 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+// Package gitsource keeps a local checkout of a git branch, from which the
+// automation server reads its configuration files.
+package gitsource
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+const remoteName = "origin"
+
+// Source is a branch of a git repository checked out into Dir. Only
+// committed and pushed revisions of the branch are checked out; local changes
+// in Dir are discarded on every Sync.
+type Source struct {
+	URL    string
+	Branch string
+	// SubDir is the directory in the repository holding the config files
+	SubDir string
+	// Dir is the local checkout
+	Dir  string
+	Auth transport.AuthMethod
+
+	repo   *git.Repository
+	commit string
+	mu     sync.Mutex
+}
+
+func New(url, branch, subdir, dir string) *Source {
+	if branch == "" {
+		branch = "master"
+	}
+	return &Source{URL: url, Branch: branch, SubDir: subdir, Dir: dir}
+}
+
+// WithBasicAuth sets the credentials for http(s) repositories.
+func (s *Source) WithBasicAuth(username, password string) *Source {
+	if username != "" || password != "" {
+		s.Auth = &http.BasicAuth{Username: username, Password: password}
+	}
+	return s
+}
+
+// ConfigDir returns the directory of the config files in the checkout.
+func (s *Source) ConfigDir() string {
+	return path.Join(s.Dir, s.SubDir)
+}
+
+// Commit returns the SHA of the checked out commit.
+func (s *Source) Commit() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commit
+}
+
+// Sync fetches the branch and checks out its head commit. It reports whether
+// the checked out commit changed.
+func (s *Source) Sync() (commit string, changed bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.repo == nil {
+		if err = s.open(); err != nil {
+			return "", false, err
+		}
+	}
+	refSpec := config.RefSpec(fmt.Sprintf("+refs/heads/%s:refs/remotes/%s/%s", s.Branch, remoteName, s.Branch))
+	err = s.repo.Fetch(&git.FetchOptions{
+		RemoteName: remoteName,
+		RefSpecs:   []config.RefSpec{refSpec},
+		Auth:       s.Auth,
+		Force:      true,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return "", false, fmt.Errorf("fetch %s: %v", s.URL, err)
+	}
+	ref, err := s.repo.Reference(plumbing.NewRemoteReferenceName(remoteName, s.Branch), true)
+	if err != nil {
+		return "", false, fmt.Errorf("branch %s: %v", s.Branch, err)
+	}
+	wt, err := s.repo.Worktree()
+	if err != nil {
+		return "", false, err
+	}
+	err = wt.Reset(&git.ResetOptions{Commit: ref.Hash(), Mode: git.HardReset})
+	if err != nil {
+		return "", false, err
+	}
+	if err = wt.Clean(&git.CleanOptions{Dir: true}); err != nil {
+		return "", false, err
+	}
+	commit = ref.Hash().String()
+	changed = commit != s.commit
+	s.commit = commit
+	return commit, changed, nil
+}
+
+// open opens the checkout in Dir, or clones the repository if there is no
+// checkout of it.
+func (s *Source) open() error {
+	repo, err := git.PlainOpen(s.Dir)
+	if err == nil {
+		remote, err := repo.Remote(remoteName)
+		if err == nil && len(remote.Config().URLs) > 0 && remote.Config().URLs[0] == s.URL {
+			s.repo = repo
+			return nil
+		}
+		// the checkout is of another repository
+		if err := os.RemoveAll(s.Dir); err != nil {
+			return err
+		}
+	} else if err != git.ErrRepositoryNotExists {
+		return err
+	}
+	repo, err = git.PlainClone(s.Dir, false, &git.CloneOptions{
+		URL:           s.URL,
+		Auth:          s.Auth,
+		RemoteName:    remoteName,
+		ReferenceName: plumbing.NewBranchReferenceName(s.Branch),
+		SingleBranch:  true,
+	})
+	if err != nil {
+		return fmt.Errorf("clone %s: %v", s.URL, err)
+	}
+	s.repo = repo
+	return nil
+}
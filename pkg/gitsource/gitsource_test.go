@@ -0,0 +1,216 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package gitsource
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+// remote is a bare repository with a working clone to push commits from
+type remote struct {
+	t    *testing.T
+	bare string
+	work string
+}
+
+func newRemote(t *testing.T) *remote {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "gitsource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	r := &remote{t: t, bare: path.Join(dir, "remote.git"), work: path.Join(dir, "work")}
+	r.git(dir, "init", "--bare", "-q", r.bare)
+	r.git(dir, "clone", "-q", r.bare, r.work)
+	r.git(r.work, "checkout", "-q", "-b", "master")
+	return r
+}
+
+func (r *remote) git(dir string, args ...string) string {
+	r.t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes files to the working clone, commits and pushes them to
+// branch, and returns the commit
+func (r *remote) commit(branch string, files map[string]string) string {
+	r.t.Helper()
+	for name, content := range files {
+		p := path.Join(r.work, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			r.t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+	r.git(r.work, "add", "-A")
+	r.git(r.work, "commit", "-q", "-m", "update")
+	r.git(r.work, "push", "-q", "origin", "HEAD:refs/heads/"+branch)
+	return r.git(r.work, "rev-parse", "HEAD")
+}
+
+func checkoutDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "checkout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return path.Join(dir, "checkout")
+}
+
+func readFile(t *testing.T, p string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestSyncClone(t *testing.T) {
+	r := newRemote(t)
+	want := r.commit("master", map[string]string{"a.yaml": "a: 1\n"})
+
+	s := New(r.bare, "", "", checkoutDir(t))
+	commit, changed, err := s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit != want || !changed {
+		t.Errorf("Sync() = %s, %t; want %s, true", commit, changed, want)
+	}
+	if s.Commit() != want {
+		t.Errorf("Commit() = %s; want %s", s.Commit(), want)
+	}
+	if got := readFile(t, path.Join(s.ConfigDir(), "a.yaml")); got != "a: 1\n" {
+		t.Errorf("a.yaml = %q", got)
+	}
+}
+
+func TestSyncChanged(t *testing.T) {
+	r := newRemote(t)
+	first := r.commit("master", map[string]string{"a.yaml": "a: 1\n"})
+	s := New(r.bare, "master", "", checkoutDir(t))
+	if _, _, err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// unchanged remote
+	commit, changed, err := s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit != first || changed {
+		t.Errorf("Sync() unchanged = %s, %t; want %s, false", commit, changed, first)
+	}
+
+	// local changes are discarded
+	local := path.Join(s.ConfigDir(), "local.yaml")
+	if err := ioutil.WriteFile(local, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	second := r.commit("master", map[string]string{"a.yaml": "a: 2\n"})
+	commit, changed, err = s.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit != second || !changed {
+		t.Errorf("Sync() changed = %s, %t; want %s, true", commit, changed, second)
+	}
+	if got := readFile(t, path.Join(s.ConfigDir(), "a.yaml")); got != "a: 2\n" {
+		t.Errorf("a.yaml = %q", got)
+	}
+	if _, err := os.Stat(local); !os.IsNotExist(err) {
+		t.Errorf("local file not removed: %v", err)
+	}
+
+	// a new source on the existing checkout opens it and reports the
+	// commit as changed
+	s2 := New(r.bare, "master", "", s.Dir)
+	commit, changed, err = s2.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit != second || !changed {
+		t.Errorf("Sync() reopened = %s, %t; want %s, true", commit, changed, second)
+	}
+}
+
+func TestSyncSubDir(t *testing.T) {
+	r := newRemote(t)
+	r.commit("configs", map[string]string{
+		"README.md":              "readme\n",
+		"region/a/vcf-a.yaml":    "a\n",
+		"region/b/vcf-b.yaml":    "b\n",
+		"region/a/sub/vcf-c.yml": "c\n",
+	})
+	s := New(r.bare, "configs", "region/a", checkoutDir(t))
+	if _, _, err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.ConfigDir(); got != path.Join(s.Dir, "region/a") {
+		t.Errorf("ConfigDir() = %s", got)
+	}
+	if got := readFile(t, path.Join(s.ConfigDir(), "vcf-a.yaml")); got != "a\n" {
+		t.Errorf("vcf-a.yaml = %q", got)
+	}
+	if got := readFile(t, path.Join(s.ConfigDir(), "sub/vcf-c.yml")); got != "c\n" {
+		t.Errorf("sub/vcf-c.yml = %q", got)
+	}
+}
+
+func TestSyncBadRef(t *testing.T) {
+	r := newRemote(t)
+	r.commit("master", map[string]string{"a.yaml": "a: 1\n"})
+	s := New(r.bare, "missing", "", checkoutDir(t))
+	commit, changed, err := s.Sync()
+	if err == nil {
+		t.Fatalf("Sync() of missing branch = %s, %t; want error", commit, changed)
+	}
+	if s.Commit() != "" {
+		t.Errorf("Commit() = %s; want empty", s.Commit())
+	}
+}
+
+func TestSyncBadURL(t *testing.T) {
+	s := New(path.Join(checkoutDir(t), "missing.git"), "master", "", checkoutDir(t))
+	if _, _, err := s.Sync(); err == nil {
+		t.Fatal("Sync() of missing repository: want error")
+	}
+}
@@ -0,0 +1,190 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package revision
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/vcf-automation/pkg/stack"
+)
+
+var ErrNotFound = errors.New("revision not found")
+var ErrAmbiguous = errors.New("revision id ambiguous")
+
+// Revision is a config that was applied to a stack controller. Its ID is the
+// hash of the effective config.
+type Revision struct {
+	ID        string    `json:"id" yaml:"id"`
+	Timestamp time.Time `json:"timestamp" yaml:"timestamp"`
+	// Source is the config file, or the revision the config was rolled back
+	// to
+	Source string `json:"source" yaml:"source"`
+	// Trigger is what caused the config to be applied, e.g. reload or
+	// rollback
+	Trigger string `json:"trigger,omitempty" yaml:"trigger,omitempty"`
+	// Commit is the SHA of the git commit the config was read from
+	Commit string                 `json:"commit,omitempty" yaml:"commit,omitempty"`
+	Config *stack.EffectiveConfig `json:"config,omitempty" yaml:"config,omitempty"`
+}
+
+// Diff is the difference between the configs of two revisions
+type Diff struct {
+	From    string               `json:"from" yaml:"from"`
+	To      string               `json:"to" yaml:"to"`
+	Changes []stack.ConfigChange `json:"changes" yaml:"changes"`
+}
+
+// Store persists the revisions of all stacks below a root directory. Each
+// stack has a directory holding one file per distinct config, named by its
+// hash, and the history of applied revisions.
+type Store struct {
+	root string
+	mu   sync.Mutex
+}
+
+func NewStore(root string) *Store {
+	return &Store{root: root}
+}
+
+// Record adds the config to the history of the stack, with source, trigger
+// and commit taken from r. If the config is the same as the latest revision,
+// no new revision is added and the latest revision is returned.
+func (s *Store) Record(name string, cfg *stack.Config, r Revision) (*Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history, err := s.readHistory(name)
+	if err != nil {
+		return nil, err
+	}
+	id := cfg.Hash()
+	if len(history) > 0 && history[len(history)-1].ID == id {
+		return &history[len(history)-1], nil
+	}
+	if err := os.MkdirAll(path.Join(s.root, name), 0755); err != nil {
+		return nil, err
+	}
+	e := cfg.Effective()
+	if err := writeJSON(s.configPath(name, id), e); err != nil {
+		return nil, err
+	}
+	r.ID = id
+	r.Timestamp = time.Now().UTC()
+	r.Config = nil
+	history = append(history, r)
+	if err := writeJSON(s.historyPath(name), history); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// List returns the revisions of the stack, oldest first, without their
+// configs.
+func (s *Store) List(name string) ([]Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readHistory(name)
+}
+
+// Get returns the latest revision of the stack whose id starts with id,
+// including its config. The id "latest" refers to the latest revision.
+func (s *Store) Get(name, id string) (*Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history, err := s.readHistory(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, ErrNotFound
+	}
+	var r *Revision
+	if id == "latest" {
+		r = &history[len(history)-1]
+	} else {
+		for i := len(history) - 1; i >= 0; i-- {
+			if !strings.HasPrefix(history[i].ID, id) {
+				continue
+			}
+			if r != nil && r.ID != history[i].ID {
+				return nil, fmt.Errorf("%s: %v", id, ErrAmbiguous)
+			}
+			if r == nil {
+				r = &history[i]
+			}
+		}
+	}
+	if r == nil {
+		return nil, fmt.Errorf("%s: %v", id, ErrNotFound)
+	}
+	b, err := ioutil.ReadFile(s.configPath(name, r.ID))
+	if err != nil {
+		return nil, err
+	}
+	e := stack.EffectiveConfig{}
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	r.Config = &e
+	return r, nil
+}
+
+func (s *Store) readHistory(name string) ([]Revision, error) {
+	history := make([]Revision, 0)
+	b, err := ioutil.ReadFile(s.historyPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return history, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func (s *Store) historyPath(name string) string {
+	return path.Join(s.root, name, "history.json")
+}
+
+func (s *Store) configPath(name, id string) string {
+	return path.Join(s.root, name, id+".json")
+}
+
+// writeJSON writes v to a temporary file first, so that an interrupted write
+// does not corrupt the existing file
+func writeJSON(fpath string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fpath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fpath)
+}
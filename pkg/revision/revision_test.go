@@ -0,0 +1,150 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package revision
+
+import (
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/sapcc/vcf-automation/pkg/stack"
+)
+
+// readConfig writes a config of the example-go project with the stack props
+// content and reads it
+func readConfig(t *testing.T, content string) *stack.Config {
+	t.Helper()
+	f := path.Join(t.TempDir(), "example.yaml")
+	cfg := "projectType: example-go\nstack: s1\nprops:\n  stack:\n    content: " + content + "\n"
+	if err := ioutil.WriteFile(f, []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := stack.ReadConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRecord(t *testing.T) {
+	s := NewStore(t.TempDir())
+	a, b := readConfig(t, "a"), readConfig(t, "b")
+
+	r1, err := s.Record("example-s1", a, Revision{Source: "example.yaml", Trigger: "create", Commit: "c1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r1.ID != a.Hash() || r1.Trigger != "create" || r1.Commit != "c1" || r1.Timestamp.IsZero() {
+		t.Errorf("revision = %+v; want id %s of create at c1", r1, a.Hash())
+	}
+	// the same config as the latest revision is not recorded again
+	r2, err := s.Record("example-s1", a, Revision{Source: "example.yaml", Trigger: "reload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.Trigger != "create" {
+		t.Errorf("trigger = %s; want the latest revision of create", r2.Trigger)
+	}
+	// going back to an earlier config is a new revision
+	for _, c := range []*stack.Config{b, a} {
+		if _, err := s.Record("example-s1", c, Revision{Source: "example.yaml", Trigger: "reload"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := s.List("example-s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{a.Hash(), b.Hash(), a.Hash()}
+	if len(l) != len(want) {
+		t.Fatalf("got %d revisions; want %d", len(l), len(want))
+	}
+	for i, r := range l {
+		if r.ID != want[i] || r.Config != nil {
+			t.Errorf("revision %d = %s with config %v; want %s without config", i, r.ID, r.Config, want[i])
+		}
+	}
+	if l, err := s.List("example-s2"); err != nil || len(l) != 0 {
+		t.Errorf("revisions of an unknown stack = %v, %v; want none", l, err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	s := NewStore(t.TempDir())
+	a, b := readConfig(t, "a"), readConfig(t, "b")
+	for _, c := range []*stack.Config{a, b} {
+		if _, err := s.Record("example-s1", c, Revision{Source: "example.yaml"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		id   string
+		want string
+		err  error
+	}{
+		{"latest", b.Hash(), nil},
+		{a.Hash(), a.Hash(), nil},
+		{a.Hash()[:8], a.Hash(), nil},
+		{"", "", ErrAmbiguous},
+		{"xyz", "", ErrNotFound},
+	}
+	for _, tt := range tests {
+		r, err := s.Get("example-s1", tt.id)
+		if tt.err != nil {
+			if err == nil || err.Error() != tt.id+": "+tt.err.Error() {
+				t.Errorf("%q: err = %v; want %v", tt.id, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.id, err)
+			continue
+		}
+		if r.ID != tt.want || r.Config == nil {
+			t.Errorf("%q: revision %s with config %v; want %s with config", tt.id, r.ID, r.Config, tt.want)
+		}
+	}
+	if _, err := s.Get("example-s2", "latest"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown stack: err = %v; want ErrNotFound", err)
+	}
+}
+
+// TestRollbackConfig reads back the config of a revision, as a rollback does
+func TestRollbackConfig(t *testing.T) {
+	s := NewStore(t.TempDir())
+	a := readConfig(t, "a")
+	if _, err := s.Record("example-s1", a, Revision{Source: "example.yaml"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Record("example-s1", readConfig(t, "b"), Revision{Source: "example.yaml"}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.Get("example-s1", a.Hash()[:8])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := stack.ConfigFromEffective(*r.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Hash() != a.Hash() || c.StackName != "s1" || c.ProjectType != stack.ProjectExample {
+		t.Errorf("config %s of %s/%s; want %s", c.Hash(), c.ProjectType, c.StackName, a.Hash())
+	}
+}
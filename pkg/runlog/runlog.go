@@ -0,0 +1,405 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+// Package runlog records the steps of stack operations per resource from the
+// event stream of the pulumi engine, and stores the records of each run.
+package runlog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+var ErrNotFound = errors.New("run not found")
+var ErrAmbiguous = errors.New("run id ambiguous")
+
+// Status of runs and operations
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// colors matches the color directives of engine messages, e.g. <{%reset%}>
+var colors = regexp.MustCompile(`<\{%[^%]*%\}>`)
+
+// Diagnostic is a message of the engine or a resource provider
+type Diagnostic struct {
+	Time     time.Time `json:"time" yaml:"time"`
+	Severity string    `json:"severity" yaml:"severity"`
+	Message  string    `json:"message" yaml:"message"`
+}
+
+// Operation is a step of the engine on a single resource, e.g. the create of
+// a RemoteExec on an esxi host
+type Operation struct {
+	URN         string       `json:"urn" yaml:"urn"`
+	Type        string       `json:"type" yaml:"type"`
+	Op          string       `json:"op" yaml:"op"`
+	Start       time.Time    `json:"start" yaml:"start"`
+	End         time.Time    `json:"end,omitempty" yaml:"end,omitempty"`
+	Status      string       `json:"status" yaml:"status"`
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty" yaml:"diagnostics,omitempty"`
+}
+
+// Duration is the time the operation took, or has taken so far
+func (o *Operation) Duration() time.Duration {
+	if o.End.IsZero() {
+		return time.Since(o.Start)
+	}
+	return o.End.Sub(o.Start)
+}
+
+// Run is the record of a stack operation (preview, refresh, update or
+// destroy). Failed lists the urns of the failed operations; Diagnostics are
+// the messages not related to a resource.
+type Run struct {
+	ID      string `json:"id" yaml:"id"`
+	Project string `json:"project" yaml:"project"`
+	Stack   string `json:"stack" yaml:"stack"`
+	Kind    string `json:"kind" yaml:"kind"`
+	// Commit is the commit of the config repository the run applied
+	Commit      string         `json:"commit,omitempty" yaml:"commit,omitempty"`
+	Start       time.Time      `json:"start" yaml:"start"`
+	End         time.Time      `json:"end,omitempty" yaml:"end,omitempty"`
+	Status      string         `json:"status" yaml:"status"`
+	Error       string         `json:"error,omitempty" yaml:"error,omitempty"`
+	Changes     map[string]int `json:"changes,omitempty" yaml:"changes,omitempty"`
+	Failed      []string       `json:"failed,omitempty" yaml:"failed,omitempty"`
+	Operations  []*Operation   `json:"operations,omitempty" yaml:"operations,omitempty"`
+	Diagnostics []Diagnostic   `json:"diagnostics,omitempty" yaml:"diagnostics,omitempty"`
+}
+
+// Filter selects operations of a run. Status and Op match exactly, URN and
+// Type by substring; empty fields match all operations.
+type Filter struct {
+	Status string
+	Op     string
+	URN    string
+	Type   string
+}
+
+func (f Filter) Match(o *Operation) bool {
+	return (f.Status == "" || o.Status == f.Status) &&
+		(f.Op == "" || o.Op == f.Op) &&
+		(f.URN == "" || strings.Contains(o.URN, f.URN)) &&
+		(f.Type == "" || strings.Contains(o.Type, f.Type))
+}
+
+// Filter returns a copy of the run with the operations matching f
+func (r *Run) Filter(f Filter) *Run {
+	c := *r
+	c.Operations = make([]*Operation, 0)
+	for _, o := range r.Operations {
+		if f.Match(o) {
+			c.Operations = append(c.Operations, o)
+		}
+	}
+	return &c
+}
+
+// Recorder builds the record of a run from the engine events sent to its
+// channel. The automation api closes the channel when the operation returns,
+// but not if the operation failed before the engine was started; therefore
+// recording also stops when Finish is called, which must be after the
+// operation returned.
+type Recorder struct {
+	run      *Run
+	ops      map[string]*Operation
+	latest   map[string]*Operation
+	events   chan events.EngineEvent
+	finished chan struct{}
+	done     chan struct{}
+}
+
+// NewRecorder starts recording a run of kind on the stack
+func NewRecorder(project, stack, kind string) *Recorder {
+	now := time.Now().UTC()
+	r := &Recorder{
+		run: &Run{
+			ID:         fmt.Sprintf("%s-%s", now.Format("20060102T150405.000Z"), kind),
+			Project:    project,
+			Stack:      stack,
+			Kind:       kind,
+			Start:      now,
+			Status:     StatusRunning,
+			Operations: make([]*Operation, 0),
+		},
+		ops:    make(map[string]*Operation),
+		latest: make(map[string]*Operation),
+		events:   make(chan events.EngineEvent),
+		finished: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go r.record()
+	return r
+}
+
+// SetCommit sets the commit of the config repository of the run. It is to be
+// called before the operation is started.
+func (r *Recorder) SetCommit(commit string) {
+	r.run.Commit = commit
+}
+
+// Events is the channel to pass to the EventStreams option of the operation
+func (r *Recorder) Events() chan<- events.EngineEvent {
+	return r.events
+}
+
+// Finish completes the record with the result err of the operation.
+// Operations still running are marked as failed if the run failed.
+func (r *Recorder) Finish(err error) *Run {
+	close(r.finished)
+	<-r.done
+	run := r.run
+	run.End = time.Now().UTC()
+	run.Status = StatusSucceeded
+	if err != nil {
+		run.Status = StatusFailed
+		run.Error = err.Error()
+	}
+	for _, o := range run.Operations {
+		if o.Status == StatusRunning {
+			o.Status = run.Status
+			o.End = run.End
+		}
+		if o.Status == StatusFailed {
+			run.Failed = append(run.Failed, o.URN)
+		}
+	}
+	return run
+}
+
+func (r *Recorder) record() {
+	defer close(r.done)
+	for {
+		select {
+		case e, ok := <-r.events:
+			if !ok {
+				return
+			}
+			if e.Error == nil {
+				r.handle(e.EngineEvent)
+			}
+		case <-r.finished:
+			return
+		}
+	}
+}
+
+func (r *Recorder) handle(e apitype.EngineEvent) {
+	t := time.Now().UTC()
+	if e.Timestamp > 0 {
+		t = time.Unix(int64(e.Timestamp), 0).UTC()
+	}
+	switch {
+	case e.ResourcePreEvent != nil:
+		m := e.ResourcePreEvent.Metadata
+		if m.Op == apitype.OpSame {
+			return
+		}
+		o := &Operation{URN: m.URN, Type: m.Type, Op: string(m.Op), Start: t, Status: StatusRunning}
+		r.ops[opKey(m)] = o
+		r.latest[m.URN] = o
+		r.run.Operations = append(r.run.Operations, o)
+	case e.ResOutputsEvent != nil:
+		if o, ok := r.ops[opKey(e.ResOutputsEvent.Metadata)]; ok {
+			o.End = t
+			o.Status = StatusSucceeded
+		}
+	case e.ResOpFailedEvent != nil:
+		m := e.ResOpFailedEvent.Metadata
+		o, ok := r.ops[opKey(m)]
+		if !ok {
+			o = &Operation{URN: m.URN, Type: m.Type, Op: string(m.Op), Start: t}
+			r.latest[m.URN] = o
+			r.run.Operations = append(r.run.Operations, o)
+		}
+		o.End = t
+		o.Status = StatusFailed
+	case e.DiagnosticEvent != nil:
+		d := e.DiagnosticEvent
+		if d.Ephemeral {
+			return
+		}
+		msg := strings.TrimSpace(colors.ReplaceAllString(d.Message, ""))
+		if msg == "" {
+			return
+		}
+		diag := Diagnostic{Time: t, Severity: d.Severity, Message: msg}
+		if o, ok := r.latest[d.URN]; ok {
+			o.Diagnostics = append(o.Diagnostics, diag)
+		} else {
+			r.run.Diagnostics = append(r.run.Diagnostics, diag)
+		}
+	case e.SummaryEvent != nil:
+		r.run.Changes = make(map[string]int)
+		for op, n := range e.SummaryEvent.ResourceChanges {
+			r.run.Changes[string(op)] = n
+		}
+	}
+}
+
+func opKey(m apitype.StepEventMetadata) string {
+	return string(m.Op) + " " + m.URN
+}
+
+// Store persists the runs of all stacks below a root directory, one file per
+// run. Keep limits the runs kept per stack; zero keeps all runs.
+type Store struct {
+	Keep int
+	root string
+	mu   sync.Mutex
+}
+
+func NewStore(root string, keep int) *Store {
+	return &Store{root: root, Keep: keep}
+}
+
+// Save writes the run and removes the oldest runs of the stack beyond Keep
+func (s *Store) Save(run *Run) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir := path.Join(s.root, run.Project, run.Stack)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, run.ID+".json"), b, 0644); err != nil {
+		return err
+	}
+	if s.Keep <= 0 {
+		return nil
+	}
+	ids, err := s.ids(run.Project, run.Stack)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids[min(s.Keep, len(ids)):] {
+		if err := os.Remove(path.Join(dir, id+".json")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List returns the runs of the stack, newest first, without their
+// operations and diagnostics
+func (s *Store) List(project, stack string) ([]Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.ids(project, stack)
+	if err != nil {
+		return nil, err
+	}
+	l := make([]Run, 0, len(ids))
+	for _, id := range ids {
+		r, err := s.read(project, stack, id)
+		if err != nil {
+			return nil, err
+		}
+		r.Operations = nil
+		r.Diagnostics = nil
+		l = append(l, *r)
+	}
+	return l, nil
+}
+
+// Get returns the run of the stack whose id starts with id. The id "latest"
+// refers to the latest run.
+func (s *Store) Get(project, stack, id string) (*Run, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.ids(project, stack)
+	if err != nil {
+		return nil, err
+	}
+	if id == "latest" {
+		if len(ids) == 0 {
+			return nil, ErrNotFound
+		}
+		return s.read(project, stack, ids[0])
+	}
+	found := ""
+	for _, i := range ids {
+		if !strings.HasPrefix(i, id) {
+			continue
+		}
+		if found != "" {
+			return nil, fmt.Errorf("%s: %v", id, ErrAmbiguous)
+		}
+		found = i
+	}
+	if found == "" {
+		return nil, fmt.Errorf("%s: %v", id, ErrNotFound)
+	}
+	return s.read(project, stack, found)
+}
+
+// ids returns the ids of the runs of the stack, newest first
+func (s *Store) ids(project, stack string) ([]string, error) {
+	files, err := ioutil.ReadDir(path.Join(s.root, project, stack))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	ids := make([]string, 0, len(files))
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(f.Name(), ".json"))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	return ids, nil
+}
+
+func (s *Store) read(project, stack, id string) (*Run, error) {
+	b, err := ioutil.ReadFile(path.Join(s.root, project, stack, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	r := Run{}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("run %s: %v", id, err)
+	}
+	return &r, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
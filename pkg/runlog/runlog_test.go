@@ -0,0 +1,85 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package runlog
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder("vcf", "m1", "update")
+	ok := apitype.StepEventMetadata{Op: apitype.OpCreate, URN: "urn:ok", Type: "t"}
+	failed := apitype.StepEventMetadata{Op: apitype.OpUpdate, URN: "urn:failed", Type: "t"}
+	running := apitype.StepEventMetadata{Op: apitype.OpDelete, URN: "urn:running", Type: "t"}
+	for _, e := range []apitype.EngineEvent{
+		{ResourcePreEvent: &apitype.ResourcePreEvent{Metadata: ok}},
+		{ResourcePreEvent: &apitype.ResourcePreEvent{Metadata: failed}},
+		{ResourcePreEvent: &apitype.ResourcePreEvent{Metadata: running}},
+		{ResOutputsEvent: &apitype.ResOutputsEvent{Metadata: ok}},
+		{DiagnosticEvent: &apitype.DiagnosticEvent{URN: "urn:failed", Severity: "error", Message: "<{%fg 1%}>quota exceeded<{%reset%}>\n"}},
+		{ResOpFailedEvent: &apitype.ResOpFailedEvent{Metadata: failed}},
+	} {
+		r.Events() <- events.EngineEvent{EngineEvent: e}
+	}
+	close(r.events)
+
+	run := r.Finish(errors.New("update failed"))
+	if run.Status != StatusFailed || run.Error != "update failed" {
+		t.Errorf("status = %s, error = %q; want failed", run.Status, run.Error)
+	}
+	want := map[string]string{"urn:ok": StatusSucceeded, "urn:failed": StatusFailed, "urn:running": StatusFailed}
+	if len(run.Operations) != len(want) {
+		t.Fatalf("got %d operations; want %d", len(run.Operations), len(want))
+	}
+	for _, o := range run.Operations {
+		if o.Status != want[o.URN] {
+			t.Errorf("%s: status = %s; want %s", o.URN, o.Status, want[o.URN])
+		}
+	}
+	if len(run.Failed) != 2 {
+		t.Errorf("failed = %v; want urn:failed and urn:running", run.Failed)
+	}
+	if d := run.Operations[1].Diagnostics; len(d) != 1 || d[0].Message != "quota exceeded" {
+		t.Errorf("diagnostics = %v; want quota exceeded", d)
+	}
+}
+
+// TestRecorderNotStarted finishes a run whose operation failed before the
+// engine was started, so that the channel is never closed
+func TestRecorderNotStarted(t *testing.T) {
+	r := NewRecorder("vcf", "m1", "refresh")
+	start := time.Now()
+	run := r.Finish(errors.New("language runtime failed"))
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Finish took %s", d)
+	}
+	if run.Status != StatusFailed || len(run.Operations) != 0 {
+		t.Errorf("run = %+v; want failed without operations", run)
+	}
+	select {
+	case <-r.done:
+	default:
+		t.Error("recording not stopped")
+	}
+}
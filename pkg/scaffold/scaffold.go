@@ -0,0 +1,266 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+// Package scaffold renders new stack configs from a few settings, deriving
+// gateways, reserved addresses and node addresses from the network CIDRs.
+package scaffold
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"gopkg.in/yaml.v2"
+)
+
+// Offsets of the derived addresses from the network address of a subnet
+const (
+	offsetGateway     = 1
+	offsetHelperVM    = 10
+	offsetVCenter     = 3
+	offsetSDDCManager = 4
+	offsetNsxt        = 5
+	offsetNsxtManager = 6
+	offsetNode        = 11
+	nsxtManagers      = 3
+)
+
+var stackNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// Options are the settings of a new config
+type Options struct {
+	ProjectType stack.ProjectType
+	StackName   string
+	Region      string
+	Domain      string
+	Tenant      string
+	// vcf
+	ManagementCIDR  string
+	DeploymentCIDR  string
+	DNSZone         string
+	ExternalNetwork string
+	PublicRouter    string
+	EsxiImage       string
+	EsxiFlavor      string
+	HelperImage     string
+	HelperFlavor    string
+	// esxi
+	NodeCIDR    string
+	StorageCIDR string
+	Nodes       int
+}
+
+// DefaultNodes returns the default number of esxi nodes of project type t
+func DefaultNodes(t stack.ProjectType) int {
+	switch t {
+	case stack.ProjectVCFManagement:
+		return 4
+	default:
+		return 3
+	}
+}
+
+type node struct {
+	Name string
+	IP   string
+}
+
+type host struct {
+	Hostname string
+	IP       string
+}
+
+type data struct {
+	Options
+	ManagementGateway string
+	ManagementMask    string
+	DeploymentGateway string
+	HelperIP          string
+	ReverseZone       string
+	SDDCManager       host
+	VCenter           host
+	Nsxt              host
+	NsxtManagers      []host
+	EsxiNodes         []node
+	Management        bool
+}
+
+// Render returns the config of o
+func Render(o Options) ([]byte, error) {
+	if !stackNameRe.MatchString(o.StackName) {
+		return nil, fmt.Errorf("stack name %q: only letters, digits, '.', '_' and '-' allowed", o.StackName)
+	}
+	d := data{Options: o}
+	var tmpl string
+	var err error
+	switch o.ProjectType {
+	case stack.ProjectVCFManagement, stack.ProjectVCFWorkload:
+		tmpl = vcfTemplate
+		err = d.deriveVCF()
+	case stack.ProjectEsxi:
+		tmpl = esxiTemplate
+		err = d.deriveEsxi()
+	default:
+		return nil, fmt.Errorf("project %q: %v", o.ProjectType, stack.ErrNotSupported)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t, err := template.New(string(o.ProjectType)).Funcs(template.FuncMap{"yaml": yamlScalar}).Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.Buffer{}
+	if err := t.Execute(&buf, d); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *data) deriveVCF() error {
+	mgmt, err := parseCIDR("management", d.ManagementCIDR)
+	if err != nil {
+		return err
+	}
+	deploy, err := parseCIDR("deployment", d.DeploymentCIDR)
+	if err != nil {
+		return err
+	}
+	if mgmt.Contains(deploy.IP) || deploy.Contains(mgmt.IP) {
+		return fmt.Errorf("management network %s and deployment network %s overlap", mgmt, deploy)
+	}
+	if d.Nodes < 1 {
+		return fmt.Errorf("node count %d: at least one node required", d.Nodes)
+	}
+	if d.ManagementGateway, err = hostIP(mgmt, offsetGateway); err != nil {
+		return err
+	}
+	d.ManagementMask = net.IP(mgmt.Mask).String()
+	if d.DeploymentGateway, err = hostIP(deploy, offsetGateway); err != nil {
+		return err
+	}
+	if d.HelperIP, err = hostIP(deploy, offsetHelperVM); err != nil {
+		return err
+	}
+	d.ReverseZone = reverseZone(mgmt)
+	d.Management = d.ProjectType == stack.ProjectVCFManagement
+	if d.Management {
+		if d.SDDCManager, err = newHost(mgmt, d.StackName+"-sddc", offsetSDDCManager); err != nil {
+			return err
+		}
+	}
+	if d.VCenter, err = newHost(mgmt, d.StackName+"-vc", offsetVCenter); err != nil {
+		return err
+	}
+	if d.Nsxt, err = newHost(mgmt, d.StackName+"-nsxt", offsetNsxt); err != nil {
+		return err
+	}
+	for i := 0; i < nsxtManagers; i++ {
+		h, err := newHost(mgmt, fmt.Sprintf("%s-nsxt-%02d", d.StackName, i+1), offsetNsxtManager+i)
+		if err != nil {
+			return err
+		}
+		d.NsxtManagers = append(d.NsxtManagers, h)
+	}
+	return d.deriveNodes(mgmt)
+}
+
+func (d *data) deriveEsxi() error {
+	nodes, err := parseCIDR("node", d.NodeCIDR)
+	if err != nil {
+		return err
+	}
+	if _, err := parseCIDR("storage", d.StorageCIDR); err != nil {
+		return err
+	}
+	if d.Nodes < 1 {
+		return fmt.Errorf("node count %d: at least one node required", d.Nodes)
+	}
+	return d.deriveNodes(nodes)
+}
+
+func (d *data) deriveNodes(n *net.IPNet) error {
+	for i := 0; i < d.Nodes; i++ {
+		ip, err := hostIP(n, offsetNode+i)
+		if err != nil {
+			return err
+		}
+		d.EsxiNodes = append(d.EsxiNodes, node{fmt.Sprintf("%s-esxi-%02d", d.StackName, i+1), ip})
+	}
+	return nil
+}
+
+func newHost(n *net.IPNet, hostname string, offset int) (host, error) {
+	ip, err := hostIP(n, offset)
+	return host{hostname, ip}, err
+}
+
+func parseCIDR(name, cidr string) (*net.IPNet, error) {
+	if cidr == "" {
+		return nil, fmt.Errorf("%s network cidr not set", name)
+	}
+	ip, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("%s network: %v", name, err)
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("%s network %s: only ipv4 supported", name, cidr)
+	}
+	return n, nil
+}
+
+// yamlScalar encodes s as yaml scalar, quoting it if necessary
+func yamlScalar(s string) (string, error) {
+	b, err := yaml.Marshal(s)
+	return strings.TrimSuffix(string(b), "\n"), err
+}
+
+// hostIP returns the address at offset from the network address of n. The
+// address must not be the broadcast address.
+func hostIP(n *net.IPNet, offset int) (string, error) {
+	base := binary.BigEndian.Uint32(n.IP.To4())
+	ones, bits := n.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	if uint32(offset) >= size-1 {
+		return "", fmt.Errorf("network %s too small for address offset %d", n, offset)
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, base+uint32(offset))
+	return ip.String(), nil
+}
+
+// reverseZone returns the reverse dns zone of n, rounded to whole octets,
+// e.g. 0.168.192.in-addr.arpa for 192.168.0.0/24
+func reverseZone(n *net.IPNet) string {
+	ones, _ := n.Mask.Size()
+	octets := ones / 8
+	if octets == 0 {
+		octets = 1
+	}
+	ip := n.IP.To4()
+	labels := make([]string, 0, octets+2)
+	for i := octets - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprint(ip[i]))
+	}
+	return strings.Join(append(labels, "in-addr", "arpa"), ".")
+}
@@ -0,0 +1,209 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package scaffold
+
+import (
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	"github.com/sapcc/vcf-automation/pkg/stack/esxi"
+	"github.com/sapcc/vcf-automation/pkg/stack/vcf"
+)
+
+func vcfOptions(t stack.ProjectType) Options {
+	return Options{
+		ProjectType:     t,
+		StackName:       "vcf-01",
+		Region:          "qa-de-1",
+		Domain:          "monsoon3",
+		Tenant:          "vcf",
+		ManagementCIDR:  "10.180.0.0/24",
+		DeploymentCIDR:  "10.180.1.0/24",
+		DNSZone:         "vcf-01.example.com",
+		ExternalNetwork: "FloatingIP-external",
+		PublicRouter:    "router",
+		EsxiImage:       "esxi-7",
+		EsxiFlavor:      "esxi.large",
+		HelperImage:     "ubuntu",
+		HelperFlavor:    "m1.small",
+		Nodes:           DefaultNodes(t),
+	}
+}
+
+// readRendered renders o and reads and validates the config like a config
+// file
+func readRendered(t *testing.T, o Options) *stack.Config {
+	t.Helper()
+	b, err := Render(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := path.Join(t.TempDir(), o.StackName+".yaml")
+	if err := ioutil.WriteFile(f, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := stack.ReadConfig(f)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, b)
+	}
+	if err := stack.ValidateConfig(cfg); err != nil {
+		t.Fatalf("%v\n%s", err, b)
+	}
+	return cfg
+}
+
+func TestRenderVCF(t *testing.T) {
+	cfg := readRendered(t, vcfOptions(stack.ProjectVCFManagement))
+	p := vcf.StackProps{}
+	if err := stack.UnmarshalStackProps(cfg.Props.StackProps, &p); err != nil {
+		t.Fatal(err)
+	}
+	for field, got := range map[string]string{
+		"10.180.0.1":               p.ManagementNetwork.SubnetGateway,
+		"255.255.255.0":            p.ManagementNetwork.SubnetMask,
+		"10.180.1.1":               p.DeploymentNetwork.Gateway,
+		"10.180.1.10":              p.HelperVM.IP,
+		"0.180.10.in-addr.arpa":    p.ReverseDNSZoneName,
+		"10.180.0.3":               p.VCenter.IP,
+		"10.180.0.4":               p.SDDCManager.IP,
+		"vcf-01-sddc":              p.SDDCManager.Hostname,
+		"10.180.0.5":               p.Nsxt.IP,
+		"10.180.0.8":               p.NsxtManagers[2].IP,
+		"vcf-01-esxi-04":           p.EsxiNodes[3].Name,
+		"10.180.0.14":              p.EsxiNodes[3].IP,
+		"FloatingIP-external":      p.ExternalNetwork.Name,
+		"vcf-01-management-subnet": p.ManagementNetwork.SubnetName,
+	} {
+		if got != field {
+			t.Errorf("got %q; want %q", got, field)
+		}
+	}
+	if len(p.EsxiNodes) != 4 || len(p.NsxtManagers) != nsxtManagers {
+		t.Errorf("%d nodes and %d nsx-t managers; want 4 and %d", len(p.EsxiNodes), len(p.NsxtManagers), nsxtManagers)
+	}
+}
+
+func TestRenderVCFWorkload(t *testing.T) {
+	cfg := readRendered(t, vcfOptions(stack.ProjectVCFWorkload))
+	p := vcf.StackProps{}
+	if err := stack.UnmarshalStackProps(cfg.Props.StackProps, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.SDDCManager != (vcf.SDDCManager{}) {
+		t.Errorf("sddc manager %+v; want none for workload domains", p.SDDCManager)
+	}
+	if len(p.EsxiNodes) != 3 {
+		t.Errorf("%d nodes; want 3", len(p.EsxiNodes))
+	}
+}
+
+func TestRenderEsxi(t *testing.T) {
+	o := Options{
+		ProjectType: stack.ProjectEsxi,
+		StackName:   "esxi-01",
+		Region:      "qa-de-1",
+		Domain:      "monsoon3",
+		Tenant:      "esxi",
+		NodeCIDR:    "10.0.0.0/28",
+		StorageCIDR: "10.0.1.0/24",
+		EsxiImage:   "esxi 7.0",
+		EsxiFlavor:  "bm.large",
+		Nodes:       2,
+	}
+	cfg := readRendered(t, o)
+	p := esxi.StackProps{}
+	if err := stack.UnmarshalStackProps(cfg.Props.StackProps, &p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Nodes) != 2 || p.Nodes[1].Name != "esxi-01-esxi-02" || p.Nodes[1].IP != "10.0.0.12" || p.Nodes[1].Image != "esxi 7.0" {
+		t.Errorf("nodes = %+v", p.Nodes)
+	}
+	if p.Prefix != "esxi-01" {
+		t.Errorf("prefix = %q; want esxi-01", p.Prefix)
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(o *Options)
+		err    string
+	}{
+		{"stack name", func(o *Options) { o.StackName = "vcf 01" }, "only letters, digits"},
+		{"project type", func(o *Options) { o.ProjectType = stack.ProjectExample }, "not supported"},
+		{"no management cidr", func(o *Options) { o.ManagementCIDR = "" }, "management network cidr not set"},
+		{"invalid cidr", func(o *Options) { o.DeploymentCIDR = "10.180.1.0" }, "deployment network"},
+		{"ipv6", func(o *Options) { o.ManagementCIDR = "fd00::/64" }, "only ipv4 supported"},
+		{"overlap", func(o *Options) { o.DeploymentCIDR = "10.180.0.128/25" }, "overlap"},
+		{"no nodes", func(o *Options) { o.Nodes = 0 }, "at least one node"},
+		{"too small", func(o *Options) { o.ManagementCIDR = "10.180.0.0/29" }, "too small"},
+		{"too many nodes", func(o *Options) { o.ManagementCIDR, o.Nodes = "10.180.0.0/28", 5 }, "too small"},
+	}
+	for _, tt := range tests {
+		o := vcfOptions(stack.ProjectVCFManagement)
+		tt.modify(&o)
+		_, err := Render(o)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v; want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestHostIP(t *testing.T) {
+	_, n, _ := net.ParseCIDR("192.168.0.0/30")
+	if ip, err := hostIP(n, 2); err != nil || ip != "192.168.0.2" {
+		t.Errorf("offset 2 = %s, %v; want 192.168.0.2", ip, err)
+	}
+	// the broadcast address is not a host address
+	if ip, err := hostIP(n, 3); err == nil {
+		t.Errorf("offset 3 = %s; want error", ip)
+	}
+}
+
+func TestReverseZone(t *testing.T) {
+	for cidr, want := range map[string]string{
+		"192.168.0.0/24": "0.168.192.in-addr.arpa",
+		"10.180.0.0/22":  "180.10.in-addr.arpa",
+		"10.0.0.0/8":     "10.in-addr.arpa",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		if got := reverseZone(n); got != want {
+			t.Errorf("%s: %s; want %s", cidr, got, want)
+		}
+	}
+}
+
+func TestYAMLScalar(t *testing.T) {
+	for s, want := range map[string]string{
+		"plain":    "plain",
+		"esxi 7.0": "esxi 7.0",
+		"yes":      `"yes"`,
+		"1.0":      `"1.0"`,
+		"a: b":     `'a: b'`,
+		"":         `""`,
+	} {
+		if got, err := yamlScalar(s); err != nil || got != want {
+			t.Errorf("%q: %s, %v; want %s", s, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package scaffold
+
+const vcfTemplate = `# {{.ProjectType}} stack {{.StackName}}, generated by automation init.
+# Addresses were derived from the management network {{.ManagementCIDR}} and
+# the deployment network {{.DeploymentCIDR}}; review them before deploying.
+projectType: {{.ProjectType}}
+stack: {{.StackName}}
+props:
+  openstack:
+    region: {{.Region | yaml}}
+    domain: {{.Domain | yaml}}
+    tenant: {{.Tenant | yaml}}
+  stack:
+    # network with floating ips of the public router
+    externalNetwork:
+      name: {{.ExternalNetwork | yaml}}
+    publicRouter: {{.PublicRouter | yaml}}
+    # esxi management network; the gateway is the first address
+    managementNetwork:
+      networkName: {{.StackName}}-management
+      subnetName: {{.StackName}}-management-subnet
+      subnetCidr: {{.ManagementCIDR}}
+      subnetGateway: {{.ManagementGateway}}
+      subnetMask: {{.ManagementMask}}
+    # network of the helper vm, which runs the cloud builder
+    deploymentNetwork:
+      networkName: {{.StackName}}-deployment
+      subnetName: {{.StackName}}-deployment-subnet
+      cidr: {{.DeploymentCIDR}}
+      gatewayIP: {{.DeploymentGateway}}
+    helperVM:
+      imageName: {{.HelperImage | yaml}}
+      flavorName: {{.HelperFlavor | yaml}}
+      ip: {{.HelperIP}}
+    dnsZoneName: {{.DNSZone | yaml}}
+    reverseDnsZoneName: {{.ReverseZone}}
+{{- if .Management}}
+    # sddc manager, vcenter and nsx-t addresses are added to the reserved ips
+    sddcManager:
+      hostname: {{.SDDCManager.Hostname}}
+      ip: {{.SDDCManager.IP}}
+      domain: {{.DNSZone | yaml}}
+{{- else}}
+    # vcenter and nsx-t addresses are added to the reserved ips
+{{- end}}
+    vcenter:
+      hostname: {{.VCenter.Hostname}}
+      ip: {{.VCenter.IP}}
+    nsxt:
+      hostname: {{.Nsxt.Hostname}}
+      ip: {{.Nsxt.IP}}
+    nsxtManagers:
+{{- range .NsxtManagers}}
+      - hostname: {{.Hostname}}
+        ip: {{.IP}}
+{{- end}}
+    # further addresses to keep free in the management network
+    reservedIPs: []
+    esxiServerImage: {{.EsxiImage | yaml}}
+    esxiServerFlavor: {{.EsxiFlavor | yaml}}
+    esxiNodes:
+{{- range .EsxiNodes}}
+      - name: {{.Name}}
+        ip: {{.IP}}
+{{- end}}
+`
+
+const esxiTemplate = `# esxi stack {{.StackName}}, generated by automation init.
+# Node addresses were derived from the node network {{.NodeCIDR}}; review them
+# before deploying.
+projectType: esxi
+stack: {{.StackName}}
+props:
+  openstack:
+    region: {{.Region | yaml}}
+    domain: {{.Domain | yaml}}
+    tenant: {{.Tenant | yaml}}
+  stack:
+    # prefix of the names of all openstack resources
+    resourcePrefix: {{.StackName}}
+    nodeSubnet: {{.NodeCIDR}}
+    storageSubnet: {{.StorageCIDR}}
+    # ironic nodes; set uuid to pin a node to a baremetal server
+    nodes:
+{{- range .EsxiNodes}}
+      - name: {{.Name}}
+        ip: {{.IP}}
+        image: {{$.EsxiImage | yaml}}
+        flavor: {{$.EsxiFlavor | yaml}}
+{{- end}}
+    # nfs shares, e.g. {name: datastore01, size: 1024}
+    shares: []
+`
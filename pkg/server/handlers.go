@@ -19,18 +19,38 @@
 package server
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/sapcc/vcf-automation/pkg/doctor"
+	"github.com/sapcc/vcf-automation/pkg/revision"
+	"github.com/sapcc/vcf-automation/pkg/runlog"
+	"github.com/sapcc/vcf-automation/pkg/snapshot"
+	"github.com/sapcc/vcf-automation/pkg/stack"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
+// ChecksumHeader carries the sha256 checksum of an exported or imported state
+const ChecksumHeader = "X-Checksum-Sha256"
+
+// CallerHeader identifies the user calling the API, recorded in the provenance
+// of the stack operations the call triggers
+const CallerHeader = "X-Automation-Caller"
+
 type reloadResponse struct {
 	Message string          `json:"message,omitempty"`
 	Err     string          `json:"err,omitempty"`
@@ -46,12 +66,20 @@ type ConfigMessage struct {
 }
 
 type StackSummary struct {
-	Name       string            `json:"name,omitempty"`
-	ConfigFile string            `json:"config_file,omitempty"`
-	Status     string            `json:"status,omitempty"`
-	HasError   bool              `json:"has_error,omitempty"`
-	Outputs    map[string]string `json:"outputs,omitempty"`
-	Links      []Link            `json:"links,omitempty"`
+	Name       string               `json:"name,omitempty"`
+	Project    string               `json:"project,omitempty"`
+	Stack      string               `json:"stack,omitempty"`
+	ConfigFile string               `json:"config_file,omitempty"`
+	Revision   string               `json:"revision,omitempty"`
+	Commit     string               `json:"commit,omitempty"`
+	Status     string               `json:"status,omitempty"`
+	State      string               `json:"state,omitempty"`
+	StateSince time.Time            `json:"state_since,omitempty"`
+	HasError   bool                 `json:"has_error,omitempty"`
+	Lock       *stack.LockError     `json:"lock,omitempty"`
+	Outputs    map[string]string    `json:"outputs,omitempty"`
+	Plugins    []stack.PluginStatus `json:"plugins,omitempty"`
+	Links      []Link               `json:"links,omitempty"`
 }
 
 type Link struct {
@@ -61,20 +89,66 @@ type Link struct {
 }
 
 func reload(w http.ResponseWriter, r *http.Request) {
-	messages := manager.ReloadConfigs()
-	err := writeJson(w, messages)
+	messages, err := manager.SyncConfigs(true, requestTrigger(r, stack.TriggerReload))
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = writeJson(w, messages)
 	if err != nil {
 		handleError(w, http.StatusInternalServerError, err)
 		return
 	}
 }
 
+// gitWebhook handles push events of the config repository. If a webhook
+// secret is configured, the request must be signed with it (GitHub) or carry
+// it as token (GitLab).
+func gitWebhook(w http.ResponseWriter, r *http.Request) {
+	if manager.git == nil {
+		handleError(w, http.StatusNotFound, fmt.Errorf("configs are not read from git"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleError(w, http.StatusBadRequest, err)
+		return
+	}
+	if secret := opts.ConfigGitWebhookSecret; secret != "" {
+		if !verifyWebhook(r, body, secret) {
+			handleError(w, http.StatusUnauthorized, fmt.Errorf("invalid webhook signature"))
+			return
+		}
+	}
+	messages, err := manager.SyncConfigs(false, requestTrigger(r, stack.TriggerGit))
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = writeJson(w, messages)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+func verifyWebhook(r *http.Request, body []byte, secret string) bool {
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return hmac.Equal([]byte(token), []byte(secret))
+	}
+	sig := strings.TrimPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(sig), []byte(expected))
+}
+
 func startStack(w http.ResponseWriter, r *http.Request) {
 	c, err := getControllerByHttpRequest(r)
 	if err != nil {
 		handleError(w, http.StatusInternalServerError, err)
 	} else {
-		c.start()
+		c.start(requestTrigger(r, stack.TriggerStart))
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(fmt.Sprintf("stack %s-%s started\n", c.ProjectType, c.StackName)))
 	}
@@ -94,17 +168,95 @@ func stopStack(w http.ResponseWriter, r *http.Request) {
 func reloadStack(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	project := vars["project"]
-	stack := vars["stack"]
-	nc, err := manager.Update(project, stack)
+	stackName := vars["stack"]
+	nc, err := manager.Update(project, stackName)
 	if err != nil {
 		handleError(w, http.StatusInternalServerError, err)
 		return
 	}
-	nc.triggerUpdateStack()
+	nc.triggerUpdateStack(requestTrigger(r, stack.TriggerReload))
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("stack %s-%s reloaded\n", project, stack)))
+	w.Write([]byte(fmt.Sprintf("stack %s-%s reloaded\n", project, stackName)))
+}
+
+// selectResources returns the handler running operation on the resources of
+// the stack selected by the query parameters target, replace and exclude,
+// which may be repeated, and target-dependents. The operation is run by the
+// controller loop, so the stack must be running. The resolved urns are
+// returned.
+func selectResources(operation string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := getControllerByHttpRequest(r)
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !c.running {
+			handleError(w, http.StatusConflict, fmt.Errorf("stack %s is not running, start the controller first", c.cfgName()))
+			return
+		}
+		q := r.URL.Query()
+		sel := &stack.Selection{
+			Operation:        operation,
+			Targets:          q["target"],
+			Replace:          q["replace"],
+			Exclude:          q["exclude"],
+			TargetDependents: q.Get("target-dependents") == "true",
+		}
+		if err := sel.Validate(); err != nil {
+			handleError(w, http.StatusBadRequest, err)
+			return
+		}
+		res, err := c.ResolveSelection(r.Context(), sel)
+		if err != nil {
+			handleError(w, http.StatusBadRequest, err)
+			return
+		}
+		t := requestTrigger(r, stack.TriggerSelect)
+		t.Selection = sel
+		c.triggerUpdateStack(t)
+		if err := writeJson(w, res); err != nil {
+			handleError(w, http.StatusInternalServerError, err)
+		}
+	}
+}
+
+// unlockStack cancels the operation holding the stale lock of the stack. The
+// query parameter refresh=true refreshes the stack afterwards, force=true
+// skips the checks that the lock is stale.
+func unlockStack(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	q := r.URL.Query()
+	res, err := c.Unlock(r.Context(), stack.UnlockOptions{
+		Refresh: q.Get("refresh") == "true",
+		Force:   q.Get("force") == "true",
+		Trigger: requestTrigger(r, stack.TriggerUnlock),
+	})
+	switch {
+	case errors.Is(err, stack.ErrLockInUse), errors.Is(err, stack.ErrNotLocked):
+		handleError(w, http.StatusConflict, err)
+		return
+	case err != nil && res == nil:
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	case err != nil:
+		// unlocked, but the refresh failed
+		logger.WithError(err).Errorf("stack %s unlocked", c.cfgName())
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logger.Infof("stack %s unlocked by %s", c.cfgName(), requestTrigger(r, stack.TriggerUnlock).Caller)
+	if err := writeJson(w, res); err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+	}
 }
 
+// jsonFileHandler returns the value of the output key as json. Secret
+// outputs are masked like in getStackOutputs.
 func jsonFileHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	c, err := getControllerByHttpRequest(r)
@@ -112,50 +264,52 @@ func jsonFileHandler(w http.ResponseWriter, r *http.Request) {
 		handleError(w, http.StatusInternalServerError, err)
 		return
 	}
-	s, err := c.Controller.GetOutput(vars["key"])
+	reveal, ok := revealRequested(w, r)
+	if !ok {
+		return
+	}
+	o, err := c.GetOutputs()
 	if err != nil {
 		handleError(w, http.StatusInternalServerError, err)
 		return
 	}
-	err = writeJson(w, s)
+	if !reveal {
+		o = o.Masked()
+	}
+	v, ok := o[vars["key"]]
+	if !ok {
+		handleError(w, http.StatusNotFound, fmt.Errorf("output %q not found", vars["key"]))
+		return
+	}
+	b, err := outputJSON(v.Value)
 	if err != nil {
 		handleError(w, http.StatusInternalServerError, err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// outputJSON encodes the value of an output as json. Strings holding a json
+// object, like the payloads exported by the python programs, are returned
+// as the object; other values, e.g. a masked secret, as they are.
+func outputJSON(v interface{}) ([]byte, error) {
+	if s, ok := v.(string); ok {
+		var obj map[string]*json.RawMessage
+		if err := json.Unmarshal([]byte(s), &obj); err == nil && obj != nil {
+			return json.Marshal(obj)
+		}
+	}
+	return json.Marshal(v)
 }
 
 // TODO: show stck summary only for the project
 func stackSummaries(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
 	ss := make([]StackSummary, 0)
-	for k, c := range manager.controllers {
-		project, stack := c.GetProjectStackName()
-		httpBase := "http://localhost:8080"
-		uriBase := httpBase + fmt.Sprintf("/%s/%s", project, stack)
-		status := "stopped"
-		if c.running {
-			status = "running"
-		}
-		hasError := false
-		if c.GetError() != nil {
-			hasError = true
-		}
-		links := make([]Link, 0)
-		links = append(links, Link{"cloud-builder", uriBase + "/cloud-builder.json", "payload for cloud builder"})
-		links = append(links, Link{"state", uriBase + "/state", "resources deployed by automation"})
-		links = append(links, Link{"error", uriBase + "/error", ""})
-		links = append(links, Link{"start", uriBase + "/start", "restart automation controller loop"})
-		links = append(links, Link{"stop", uriBase + "/stop", "pause automation controller"})
-		links = append(links, Link{"reload", uriBase + "/reload", "force controller to reload configuration"})
-		s := StackSummary{
-			Name:       k,
-			ConfigFile: c.ConfigPath,
-			Status:     status,
-			HasError:   hasError,
-			Links:      links,
-		}
-		ss = append(ss, s)
+	for k, c := range manager.snapshot() {
+		ss = append(ss, newStackSummary(r, k, c))
 	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].Name < ss[j].Name })
 	err := writeJson(w, ss)
 	if err != nil {
 		handleError(w, http.StatusInternalServerError, err)
@@ -163,6 +317,61 @@ func stackSummaries(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func stackStatus(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = writeJson(w, newStackSummary(r, c.cfgName(), c))
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+func newStackSummary(r *http.Request, name string, c *StackController) StackSummary {
+	project, stackName := c.GetProjectStackName()
+	httpBase := "http://" + r.Host
+	uriBase := httpBase + fmt.Sprintf("/%s/%s", project, stackName)
+	status := "stopped"
+	if c.running {
+		status = "running"
+	}
+	hasError := false
+	var lock *stack.LockError
+	if err := c.GetError(); err != nil {
+		hasError = true
+		errors.As(err, &lock)
+	}
+	state, since := c.State()
+	links := make([]Link, 0)
+	links = append(links, Link{"cloud-builder", uriBase + "/cloud-builder.json", "payload for cloud builder"})
+	links = append(links, Link{"state", uriBase + "/state", "resources deployed by automation"})
+	links = append(links, Link{"status", uriBase + "/status", "status of the automation controller"})
+	links = append(links, Link{"error", uriBase + "/error", ""})
+	links = append(links, Link{"effective-config", uriBase + "/effective-config", "merged configuration and the source of each value"})
+	links = append(links, Link{"revisions", uriBase + "/revisions", "configurations applied to the stack"})
+	links = append(links, Link{"start", uriBase + "/start", "restart automation controller loop"})
+	links = append(links, Link{"stop", uriBase + "/stop", "pause automation controller"})
+	links = append(links, Link{"reload", uriBase + "/reload", "force controller to reload configuration"})
+	return StackSummary{
+		Name:       name,
+		Project:    project,
+		Stack:      stackName,
+		ConfigFile: c.ConfigPath,
+		Revision:   c.Revision,
+		Commit:     c.Commit,
+		Status:     status,
+		State:      state,
+		StateSince: since,
+		HasError:   hasError,
+		Lock:       lock,
+		Plugins:    c.Plugins(),
+		Links:      links,
+	}
+}
+
 func getStackError(w http.ResponseWriter, r *http.Request) {
 	c, err := getControllerByHttpRequest(r)
 	if err != nil {
@@ -178,22 +387,474 @@ func getStackError(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// revealRequested reports whether the request asks to reveal secret outputs
+// with reveal=true. Revealing requires the server to require an api token;
+// otherwise the request is refused and ok is false.
+func revealRequested(w http.ResponseWriter, r *http.Request) (reveal, ok bool) {
+	reveal = r.URL.Query().Get("reveal") == "true"
+	if reveal && opts.APIToken == "" {
+		handleError(w, http.StatusForbidden, fmt.Errorf("revealing secrets requires an api token"))
+		return false, false
+	}
+	return reveal, true
+}
+
+// getStackOutputs returns the outputs in the format given by the query
+// parameter format (json, yaml, dotenv or flat). Secret values are masked,
+// unless reveal=true is given and the server requires an api token.
 func getStackOutputs(w http.ResponseWriter, r *http.Request) {
 	c, err := getControllerByHttpRequest(r)
 	if err != nil {
 		handleError(w, http.StatusInternalServerError, err)
 		return
 	}
+	reveal, ok := revealRequested(w, r)
+	if !ok {
+		return
+	}
 	o, err := c.GetOutputs()
 	if err != nil {
 		handleError(w, http.StatusInternalServerError, err)
 		return
 	}
-	err = writeJson(w, o)
+	if !reveal {
+		o = o.Masked()
+	}
+	format := r.URL.Query().Get("format")
+	b, err := stack.FormatOutputs(o, format)
+	if err != nil {
+		handleError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch format {
+	case stack.OutputsJSON, "":
+		w.Header().Set("Content-Type", "application/json")
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// resourceFilter reads the resource filter from the query parameters type,
+// name, urn and q
+func resourceFilter(r *http.Request) stack.ResourceFilter {
+	q := r.URL.Query()
+	return stack.ResourceFilter{
+		Type:  q.Get("type"),
+		Name:  q.Get("name"),
+		URN:   q.Get("urn"),
+		Query: q.Get("q"),
+	}
+}
+
+// getStackResources returns the resource tree of the stack, filtered by the
+// query parameters. format=table returns an indented table instead of json.
+func getStackResources(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res, err := c.Resources(r.Context())
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res = stack.FilterResources(res, resourceFilter(r))
+	switch format := r.URL.Query().Get("format"); format {
+	case "table":
+		w.Header().Set("Content-Type", "text/plain")
+		stack.WriteResourceTable(w, res)
+	case "json", "":
+		if err := writeJson(w, res); err != nil {
+			handleError(w, http.StatusInternalServerError, err)
+		}
+	default:
+		handleError(w, http.StatusBadRequest, fmt.Errorf("format %q not supported", format))
+	}
+}
+
+// searchResources returns the filtered resources of all stacks, e.g. to find
+// the stack owning an ip address. Stacks without match are left out.
+func searchResources(w http.ResponseWriter, r *http.Request) {
+	f := resourceFilter(r)
+	l := make([]stack.StackResources, 0)
+	for _, c := range manager.snapshot() {
+		project, stackName := c.GetProjectStackName()
+		sr := stack.StackResources{Project: project, Stack: stackName, ConfigFile: c.ConfigPath}
+		res, err := c.Resources(r.Context())
+		if err != nil {
+			sr.Error = err.Error()
+			l = append(l, sr)
+			continue
+		}
+		if sr.Resources = stack.FilterResources(res, f); len(sr.Resources) > 0 {
+			l = append(l, sr)
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].ConfigFile < l[j].ConfigFile })
+	if err := writeJson(w, l); err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// runDoctor runs the prerequisite checks for the configs of the server. The
+// status is 503 if a check failed.
+func runDoctor(w http.ResponseWriter, r *http.Request) {
+	files, err := manager.ListConfigFiles()
+	if err != nil {
+		logger.WithError(err).Error("list config files failed")
+	}
+	rep := doctor.Run(r.Context(), doctor.Options{
+		ProjectRoot:    manager.ProjectRoot,
+		ConfigDir:      manager.ConfigRoot,
+		ConfigFiles:    files,
+		PluginCacheDir: opts.PluginCacheDir,
+	})
+	b, err := json.Marshal(rep)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if rep.OK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+}
+
+// projectRoute handles the route of a project type. Stacks of project types
+// without the route return 404.
+func projectRoute(route stack.Route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := getControllerByHttpRequest(r)
+		if err != nil {
+			handleError(w, http.StatusInternalServerError, err)
+			return
+		}
+		handler, ok := c.Route(route.Method, route.Path)
+		if !ok {
+			handleError(w, http.StatusNotFound, fmt.Errorf("%s of project %s: %v", route.Path, c.ProjectType, stack.ErrNotSupported))
+			return
+		}
+		b, status, err := handler(r, c.Controller, opts.APIToken != "")
+		if err != nil {
+			handleError(w, status, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+// exportState returns the deployment of the stack; its sha256 checksum is
+// sent in the header X-Checksum-Sha256
+func exportState(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
 	if err != nil {
 		handleError(w, http.StatusInternalServerError, err)
 		return
 	}
+	b, err := c.ExportState(r.Context())
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(ChecksumHeader, stack.StateChecksum(b))
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// importState replaces the deployment of a stopped stack with the request
+// body, which must match the checksum in the header X-Checksum-Sha256
+func importState(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleError(w, http.StatusBadRequest, err)
+		return
+	}
+	checksum := r.Header.Get(ChecksumHeader)
+	if checksum == "" {
+		handleError(w, http.StatusBadRequest, fmt.Errorf("header %s not set", ChecksumHeader))
+		return
+	}
+	if err := stack.VerifyStateChecksum(b, checksum); err != nil {
+		handleError(w, http.StatusBadRequest, err)
+		return
+	}
+	backup, err := c.ImportState(r.Context(), b, manager.BackupRoot)
+	if errors.Is(err, stack.ErrStackNotStopped) {
+		handleError(w, http.StatusConflict, fmt.Errorf("%v, stop the controller first", err))
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logger.Infof("state of stack %s imported, backup written to %s", c.cfgName(), backup)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("state of stack %s imported, backup written to %s\n", c.cfgName(), backup)))
+}
+
+// SnapshotRestore is the result of restoring a snapshot
+type SnapshotRestore struct {
+	Snapshot *snapshot.Snapshot     `json:"snapshot"`
+	Backup   string                 `json:"backup"`
+	Changes  []stack.ResourceChange `json:"changes"`
+}
+
+func listSnapshots(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	l, err := c.Snapshots(r.Context())
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := writeJson(w, l); err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// diffSnapshot returns the resource changes restoring the snapshot would make
+func diffSnapshot(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	_, changes, err := c.DiffSnapshot(r.Context(), mux.Vars(r)["snapshot"])
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := writeJson(w, changes); err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// restoreSnapshot imports the snapshot into the stack, which must be
+// stopped, and returns the resource changes made to the state
+func restoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	snap, changes, err := c.DiffSnapshot(r.Context(), mux.Vars(r)["snapshot"])
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	_, backup, err := c.RestoreSnapshot(r.Context(), snap.ID, manager.BackupRoot)
+	if errors.Is(err, stack.ErrStackNotStopped) {
+		handleError(w, http.StatusConflict, fmt.Errorf("%v, stop the controller first", err))
+		return
+	}
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logger.Infof("snapshot %s restored into stack %s, backup written to %s", snap.ID, c.cfgName(), backup)
+	if err := writeJson(w, SnapshotRestore{Snapshot: snap, Backup: backup, Changes: changes}); err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func listRuns(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	l, err := c.Runs()
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := writeJson(w, l); err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// getRun returns the record of a run with the operations matching the query
+// parameters status, op, urn and type
+func getRun(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	q := r.URL.Query()
+	f := runlog.Filter{Status: q.Get("status"), Op: q.Get("op"), URN: q.Get("urn"), Type: q.Get("type")}
+	run, err := c.GetRun(mux.Vars(r)["run"], f)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := writeJson(w, run); err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// getHistory returns the Pulumi update history of the stack with the
+// provenance of the updates started by the controller. The query parameters
+// page-size and page select a page, the complete history by default.
+func getHistory(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	pageSize, page := 0, 0
+	q := r.URL.Query()
+	for k, v := range map[string]*int{"page-size": &pageSize, "page": &page} {
+		if q.Get(k) == "" {
+			continue
+		}
+		if *v, err = strconv.Atoi(q.Get(k)); err != nil || *v < 0 {
+			handleError(w, http.StatusBadRequest, fmt.Errorf("invalid %s: %s", k, q.Get(k)))
+			return
+		}
+	}
+	h, err := c.History(r.Context(), pageSize, page)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := writeJson(w, h); err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func getEffectiveConfig(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = writeJson(w, c.Effective())
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+func listRevisions(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	revs, err := manager.revisions.List(c.cfgName())
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = writeJson(w, revs)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+func getRevision(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	rev, err := manager.revisions.Get(c.cfgName(), mux.Vars(r)["revision"])
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = writeJson(w, rev)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+// diffRevisions compares the revisions given by the query parameters from and
+// to. The parameter to defaults to the latest revision.
+func diffRevisions(w http.ResponseWriter, r *http.Request) {
+	c, err := getControllerByHttpRequest(r)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("from") == "" {
+		handleError(w, http.StatusBadRequest, fmt.Errorf("query parameter from not set"))
+		return
+	}
+	to := q.Get("to")
+	if to == "" {
+		to = "latest"
+	}
+	oldRev, err := manager.revisions.Get(c.cfgName(), q.Get("from"))
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	newRev, err := manager.revisions.Get(c.cfgName(), to)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	d := revision.Diff{
+		From:    oldRev.ID,
+		To:      newRev.ID,
+		Changes: stack.DiffConfig(oldRev.Config.Config, newRev.Config.Config),
+	}
+	err = writeJson(w, d)
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+}
+
+func rollbackRevision(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	rev, err := manager.Rollback(vars["project"], vars["stack"], vars["revision"], requestTrigger(r, stack.TriggerRollback))
+	if err != nil {
+		handleError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("stack %s-%s rolled back to revision %s\n", vars["project"], vars["stack"], rev.ID)))
+}
+
+// authMiddleware requires the bearer token configured as api_token, if any.
+// The git webhook is authenticated by its own secret.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := opts.APIToken
+		if token == "" || r.URL.Path == "/webhook/git" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !hmac.Equal([]byte(got), []byte(token)) {
+			handleError(w, http.StatusUnauthorized, fmt.Errorf("invalid or missing token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
@@ -248,6 +909,19 @@ func handleErrors(w http.ResponseWriter, statusCode int, errs []error) {
 	handleError(w, http.StatusInternalServerError, err)
 }
 
+// requestTrigger returns the trigger name for the request. The caller is the
+// remote address, prefixed with the user from the CallerHeader if sent.
+func requestTrigger(r *http.Request, name string) stack.Trigger {
+	caller := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		caller = host
+	}
+	if u := r.Header.Get(CallerHeader); u != "" {
+		caller = fmt.Sprintf("%s (%s)", u, caller)
+	}
+	return stack.Trigger{Name: name, Caller: caller}
+}
+
 func getControllerByHttpRequest(r *http.Request) (*StackController, error) {
 	vars := mux.Vars(r)
 	project := vars["project"]
@@ -261,7 +935,7 @@ func getControllerByHttpRequest(r *http.Request) (*StackController, error) {
 }
 
 func serveTemplate(w http.ResponseWriter, r *http.Request) {
-	td := viper.GetString("templates_dir")
+	td := opts.TemplatePath
 	// lp := filepath.Join(td, "layout.html")
 	fp := filepath.Join(td, filepath.Clean(r.URL.Path))
 
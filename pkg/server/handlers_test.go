@@ -0,0 +1,52 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package server
+
+import (
+	"testing"
+
+	"github.com/sapcc/vcf-automation/pkg/stack"
+)
+
+func TestOutputJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"json object string", `{"b": 1, "a": "x"}`, `{"a":"x","b":1}`},
+		{"masked secret", stack.SecretMask, `"[secret]"`},
+		{"plain string", "10.0.0.1", `"10.0.0.1"`},
+		{"json list string", `[1, 2]`, `"[1, 2]"`},
+		{"null string", "null", `"null"`},
+		{"list", []interface{}{"a", 1}, `["a",1]`},
+		{"map", map[string]interface{}{"k": true}, `{"k":true}`},
+		{"number", 3.5, `3.5`},
+	}
+	for _, tt := range tests {
+		b, err := outputJSON(tt.value)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(b) != tt.want {
+			t.Errorf("%s: outputJSON = %s; want %s", tt.name, b, tt.want)
+		}
+	}
+}
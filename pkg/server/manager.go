@@ -20,45 +20,101 @@ package server
 
 import (
 	"fmt"
-	"io/ioutil"
-	"path"
 	"sync"
+	"time"
 
+	"github.com/sapcc/vcf-automation/pkg/gitsource"
+	"github.com/sapcc/vcf-automation/pkg/revision"
 	"github.com/sapcc/vcf-automation/pkg/stack"
-	"github.com/spf13/viper"
 )
 
 type Manager struct {
 	controllers map[string]*StackController
+	revisions   *revision.Store
+	git         *gitsource.Source
+	syncMu      sync.Mutex
 	ProjectRoot string
 	ConfigRoot  string
+	// BackupRoot holds the state backups written before a state import
+	BackupRoot string
 	sync.Mutex
 }
 
 type StackController struct {
 	*stack.Controller
 	ConfigPath string
-	running    bool
-	updCh      chan bool
-	canCh      chan bool
+	// Revision and Commit are the last config revision applied successfully
+	Revision string
+	Commit   string
+	// pending is the revision of the config the controller applies next,
+	// with the hash of the config as id; guarded by the manager lock
+	pending *revision.Revision
+	running bool
+	updCh   chan stack.Trigger
+	canCh   chan bool
 }
 
 func NewManager() *Manager {
-	workdir := viper.GetString("work_dir")
-	projectdir := viper.GetString("project_root")
-	configdir := viper.GetString("config_dir")
-	if projectdir == "" {
-		projectdir = path.Join(workdir, "projects")
-	}
-	if configdir == "" {
-		configdir = path.Join(workdir, "etc")
-	}
-	logger.Debugf("config directory: %s", configdir)
-	logger.Debugf("project directory: %s", projectdir)
-	return &Manager{
+	projectdir := opts.ProjectRoot
+	configdir := opts.ConfigDir
+	revisiondir := opts.RevisionDir
+	backupdir := opts.StateBackupDir
+	m := &Manager{
 		ProjectRoot: projectdir,
 		ConfigRoot:  configdir,
+		BackupRoot:  backupdir,
 		controllers: make(map[string]*StackController),
+		revisions:   revision.NewStore(revisiondir),
+	}
+	// configs are read from a checkout of the git repository instead of the
+	// config directory
+	if gitURL := opts.ConfigGitURL; gitURL != "" {
+		m.git = gitsource.New(
+			gitURL,
+			opts.ConfigGitBranch,
+			opts.ConfigGitSubdir,
+			opts.ConfigGitCheckout,
+		).WithBasicAuth(opts.ConfigGitUsername, opts.ConfigGitPassword)
+		m.ConfigRoot = m.git.ConfigDir()
+		logger.Debugf("config repository: %s (branch %s)", gitURL, m.git.Branch)
+	}
+	logger.Debugf("config directory: %s", m.ConfigRoot)
+	logger.Debugf("project directory: %s", projectdir)
+	logger.Debugf("revision directory: %s", revisiondir)
+	logger.Debugf("state backup directory: %s", backupdir)
+	return m
+}
+
+// SyncConfigs checks out the latest commit of the config repository, if
+// configs are read from git, and reloads the configs for trigger t if the
+// commit changed or force is set.
+func (m *Manager) SyncConfigs(force bool, t stack.Trigger) (messages []string, err error) {
+	m.syncMu.Lock()
+	defer m.syncMu.Unlock()
+	if m.git != nil {
+		commit, changed, err := m.git.Sync()
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			logger.Infof("config repository at commit %s", commit)
+		}
+		force = force || changed
+	}
+	if !force {
+		return []string{}, nil
+	}
+	return m.ReloadConfigs(t), nil
+}
+
+// pollConfigs syncs the config repository every interval
+func (m *Manager) pollConfigs(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := m.SyncConfigs(false, stack.Trigger{Name: stack.TriggerGit}); err != nil {
+			logger.WithError(err).Error("sync config repository failed")
+		}
 	}
 }
 
@@ -81,7 +137,9 @@ func (m *Manager) New(cfgpath string) (*StackController, error) {
 		return nil, err
 	}
 	sc := &StackController{Controller: mc, ConfigPath: cfgpath}
+	mc.OnApplied(func(cfg *stack.Config) { m.recordRevision(cfgName, sc, cfg) })
 	m.controllers[cfgName] = sc
+	m.setPendingRevision(sc, revision.Revision{Source: cfgpath, Trigger: "create", Commit: m.commit()})
 	return sc, nil
 }
 
@@ -108,23 +166,84 @@ func (m *Manager) Update(project, stack string) (*StackController, error) {
 	if err != nil {
 		return nil, err
 	}
+	m.setPendingRevision(sc, revision.Revision{Source: sc.ConfigPath, Trigger: "reload", Commit: m.commit()})
 	return sc, nil
 }
 
-func (m *Manager) ListConfigFiles() (cfgFiles []string, err error) {
-	files, err := ioutil.ReadDir(manager.ConfigRoot)
+// Rollback re-applies the config of an earlier revision to the controller
+// and triggers a stack update for t. The config file is not changed, so the
+// next reload applies the config file again.
+func (m *Manager) Rollback(project, stackName, id string, t stack.Trigger) (*revision.Revision, error) {
+	m.Lock()
+	defer m.Unlock()
+	cfgName := fmt.Sprintf("%s-%s", project, stackName)
+	sc, ok := m.controllers[cfgName]
+	if !ok {
+		return nil, fmt.Errorf("controller not exist")
+	}
+	r, err := m.revisions.Get(cfgName, id)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := stack.ConfigFromEffective(*r.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err := sc.ApplyConfig(cfg); err != nil {
+		return nil, err
+	}
+	m.setPendingRevision(sc, revision.Revision{Source: fmt.Sprintf("revision %s", r.ID), Trigger: "rollback", Commit: r.Commit})
+	sc.triggerUpdateStack(t)
+	return r, nil
+}
+
+// setPendingRevision sets r as the revision of the config of the controller,
+// which is recorded once the controller applied the config successfully, and
+// the commit of r as the commit of the following stack operations. The
+// manager lock is held.
+func (m *Manager) setPendingRevision(sc *StackController, r revision.Revision) {
+	r.ID = sc.Config.Hash()
+	sc.pending = &r
+	sc.SetCommit(r.Commit)
+}
+
+// recordRevision records cfg, which the controller applied successfully, as
+// a new revision with the pending revision of cfg. Configs replaced by
+// another config before they were applied are not recorded. Failing to
+// record does not fail the update.
+func (m *Manager) recordRevision(cfgName string, sc *StackController, cfg *stack.Config) {
+	m.Lock()
+	defer m.Unlock()
+	r := sc.pending
+	if r == nil || r.ID != cfg.Hash() {
+		return
+	}
+	rev, err := m.revisions.Record(cfgName, cfg, *r)
 	if err != nil {
+		logger.WithError(err).Errorf("record revision of %s failed", cfgName)
 		return
 	}
-	for _, f := range files {
-		if !f.IsDir() {
-			cfgFiles = append(cfgFiles, path.Join(m.ConfigRoot, f.Name()))
-		}
+	sc.pending = nil
+	sc.Revision = rev.ID
+	sc.Commit = rev.Commit
+}
+
+// commit returns the commit of the config repository, if configs are read
+// from git
+func (m *Manager) commit() string {
+	if m.git == nil {
+		return ""
 	}
-	return
+	return m.git.Commit()
+}
+
+func (m *Manager) ListConfigFiles() (cfgFiles []string, err error) {
+	return stack.ConfigFiles(m.ConfigRoot)
 }
 
-func (m *Manager) ReloadConfigs() (messages []string) {
+// ReloadConfigs creates, updates and deletes the controllers from the config
+// files. The stacks of created and updated controllers are updated for t.
+func (m *Manager) ReloadConfigs(t stack.Trigger) (messages []string) {
 	messages = make([]string, 0)
 	cfgFiles, err := manager.ListConfigFiles()
 	if err != nil {
@@ -153,7 +272,7 @@ func (m *Manager) ReloadConfigs() (messages []string) {
 				messages = append(messages, msg)
 				logger.Println(msg)
 			}
-			nc.start()
+			nc.start(t)
 		} else {
 			// update controller
 			nc, err := manager.Update(project, stack)
@@ -167,7 +286,7 @@ func (m *Manager) ReloadConfigs() (messages []string) {
 				messages = append(messages, msg)
 				logger.Println(msg)
 			}
-			nc.triggerUpdateStack()
+			nc.triggerUpdateStack(t)
 		}
 	}
 	// delete non exist controller
@@ -187,19 +306,24 @@ func (m *Manager) ReloadConfigs() (messages []string) {
 	return
 }
 
+func (c *StackController) cfgName() string {
+	project, stack := c.GetProjectStackName()
+	return fmt.Sprintf("%s-%s", project, stack)
+}
+
 func (c *StackController) reloadConfig() error {
 	return c.Controller.ReloadConfig(c.ConfigPath)
 }
 
-func (c *StackController) start() {
+func (c *StackController) start(t stack.Trigger) {
 	if c.updCh == nil {
-		c.updCh = make(chan bool)
+		c.updCh = make(chan stack.Trigger)
 	}
 	if c.canCh == nil {
 		c.canCh = make(chan bool)
 	}
 	c.running = true
-	go c.Controller.Run(c.updCh, c.canCh)
+	go c.Controller.Run(t, c.updCh, c.canCh)
 }
 
 func (c *StackController) stop() {
@@ -209,8 +333,8 @@ func (c *StackController) stop() {
 	}()
 }
 
-func (c *StackController) triggerUpdateStack() {
+func (c *StackController) triggerUpdateStack(t stack.Trigger) {
 	go func() {
-		c.updCh <- true
+		c.updCh <- t
 	}()
 }
@@ -25,68 +25,106 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/sapcc/vcf-automation/pkg/settings"
+	"github.com/sapcc/vcf-automation/pkg/stack"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
 var (
 	manager *Manager
-	logger  = log.WithField("package", "server")
+	// opts are the settings the server was started with
+	opts   *settings.Settings
+	logger = log.WithField("package", "server")
 )
 
-func Run(port int) {
-	log.SetFormatter(&log.TextFormatter{
-		FieldMap: log.FieldMap{
-			log.FieldKeyMsg: "message",
-		},
-	})
-	log.SetLevel(log.DebugLevel)
+func Run(s *settings.Settings) {
+	opts = s
 	log.SetOutput(os.Stdout)
 
 	// load configuration files and initialize controllers
 	manager = NewManager()
-	manager.ReloadConfigs()
+	if _, err := manager.SyncConfigs(true, stack.Trigger{Name: stack.TriggerStart}); err != nil {
+		logger.WithError(err).Error("sync configs failed")
+	}
+	if manager.git != nil {
+		if s.ConfigGitPollInterval > 0 {
+			go manager.pollConfigs(s.ConfigGitPollInterval)
+		}
+	} else if s.ConfigWatch {
+		if err := manager.watchConfigs(s.ConfigWatchDebounce); err != nil {
+			logger.WithError(err).Error("watch config directory failed")
+		}
+	}
+
+	// let other replicas sharing the backend know this server runs, so that
+	// they don't remove the locks of its stacks
+	stopHeartbeat := stack.StartReplicaHeartbeat()
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
 
 	r := mux.NewRouter()
 	r.Use(loggingMiddleware)
-	r.Headers("Content-Type", "application/json")
+	r.Use(authMiddleware)
 	r.HandleFunc("/reload", reload).Methods("GET")
+	r.HandleFunc("/webhook/git", gitWebhook).Methods("POST")
 	r.HandleFunc("/vcf", stackSummaries).Methods("GET")
+	r.HandleFunc("/doctor", runDoctor).Methods("GET")
+	r.HandleFunc("/resources", searchResources).Methods("GET")
 	r.HandleFunc("/{project}/{stack}/state", getStackOutputs).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/outputs", getStackOutputs).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/state/export", exportState).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/state/import", importState).Methods("POST")
+	r.HandleFunc("/{project}/{stack}/resources", getStackResources).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/snapshots", listSnapshots).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/snapshots/{snapshot}/diff", diffSnapshot).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/snapshots/{snapshot}/restore", restoreSnapshot).Methods("POST")
+	r.HandleFunc("/{project}/{stack}/runs", listRuns).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/runs/{run}", getRun).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/history", getHistory).Methods("GET")
 	r.HandleFunc("/{project}/{stack}/error", getStackError).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/status", stackStatus).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/effective-config", getEffectiveConfig).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/revisions", listRevisions).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/revisions/diff", diffRevisions).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/revisions/{revision}", getRevision).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/revisions/{revision}/rollback", rollbackRevision).Methods("POST")
 	r.HandleFunc("/{project}/{stack}/start", startStack).Methods("GET")
 	r.HandleFunc("/{project}/{stack}/stop", stopStack).Methods("GET")
 	r.HandleFunc("/{project}/{stack}/reload", reloadStack).Methods("GET")
+	r.HandleFunc("/{project}/{stack}/refresh", selectResources(stack.RunRefresh)).Methods("POST")
+	r.HandleFunc("/{project}/{stack}/update", selectResources(stack.RunUpdate)).Methods("POST")
+	r.HandleFunc("/{project}/{stack}/unlock", unlockStack).Methods("POST")
+	for _, route := range stack.ProjectRoutes() {
+		r.HandleFunc("/{project}/{stack}/"+route.Path, projectRoute(route)).Methods(route.Method)
+	}
 	r.HandleFunc("/{project}/{stack}/{key}.json", jsonFileHandler).Methods("GET")
 
 	h := pageHandler{
-		staticPath:   viper.GetString("static_path"),
-		templatePath: viper.GetString("template_path"),
+		staticPath:   s.StaticPath,
+		templatePath: s.TemplatePath,
 	}
 	r.Handle("/", h)
 
-	s := &http.Server{
+	srv := &http.Server{
 		Handler:      r,
-		Addr:         fmt.Sprintf("0.0.0.0:%d", port),
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		Addr:         fmt.Sprintf("0.0.0.0:%d", s.Port),
+		WriteTimeout: s.WriteTimeout,
+		ReadTimeout:  s.ReadTimeout,
 	}
 
 	go func() {
-		logger.Printf("listening on port %d", port)
-		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Printf("listening on port %d", s.Port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			logger.Error(err)
 		}
 	}()
 
 	<-stop
-	s.Shutdown(ctx)
+	stopHeartbeat()
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	srv.Shutdown(ctx)
 }
@@ -0,0 +1,191 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sapcc/vcf-automation/pkg/stack"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	eventCreated = "created"
+	eventUpdated = "updated"
+	eventStopped = "stopped"
+	eventFailed  = "failed"
+)
+
+// watchConfigs watches the config directory and reconciles the controllers
+// affected by changed files, once no further change happened for debounce.
+func (m *Manager) watchConfigs(debounce time.Duration) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(m.ConfigRoot); err != nil {
+		w.Close()
+		return err
+	}
+	logger.Infof("watching config directory %s", m.ConfigRoot)
+	go func() {
+		defer w.Close()
+		pending := make(map[string]struct{})
+		timer := time.NewTimer(debounce)
+		timer.Stop()
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if !stack.IsConfigFile(filepath.Base(ev.Name)) {
+					continue
+				}
+				pending[ev.Name] = struct{}{}
+				timer.Reset(debounce)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logger.WithError(err).Error("watch config directory")
+			case <-timer.C:
+				changed := make([]string, 0, len(pending))
+				for f := range pending {
+					changed = append(changed, f)
+				}
+				pending = make(map[string]struct{})
+				m.syncMu.Lock()
+				m.Reconcile(changed)
+				m.syncMu.Unlock()
+			}
+		}
+	}()
+	return nil
+}
+
+// Reconcile creates, updates or stops the controllers affected by the changed
+// config files. A controller is affected if its config file, or a file its
+// config extends, changed.
+func (m *Manager) Reconcile(changed []string) (messages []string) {
+	messages = make([]string, 0)
+	isChanged := make(map[string]bool)
+	for _, f := range changed {
+		isChanged[path.Clean(f)] = true
+	}
+	event := func(kind, cfgpath string, err error) {
+		l := logger.WithFields(log.Fields{"event": kind, "config": cfgpath})
+		msg := fmt.Sprintf("controller %s from config %s", kind, cfgpath)
+		if err != nil {
+			l.WithError(err).Error("reconcile config")
+			msg = fmt.Sprintf("%s: %v", msg, err)
+		} else {
+			l.Info("reconcile config")
+		}
+		messages = append(messages, msg)
+	}
+
+	handled := make(map[string]bool)
+	for cfgName, sc := range m.snapshot() {
+		handled[sc.ConfigPath] = true
+		if isChanged[sc.ConfigPath] {
+			if _, err := os.Stat(sc.ConfigPath); os.IsNotExist(err) {
+				m.remove(cfgName)
+				event(eventStopped, sc.ConfigPath, nil)
+				continue
+			}
+			cfg, err := stack.ReadConfig(sc.ConfigPath)
+			if err != nil {
+				event(eventFailed, sc.ConfigPath, err)
+				continue
+			}
+			// the file now configures another stack
+			if cfg.ProjectType != sc.ProjectType || cfg.StackName != sc.StackName {
+				m.remove(cfgName)
+				event(eventStopped, sc.ConfigPath, nil)
+				handled[sc.ConfigPath] = false
+				continue
+			}
+		} else if !dependsOnAny(sc.Config, isChanged) {
+			continue
+		}
+		project, stackName := sc.GetProjectStackName()
+		nc, err := m.Update(project, stackName)
+		if err != nil {
+			event(eventFailed, sc.ConfigPath, err)
+			continue
+		}
+		nc.triggerUpdateStack(stack.Trigger{Name: stack.TriggerWatch})
+		event(eventUpdated, sc.ConfigPath, nil)
+	}
+
+	for _, f := range changed {
+		f = path.Clean(f)
+		if handled[f] || path.Dir(f) != path.Clean(m.ConfigRoot) {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			continue
+		}
+		nc, err := m.New(f)
+		if err != nil {
+			event(eventFailed, f, err)
+			continue
+		}
+		nc.start(stack.Trigger{Name: stack.TriggerWatch})
+		event(eventCreated, f, nil)
+	}
+	return messages
+}
+
+func dependsOnAny(cfg *stack.Config, files map[string]bool) bool {
+	for _, f := range cfg.Files() {
+		if files[f] {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot returns a copy of the controllers, which can be iterated while
+// controllers are added or removed
+func (m *Manager) snapshot() map[string]*StackController {
+	m.Lock()
+	defer m.Unlock()
+	s := make(map[string]*StackController, len(m.controllers))
+	for k, v := range m.controllers {
+		s[k] = v
+	}
+	return s
+}
+
+// remove stops the controller and removes it from the manager
+func (m *Manager) remove(cfgName string) {
+	m.Lock()
+	defer m.Unlock()
+	if sc, ok := m.controllers[cfgName]; ok {
+		sc.stop()
+		delete(m.controllers, cfgName)
+	}
+}
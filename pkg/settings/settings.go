@@ -0,0 +1,421 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+// Package settings holds the settings of the automation binary. Settings are
+// read once from a settings file, the environment (AUTOMATION_<KEY>) and the
+// command line flags. Flags take precedence over the environment, the
+// environment over the settings file and the file over the defaults.
+package settings
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix is the prefix of the environment variables of the settings
+const EnvPrefix = "automation"
+
+// SecretMask replaces secret values when settings are shown
+const SecretMask = "[secret]"
+
+// Settings of the automation binary. The mapstructure tags are the keys in the
+// settings file; the environment variables are the upper case keys with the
+// prefix AUTOMATION_.
+type Settings struct {
+	WorkDir        string `mapstructure:"work_dir"`
+	ProjectRoot    string `mapstructure:"project_root"`
+	ConfigDir      string `mapstructure:"config_dir"`
+	RevisionDir    string `mapstructure:"revision_dir"`
+	StateBackupDir string `mapstructure:"state_backup_dir"`
+	StateCacheURL  string `mapstructure:"state_cache_url"`
+	SnapshotURL    string `mapstructure:"snapshot_url"`
+	RunDir         string `mapstructure:"run_dir"`
+	PluginCacheDir string `mapstructure:"plugin_cache_dir"`
+	StaticPath     string `mapstructure:"static_path"`
+	TemplatePath   string `mapstructure:"template_path"`
+
+	Port            int           `mapstructure:"port"`
+	ReadTimeout     time.Duration `mapstructure:"read_timeout"`
+	WriteTimeout    time.Duration `mapstructure:"write_timeout"`
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+	APIToken        string        `mapstructure:"api_token" secret:"true"`
+
+	SnapshotKeep   int           `mapstructure:"snapshot_keep"`
+	SnapshotMaxAge time.Duration `mapstructure:"snapshot_max_age"`
+	RunKeep        int           `mapstructure:"run_keep"`
+
+	LogLevel  string `mapstructure:"log_level"`
+	LogFormat string `mapstructure:"log_format"`
+
+	ConfigWatch         bool          `mapstructure:"config_watch"`
+	ConfigWatchDebounce time.Duration `mapstructure:"config_watch_debounce"`
+
+	ConfigGitURL           string        `mapstructure:"config_git_url"`
+	ConfigGitBranch        string        `mapstructure:"config_git_branch"`
+	ConfigGitSubdir        string        `mapstructure:"config_git_subdir"`
+	ConfigGitCheckout      string        `mapstructure:"config_git_checkout"`
+	ConfigGitUsername      string        `mapstructure:"config_git_username"`
+	ConfigGitPassword      string        `mapstructure:"config_git_password" secret:"true"`
+	ConfigGitPollInterval  time.Duration `mapstructure:"config_git_poll_interval"`
+	ConfigGitWebhookSecret string        `mapstructure:"config_git_webhook_secret" secret:"true"`
+
+	VMwarePassword string `mapstructure:"vmware_password" secret:"true"`
+
+	// Credentials are the openstack credential sets by name, "" for the
+	// default set, see CredentialKey
+	Credentials map[string]Credentials `mapstructure:"-"`
+}
+
+// Credentials is a set of openstack credentials by field, e.g. username
+type Credentials map[string]string
+
+// CredentialFields are the fields of an openstack credential set; secret
+// fields are masked when settings are shown
+var CredentialFields = map[string]bool{
+	"username":                      false,
+	"password":                      true,
+	"token":                         true,
+	"application_credential_id":     false,
+	"application_credential_name":   false,
+	"application_credential_secret": true,
+}
+
+// defaults of the settings; keys without default are empty
+var defaults = map[string]interface{}{
+	"port":                     8080,
+	"read_timeout":             15 * time.Second,
+	"write_timeout":            15 * time.Second,
+	"shutdown_timeout":         5 * time.Second,
+	"snapshot_keep":            20,
+	"snapshot_max_age":         30 * 24 * time.Hour,
+	"run_keep":                 50,
+	"log_level":                "info",
+	"log_format":               "text",
+	"config_watch":             true,
+	"config_watch_debounce":    2 * time.Second,
+	"config_git_branch":        "master",
+	"config_git_poll_interval": time.Minute,
+}
+
+var (
+	current *Settings
+	file    string
+	flags   = make(map[string]*pflag.Flag)
+)
+
+// BindFlag binds the setting key to a command line flag
+func BindFlag(key string, f *pflag.Flag) {
+	viper.BindPFlag(key, f)
+	flags[key] = f
+}
+
+// Load reads the settings from the settings file fpath (optional), the
+// environment and the bound flags, resolves the derived paths and validates
+// them. The settings are kept for Get.
+func Load(fpath string) (*Settings, error) {
+	viper.SetEnvPrefix(EnvPrefix)
+	viper.AutomaticEnv()
+	for _, k := range Keys() {
+		if v, ok := defaults[k]; ok {
+			viper.SetDefault(k, v)
+		} else {
+			// known to viper, so that Unmarshal picks up the environment
+			viper.SetDefault(k, reflect.Zero(fieldType(k)).Interface())
+		}
+	}
+	file = fpath
+	if fpath != "" {
+		viper.SetConfigFile(fpath)
+		if err := viper.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("read settings file %s: %v", fpath, err)
+		}
+	}
+	s := &Settings{}
+	if err := viper.Unmarshal(s); err != nil {
+		return nil, fmt.Errorf("settings: %v", err)
+	}
+	s.Credentials = loadCredentials()
+	s.resolve()
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	current = s
+	return s, nil
+}
+
+// Get returns the settings loaded by Load. If they were not loaded, they are
+// loaded from the environment; invalid settings exit the binary, instead of
+// running with zero values.
+func Get() *Settings {
+	if current == nil {
+		if _, err := Load(""); err != nil {
+			log.WithError(err).Fatal("invalid settings")
+		}
+	}
+	return current
+}
+
+// CredentialKey returns the key of field of the openstack credential set
+// name: os_<field> for the default set, os_<name>_<field> otherwise
+func CredentialKey(name, field string) string {
+	if name == "" {
+		return "os_" + field
+	}
+	return "os_" + name + "_" + field
+}
+
+// Credential returns field of the openstack credential set name
+func (s *Settings) Credential(name, field string) string {
+	return s.Credentials[name][field]
+}
+
+// loadCredentials reads the openstack credential sets whose keys are set in
+// the environment, the settings file or the flags
+func loadCredentials() map[string]Credentials {
+	names := make(map[string]bool)
+	for _, e := range os.Environ() {
+		k := strings.SplitN(e, "=", 2)[0]
+		if strings.HasPrefix(k, strings.ToUpper(EnvPrefix)+"_") {
+			if name, ok := credentialSetName(strings.ToLower(strings.TrimPrefix(k, strings.ToUpper(EnvPrefix)+"_"))); ok {
+				names[name] = true
+			}
+		}
+	}
+	for _, k := range viper.AllKeys() {
+		if name, ok := credentialSetName(k); ok {
+			names[name] = true
+		}
+	}
+	sets := make(map[string]Credentials, len(names))
+	for name := range names {
+		c := make(Credentials, len(CredentialFields))
+		for field := range CredentialFields {
+			if v := viper.GetString(CredentialKey(name, field)); v != "" {
+				c[field] = v
+			}
+		}
+		sets[name] = c
+	}
+	return sets
+}
+
+// credentialSetName returns the name of the credential set of key, false if
+// key is not a credential key
+func credentialSetName(key string) (string, bool) {
+	if !strings.HasPrefix(key, "os_") {
+		return "", false
+	}
+	rest := strings.TrimPrefix(key, "os_")
+	if _, ok := CredentialFields[rest]; ok {
+		return "", true
+	}
+	for field := range CredentialFields {
+		if name := strings.TrimSuffix(rest, "_"+field); name != rest && name != "" {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// resolve derives the paths which are not set from the work directory
+func (s *Settings) resolve() {
+	if s.ProjectRoot == "" {
+		s.ProjectRoot = path.Join(s.WorkDir, "projects")
+	}
+	if s.ConfigDir == "" {
+		s.ConfigDir = path.Join(s.WorkDir, "etc")
+	}
+	if s.RevisionDir == "" {
+		s.RevisionDir = path.Join(s.ConfigDir, ".revisions")
+	}
+	if s.StateBackupDir == "" {
+		s.StateBackupDir = path.Join(s.WorkDir, "state-backups")
+	}
+	if s.StateCacheURL == "" {
+		s.StateCacheURL = fileURL(path.Join(s.WorkDir, "state-cache"))
+	}
+	if s.SnapshotURL == "" {
+		s.SnapshotURL = fileURL(path.Join(s.WorkDir, "snapshots"))
+	}
+	if s.RunDir == "" {
+		s.RunDir = path.Join(s.WorkDir, "runs")
+	}
+	if s.ConfigGitCheckout == "" {
+		s.ConfigGitCheckout = path.Join(s.WorkDir, "git-config")
+	}
+}
+
+// fileURL returns the file url of the directory dir
+func fileURL(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return "file://" + filepath.ToSlash(dir)
+}
+
+// Validate checks the settings and reports all invalid values at once
+func (s *Settings) Validate() error {
+	var errs []string
+	if s.Port < 1 || s.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("port: %d out of range", s.Port))
+	}
+	if _, err := log.ParseLevel(s.LogLevel); err != nil {
+		errs = append(errs, fmt.Sprintf("log_level: %v", err))
+	}
+	if s.LogFormat != "text" && s.LogFormat != "json" {
+		errs = append(errs, fmt.Sprintf("log_format: %q is not text or json", s.LogFormat))
+	}
+	for k, d := range map[string]time.Duration{
+		"read_timeout":     s.ReadTimeout,
+		"write_timeout":    s.WriteTimeout,
+		"shutdown_timeout": s.ShutdownTimeout,
+	} {
+		if d <= 0 {
+			errs = append(errs, fmt.Sprintf("%s: must be positive", k))
+		}
+	}
+	if s.SnapshotKeep < 0 {
+		errs = append(errs, "snapshot_keep: must not be negative")
+	}
+	if s.SnapshotMaxAge < 0 {
+		errs = append(errs, "snapshot_max_age: must not be negative")
+	}
+	if s.RunKeep < 0 {
+		errs = append(errs, "run_keep: must not be negative")
+	}
+	if s.ConfigWatchDebounce < 0 {
+		errs = append(errs, "config_watch_debounce: must not be negative")
+	}
+	if s.ConfigGitPollInterval < 0 {
+		errs = append(errs, "config_git_poll_interval: must not be negative")
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("invalid settings: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ConfigureLogging sets the level and the format of the logger
+func (s *Settings) ConfigureLogging() {
+	level, err := log.ParseLevel(s.LogLevel)
+	if err != nil {
+		level = log.InfoLevel
+	}
+	log.SetLevel(level)
+	fieldMap := log.FieldMap{log.FieldKeyMsg: "message"}
+	if s.LogFormat == "json" {
+		log.SetFormatter(&log.JSONFormatter{FieldMap: fieldMap})
+	} else {
+		log.SetFormatter(&log.TextFormatter{FieldMap: fieldMap})
+	}
+}
+
+// Setting is a single setting as shown by `automation settings show`
+type Setting struct {
+	Key    string      `json:"key"`
+	Env    string      `json:"env"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// Show returns the settings in key order with secrets masked and the source
+// of each value: flag, env, file or default. The openstack credentials are
+// shown for the sets which are set.
+func (s *Settings) Show() []Setting {
+	v := reflect.ValueOf(*s)
+	t := v.Type()
+	l := make([]Setting, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := f.Tag.Get("mapstructure")
+		if key == "-" {
+			continue
+		}
+		var value interface{} = v.Field(i).Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if f.Tag.Get("secret") == "true" && v.Field(i).String() != "" {
+			value = SecretMask
+		}
+		l = append(l, Setting{Key: key, Env: envName(key), Value: value, Source: source(key)})
+	}
+	for name, c := range s.Credentials {
+		for field, v := range c {
+			var value interface{} = v
+			if CredentialFields[field] {
+				value = SecretMask
+			}
+			key := CredentialKey(name, field)
+			l = append(l, Setting{Key: key, Env: envName(key), Value: value, Source: source(key)})
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Key < l[j].Key })
+	return l
+}
+
+// Keys returns the keys of all settings, without the openstack credentials
+func Keys() []string {
+	t := reflect.TypeOf(Settings{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if k := t.Field(i).Tag.Get("mapstructure"); k != "-" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func fieldType(key string) reflect.Type {
+	t := reflect.TypeOf(Settings{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("mapstructure") == key {
+			return t.Field(i).Type
+		}
+	}
+	return reflect.TypeOf("")
+}
+
+func envName(key string) string {
+	return strings.ToUpper(EnvPrefix + "_" + key)
+}
+
+// source returns where the value of key comes from, in order of precedence
+func source(key string) string {
+	if f, ok := flags[key]; ok && f.Changed {
+		return "flag"
+	}
+	if _, ok := os.LookupEnv(envName(key)); ok {
+		return "env"
+	}
+	if file != "" && viper.InConfig(key) {
+		return "file"
+	}
+	return "default"
+}
@@ -0,0 +1,104 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package settings
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func setenv(t *testing.T, k, v string) {
+	t.Helper()
+	old, ok := os.LookupEnv(k)
+	os.Setenv(k, v)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(k, old)
+		} else {
+			os.Unsetenv(k)
+		}
+	})
+}
+
+func TestCredentialSetName(t *testing.T) {
+	tests := []struct {
+		key  string
+		name string
+		ok   bool
+	}{
+		{"os_username", "", true},
+		{"os_application_credential_secret", "", true},
+		{"os_lab_username", "lab", true},
+		{"os_qa_de_1_application_credential_id", "qa_de_1", true},
+		{"os_lab_region", "", false},
+		{"vmware_password", "", false},
+		{"os_", "", false},
+	}
+	for _, tt := range tests {
+		name, ok := credentialSetName(tt.key)
+		if name != tt.name || ok != tt.ok {
+			t.Errorf("%s: got %q, %v; want %q, %v", tt.key, name, ok, tt.name, tt.ok)
+		}
+	}
+}
+
+func TestLoadCredentials(t *testing.T) {
+	f := path.Join(t.TempDir(), "settings.yaml")
+	err := ioutil.WriteFile(f, []byte("os_lab_username: fileuser\nos_lab_password: filesecret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "AUTOMATION_OS_USERNAME", "user")
+	setenv(t, "AUTOMATION_OS_PASSWORD", "secret")
+	setenv(t, "AUTOMATION_OS_LAB_PASSWORD", "envsecret")
+	s, err := Load(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ name, field, want string }{
+		{"", "username", "user"},
+		{"", "password", "secret"},
+		{"lab", "username", "fileuser"},
+		// the environment takes precedence over the file
+		{"lab", "password", "envsecret"},
+		{"lab", "token", ""},
+		{"other", "username", ""},
+	} {
+		if v := s.Credential(tt.name, tt.field); v != tt.want {
+			t.Errorf("%s %s = %q; want %q", tt.name, tt.field, v, tt.want)
+		}
+	}
+
+	shown := make(map[string]Setting)
+	for _, st := range s.Show() {
+		shown[st.Key] = st
+	}
+	for key, want := range map[string]Setting{
+		"os_username":     {Value: "user", Source: "env"},
+		"os_password":     {Value: SecretMask, Source: "env"},
+		"os_lab_username": {Value: "fileuser", Source: "file"},
+		"os_lab_password": {Value: SecretMask, Source: "env"},
+	} {
+		if got := shown[key]; got.Value != want.Value || got.Source != want.Source {
+			t.Errorf("show %s = %v from %s; want %v from %s", key, got.Value, got.Source, want.Value, want.Source)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+// Package snapshot stores snapshots of exported stack deployments in a blob
+// bucket, a local directory or an S3-compatible object store, with count and
+// age based retention.
+package snapshot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/s3blob"
+	"gocloud.dev/gcerrors"
+)
+
+// Snapshot is a deployment of a stack saved at the update Version
+type Snapshot struct {
+	ID       string    `json:"id"`
+	Project  string    `json:"project"`
+	Stack    string    `json:"stack"`
+	Created  time.Time `json:"created"`
+	Version  int       `json:"version"`
+	Reason   string    `json:"reason,omitempty"`
+	Checksum string    `json:"checksum"`
+	Size     int64     `json:"size"`
+}
+
+// Retention limits the snapshots kept per stack. Zero values do not limit.
+type Retention struct {
+	Keep   int
+	MaxAge time.Duration
+}
+
+type Store struct {
+	Retention
+	bucket *blob.Bucket
+	url    string
+}
+
+// Open opens the snapshot store at the bucket url, e.g.
+// file:///pulumi/automation/snapshots or s3://bucket?endpoint=...&region=...
+// The directory of a file url is created if it does not exist.
+func Open(ctx context.Context, bucketURL string, r Retention) (*Store, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot store: %v", err)
+	}
+	if u.Scheme == "file" {
+		if err := os.MkdirAll(u.Path, 0700); err != nil {
+			return nil, fmt.Errorf("snapshot store: %v", err)
+		}
+	}
+	b, err := blob.OpenBucket(ctx, bucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot store %s: %v", bucketURL, err)
+	}
+	return &Store{Retention: r, bucket: b, url: bucketURL}, nil
+}
+
+// URL returns the url the store was opened with
+func (s *Store) URL() string {
+	return s.url
+}
+
+// Save stores deployment b of the stack and applies the retention. The
+// snapshot just saved is always kept.
+func (s *Store) Save(ctx context.Context, project, stack string, version int, reason string, b []byte) (*Snapshot, error) {
+	now := time.Now().UTC()
+	sum := sha256.Sum256(b)
+	checksum := hex.EncodeToString(sum[:])
+	snap := &Snapshot{
+		ID:       fmt.Sprintf("%s-%s", now.Format("20060102T150405Z"), checksum[:8]),
+		Project:  project,
+		Stack:    stack,
+		Created:  now,
+		Version:  version,
+		Reason:   reason,
+		Checksum: checksum,
+		Size:     int64(len(b)),
+	}
+	opts := &blob.WriterOptions{
+		ContentType: "application/json",
+		Metadata: map[string]string{
+			"created":  now.Format(time.RFC3339),
+			"version":  strconv.Itoa(version),
+			"reason":   reason,
+			"checksum": checksum,
+		},
+	}
+	if err := s.bucket.WriteAll(ctx, key(project, stack, snap.ID), b, opts); err != nil {
+		return nil, err
+	}
+	if _, err := s.Prune(ctx, project, stack); err != nil {
+		return snap, fmt.Errorf("prune snapshots: %v", err)
+	}
+	return snap, nil
+}
+
+// List returns the snapshots of the stack, newest first
+func (s *Store) List(ctx context.Context, project, stack string) ([]Snapshot, error) {
+	l := make([]Snapshot, 0)
+	it := s.bucket.List(&blob.ListOptions{Prefix: prefix(project, stack)})
+	for {
+		o, err := it.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if o.IsDir || !strings.HasSuffix(o.Key, ".json") {
+			continue
+		}
+		a, err := s.bucket.Attributes(ctx, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, newSnapshot(project, stack, o.Key, a))
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].ID > l[j].ID })
+	return l, nil
+}
+
+func newSnapshot(project, stack, k string, a *blob.Attributes) Snapshot {
+	snap := Snapshot{
+		ID:       strings.TrimSuffix(path.Base(k), ".json"),
+		Project:  project,
+		Stack:    stack,
+		Created:  a.ModTime.UTC(),
+		Reason:   a.Metadata["reason"],
+		Checksum: a.Metadata["checksum"],
+		Size:     a.Size,
+	}
+	if t, err := time.Parse(time.RFC3339, a.Metadata["created"]); err == nil {
+		snap.Created = t
+	}
+	snap.Version, _ = strconv.Atoi(a.Metadata["version"])
+	return snap
+}
+
+// Get returns the snapshot and its deployment. id may be a unique prefix of
+// the id or "latest". The deployment is verified against the checksum.
+func (s *Store) Get(ctx context.Context, project, stack, id string) (*Snapshot, []byte, error) {
+	l, err := s.List(ctx, project, stack)
+	if err != nil {
+		return nil, nil, err
+	}
+	var found []Snapshot
+	for _, snap := range l {
+		if id == "latest" || strings.HasPrefix(snap.ID, id) {
+			found = append(found, snap)
+		}
+		if id == "latest" || snap.ID == id {
+			found = []Snapshot{snap}
+			break
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, nil, fmt.Errorf("snapshot %s of %s/%s not found", id, project, stack)
+	case 1:
+	default:
+		return nil, nil, fmt.Errorf("snapshot id %s is ambiguous", id)
+	}
+	snap := found[0]
+	b, err := s.bucket.ReadAll(ctx, key(project, stack, snap.ID))
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(b)
+	if snap.Checksum != "" && hex.EncodeToString(sum[:]) != snap.Checksum {
+		return nil, nil, fmt.Errorf("snapshot %s: checksum mismatch", snap.ID)
+	}
+	return &snap, b, nil
+}
+
+// Prune deletes the snapshots of the stack exceeding the retention and
+// returns their ids. The newest snapshot is kept.
+func (s *Store) Prune(ctx context.Context, project, stack string) ([]string, error) {
+	l, err := s.List(ctx, project, stack)
+	if err != nil {
+		return nil, err
+	}
+	deleted := make([]string, 0)
+	for i, snap := range l {
+		if i == 0 {
+			continue
+		}
+		tooMany := s.Keep > 0 && i >= s.Keep
+		tooOld := s.MaxAge > 0 && time.Since(snap.Created) > s.MaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		err := s.bucket.Delete(ctx, key(project, stack, snap.ID))
+		if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return deleted, err
+		}
+		deleted = append(deleted, snap.ID)
+	}
+	return deleted, nil
+}
+
+// Close closes the bucket
+func (s *Store) Close() error {
+	return s.bucket.Close()
+}
+
+func prefix(project, stack string) string {
+	return path.Join(project, stack) + "/"
+}
+
+func key(project, stack, id string) string {
+	return prefix(project, stack) + id + ".json"
+}
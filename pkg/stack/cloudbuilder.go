@@ -0,0 +1,55 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/sapcc/vcf-automation/pkg/settings"
+	"github.com/sapcc/vcf-automation/pkg/stack/vcf"
+)
+
+// RenderCloudBuilder renders and validates the cloud builder payload of a
+// vcf/management config from the template of the vcf project, without
+// accessing openstack. The vmware password is masked unless reveal is set.
+func RenderCloudBuilder(cfg *Config, projectRoot string, reveal bool) ([]byte, error) {
+	if cfg.ProjectType != ProjectVCFManagement {
+		return nil, fmt.Errorf("cloud builder payload of project %q: %v", cfg.ProjectType, ErrNotSupported)
+	}
+	project, _ := cfg.GetProjectStackName()
+	tmpl, err := ioutil.ReadFile(path.Join(projectRoot, project, vcf.CloudBuilderTemplate))
+	if err != nil {
+		return nil, err
+	}
+	props := vcf.StackProps{}
+	if err := UnmarshalStackProps(cfg.Props.StackProps, &props); err != nil {
+		return nil, err
+	}
+	password := SecretMask
+	if reveal {
+		password = settings.Get().VMwarePassword
+	}
+	b, err := vcf.RenderCloudBuilder(string(tmpl), props, cfg.Props.OpenstackProps.Region, password)
+	if err != nil {
+		return nil, err
+	}
+	return b, vcf.ValidateCloudBuilder(b)
+}
@@ -19,6 +19,8 @@
 package stack
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"path"
@@ -43,11 +45,31 @@ type StackProps interface{}
 
 // Config is configuration of project/stack
 type Config struct {
-	ProjectType    ProjectType `json:"project_type" yaml:"projectType"`
-	StackName      string      `json:"stack" yaml:"stack"`
-	Props          Props       `json:"props" yaml:"props"`
-	DependsOn      []string    `json:"depends_on,omitempty" yaml:"dependsOn"`
-	baseStackProps []StackProps
+	ProjectType ProjectType `json:"project_type" yaml:"projectType"`
+	StackName   string      `json:"stack" yaml:"stack"`
+	Props       Props       `json:"props" yaml:"props"`
+	// Secrets selects the key of the secrets in the stack config and state
+	Secrets SecretsConfig `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+	// Extends lists the configs this config is based on, relative to the
+	// directory of the config file. They are merged in order, and this
+	// config is merged last.
+	Extends []string `json:"extends,omitempty" yaml:"extends,omitempty"`
+	// DependsOn is the deprecated name of Extends
+	DependsOn []string `json:"depends_on,omitempty" yaml:"dependsOn,omitempty"`
+	// Merge overrides the merge strategies used when merging this config
+	// into its bases, keyed by field path, e.g. props.stack.esxiNodes
+	Merge map[string]MergeStrategy `json:"merge,omitempty" yaml:"merge,omitempty"`
+
+	effective map[string]interface{}
+	sources   map[string]string
+	files     []string
+}
+
+// EffectiveConfig is the config after merging all configs it extends.
+// Sources maps the path of every value to the file it came from.
+type EffectiveConfig struct {
+	Config  map[string]interface{} `json:"config" yaml:"config"`
+	Sources map[string]string      `json:"sources" yaml:"sources"`
 }
 
 // Props is configuration needed for pulumi projects. It holds general
@@ -59,41 +81,236 @@ type Props struct {
 
 // OpenstackProps
 type OpenstackProps struct {
-	Region string `json:"region" yaml:"region"`
-	Domain string `json:"domain" yaml:"domain"`
-	Tenant string `json:"tenant" yaml:"tenant"`
+	Region string         `json:"region" yaml:"region"`
+	Domain string         `json:"domain" yaml:"domain"`
+	Tenant string         `json:"tenant" yaml:"tenant"`
+	Auth   *OpenstackAuth `json:"auth,omitempty" yaml:"auth,omitempty"`
+}
+
+// OpenstackAuth overrides how the openstack provider authenticates. Every
+// field is optional; without an auth block the stack authenticates against
+// the CCloud identity endpoint of the region with user name and password, in
+// the domain of the tenant, and without TLS verification.
+type OpenstackAuth struct {
+	// URL overrides the identity endpoint, e.g. for a lab openstack
+	URL string `json:"url,omitempty" yaml:"url,omitempty"`
+	// Method is one of password (default), token or application-credential
+	Method AuthMethod `json:"method,omitempty" yaml:"method,omitempty"`
+	// UserDomain defaults to OpenstackProps.Domain, and to ccadmin for the
+	// vcf projects
+	UserDomain string `json:"user_domain,omitempty" yaml:"userDomain,omitempty"`
+	// ProjectDomain defaults to OpenstackProps.Domain
+	ProjectDomain string `json:"project_domain,omitempty" yaml:"projectDomain,omitempty"`
+	// CACertFile is the path of a CA bundle used to verify the endpoint
+	CACertFile string `json:"cacert_file,omitempty" yaml:"caCertFile,omitempty"`
+	// Insecure disables TLS verification. It defaults to true, unless a
+	// CACertFile is given.
+	Insecure *bool `json:"insecure,omitempty" yaml:"insecure,omitempty"`
+	// Credentials names the credential set to read the secrets from. The set
+	// "lab" is read from AUTOMATION_OS_LAB_USERNAME, AUTOMATION_OS_LAB_PASSWORD
+	// and so on; the default set from AUTOMATION_OS_USERNAME etc.
+	Credentials string `json:"credentials,omitempty" yaml:"credentials,omitempty"`
 }
 
-// ReadConfig reads config from config file full path (configFilePath)
+// AuthMethod is the openstack authentication method
+type AuthMethod string
+
+const (
+	AuthPassword              AuthMethod = "password"
+	AuthToken                 AuthMethod = "token"
+	AuthApplicationCredential AuthMethod = "application-credential"
+)
+
+// ReadConfig reads config from config file full path (configFilePath). The
+// configs it extends are read relative to its directory and merged into it,
+// see MergeStrategy.
 func ReadConfig(configFilePath string) (*Config, error) {
-	b, err := ioutil.ReadFile(configFilePath)
+	docs := make([]configDoc, 0)
+	err := readConfigDocs(configFilePath, nil, make(map[string]bool), &docs)
+	if err != nil {
+		return nil, err
+	}
+	top := docs[len(docs)-1]
+
+	// the project type decides the fields of the merge strategy merge, so it
+	// has to be known before merging
+	var projectType ProjectType
+	for _, d := range docs {
+		if t, ok := d.data["projectType"]; ok {
+			projectType = ProjectType(fmt.Sprint(t))
+		}
+	}
+	keys := projectMergeKeys(projectType)
+	m := merger{sources: make(map[string]string)}
+	var merged interface{}
+	for _, d := range docs {
+		m.strategies = make(map[string]MergeStrategy)
+		for k, v := range d.merge {
+			if v == MergeItems {
+				key, ok := keys[k]
+				if !ok {
+					return nil, fmt.Errorf("%s: merge %s: project type %s merges no items of the list, use %s<field>",
+						d.file, k, projectType, mergeByKey)
+				}
+				v = MergeByKey(key)
+			}
+			m.strategies[k] = v
+		}
+		merged = m.merge(merged, d.data, "", d.file)
+	}
+
+	b, err := yaml.Marshal(merged)
 	if err != nil {
 		return nil, err
 	}
 	c := Config{}
 	if err = yaml.Unmarshal(b, &c); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %v", configFilePath, err)
 	}
 	if err := c.validate(); err != nil {
 		err = fmt.Errorf("%s: %v", configFilePath, err)
 		return nil, err
 	}
-	for _, fname := range c.DependsOn {
-		dc, err := ReadConfig(path.Join(path.Dir(configFilePath), fname))
+	c.Extends = top.extends
+	c.Merge = top.merge
+	c.effective = merged.(map[string]interface{})
+	c.sources = m.sources
+	for _, d := range docs {
+		c.files = append(c.files, d.file)
+	}
+	return &c, nil
+}
+
+// File returns the config file the config was read from, empty if it was not
+// read from a file, e.g. on rollback.
+func (c *Config) File() string {
+	if len(c.files) == 0 {
+		return ""
+	}
+	return c.files[len(c.files)-1]
+}
+
+// Files returns the config file and the files of the configs it extends.
+func (c *Config) Files() []string {
+	return c.files
+}
+
+// Effective returns the merged config and the source of each value.
+func (c *Config) Effective() EffectiveConfig {
+	return EffectiveConfig{Config: c.effective, Sources: c.sources}
+}
+
+// Hash returns the sha256 hash of the effective config. Configs with the same
+// content have the same hash, regardless of how they are split into files.
+func (c *Config) Hash() string {
+	// encoding/json sorts map keys, which makes the encoding deterministic
+	b, _ := json.Marshal(c.effective)
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// ConfigFromEffective creates the config from an effective config, e.g. one
+// that was recorded earlier.
+func ConfigFromEffective(e EffectiveConfig) (*Config, error) {
+	b, err := yaml.Marshal(e.Config)
+	if err != nil {
+		return nil, err
+	}
+	c := Config{}
+	if err = yaml.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	c.effective = normalize(e.Config).(map[string]interface{})
+	c.sources = e.Sources
+	return &c, nil
+}
+
+// configDoc is a single config file before merging
+type configDoc struct {
+	file    string
+	data    map[string]interface{}
+	extends []string
+	merge   map[string]MergeStrategy
+}
+
+// readConfigDocs reads the config file fpath and, recursively, the configs it
+// extends into docs, bases first. A config extended more than once is read
+// only once. chain holds the files currently being read, to detect cycles.
+func readConfigDocs(fpath string, chain []string, done map[string]bool, docs *[]configDoc) error {
+	fpath = path.Clean(fpath)
+	for _, f := range chain {
+		if f == fpath {
+			return fmt.Errorf("extends cycle: %s -> %s", strings.Join(chain, " -> "), fpath)
+		}
+	}
+	if done[fpath] {
+		return nil
+	}
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return err
+	}
+	raw := make(map[interface{}]interface{})
+	if err = yaml.Unmarshal(b, &raw); err != nil {
+		return fmt.Errorf("%s: %v", fpath, err)
+	}
+	d := configDoc{file: fpath, data: normalize(raw).(map[string]interface{})}
+	var header struct {
+		Extends   []string                 `yaml:"extends"`
+		DependsOn []string                 `yaml:"dependsOn"`
+		Merge     map[string]MergeStrategy `yaml:"merge"`
+	}
+	if err = yaml.Unmarshal(b, &header); err != nil {
+		return fmt.Errorf("%s: %v", fpath, err)
+	}
+	for k, st := range header.Merge {
+		if err := st.validate(); err != nil {
+			return fmt.Errorf("%s: merge %s: %v", fpath, k, err)
+		}
+	}
+	d.extends = append(header.Extends, header.DependsOn...)
+	d.merge = header.Merge
+	delete(d.data, "extends")
+	delete(d.data, "dependsOn")
+	delete(d.data, "merge")
+
+	chain = append(chain, fpath)
+	for _, fname := range d.extends {
+		err := readConfigDocs(path.Join(path.Dir(fpath), fname), chain, done, docs)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		c.baseStackProps = append(c.baseStackProps, dc.Props.StackProps)
 	}
-	return &c, nil
+	done[fpath] = true
+	*docs = append(*docs, d)
+	return nil
+}
+
+// projectMergeKeys returns the fields by which the strategy merge merges the
+// list items of the stack props of the project type, by path
+func projectMergeKeys(t ProjectType) map[string]string {
+	var keys map[string]string
+	if p, err := LookupProject(t); err == nil {
+		keys = p.MergeKeys()
+	}
+	m := make(map[string]string)
+	for field, key := range keys {
+		m["props.stack."+field] = key
+	}
+	return m
 }
 
-// GetProjectStackName returns stack's project type and stack name. If project
-// type is composite with main and sub type, as mainProjectType/subProjectType,
-// only main project type is returned.
-func (c *Config) GetProjectStackName() (projectType, stackName string) {
-	p := strings.Split(string(c.ProjectType), "/")
-	return p[0], c.StackName
+// GetProjectStackName returns the project directory of the stack's project
+// type, e.g. vcf for vcf/management, and the stack name. The project type is
+// returned as it is if it is not registered.
+func (c *Config) GetProjectStackName() (project, stackName string) {
+	p, err := c.Project()
+	if err != nil {
+		return string(c.ProjectType), c.StackName
+	}
+	return p.Dir(), c.StackName
 }
 
 func (c *Config) validate() error {
@@ -103,6 +320,18 @@ func (c *Config) validate() error {
 	if c.StackName == "" {
 		return fmt.Errorf("stack not set")
 	}
+	if err := c.Secrets.Validate(); err != nil {
+		return fmt.Errorf("secrets: %v", err)
+	}
+	// the vcf program scopes its providers to the projects cloud_admin and
+	// master, an application credential is bound to a single project
+	if a := c.Props.OpenstackProps.Auth; a != nil && a.Method == AuthApplicationCredential {
+		if p, err := c.Project(); err == nil {
+			if _, ok := p.(vcfProject); ok {
+				return fmt.Errorf("props.openstack.auth.method %s: %v for project type %s", a.Method, ErrNotSupported, c.ProjectType)
+			}
+		}
+	}
 	return nil
 }
 
@@ -188,3 +417,28 @@ func UnmarshalStackPropList(data []StackProps, props interface{}) error {
 // 	}
 // 	return &nc, nil
 // }
+
+// IsConfigFile reports whether the file name is a config file. Hidden files
+// and the temporary files of editors are not.
+func IsConfigFile(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "#") {
+		return false
+	}
+	ext := path.Ext(name)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// ConfigFiles returns the config files in dir
+func ConfigFiles(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var l []string
+	for _, f := range files {
+		if !f.IsDir() && IsConfigFile(f.Name()) {
+			l = append(l, path.Join(dir, f.Name()))
+		}
+	}
+	return l, nil
+}
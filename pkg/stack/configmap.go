@@ -0,0 +1,151 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// DesiredConfig returns the pulumi config that configuring the stack of cfg
+// sets, without accessing the stack. Credentials missing in the environment
+// are replaced by the name of their env variable.
+func DesiredConfig(cfg *Config) (auto.ConfigMap, error) {
+	m, err := openstackConfigOf(cfg, true)
+	if err != nil {
+		return nil, err
+	}
+	s, err := stackPropsConfig(cfg, true)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range s {
+		m[k] = v
+	}
+	return m, nil
+}
+
+// LiveConfig returns the pulumi config of the existing stack of cfg, with keys
+// qualified by the pulumi project name. The stack is selected, not created.
+func LiveConfig(ctx context.Context, cfg *Config, projectRoot string) (auto.ConfigMap, string, error) {
+	project, stackName := cfg.GetProjectStackName()
+	s, err := auto.SelectStackLocalSource(ctx, stackName, path.Join(projectRoot, project))
+	if err != nil {
+		return nil, "", err
+	}
+	settings, err := s.Workspace().ProjectSettings(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	m, err := s.GetAllConfig(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	return m, settings.Name.String(), nil
+}
+
+// QualifyConfig returns m with keys without namespace prefixed by the pulumi
+// project name, as pulumi stores them.
+func QualifyConfig(m auto.ConfigMap, project string) auto.ConfigMap {
+	q := make(auto.ConfigMap, len(m))
+	for k, v := range m {
+		if !strings.Contains(k, ":") {
+			k = project + ":" + k
+		}
+		q[k] = v
+	}
+	return q
+}
+
+// DiffConfigMaps compares two pulumi configs key by key. Values holding json
+// objects or lists are compared value by value, with paths below the key.
+// Secret values are replaced by SecretMask.
+func DiffConfigMaps(old, new auto.ConfigMap) []ConfigChange {
+	changes := make([]ConfigChange, 0)
+	keys := make(map[string]bool)
+	for k := range old {
+		keys[k] = true
+	}
+	for k := range new {
+		keys[k] = true
+	}
+	for k := range keys {
+		o, inOld := old[k]
+		n, inNew := new[k]
+		secret := o.Secret || n.Secret
+		before := make(map[string]interface{})
+		after := make(map[string]interface{})
+		if inOld {
+			before[k] = configValueOf(o)
+		}
+		if inNew {
+			after[k] = configValueOf(n)
+		}
+		cs := DiffConfig(before, after)
+		for _, c := range cs {
+			if secret {
+				c.Old, c.New = maskValue(c.Old), maskValue(c.New)
+			}
+			changes = append(changes, c)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// configValueOf decodes json objects and lists in v, other values are kept
+// as string
+func configValueOf(v auto.ConfigValue) interface{} {
+	s := strings.TrimSpace(v.Value)
+	if strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[") {
+		var d interface{}
+		if err := json.Unmarshal([]byte(s), &d); err == nil {
+			return d
+		}
+	}
+	return v.Value
+}
+
+func maskValue(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return SecretMask
+}
+
+// stackPropsConfig returns the project specific pulumi config of cfg
+func stackPropsConfig(cfg *Config, lenient bool) (auto.ConfigMap, error) {
+	p, err := cfg.Project()
+	if err != nil {
+		return nil, err
+	}
+	props, err := cfg.DecodeProps()
+	if err != nil {
+		return nil, err
+	}
+	if err := props.Validate(); err != nil {
+		return nil, err
+	}
+	return p.StackConfig(props, lenient)
+}
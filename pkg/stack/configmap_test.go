@@ -0,0 +1,101 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+func TestDiffConfigMaps(t *testing.T) {
+	old := auto.ConfigMap{
+		"p:region":   configValue("qa-de-1"),
+		"p:password": configSecret("old"),
+		"p:token":    configSecret("t"),
+		"p:nodes":    configValue(`[{"name":"n01","ip":"10.0.0.1"}]`),
+		"p:same":     configValue("x"),
+	}
+	new := auto.ConfigMap{
+		"p:region":   configValue("qa-de-2"),
+		"p:password": configSecret("new"),
+		"p:nodes":    configValue(`[{"name":"n01","ip":"10.0.0.2"}]`),
+		"p:same":     configValue("x"),
+		"p:broken":   configValue("{not json"),
+	}
+	want := []ConfigChange{
+		{Path: "p:broken", Kind: ChangeAdded, New: "{not json"},
+		{Path: "p:nodes[0].ip", Kind: ChangeChanged, Old: "10.0.0.1", New: "10.0.0.2"},
+		{Path: "p:password", Kind: ChangeChanged, Old: SecretMask, New: SecretMask},
+		{Path: "p:region", Kind: ChangeChanged, Old: "qa-de-1", New: "qa-de-2"},
+		{Path: "p:token", Kind: ChangeRemoved, Old: SecretMask},
+	}
+	if got := DiffConfigMaps(old, new); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestQualifyConfig(t *testing.T) {
+	m := auto.ConfigMap{
+		"stackType":        configValue("management"),
+		"openstack:region": configValue("qa-de-1"),
+	}
+	want := auto.ConfigMap{
+		"vcf:stackType":    configValue("management"),
+		"openstack:region": configValue("qa-de-1"),
+	}
+	if got := QualifyConfig(m, "vcf"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestDesiredConfig(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{"esxi.yaml": `projectType: esxi
+stack: s1
+props:
+  openstack:
+    region: qa-de-1
+    domain: monsoon3
+    tenant: vcf
+  stack:
+    nodeSubnet: 10.0.0.0/24
+    storageSubnet: 10.0.1.0/24
+`})
+	cfg, err := ReadConfig(path.Join(dir, "esxi.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setCredentials(t, map[string]string{"os_username": "user"})
+	m, err := DesiredConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// missing credentials are shown by their env variable
+	for k, want := range map[string]auto.ConfigValue{
+		"openstack:region":   configValue("qa-de-1"),
+		"openstack:userName": configValue("user"),
+		"openstack:password": configSecret("$AUTOMATION_OS_PASSWORD"),
+	} {
+		if got := m[k]; got != want {
+			t.Errorf("%s = %+v; want %+v", k, got, want)
+		}
+	}
+}
@@ -3,17 +3,31 @@ package stack
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/auto"
-	"github.com/sapcc/vcf-automation/pkg/stack/esxi"
-	"github.com/sapcc/vcf-automation/pkg/stack/vcf"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optpreview"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optrefresh"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
+)
+
+// States of the controller loop
+const (
+	StatePending      = "Pending"
+	StateInitializing = "Initializing"
+	StateConfiguring  = "Configuring"
+	StateRefreshing   = "Refreshing"
+	StateUpdating     = "Updating"
+	StateIdle         = "Idle"
+	StateFailed       = "Failed"
+	StateStopped      = "Stopped"
 )
 
 type Controller struct {
@@ -22,8 +36,34 @@ type Controller struct {
 	projectRoot string
 	stack       Stack
 	configured  bool
-	err         error
+	progress    io.Writer
 	mu          sync.Mutex
+
+	// state and err, the error of the last run of the controller loop, are
+	// guarded by their own mutex, so that they can be read while mu is held
+	// by a stack operation
+	state     string
+	stateTime time.Time
+	err       error
+	stateMu   sync.Mutex
+	// trigger is the trigger of the current stack operation and commit the
+	// commit of the config repository of the config, guarded by stateMu;
+	// tags are the provenance tags last set on the stack and tagsUnsupported
+	// is set once the backend rejected stack tags, guarded by mu
+	trigger         Trigger
+	commit          string
+	tags            map[string]string
+	tagsUnsupported bool
+	// plugins is the status of the required plugins, guarded by stateMu
+	plugins []PluginStatus
+	// applied is called by the controller loop with the config of every
+	// successful update
+	applied func(cfg *Config)
+
+	// deployment is the latest deployment read, at update deploymentVersion
+	deployment        *apitype.DeploymentV3
+	deploymentVersion int
+	deployMu          sync.Mutex
 }
 
 // NewController creates *Controller with config and projectRoot, and validates
@@ -34,6 +74,9 @@ func NewController(config *Config, projectRoot string) (*Controller, error) {
 		Config:      config,
 		projectRoot: projectRoot,
 		projectPath: path.Join(projectRoot, project),
+		state:       StatePending,
+		stateTime:   time.Now(),
+		trigger:     CLITrigger(),
 	}
 	err := l.Validate()
 	if err != nil {
@@ -69,6 +112,12 @@ func (c *Controller) ReloadConfig(cfgpath string) error {
 	if err != nil {
 		return err
 	}
+	return c.ApplyConfig(cfg)
+}
+
+// ApplyConfig replaces the controller's config by cfg, which must be of the
+// same project and stack. The stack is re-configured on the next update.
+func (c *Controller) ApplyConfig(cfg *Config) error {
 	if cfg.ProjectType != c.ProjectType {
 		return fmt.Errorf("project does not match")
 	}
@@ -79,19 +128,25 @@ func (c *Controller) ReloadConfig(cfgpath string) error {
 	return nil
 }
 
+// OnApplied sets the function the controller loop calls with the config of
+// every successful update. It must be set before Run.
+func (c *Controller) OnApplied(f func(cfg *Config)) {
+	c.applied = f
+}
+
 func (c *Controller) Validate() error {
-	switch c.ProjectType {
-	case ProjectEsxi, ProjectExample, ProjectVCFWorkload, ProjectVCFManagement:
-		if f, err := os.Stat(c.projectPath); err != nil || !f.IsDir() {
-			return fmt.Errorf("project directory does not exist: %s", c.projectPath)
-		}
-	default:
-		return fmt.Errorf("project not supported: %s", c.ProjectType)
+	if _, err := c.Project(); err != nil {
+		return err
+	}
+	if f, err := os.Stat(c.projectPath); err != nil || !f.IsDir() {
+		return fmt.Errorf("project directory does not exist: %s", c.projectPath)
 	}
 	return nil
 }
 
-func (c *Controller) Run(updateCh <-chan bool, cancelCh <-chan bool) {
+// Run runs the controller loop, which updates the stack first for trigger,
+// then for every trigger from updateCh and on schedule, until cancelCh.
+func (c *Controller) Run(trigger Trigger, updateCh <-chan Trigger, cancelCh <-chan bool) {
 	logger := log.WithFields(log.Fields{
 		"package": "stack",
 		"project": c.ProjectType,
@@ -103,47 +158,63 @@ func (c *Controller) Run(updateCh <-chan bool, cancelCh <-chan bool) {
 
 Forloop:
 	for {
-		func() {
+		c.SetTrigger(trigger)
+		err := func() error {
 			ctx := context.Background()
+			cfg := c.Config
 			if c.stack == nil {
 				logger.Info("initialize stack")
+				c.setState(StateInitializing)
 				if err := c.InitStack(ctx); err != nil {
-					c.err = err
-					logger.WithError(c.err).Error("initialize stack failed")
-					return
+					logger.WithError(err).Error("initialize stack failed")
+					return err
 				}
 			}
 			if !c.configured {
 				logger.Info("configure stack")
+				c.setState(StateConfiguring)
 				if err := c.ConfigureStack(ctx); err != nil {
-					c.err = err
-					logger.WithError(c.err).Error("configure stack failed")
-					return
+					logger.WithError(err).Error("configure stack failed")
+					return err
 				}
 				c.configured = true
 			}
+			if sel := trigger.Selection; sel != nil {
+				logger.WithField("selection", *sel).Infof("%s selected resources", sel.Operation)
+				if err := c.runSelected(ctx, sel); err != nil {
+					logger.WithError(err).Errorf("%s selected resources failed", sel.Operation)
+					return err
+				}
+				return nil
+			}
 			logger.Info("refresh stack")
-			if err := c.RefreshStack(ctx); err != nil {
-				c.err = err
-				logger.WithError(c.err).Error("refresh stack failed")
-				return
+			c.setState(StateRefreshing)
+			if _, err := c.RefreshStack(ctx); err != nil {
+				logger.WithError(err).Error("refresh stack failed")
+				return err
 			}
 			logger.Info("update stack")
-			if err := c.UpdateStack(ctx); err != nil {
-				c.err = err
-				logger.WithError(c.err).Error("update stack failed")
-				return
+			c.setState(StateUpdating)
+			if _, err := c.UpdateStack(ctx); err != nil {
+				logger.WithError(err).Error("update stack failed")
+				return err
+			}
+			if c.applied != nil {
+				c.applied(cfg)
 			}
-			c.err = nil
+			return nil
 		}()
 
-		if c.err == nil {
+		if err == nil {
+			c.setResult(StateIdle, nil)
 			logger.Info("stack resources:")
 			c.PrintStackResources()
+		} else {
+			c.setResult(StateFailed, err)
 		}
 
 		select {
-		case <-updateCh:
+		case trigger = <-updateCh:
 			// force re-configuring stack since configuration might have
 			// changed; reset timer so that next update will wait full
 			// tickerDuration
@@ -151,12 +222,38 @@ Forloop:
 			ticker.Reset(tickerDuration)
 		case <-cancelCh:
 			c.configured = false
+			c.setState(StateStopped)
 			break Forloop
 		case <-ticker.C:
+			trigger = Trigger{Name: TriggerSchedule}
 		}
 	}
 }
 
+// State returns the state of the controller loop and since when the
+// controller is in this state.
+func (c *Controller) State() (string, time.Time) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state, c.stateTime
+}
+
+func (c *Controller) setState(state string) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.state = state
+	c.stateTime = time.Now()
+}
+
+// setResult sets the state and the error of a run of the controller loop
+func (c *Controller) setResult(state string, err error) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.state = state
+	c.stateTime = time.Now()
+	c.err = err
+}
+
 // RuntimeError returns error thrown when refresh/update/destroy stack
 func (c *Controller) RuntimeError() error {
 	return c.stack.GetError()
@@ -165,30 +262,20 @@ func (c *Controller) RuntimeError() error {
 func (l *Controller) InitStack(ctx context.Context) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	switch v := ProjectType(l.ProjectType); v {
-	case ProjectExample:
-		if s, err := InitExampleStack(ctx, l.StackName, l.projectPath); err != nil {
-			return err
-		} else {
-			l.stack = s
-		}
-	case ProjectEsxi:
-		s, err := esxi.InitEsxiStack(ctx, l.StackName, l.projectPath)
-		if err != nil {
-			return err
-		}
-		l.stack = s
-	case ProjectVCFManagement, ProjectVCFWorkload:
-		s, err := vcf.InitVCFStack(ctx, l.StackName, l.projectPath)
-		if err != nil {
-			return err
-		}
-		l.stack = s
-	default:
-		return fmt.Errorf("project %q: %v", l.ProjectType, ErrNotSupported)
+	p, err := l.Project()
+	if err != nil {
+		return err
 	}
-
-	return nil
+	opts, err := l.Secrets.workspaceOptions()
+	if err != nil {
+		return err
+	}
+	s, err := p.InitStack(ctx, l.StackName, l.projectPath, opts...)
+	if err != nil {
+		return err
+	}
+	l.stack = s
+	return l.ensurePlugins(ctx)
 }
 
 // ConfigureStack configure the stack with openstack properties (user, domain,
@@ -202,7 +289,7 @@ func (c *Controller) ConfigureStack(ctx context.Context) error {
 	if c.stack == nil {
 		return fmt.Errorf("stack uninitialized")
 	}
-	err := c.configureOpenstackProps(ctx, c.Config.Props.OpenstackProps)
+	err := c.configureOpenstackProps(ctx, c.Config)
 	if err != nil {
 		return err
 	}
@@ -213,50 +300,137 @@ func (c *Controller) ConfigureStack(ctx context.Context) error {
 	return nil
 }
 
-func (c *Controller) RefreshStack(ctx context.Context) error {
+// SetProgressWriter makes the stack operations stream their progress to w.
+func (c *Controller) SetProgressWriter(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.progress = w
+}
+
+func (c *Controller) PreviewStack(ctx context.Context) (auto.PreviewResult, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.stack == nil {
-		return fmt.Errorf("stack uninitialized")
+		return auto.PreviewResult{}, fmt.Errorf("stack uninitialized")
 	}
-	if err := c.stack.Refresh(ctx); err != nil {
-		return err
+	opts := []optpreview.Option{}
+	if c.progress != nil {
+		opts = append(opts, optpreview.ProgressStreams(c.progress))
 	}
-	return nil
+	rec := c.startRun(RunPreview)
+	opts = append(opts, optpreview.EventStreams(rec.Events()))
+	res, err := c.stack.Preview(ctx, opts...)
+	c.finishRun(rec, err)
+	err = c.lockError(err)
+	return res, err
+}
+
+func (c *Controller) RefreshStack(ctx context.Context) (auto.RefreshResult, error) {
+	return c.RefreshStackSelection(ctx, nil)
 }
 
-func (c *Controller) UpdateStack(ctx context.Context) error {
+// RefreshStackSelection refreshes the resources selected by sel, or all
+// resources if sel is nil.
+func (c *Controller) RefreshStackSelection(ctx context.Context, sel *Selection) (auto.RefreshResult, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.stack == nil {
-		return fmt.Errorf("stack uninitialized")
+		return auto.RefreshResult{}, fmt.Errorf("stack uninitialized")
 	}
-	if res, err := c.stack.Update(ctx); err != nil {
-		return err
-	} else {
-		printStackOutputs(res.Outputs)
+	if sel != nil {
+		return c.refreshSelection(ctx, sel)
 	}
-	return nil
+	opts := []optrefresh.Option{}
+	if c.progress != nil {
+		opts = append(opts, optrefresh.ProgressStreams(c.progress))
+	}
+	prov := c.provenance()
+	c.tagStack(ctx, prov)
+	opts = append(opts, optrefresh.Message(prov.Message(RunRefresh)))
+	rec := c.startRun(RunRefresh)
+	opts = append(opts, optrefresh.EventStreams(rec.Events()))
+	res, err := c.stack.Refresh(ctx, opts...)
+	c.finishRun(rec, err)
+	err = c.lockError(err)
+	return res, err
+}
+
+func (c *Controller) UpdateStack(ctx context.Context) (auto.UpResult, error) {
+	return c.UpdateStackSelection(ctx, nil)
+}
+
+// UpdateStackSelection updates and replaces the resources selected by sel,
+// or updates all resources if sel is nil.
+func (c *Controller) UpdateStackSelection(ctx context.Context, sel *Selection) (auto.UpResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stack == nil {
+		return auto.UpResult{}, fmt.Errorf("stack uninitialized")
+	}
+	if err := c.snapshotState(ctx, "update"); err != nil {
+		return auto.UpResult{}, fmt.Errorf("snapshot state before update: %v", err)
+	}
+	if sel != nil {
+		return c.updateSelection(ctx, sel)
+	}
+	opts := []optup.Option{}
+	if c.progress != nil {
+		opts = append(opts, optup.ProgressStreams(c.progress))
+	}
+	prov := c.provenance()
+	c.tagStack(ctx, prov)
+	opts = append(opts, optup.Message(prov.Message(RunUpdate)))
+	rec := c.startRun(RunUpdate)
+	opts = append(opts, optup.EventStreams(rec.Events()))
+	res, err := c.stack.Update(ctx, opts...)
+	c.finishRun(rec, err)
+	err = c.lockError(err)
+	if err != nil {
+		return res, err
+	}
+	printStackOutputs(res.Outputs)
+	return res, nil
+}
+
+func (c *Controller) DestroyStack(ctx context.Context) (auto.DestroyResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stack == nil {
+		return auto.DestroyResult{}, fmt.Errorf("stack uninitialized")
+	}
+	opts := []optdestroy.Option{}
+	if c.progress != nil {
+		opts = append(opts, optdestroy.ProgressStreams(c.progress))
+	}
+	prov := c.provenance()
+	c.tagStack(ctx, prov)
+	opts = append(opts, optdestroy.Message(prov.Message(RunDestroy)))
+	rec := c.startRun(RunDestroy)
+	opts = append(opts, optdestroy.EventStreams(rec.Events()))
+	res, err := c.stack.Destroy(ctx, opts...)
+	c.finishRun(rec, err)
+	err = c.lockError(err)
+	return res, err
 }
 
 func (c *Controller) GetError() error {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
 	return c.err
 }
 
-func (c *Controller) GetOutputs() (map[string]string, error) {
+func (c *Controller) GetOutputs() (Outputs, error) {
 	ctx, stop := context.WithTimeout(context.Background(), 10*time.Second)
 	defer stop()
 	outputs, err := c.stack.Outputs(ctx)
 	if err != nil {
 		return nil, err
 	}
-	n := make(map[string]string, 0)
-	for k, v := range outputs {
-		if s, ok := v.Value.(string); ok {
-			n[k] = s
-		}
+	p, err := c.Project()
+	if err != nil {
+		return nil, err
 	}
-	return n, nil
+	return p.DecodeOutputs(outputs), nil
 }
 
 func (c *Controller) GetOutput(key string) (string, error) {
@@ -266,86 +440,76 @@ func (c *Controller) GetOutput(key string) (string, error) {
 }
 
 // config openstack
-func (c *Controller) configureOpenstackProps(ctx context.Context, p OpenstackProps) error {
-	if p.Region == "" {
-		return fmt.Errorf("Config.Props.Openstack.Region not set")
-	}
-	if p.Domain == "" {
-		return fmt.Errorf("Config.Props.Openstack.Domain not set")
-	}
-	if p.Tenant == "" {
-		return fmt.Errorf("Config.Props.Openstack.Tenant not set")
-	}
-	osAuthURL := fmt.Sprintf("https://identity-3.%s.cloud.sap/v3", p.Region)
-	osUsername := viper.GetString("os_username")
-	if osUsername == "" {
-		return fmt.Errorf("env variable AUTOMATION_OS_USERNAME not configured")
-	}
-	osPassword := viper.GetString("os_password")
-	if osPassword == "" {
-		return fmt.Errorf("env variable AUTOMATION_OS_PASSWORD not configured")
-	}
-	m := auto.ConfigMap{
-		"openstack:authUrl":           configValue(osAuthURL),
-		"openstack:region":            configValue(p.Region),
-		"openstack:projectDomainName": configValue(p.Domain),
-		"openstack:tenantName":        configValue(p.Tenant),
-		"openstack:userDomainName":    configValue(p.Domain),
-		"openstack:userName":          configValue(osUsername),
-		"openstack:insecure":          configValue("true"),
-		"openstack:password":          configSecret(osPassword),
+func (c *Controller) configureOpenstackProps(ctx context.Context, cfg *Config) error {
+	m, err := openstackConfigOf(cfg, false)
+	if err != nil {
+		return err
 	}
-	return c.stack.SetAllConfig(ctx, m)
-}
-
-// configure stack props
-func (c *Controller) configureStackProps(ctx context.Context, cfg *Config) error {
-	switch v := ProjectType(cfg.ProjectType); v {
-	case ProjectExample:
-	case ProjectEsxi:
-		stackProps := append([]StackProps{cfg.Props.StackProps}, cfg.baseStackProps...)
-		props := make([]esxi.StackProps, len(stackProps))
-		err := UnmarshalStackProps(cfg.Props.StackProps, &props)
-		if err != nil {
-			return err
-		}
-		err = c.stack.(*esxi.Stack).Configure(ctx, props...)
-		if err != nil {
-			return err
-		}
-	case ProjectVCFManagement, ProjectVCFWorkload:
-		stackProps := append([]StackProps{cfg.Props.StackProps}, cfg.baseStackProps...)
-		props := make([]vcf.StackProps, len(stackProps))
-		err := UnmarshalStackPropList(stackProps, &props)
-		if err != nil {
-			return err
+	current, err := c.stack.GetAllConfig(ctx)
+	if err != nil {
+		return err
+	}
+	stale := make([]string, 0)
+	for _, k := range openstackAuthKeys {
+		if _, ok := m[k]; ok {
+			continue
 		}
-		err = c.stack.(*vcf.Stack).Configure(ctx, props...)
-		if err != nil {
-			return err
+		if _, ok := current[k]; ok {
+			stale = append(stale, k)
 		}
-		// config metadata and env variables
-		stackType := strings.Split(string(v), "/")[1]
-		c.configureValue(ctx, "stackType", stackType)
-		if err != nil {
+	}
+	if len(stale) > 0 {
+		if err := c.stack.RemoveAllConfig(ctx, stale); err != nil {
 			return err
 		}
-		password := viper.GetString("vmware_password")
-		c.configureValue(ctx, "vmwarePassword", password)
-		if err != nil {
+	}
+	return c.stack.SetAllConfig(ctx, m)
+}
+
+// configure stack props: the config of the props is set on the stack, then
+// the project type passes the props to the stack, e.g. to an inline program
+func (c *Controller) configureStackProps(ctx context.Context, cfg *Config) error {
+	p, err := cfg.Project()
+	if err != nil {
+		return err
+	}
+	props, err := cfg.DecodeProps()
+	if err != nil {
+		return err
+	}
+	if err := props.Validate(); err != nil {
+		return err
+	}
+	m, err := p.StackConfig(props, false)
+	if err != nil {
+		return err
+	}
+	if len(m) > 0 {
+		if err := c.stack.SetAllConfig(ctx, m); err != nil {
 			return err
 		}
 	}
-	return nil
+	return p.Configure(ctx, c.stack, props)
 }
 
-//
-func (c *Controller) configureValue(ctx context.Context, key, value string) error {
-	return c.stack.SetConfig(ctx, key, auto.ConfigValue{Value: value})
+// Resources returns the resource tree of the latest deployment of the stack
+func (c *Controller) Resources(ctx context.Context) ([]*ResourceNode, error) {
+	d, err := c.Deployment(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ResourceTree(d.Resources), nil
 }
 
 func (c *Controller) PrintStackResources() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	printStackResources(c.StackName)
+	ctx, stop := context.WithTimeout(context.Background(), time.Minute)
+	defer stop()
+	res, err := c.Resources(ctx)
+	if err != nil {
+		log.WithError(err).Error("read stack resources failed")
+		return
+	}
+	printStackResources(res)
 }
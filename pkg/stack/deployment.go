@@ -0,0 +1,137 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/sapcc/vcf-automation/pkg/settings"
+	"github.com/sapcc/vcf-automation/pkg/statecache"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	stateCache     *statecache.Cache
+	stateCacheOnce sync.Once
+)
+
+// openStateCache opens the state cache of the settings once. Without cache,
+// deployments are only cached in memory.
+func openStateCache() *statecache.Cache {
+	stateCacheOnce.Do(func() {
+		u := settings.Get().StateCacheURL
+		c, err := statecache.Open(context.Background(), u)
+		if err != nil {
+			log.WithError(err).Warn("open state cache failed")
+			return
+		}
+		stateCache = c
+	})
+	return stateCache
+}
+
+// Deployment returns the latest deployment of the stack. It is read by
+// exporting the stack, so that it works with any backend, and cached by the
+// version of the latest update in memory and in the state cache. A stack
+// without updates is exported on every call.
+func (c *Controller) Deployment(ctx context.Context) (*apitype.DeploymentV3, error) {
+	if c.stack == nil {
+		return nil, ErrStackNotInitialized
+	}
+	version, err := c.updateVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.deployMu.Lock()
+	defer c.deployMu.Unlock()
+	if version > 0 && c.deployment != nil && c.deploymentVersion == version {
+		return c.deployment, nil
+	}
+	project, stackName := c.GetProjectStackName()
+	logger := log.WithFields(log.Fields{"project": c.ProjectType, "stack": c.StackName, "version": version})
+	cache := openStateCache()
+	var b []byte
+	if version > 0 && cache != nil {
+		cached, ok, err := cache.Get(ctx, project, stackName, version)
+		if err != nil {
+			logger.WithError(err).Warn("read state cache failed")
+		} else if ok {
+			b = cached
+		}
+	}
+	if b == nil {
+		if b, err = c.ExportState(ctx); err != nil {
+			return nil, err
+		}
+		if version > 0 && cache != nil {
+			if err := cache.Put(ctx, project, stackName, version, b); err != nil {
+				logger.WithError(err).Warn("write state cache failed")
+			}
+		}
+	}
+	d, err := parseDeploymentV3(b)
+	if err != nil {
+		return nil, err
+	}
+	c.deployment, c.deploymentVersion = d, version
+	return d, nil
+}
+
+// dropDeployment removes the cached deployments of the stack, after its
+// state was replaced without a new update version
+func (c *Controller) dropDeployment(ctx context.Context) {
+	c.deployMu.Lock()
+	defer c.deployMu.Unlock()
+	c.deployment = nil
+	if cache := openStateCache(); cache != nil {
+		project, stackName := c.GetProjectStackName()
+		if err := cache.Drop(ctx, project, stackName); err != nil {
+			log.WithError(err).Warn("drop state cache failed")
+		}
+	}
+}
+
+// updateVersion returns the version of the latest update of the stack, 0 if
+// there is none
+func (c *Controller) updateVersion(ctx context.Context) (int, error) {
+	h, err := c.stack.History(ctx, 1, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(h) == 0 {
+		return 0, nil
+	}
+	return h[0].Version, nil
+}
+
+func parseDeploymentV3(b []byte) (*apitype.DeploymentV3, error) {
+	u, err := parseDeployment(b)
+	if err != nil {
+		return nil, err
+	}
+	d := &apitype.DeploymentV3{}
+	if err := json.Unmarshal(u.Deployment, d); err != nil {
+		return nil, fmt.Errorf("state: %v", err)
+	}
+	return d, nil
+}
@@ -0,0 +1,90 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"reflect"
+	"sort"
+)
+
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// ConfigChange is the change of a single value between two configs
+type ConfigChange struct {
+	Path string      `json:"path" yaml:"path"`
+	Kind string      `json:"kind" yaml:"kind"`
+	Old  interface{} `json:"old,omitempty" yaml:"old,omitempty"`
+	New  interface{} `json:"new,omitempty" yaml:"new,omitempty"`
+}
+
+// DiffConfig compares two effective configs value by value and returns the
+// changes sorted by path.
+func DiffConfig(old, new map[string]interface{}) []ConfigChange {
+	o := make(map[string]interface{})
+	n := make(map[string]interface{})
+	flatten(normalize(old), "", o)
+	flatten(normalize(new), "", n)
+	changes := make([]ConfigChange, 0)
+	for p, ov := range o {
+		nv, ok := n[p]
+		switch {
+		case !ok:
+			changes = append(changes, ConfigChange{Path: p, Kind: ChangeRemoved, Old: ov})
+		case !reflect.DeepEqual(ov, nv):
+			changes = append(changes, ConfigChange{Path: p, Kind: ChangeChanged, Old: ov, New: nv})
+		}
+	}
+	for p, nv := range n {
+		if _, ok := o[p]; !ok {
+			changes = append(changes, ConfigChange{Path: p, Kind: ChangeAdded, New: nv})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// flatten stores all leaf values of v into m, keyed by their path
+func flatten(v interface{}, path string, m map[string]interface{}) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 0 && path != "" {
+			m[path] = t
+		}
+		for k, vv := range t {
+			flatten(vv, joinPath(path, k), m)
+		}
+	case []interface{}:
+		if len(t) == 0 {
+			m[path] = t
+		}
+		for i, vv := range t {
+			flatten(vv, indexPath(path, i), m)
+		}
+	case int:
+		// configs decoded from json hold float64 numbers, configs decoded from
+		// yaml hold int numbers
+		m[path] = float64(t)
+	default:
+		m[path] = v
+	}
+}
@@ -0,0 +1,70 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	old := map[string]interface{}{
+		"stack": "s1",
+		"props": map[interface{}]interface{}{
+			"openstack": map[string]interface{}{"region": "qa-de-1", "tenant": "a"},
+			"stack": map[string]interface{}{
+				"nodes": []interface{}{
+					map[string]interface{}{"name": "n01", "cpus": 8},
+					map[string]interface{}{"name": "n02", "cpus": 8},
+				},
+				"shares": []interface{}{},
+				"size":   10,
+			},
+		},
+	}
+	new := map[string]interface{}{
+		"stack": "s1",
+		"props": map[string]interface{}{
+			"openstack": map[string]interface{}{"region": "qa-de-2", "domain": "d"},
+			"stack": map[string]interface{}{
+				"nodes": []interface{}{
+					map[string]interface{}{"name": "n01", "cpus": float64(8)},
+				},
+				"shares": []interface{}{"s"},
+				// yaml decodes ints, json floats; equal numbers are no change
+				"size": float64(10),
+			},
+		},
+	}
+	want := []ConfigChange{
+		{Path: "props.openstack.domain", Kind: ChangeAdded, New: "d"},
+		{Path: "props.openstack.region", Kind: ChangeChanged, Old: "qa-de-1", New: "qa-de-2"},
+		{Path: "props.openstack.tenant", Kind: ChangeRemoved, Old: "a"},
+		{Path: "props.stack.nodes[1].cpus", Kind: ChangeRemoved, Old: float64(8)},
+		{Path: "props.stack.nodes[1].name", Kind: ChangeRemoved, Old: "n02"},
+		{Path: "props.stack.shares", Kind: ChangeRemoved, Old: []interface{}{}},
+		{Path: "props.stack.shares[0]", Kind: ChangeAdded, New: "s"},
+	}
+	if got := DiffConfig(old, new); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+	if got := DiffConfig(old, old); len(got) != 0 {
+		t.Errorf("diff of the same config = %+v; want none", got)
+	}
+}
@@ -27,3 +27,7 @@ var ErrNodeExists = errors.New("node exists")
 var ErrStackNotInitialized = errors.New("stack not initialized")
 var ErrBackendURLNotSet = errors.New("env variable PULUMI_BACKEND_URL not set")
 var ErrBadFormat = errors.New("bad format")
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+var ErrNotLocked = errors.New("not locked")
+var ErrLockInUse = errors.New("lock in use")
+var ErrStackNotStopped = errors.New("stack not stopped")
@@ -20,16 +20,36 @@ package esxi
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"net"
+	"sync"
 
-	"github.com/imdario/mergo"
 	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optrefresh"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
 )
 
+// ProjectName is the name of the pulumi project in Pulumi.yaml
+const ProjectName = "esxi"
+
+// legacyConfigKeys were set on the stack before the props were passed to the
+// inline program; they are removed when the stack is configured
+var legacyConfigKeys = []string{"resourcePrefix", "nodeSubnet", "storageSubnet", "shareNetworkUUID", "nodes", "shares"}
+
+// MergeKeys are the fields by which list items of StackProps are matched
+// when a config merges a list into the configs it extends with the strategy
+// merge.
+var MergeKeys = map[string]string{
+	"nodes":  "name",
+	"shares": "name",
+}
+
 type Stack struct {
 	*auto.Stack
 	state StackState
+	props StackProps
+	mu    sync.Mutex
 }
 
 type StackState struct {
@@ -63,62 +83,91 @@ type Share struct {
 	Size int    `yaml:"size"`
 }
 
-func InitEsxiStack(ctx context.Context, stackName, projectDir string) (*Stack, error) {
-	s, err := auto.UpsertStackLocalSource(ctx, stackName, projectDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create or select stack: %v", err)
-	}
-	return &Stack{&s, StackState{}}, nil
-}
-
-// Config Esxi Project specific properties
-func (s *Stack) Configure(ctx context.Context, props ...StackProps) error {
-	p := props[0]
-	for _, q := range props[1:] {
-		mergo.Merge(&p, q)
-	}
+// Validate checks that the props hold the settings required by the esxi
+// program and that addresses are well-formed.
+func (p StackProps) Validate() error {
 	if p.NodeSubnet == "" {
 		return fmt.Errorf("Config.Props.Stack.NodeSubnet not set")
 	}
 	if p.StorageSubnet == "" {
 		return fmt.Errorf("Config.Props.Stack.StorageSubnet not set")
 	}
+	if _, _, err := net.ParseCIDR(p.NodeSubnet); err != nil {
+		return fmt.Errorf("Config.Props.Stack.NodeSubnet: %v", err)
+	}
+	if _, _, err := net.ParseCIDR(p.StorageSubnet); err != nil {
+		return fmt.Errorf("Config.Props.Stack.StorageSubnet: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, n := range p.Nodes {
+		if n.Name == "" {
+			return fmt.Errorf("Config.Props.Stack.Nodes: node without name")
+		}
+		if names[n.Name] {
+			return fmt.Errorf("Config.Props.Stack.Nodes: duplicate node %s", n.Name)
+		}
+		names[n.Name] = true
+		if n.IP != "" && net.ParseIP(n.IP) == nil {
+			return fmt.Errorf("Config.Props.Stack.Nodes.%s.IP: invalid ip address %q", n.Name, n.IP)
+		}
+	}
+	return nil
+}
 
-	// set project settings
-	s.SetConfig(ctx, "resourcePrefix", auto.ConfigValue{Value: p.Prefix})
-	s.SetConfig(ctx, "nodeSubnet", auto.ConfigValue{Value: p.NodeSubnet})
-	s.SetConfig(ctx, "storageSubnet", auto.ConfigValue{Value: p.StorageSubnet})
-	s.SetConfig(ctx, "shareNetworkUUID", auto.ConfigValue{Value: p.ShareNetworkName})
-	nodes, err := json.Marshal(p.Nodes)
+// InitEsxiStack creates or selects the stack of the esxi program, which is
+// built into the binary. The project directory holds Pulumi.yaml and the
+// stack settings.
+func InitEsxiStack(ctx context.Context, stackName, projectDir string, opts ...auto.LocalWorkspaceOption) (*Stack, error) {
+	s := &Stack{}
+	opts = append([]auto.LocalWorkspaceOption{auto.WorkDir(projectDir)}, opts...)
+	st, err := auto.UpsertStackInlineSource(ctx, stackName, ProjectName, s.program, opts...)
 	if err != nil {
+		return nil, fmt.Errorf("failed to create or select stack: %v", err)
+	}
+	s.Stack = &st
+	return s, nil
+}
+
+// Configure passes the esxi project specific properties to the program
+func (s *Stack) Configure(ctx context.Context, p StackProps) error {
+	if err := p.Validate(); err != nil {
 		return err
 	}
-	s.SetConfig(ctx, "nodes", auto.ConfigValue{Value: string(nodes)})
-	shares, err := json.Marshal(p.Shares)
+	s.mu.Lock()
+	s.props = p
+	s.mu.Unlock()
+	current, err := s.GetAllConfig(ctx)
 	if err != nil {
 		return err
 	}
-	s.SetConfig(ctx, "shares", auto.ConfigValue{Value: string(shares)})
-
-	return nil
+	stale := make([]string, 0)
+	for _, k := range legacyConfigKeys {
+		if _, ok := current[ProjectName+":"+k]; ok {
+			stale = append(stale, k)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	return s.RemoveAllConfig(ctx, stale)
 }
 
 func (s *Stack) UpdateConfig(ctx context.Context, payload *StackProps) error {
 	return nil
 }
 
-func (s *Stack) Refresh(ctx context.Context) error {
-	_, err := s.Stack.Refresh(ctx)
+func (s *Stack) Refresh(ctx context.Context, opts ...optrefresh.Option) (auto.RefreshResult, error) {
+	res, err := s.Stack.Refresh(ctx, opts...)
 	if err != nil {
 		s.state.refreshError = err
-		return err
+		return auto.RefreshResult{}, err
 	}
 	// printUpdateSummary(res.Summary)
-	return nil
+	return res, nil
 }
 
-func (s *Stack) Update(ctx context.Context) (auto.UpResult, error) {
-	res, err := s.Stack.Up(ctx)
+func (s *Stack) Update(ctx context.Context, opts ...optup.Option) (auto.UpResult, error) {
+	res, err := s.Stack.Up(ctx, opts...)
 	if err != nil {
 		s.state.err = err
 		return auto.UpResult{}, err
@@ -126,14 +175,13 @@ func (s *Stack) Update(ctx context.Context) (auto.UpResult, error) {
 	return res, nil
 }
 
-func (s *Stack) Destroy(ctx context.Context) error {
-	res, err := s.Stack.Destroy(ctx)
+func (s *Stack) Destroy(ctx context.Context, opts ...optdestroy.Option) (auto.DestroyResult, error) {
+	res, err := s.Stack.Destroy(ctx, opts...)
 	if err != nil {
 		s.state.err = err
-		return err
+		return auto.DestroyResult{}, err
 	}
-	fmt.Println(res)
-	return nil
+	return res, nil
 }
 
 func (s *Stack) GetState() interface{} {
@@ -0,0 +1,57 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package esxi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStackPropsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(p *StackProps)
+		err    string
+	}{
+		{"valid", func(p *StackProps) {}, ""},
+		{"no node subnet", func(p *StackProps) { p.NodeSubnet = "" }, "NodeSubnet not set"},
+		{"no storage subnet", func(p *StackProps) { p.StorageSubnet = "" }, "StorageSubnet not set"},
+		{"invalid node subnet", func(p *StackProps) { p.NodeSubnet = "10.0.0.1" }, "NodeSubnet:"},
+		{"invalid storage subnet", func(p *StackProps) { p.StorageSubnet = "storage" }, "StorageSubnet:"},
+		{"node without ip", func(p *StackProps) { p.Nodes[1].IP = "" }, ""},
+		{"invalid node ip", func(p *StackProps) { p.Nodes[1].IP = "10.0.0" }, "Nodes.n02.IP: invalid ip address"},
+		{"node without name", func(p *StackProps) { p.Nodes[0].Name = "" }, "node without name"},
+		{"duplicate node", func(p *StackProps) { p.Nodes[1].Name = "n01" }, "duplicate node n01"},
+	}
+	for _, tt := range tests {
+		p := StackProps{
+			NodeSubnet:    "10.0.0.0/24",
+			StorageSubnet: "10.0.1.0/24",
+			Nodes:         []Node{{Name: "n01", IP: "10.0.0.11"}, {Name: "n02", IP: "10.0.0.12"}},
+		}
+		tt.modify(&p)
+		err := p.Validate()
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: err = %v; want %q", tt.name, err, tt.err)
+		}
+	}
+}
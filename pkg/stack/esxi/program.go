@@ -16,17 +16,15 @@
 *
 ******************************************************************************/
 
-package main
+package esxi
 
 import (
-	"encoding/json"
 	"fmt"
 
 	"github.com/pulumi/pulumi-openstack/sdk/v3/go/openstack/compute"
 	"github.com/pulumi/pulumi-openstack/sdk/v3/go/openstack/networking"
 	"github.com/pulumi/pulumi-openstack/sdk/v3/go/openstack/sharedfilesystem"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
-	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
 )
 
 type Network struct {
@@ -34,61 +32,32 @@ type Network struct {
 	Subnet  *networking.Subnet
 }
 
-type EsxiInstance struct {
-	Instance *compute.Instance
-	SecGroup *compute.SecGroup
+// program is the pulumi program of the esxi project. It runs inline, with the
+// props set by Configure.
+func (s *Stack) program(ctx *pulumi.Context) error {
+	s.mu.Lock()
+	p := s.props
+	s.mu.Unlock()
+	return newEsxiStack(ctx, p)
 }
 
-type NodeProps struct {
-	ID     int    `json:"id"`
-	Image  string `json:"image"`
-	Flavor string `json:"flavor"`
-	UUID   string `json:"uuid"`
-	IP     string `json:"ip"`
-}
-
-type ShareProps struct {
-	Name string `json:"name"`
-	Size int    `json:"size"`
-}
-
-func newEsxiStack(ctx *pulumi.Context) error {
-	// Read stack configuration
-	conf := config.New(ctx, "")
-	prefix := conf.Get("resourcePrefix")
-	nodeSubent := conf.Get("nodeSubnet")
-	storageSubnet := conf.Get("storageSubnet")
-
-	nodePropsStr := conf.Get("nodes")
-	nodeProps := make([]NodeProps, 0)
-	err := json.Unmarshal([]byte(nodePropsStr), &nodeProps)
-	if err != nil {
-		return err
-	}
-
-	sharePropsStr := conf.Get("shares")
-	shareProps := make([]ShareProps, 0)
-	err = json.Unmarshal([]byte(sharePropsStr), &shareProps)
-	if err != nil {
-		return err
-	}
-
+func newEsxiStack(ctx *pulumi.Context, p StackProps) error {
 	// Create Instance
-	esxiNetwork, err := newEsxiNetwork(ctx, prefix, nodeSubent)
+	esxiNetwork, err := newEsxiNetwork(ctx, p.Prefix, p.NodeSubnet)
 	if err != nil {
 		return err
 	}
-	sg, err := newEsxiSecGroup(ctx, prefix)
+	sg, err := newEsxiSecGroup(ctx, p.Prefix)
 	if err != nil {
 		return err
 	}
 	nodes := make([]*compute.Instance, 0)
-	for _, np := range nodeProps {
-		port, err := newEsxiPort(ctx, prefix, &np, esxiNetwork, sg)
+	for i := range p.Nodes {
+		port, err := newEsxiPort(ctx, p.Prefix, i, &p.Nodes[i], esxiNetwork, sg)
 		if err != nil {
 			return err
 		}
-		instance, err := newComputeInstance(ctx, prefix, &np, port)
+		instance, err := newComputeInstance(ctx, p.Prefix, i, &p.Nodes[i], port)
 		if err != nil {
 			return err
 		}
@@ -96,17 +65,17 @@ func newEsxiStack(ctx *pulumi.Context) error {
 	}
 
 	// Create NFS Shares
-	storageNetwork, err := newStroageNetwork(ctx, prefix, storageSubnet)
+	storageNetwork, err := newStroageNetwork(ctx, p.Prefix, p.StorageSubnet)
 	if err != nil {
 		return err
 	}
-	shareNetwork, err := newShareNetwork(ctx, prefix, storageNetwork)
+	shareNetwork, err := newShareNetwork(ctx, p.Prefix, storageNetwork)
 	if err != nil {
 		return err
 	}
 	shares := make([]*sharedfilesystem.Share, 0)
-	for _, s := range shareProps {
-		nfs, err := newNFSShare(ctx, prefix, &s, shareNetwork)
+	for i := range p.Shares {
+		nfs, err := newNFSShare(ctx, p.Prefix, &p.Shares[i], shareNetwork)
 		if err != nil {
 			return err
 		}
@@ -204,8 +173,21 @@ func newEsxiSecGroup(ctx *pulumi.Context, prefix string) (*compute.SecGroup, err
 	})
 }
 
-func newEsxiPort(ctx *pulumi.Context, prefix string, node *NodeProps, n *Network, sg *compute.SecGroup) (*networking.Port, error) {
-	name := fmt.Sprintf("%s-port-%d", prefix, node.ID)
+// legacyAlias returns the alias of the resource of the first node to its
+// name in the former esxi program, which named the resources by the node id.
+// The id was never configured, so existing stacks have a single node with
+// id 0.
+func legacyAlias(i int, format, prefix string) []pulumi.ResourceOption {
+	if i != 0 {
+		return nil
+	}
+	return []pulumi.ResourceOption{
+		pulumi.Aliases([]pulumi.Alias{{Name: pulumi.String(fmt.Sprintf(format, prefix, 0))}}),
+	}
+}
+
+func newEsxiPort(ctx *pulumi.Context, prefix string, i int, node *Node, n *Network, sg *compute.SecGroup) (*networking.Port, error) {
+	name := fmt.Sprintf("%s-port-%s", prefix, node.Name)
 	return networking.NewPort(ctx, name, &networking.PortArgs{
 		AdminStateUp: pulumi.Bool(true),
 		NetworkId:    n.Network.ID(),
@@ -218,11 +200,11 @@ func newEsxiPort(ctx *pulumi.Context, prefix string, node *NodeProps, n *Network
 		SecurityGroupIds: pulumi.StringArray{
 			sg.ID(),
 		},
-	})
+	}, legacyAlias(i, "%s-port-%d", prefix)...)
 }
 
-func newComputeInstance(ctx *pulumi.Context, prefix string, node *NodeProps, port *networking.Port) (*compute.Instance, error) {
-	name := fmt.Sprintf("%s-instance-%d", prefix, node.ID)
+func newComputeInstance(ctx *pulumi.Context, prefix string, i int, node *Node, port *networking.Port) (*compute.Instance, error) {
+	name := fmt.Sprintf("%s-instance-%s", prefix, node.Name)
 	return compute.NewInstance(ctx, name, &compute.InstanceArgs{
 		FlavorName: pulumi.String(node.Flavor),
 		ImageName:  pulumi.String(node.Image),
@@ -231,22 +213,9 @@ func newComputeInstance(ctx *pulumi.Context, prefix string, node *NodeProps, por
 				Port: port.ID(),
 			},
 		},
-	})
+	}, legacyAlias(i, "%s-instance-%d", prefix)...)
 }
 
-func newEsxiInstance(ctx *pulumi.Context, prefix string, node *NodeProps, port *networking.Port) (*compute.Instance, error) {
-	name := fmt.Sprintf("%s-esxi-instance", prefix)
-	return compute.NewInstance(ctx, name, &compute.InstanceArgs{
-		FlavorName:            pulumi.String(node.Flavor),
-		ImageName:             pulumi.String(node.Image),
-		AvailabilityZoneHints: pulumi.String(fmt.Sprintf("::%s", node.UUID)),
-		Networks: compute.InstanceNetworkArray{
-			&compute.InstanceNetworkArgs{
-				Port: port.ID(),
-			},
-		},
-	})
-}
 func newShareNetwork(ctx *pulumi.Context, prefix string, n *Network) (*sharedfilesystem.ShareNetwork, error) {
 	name := fmt.Sprintf("%s-share-network", prefix)
 	return sharedfilesystem.NewShareNetwork(ctx, name, &sharedfilesystem.ShareNetworkArgs{
@@ -255,7 +224,7 @@ func newShareNetwork(ctx *pulumi.Context, prefix string, n *Network) (*sharedfil
 	})
 }
 
-func newNFSShare(ctx *pulumi.Context, prefix string, p *ShareProps, sn *sharedfilesystem.ShareNetwork) (*sharedfilesystem.Share, error) {
+func newNFSShare(ctx *pulumi.Context, prefix string, p *Share, sn *sharedfilesystem.ShareNetwork) (*sharedfilesystem.Share, error) {
 	shareName := fmt.Sprintf("%s-%s", prefix, p.Name)
 	return sharedfilesystem.NewShare(ctx, shareName, &sharedfilesystem.ShareArgs{
 		Description:    pulumi.String("test share description"),
@@ -0,0 +1,106 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	pbempty "github.com/golang/protobuf/ptypes/empty"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/rpcutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	pulumirpc "github.com/pulumi/pulumi/sdk/v3/proto/go"
+	"google.golang.org/grpc"
+)
+
+// inlineServer serves an inline program as the language runtime of a Pulumi
+// CLI run with --client, like the automation api does for its operations.
+type inlineServer struct {
+	program pulumi.RunFunc
+	address string
+	cancel  chan bool
+	done    chan error
+	// running is held while the program runs
+	running sync.Mutex
+}
+
+// startInlineServer starts serving program on a local port
+func startInlineServer(program pulumi.RunFunc) (*inlineServer, error) {
+	s := &inlineServer{program: program, cancel: make(chan bool)}
+	port, done, err := rpcutil.Serve(0, s.cancel, []func(*grpc.Server) error{
+		func(srv *grpc.Server) error {
+			pulumirpc.RegisterLanguageRuntimeServer(srv, s)
+			return nil
+		},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.address, s.done = fmt.Sprintf("127.0.0.1:%d", port), done
+	return s, nil
+}
+
+// Close waits for a running program and stops the server
+func (s *inlineServer) Close() error {
+	s.running.Lock()
+	defer s.running.Unlock()
+	s.cancel <- true
+	close(s.cancel)
+	return <-s.done
+}
+
+func (s *inlineServer) GetRequiredPlugins(ctx context.Context, req *pulumirpc.GetRequiredPluginsRequest) (*pulumirpc.GetRequiredPluginsResponse, error) {
+	return &pulumirpc.GetRequiredPluginsResponse{}, nil
+}
+
+func (s *inlineServer) Run(ctx context.Context, req *pulumirpc.RunRequest) (res *pulumirpc.RunResponse, err error) {
+	s.running.Lock()
+	defer s.running.Unlock()
+	var engineAddress string
+	if len(req.Args) > 0 {
+		engineAddress = req.Args[0]
+	}
+	pctx, err := pulumi.NewContext(ctx, pulumi.RunInfo{
+		EngineAddr:  engineAddress,
+		MonitorAddr: req.GetMonitorAddress(),
+		Config:      req.GetConfig(),
+		Project:     req.GetProject(),
+		Stack:       req.GetStack(),
+		Parallel:    int(req.GetParallel()),
+		DryRun:      req.GetDryRun(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			res = &pulumirpc.RunResponse{Error: fmt.Sprintf("inline program panicked: %v", r)}
+			err = nil
+		}
+	}()
+	if err := pulumi.RunWithContext(pctx, s.program); err != nil {
+		return &pulumirpc.RunResponse{Error: err.Error()}, nil
+	}
+	return &pulumirpc.RunResponse{}, nil
+}
+
+func (s *inlineServer) GetPluginInfo(ctx context.Context, req *pbempty.Empty) (*pulumirpc.PluginInfo, error) {
+	return &pulumirpc.PluginInfo{Version: "1.0.0"}, nil
+}
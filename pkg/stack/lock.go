@@ -0,0 +1,324 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LockHolder is the process holding a lock of a stack, as recorded in the
+// lock file of the Pulumi backend
+type LockHolder struct {
+	Lock  string    `json:"lock"`
+	User  string    `json:"user"`
+	Host  string    `json:"host"`
+	Pid   int       `json:"pid"`
+	Since time.Time `json:"since"`
+}
+
+func (h LockHolder) String() string {
+	return fmt.Sprintf("%s@%s (pid %d) since %s", h.User, h.Host, h.Pid, h.Since.Format(time.RFC3339))
+}
+
+// LockError is the error of a stack operation refused by the backend since
+// the stack is locked, most likely by an operation which was killed
+type LockError struct {
+	Stack   string       `json:"stack"`
+	Holders []LockHolder `json:"holders"`
+	err     error
+}
+
+func (e *LockError) Error() string {
+	holders := make([]string, 0, len(e.Holders))
+	for _, h := range e.Holders {
+		holders = append(holders, h.String())
+	}
+	if len(holders) == 0 {
+		holders = append(holders, "unknown holder")
+	}
+	return fmt.Sprintf("stack %s is locked by %s", e.Stack, strings.Join(holders, ", "))
+}
+
+func (e *LockError) Unwrap() error {
+	return e.err
+}
+
+// lockHolderRe matches the lines "<lock url>: created by <user>@<host> (pid
+// <pid>) at <time>" of the lock error of the Pulumi file backend
+var lockHolderRe = regexp.MustCompile(`(?m)^\s*(\S+): created by (.*)@(\S+) \(pid (\d+)\) at (\S+)\s*$`)
+
+// lockError returns err as LockError if the stack operation failed since the
+// stack is locked, err otherwise
+func (c *Controller) lockError(err error) error {
+	if err == nil || !strings.Contains(err.Error(), "the stack is currently locked") {
+		return err
+	}
+	lerr := &LockError{Stack: c.StackName, Holders: make([]LockHolder, 0), err: err}
+	for _, m := range lockHolderRe.FindAllStringSubmatch(err.Error(), -1) {
+		h := LockHolder{Lock: m[1], User: m[2], Host: m[3]}
+		h.Pid, _ = strconv.Atoi(m[4])
+		h.Since, _ = time.Parse(time.RFC3339, m[5])
+		lerr.Holders = append(lerr.Holders, h)
+	}
+	return lerr
+}
+
+// lockFile is the content of a lock file of the Pulumi file backend
+type lockFile struct {
+	Pid       int       `json:"pid"`
+	Username  string    `json:"username"`
+	Hostname  string    `json:"hostname"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// fileBackendDir returns the directory of the Pulumi file backend, "" for
+// other backends
+func fileBackendDir() string {
+	u, err := url.Parse(os.Getenv("PULUMI_BACKEND_URL"))
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return u.Host + u.Path
+	}
+	return u.Path
+}
+
+// Locks returns the holders of the locks of the stack. The lock files are
+// read from the file backend; for other backends the holders of the last
+// lock error are returned.
+func (c *Controller) Locks() ([]LockHolder, error) {
+	return c.locks(c.GetError())
+}
+
+// locks returns the holders of the locks of the stack, with lastErr the
+// error of the last run of the controller loop
+func (c *Controller) locks(lastErr error) ([]LockHolder, error) {
+	dir := fileBackendDir()
+	if dir == "" {
+		lerr := &LockError{}
+		if errors.As(lastErr, &lerr) {
+			return lerr.Holders, nil
+		}
+		return []LockHolder{}, nil
+	}
+	dir = filepath.Join(dir, ".pulumi", "locks", c.StackName)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []LockHolder{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	holders := make([]LockHolder, 0)
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		p := filepath.Join(dir, f.Name())
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		l := lockFile{}
+		if err := json.Unmarshal(b, &l); err != nil {
+			return nil, fmt.Errorf("lock %s: %v", p, err)
+		}
+		holders = append(holders, LockHolder{Lock: p, User: l.Username, Host: l.Hostname, Pid: l.Pid, Since: l.Timestamp})
+	}
+	sort.Slice(holders, func(i, j int) bool { return holders[i].Since.Before(holders[j].Since) })
+	return holders, nil
+}
+
+// UnlockOptions are the options of Unlock. Force skips the checks that the
+// lock is stale. Trigger is the trigger of the refresh.
+type UnlockOptions struct {
+	Refresh bool
+	Force   bool
+	Trigger Trigger
+}
+
+// Unlock is the result of Unlock
+type Unlock struct {
+	Stack     string         `json:"stack"`
+	Removed   []LockHolder   `json:"removed"`
+	Refreshed bool           `json:"refreshed"`
+	Changes   map[string]int `json:"changes,omitempty"`
+}
+
+// Unlock cancels the operation holding the stale lock of the stack, and
+// refreshes the stack afterwards with opts.Refresh. The lock is stale if its
+// holder is a process of this host which is gone, and no other automation
+// replica is running. An error wrapping ErrLockInUse is returned if the
+// lock might not be stale.
+func (c *Controller) Unlock(ctx context.Context, opts UnlockOptions) (*Unlock, error) {
+	logger := log.WithFields(log.Fields{
+		"package": "stack",
+		"project": c.ProjectType,
+		"stack":   c.StackName,
+	})
+	// refuse early instead of waiting for the running operation; the state
+	// is checked again while holding the locks
+	state, _ := c.State()
+	if err := c.checkUnlockState(state); err != nil {
+		return nil, err
+	}
+	res, err := c.unlock(ctx, opts.Force)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range res.Removed {
+		logger.Warnf("removed lock of %s", h)
+	}
+	if !opts.Refresh {
+		return res, nil
+	}
+	c.SetTrigger(opts.Trigger)
+	r, err := c.RefreshStack(ctx)
+	if err != nil {
+		return res, fmt.Errorf("refresh after unlock: %v", err)
+	}
+	res.Refreshed = true
+	if r.Summary.ResourceChanges != nil {
+		res.Changes = *r.Summary.ResourceChanges
+	}
+	return res, nil
+}
+
+// unlock cancels the operation holding the lock. mu, taken by the stack
+// operations, and stateMu, taken by the controller loop to change its state,
+// are held from the state check to clearing the lock error, so that neither
+// an operation nor the loop runs meanwhile.
+func (c *Controller) unlock(ctx context.Context, force bool) (*Unlock, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.stack == nil {
+		return nil, ErrStackNotInitialized
+	}
+	if err := c.checkUnlockState(c.state); err != nil {
+		return nil, err
+	}
+	holders, err := c.locks(c.err)
+	if err != nil {
+		return nil, err
+	}
+	if len(holders) == 0 {
+		return nil, fmt.Errorf("stack %s: %w", c.StackName, ErrNotLocked)
+	}
+	if !force {
+		if err := checkStaleLocks(holders); err != nil {
+			return nil, fmt.Errorf("stack %s: %w", c.StackName, err)
+		}
+	}
+
+	ws := c.stack.Workspace()
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "pulumi", "cancel", "--yes", "--stack", c.StackName, "--non-interactive")
+	cmd.Dir = ws.WorkDir()
+	cmd.Env = workspaceEnv(ws)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("cancel: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if fileBackendDir() != "" {
+		left, err := c.locks(c.err)
+		if err != nil {
+			return nil, err
+		}
+		if len(left) > 0 {
+			return nil, fmt.Errorf("stack %s is still locked by %s", c.StackName, left[0])
+		}
+	}
+	lerr := &LockError{}
+	if errors.As(c.err, &lerr) {
+		c.err = nil
+	}
+	return &Unlock{Stack: c.StackName, Removed: holders}, nil
+}
+
+// checkUnlockState returns an error wrapping ErrLockInUse if the controller
+// loop is in state running an operation
+func (c *Controller) checkUnlockState(state string) error {
+	switch state {
+	case StateInitializing, StateConfiguring, StateRefreshing, StateUpdating:
+		return fmt.Errorf("stack %s is %s: %w", c.StackName, strings.ToLower(state), ErrLockInUse)
+	}
+	return nil
+}
+
+// checkStaleLocks returns an error wrapping ErrLockInUse if a lock might be
+// held by a running operation: its holder is a process of this host which is
+// still running, or another automation replica is running. Replicas can only
+// be verified for the file backend.
+func checkStaleLocks(holders []LockHolder) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	for _, h := range holders {
+		if h.Host == host && processRunning(h.Pid) {
+			return fmt.Errorf("locked by running process %d of this host: %w", h.Pid, ErrLockInUse)
+		}
+	}
+	if fileBackendDir() == "" {
+		return fmt.Errorf("replicas can't be verified for backend %s: %w", os.Getenv("PULUMI_BACKEND_URL"), ErrLockInUse)
+	}
+	replicas, err := Replicas()
+	if err != nil {
+		return err
+	}
+	self := selfReplica()
+	for _, r := range replicas {
+		if r.Host != self.Host || r.Pid != self.Pid {
+			return fmt.Errorf("automation replica %s (pid %d) is running, seen %s: %w",
+				r.Host, r.Pid, r.Seen.Format(time.RFC3339), ErrLockInUse)
+		}
+	}
+	return nil
+}
+
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// EPERM: the process runs as another user
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
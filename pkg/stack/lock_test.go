@@ -0,0 +1,306 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lockMessage is the error of a Pulumi run refused by the file backend, as
+// returned by the automation api
+const lockMessage = "failed to run update: exit status 255\ncode: 255\nstdout: \n" +
+	"stderr: error: the stack is currently locked by 2 lock(s). Either wait for the other " +
+	"process(es) to end or manually delete the lock file(s).\n" +
+	"  file:///var/lib/automation/.pulumi/locks/m1/0c5b1e52-8a5e-4c5d-9c1e-5a7e8d1c2b3a.json: created by root@automation-7d9f (pid 4711) at 2021-06-01T10:00:00Z\n" +
+	"  file:///var/lib/automation/.pulumi/locks/m1/a7f3c2d1-0b4e-4f6a-8d2c-1e9b7a6c5d4f.json: created by DOMAIN\\j.doe@laptop.corp (pid 42) at 2021-06-01T12:30:00+02:00\n"
+
+func TestLockError(t *testing.T) {
+	c := &Controller{Config: &Config{StackName: "m1"}}
+	since := func(s string) time.Time {
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	tests := []struct {
+		name    string
+		err     error
+		holders []LockHolder
+	}{
+		{"no error", nil, nil},
+		{"other error", errors.New("failed to run update: exit status 1"), nil},
+		{
+			name: "file backend",
+			err:  errors.New(lockMessage),
+			holders: []LockHolder{
+				{
+					Lock: "file:///var/lib/automation/.pulumi/locks/m1/0c5b1e52-8a5e-4c5d-9c1e-5a7e8d1c2b3a.json",
+					User: "root", Host: "automation-7d9f", Pid: 4711, Since: since("2021-06-01T10:00:00Z"),
+				},
+				{
+					Lock: "file:///var/lib/automation/.pulumi/locks/m1/a7f3c2d1-0b4e-4f6a-8d2c-1e9b7a6c5d4f.json",
+					User: `DOMAIN\j.doe`, Host: "laptop.corp", Pid: 42, Since: since("2021-06-01T12:30:00+02:00"),
+				},
+			},
+		},
+		{
+			// the lock error of a selected run, see runSelection
+			name: "selection",
+			err: fmt.Errorf("update: exit status 255: %s", "error: the stack is currently locked by 1 lock(s). "+
+				"Either wait for the other process(es) to end or manually delete the lock file(s).\n"+
+				"  file:///tmp/be/.pulumi/locks/m1/0c5b1e52.json: created by root@host (pid 1) at 2021-06-01T10:00:00Z"),
+			holders: []LockHolder{
+				{Lock: "file:///tmp/be/.pulumi/locks/m1/0c5b1e52.json", User: "root", Host: "host", Pid: 1, Since: since("2021-06-01T10:00:00Z")},
+			},
+		},
+		{
+			// other backends do not report the holders
+			name:    "other backend",
+			err:     errors.New("error: the stack is currently locked by 1 lock(s)"),
+			holders: []LockHolder{},
+		},
+	}
+	for _, tt := range tests {
+		err := c.lockError(tt.err)
+		lerr := &LockError{}
+		if !errors.As(err, &lerr) {
+			if tt.holders != nil || err != tt.err {
+				t.Errorf("%s: err = %v; want %v", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if tt.holders == nil {
+			t.Errorf("%s: err = %v; want no lock error", tt.name, err)
+			continue
+		}
+		if lerr.Stack != "m1" || !reflect.DeepEqual(lerr.Holders, tt.holders) {
+			t.Errorf("%s: got %+v; want %+v", tt.name, lerr.Holders, tt.holders)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: lock error does not wrap %v", tt.name, tt.err)
+		}
+	}
+}
+
+func TestLockErrorMessage(t *testing.T) {
+	err := (&Controller{Config: &Config{StackName: "m1"}}).lockError(errors.New(lockMessage))
+	want := `stack m1 is locked by root@automation-7d9f (pid 4711) since 2021-06-01T10:00:00Z, ` +
+		`DOMAIN\j.doe@laptop.corp (pid 42) since 2021-06-01T12:30:00+02:00`
+	if err.Error() != want {
+		t.Errorf("got %q; want %q", err, want)
+	}
+	err = &LockError{Stack: "m1"}
+	if want := "stack m1 is locked by unknown holder"; err.Error() != want {
+		t.Errorf("got %q; want %q", err, want)
+	}
+}
+
+func TestFileBackendDir(t *testing.T) {
+	tests := map[string]string{
+		"":                          "",
+		"s3://bucket":               "",
+		"https://api.pulumi.com":    "",
+		"file:///var/lib/pulumi":    "/var/lib/pulumi",
+		"file://localhost/tmp/be":   "/tmp/be",
+		"file://~/.pulumi-backend":  "~/.pulumi-backend",
+		"file://relative/directory": "relative/directory",
+	}
+	for u, want := range tests {
+		setenv(t, "PULUMI_BACKEND_URL", u)
+		if got := fileBackendDir(); got != want {
+			t.Errorf("%q: got %q; want %q", u, got, want)
+		}
+	}
+}
+
+func TestLocks(t *testing.T) {
+	dir := t.TempDir()
+	setenv(t, "PULUMI_BACKEND_URL", "file://"+dir)
+	c := &Controller{Config: &Config{StackName: "m1"}}
+	if holders, err := c.locks(nil); err != nil || len(holders) != 0 {
+		t.Errorf("no locks: got %v, %v", holders, err)
+	}
+	lockDir := filepath.Join(dir, ".pulumi", "locks", "m1")
+	if err := os.MkdirAll(lockDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"b.json":   `{"pid":2,"username":"root","hostname":"h2","timestamp":"2021-06-01T11:00:00Z"}`,
+		"a.json":   `{"pid":1,"username":"root","hostname":"h1","timestamp":"2021-06-01T12:00:00Z"}`,
+		"note.txt": `not a lock`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(lockDir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	holders, err := c.locks(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(holders) != 2 || holders[0].Host != "h2" || holders[1].Host != "h1" || holders[0].Lock != filepath.Join(lockDir, "b.json") {
+		t.Errorf("got %+v; want the locks of h2 and h1", holders)
+	}
+
+	// other backends report the holders of the last lock error
+	setenv(t, "PULUMI_BACKEND_URL", "s3://bucket")
+	lerr := &LockError{Stack: "m1", Holders: []LockHolder{{Host: "h3"}}}
+	if holders, err := c.locks(fmt.Errorf("update: %w", lerr)); err != nil || !reflect.DeepEqual(holders, lerr.Holders) {
+		t.Errorf("other backend: got %v, %v; want %v", holders, err, lerr.Holders)
+	}
+}
+
+func TestCheckUnlockState(t *testing.T) {
+	c := &Controller{Config: &Config{StackName: "m1"}}
+	for state, inUse := range map[string]bool{
+		StatePending:      false,
+		StateStopped:      false,
+		StateFailed:       false,
+		StateIdle:         false,
+		StateInitializing: true,
+		StateConfiguring:  true,
+		StateRefreshing:   true,
+		StateUpdating:     true,
+	} {
+		err := c.checkUnlockState(state)
+		if errors.Is(err, ErrLockInUse) != inUse {
+			t.Errorf("%s: err = %v; want in use %v", state, err, inUse)
+		}
+	}
+}
+
+func TestCheckStaleLocks(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	heartbeat := func(dir string, r Replica) {
+		t.Helper()
+		p := filepath.Join(dir, ".automation", "replicas", fmt.Sprintf("%s-%d.json", r.Host, r.Pid))
+		if err := writeReplica(p, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	self := selfReplica()
+	tests := []struct {
+		name     string
+		backend  string
+		holders  []LockHolder
+		replicas []Replica
+		err      string
+	}{
+		{
+			name:    "process exited",
+			holders: []LockHolder{{Host: host, Pid: exited.Process.Pid}},
+		},
+		{
+			name:    "other host",
+			holders: []LockHolder{{Host: "other", Pid: os.Getpid()}},
+		},
+		{
+			name:    "process running",
+			holders: []LockHolder{{Host: host, Pid: os.Getpid()}},
+			err:     fmt.Sprintf("locked by running process %d of this host", os.Getpid()),
+		},
+		{
+			name:    "other backend",
+			backend: "s3://bucket",
+			holders: []LockHolder{{Host: "other", Pid: 1}},
+			err:     "replicas can't be verified for backend s3://bucket",
+		},
+		{
+			name:     "only this replica",
+			holders:  []LockHolder{{Host: "other", Pid: 1}},
+			replicas: []Replica{{Host: self.Host, Pid: self.Pid, Seen: time.Now()}},
+		},
+		{
+			name:     "stale replica",
+			holders:  []LockHolder{{Host: "other", Pid: 1}},
+			replicas: []Replica{{Host: "other", Pid: 1, Seen: time.Now().Add(-3 * ReplicaHeartbeatInterval)}},
+		},
+		{
+			name:     "other replica",
+			holders:  []LockHolder{{Host: "other", Pid: 1}},
+			replicas: []Replica{{Host: "other", Pid: 1, Seen: time.Now()}},
+			err:      "automation replica other (pid 1) is running",
+		},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		backend := tt.backend
+		if backend == "" {
+			backend = "file://" + dir
+		}
+		setenv(t, "PULUMI_BACKEND_URL", backend)
+		for _, r := range tt.replicas {
+			heartbeat(dir, r)
+		}
+		err := checkStaleLocks(tt.holders)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.err != "" && (!errors.Is(err, ErrLockInUse) || !strings.HasPrefix(err.Error(), tt.err)) {
+			t.Errorf("%s: err = %v; want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestReplicaHeartbeat(t *testing.T) {
+	dir := t.TempDir()
+	setenv(t, "PULUMI_BACKEND_URL", "file://"+dir)
+	stop := StartReplicaHeartbeat()
+	var replicas []Replica
+	for i := 0; i < 100; i++ {
+		var err error
+		if replicas, err = Replicas(); err != nil {
+			t.Fatal(err)
+		}
+		if len(replicas) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	self := selfReplica()
+	if len(replicas) != 1 || replicas[0].Host != self.Host || replicas[0].Pid != self.Pid {
+		t.Errorf("replicas = %+v; want this replica", replicas)
+	}
+	stop()
+	if replicas, err := Replicas(); err != nil || len(replicas) != 0 {
+		t.Errorf("replicas after stop = %+v, %v; want none", replicas, err)
+	}
+
+	setenv(t, "PULUMI_BACKEND_URL", "s3://bucket")
+	if _, err := Replicas(); err == nil {
+		t.Errorf("other backend: no error")
+	}
+	StartReplicaHeartbeat()()
+}
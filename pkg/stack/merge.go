@@ -0,0 +1,210 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MergeStrategy defines how a list in a config is combined with the same list
+// in the configs it extends.
+//
+//	replace        the list of the extending config replaces the base list
+//	append         items of the extending config are appended to the base list
+//	merge:<field>  items with the same <field> value are merged, other items
+//	               are appended; e.g. merge:name or merge:ip
+//	merge          merge:<field> with the field the project defines for the
+//	               list, see Project.MergeKeys
+//
+// Maps are always merged key by key and scalars are always replaced. Lists
+// without strategy are replaced.
+type MergeStrategy string
+
+const (
+	MergeReplace MergeStrategy = "replace"
+	MergeAppend  MergeStrategy = "append"
+	MergeItems   MergeStrategy = "merge"
+	mergeByKey                 = "merge:"
+)
+
+// MergeByKey returns the strategy that merges list items by field key.
+func MergeByKey(key string) MergeStrategy {
+	return MergeStrategy(mergeByKey + key)
+}
+
+// key returns the field name of a merge-by-key strategy, or "" otherwise.
+func (s MergeStrategy) key() string {
+	if strings.HasPrefix(string(s), mergeByKey) {
+		return strings.TrimPrefix(string(s), mergeByKey)
+	}
+	return ""
+}
+
+func (s MergeStrategy) validate() error {
+	switch {
+	case s == MergeReplace, s == MergeAppend, s == MergeItems:
+		return nil
+	case s.key() != "":
+		return nil
+	}
+	return fmt.Errorf("merge strategy %q: %v", s, ErrNotSupported)
+}
+
+// merger merges config documents into one and records, for every leaf value,
+// the file the value came from.
+type merger struct {
+	strategies map[string]MergeStrategy
+	sources    map[string]string
+}
+
+// merge merges src from file into dst and returns the result. Both dst and
+// src are normalized yaml documents, see normalize().
+func (m *merger) merge(dst, src interface{}, path, file string) interface{} {
+	if dst == nil {
+		m.record(path, src, file)
+		return src
+	}
+	switch s := src.(type) {
+	case map[string]interface{}:
+		d, ok := dst.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for k, v := range s {
+			d[k] = m.merge(d[k], v, joinPath(path, k), file)
+		}
+		return d
+	case []interface{}:
+		d, ok := dst.([]interface{})
+		if !ok {
+			break
+		}
+		switch st := m.strategies[path]; {
+		case st == MergeAppend:
+			for _, v := range s {
+				m.record(indexPath(path, len(d)), v, file)
+				d = append(d, v)
+			}
+			return d
+		case st.key() != "":
+			return m.mergeByKey(d, s, st.key(), path, file)
+		}
+	}
+	m.forget(path)
+	m.record(path, src, file)
+	return src
+}
+
+func (m *merger) mergeByKey(dst, src []interface{}, key, path, file string) []interface{} {
+	index := make(map[string]int)
+	for i, v := range dst {
+		if k, ok := itemKey(v, key); ok {
+			index[k] = i
+		}
+	}
+	for _, v := range src {
+		if k, ok := itemKey(v, key); ok {
+			if i, found := index[k]; found {
+				dst[i] = m.merge(dst[i], v, indexPath(path, i), file)
+				continue
+			}
+			index[k] = len(dst)
+		}
+		m.record(indexPath(path, len(dst)), v, file)
+		dst = append(dst, v)
+	}
+	return dst
+}
+
+// record sets file as source of all leaves in value v at path.
+func (m *merger) record(path string, v interface{}, file string) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range t {
+			m.record(joinPath(path, k), vv, file)
+		}
+	case []interface{}:
+		if len(t) == 0 {
+			m.sources[path] = file
+		}
+		for i, vv := range t {
+			m.record(indexPath(path, i), vv, file)
+		}
+	default:
+		m.sources[path] = file
+	}
+}
+
+// forget removes the sources of path and everything below it.
+func (m *merger) forget(path string) {
+	for p := range m.sources {
+		if p == path || strings.HasPrefix(p, path+".") || strings.HasPrefix(p, path+"[") {
+			delete(m.sources, p)
+		}
+	}
+}
+
+func itemKey(v interface{}, key string) (string, bool) {
+	if item, ok := v.(map[string]interface{}); ok {
+		if k, ok := item[key]; ok && k != nil {
+			return fmt.Sprint(k), true
+		}
+	}
+	return "", false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func indexPath(path string, i int) string {
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+
+// normalize converts the map[interface{}]interface{} values produced by
+// yaml.v2 into map[string]interface{}, so that documents can be merged and
+// encoded as json.
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		n := make(map[string]interface{}, len(t))
+		for k, vv := range t {
+			n[fmt.Sprint(k)] = normalize(vv)
+		}
+		return n
+	case map[string]interface{}:
+		n := make(map[string]interface{}, len(t))
+		for k, vv := range t {
+			n[k] = normalize(vv)
+		}
+		return n
+	case []interface{}:
+		n := make([]interface{}, len(t))
+		for i, vv := range t {
+			n[i] = normalize(vv)
+		}
+		return n
+	default:
+		return v
+	}
+}
@@ -0,0 +1,280 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfigs writes the config files by name into a new directory and
+// returns the directory
+func writeConfigs(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+const mergeBase = `projectType: esxi
+stack: base
+props:
+  stack:
+    nodes:
+      - name: n01
+        ip: 10.0.0.1
+      - name: n02
+        ip: 10.0.0.2
+    tags: [a]
+`
+
+func TestReadConfigMergeStrategies(t *testing.T) {
+	n := func(name, ip string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "ip": ip}
+	}
+	tests := []struct {
+		name  string
+		top   string
+		nodes []interface{}
+		tags  []interface{}
+		err   string
+	}{
+		{
+			name: "replace by default",
+			top: `extends: [base.yaml]
+stack: top
+props:
+  stack:
+    nodes:
+      - name: n02
+        ip: 10.0.1.2
+`,
+			nodes: []interface{}{n("n02", "10.0.1.2")},
+			tags:  []interface{}{"a"},
+		},
+		{
+			name: "replace",
+			top: `extends: [base.yaml]
+merge:
+  props.stack.tags: replace
+stack: top
+props:
+  stack:
+    tags: [b]
+`,
+			nodes: []interface{}{n("n01", "10.0.0.1"), n("n02", "10.0.0.2")},
+			tags:  []interface{}{"b"},
+		},
+		{
+			name: "append",
+			top: `extends: [base.yaml]
+merge:
+  props.stack.nodes: append
+  props.stack.tags: append
+stack: top
+props:
+  stack:
+    nodes:
+      - name: n02
+        ip: 10.0.1.2
+    tags: [b]
+`,
+			nodes: []interface{}{n("n01", "10.0.0.1"), n("n02", "10.0.0.2"), n("n02", "10.0.1.2")},
+			tags:  []interface{}{"a", "b"},
+		},
+		{
+			name: "merge by field",
+			top: `extends: [base.yaml]
+merge:
+  props.stack.nodes: merge:ip
+stack: top
+props:
+  stack:
+    nodes:
+      - name: n02b
+        ip: 10.0.0.2
+      - name: n03
+        ip: 10.0.0.3
+`,
+			nodes: []interface{}{n("n01", "10.0.0.1"), n("n02b", "10.0.0.2"), n("n03", "10.0.0.3")},
+			tags:  []interface{}{"a"},
+		},
+		{
+			name: "merge by the field of the project",
+			top: `extends: [base.yaml]
+merge:
+  props.stack.nodes: merge
+stack: top
+props:
+  stack:
+    nodes:
+      - name: n02
+        ip: 10.0.1.2
+      - name: n03
+        ip: 10.0.1.3
+`,
+			nodes: []interface{}{n("n01", "10.0.0.1"), n("n02", "10.0.1.2"), n("n03", "10.0.1.3")},
+			tags:  []interface{}{"a"},
+		},
+		{
+			name: "merge without field of the project",
+			top: `extends: [base.yaml]
+merge:
+  props.stack.tags: merge
+stack: top
+`,
+			err: "merges no items of the list",
+		},
+		{
+			name: "unknown strategy",
+			top: `extends: [base.yaml]
+merge:
+  props.stack.tags: prepend
+stack: top
+`,
+			err: "not supported",
+		},
+	}
+	for _, tt := range tests {
+		dir := writeConfigs(t, map[string]string{"base.yaml": mergeBase, "top.yaml": tt.top})
+		c, err := ReadConfig(path.Join(dir, "top.yaml"))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: err = %v; want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		props := c.Effective().Config["props"].(map[string]interface{})["stack"].(map[string]interface{})
+		if !reflect.DeepEqual(props["nodes"], tt.nodes) {
+			t.Errorf("%s: nodes = %v; want %v", tt.name, props["nodes"], tt.nodes)
+		}
+		if !reflect.DeepEqual(props["tags"], tt.tags) {
+			t.Errorf("%s: tags = %v; want %v", tt.name, props["tags"], tt.tags)
+		}
+		if c.StackName != "top" || c.ProjectType != ProjectEsxi {
+			t.Errorf("%s: stack %s of %s; want top of %s", tt.name, c.StackName, c.ProjectType, ProjectEsxi)
+		}
+	}
+}
+
+func TestReadConfigCycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{"self", map[string]string{"a.yaml": "extends: [a.yaml]\n"}},
+		{"two files", map[string]string{
+			"a.yaml": "extends: [b.yaml]\n",
+			"b.yaml": "extends: [a.yaml]\n",
+		}},
+		{"dependsOn", map[string]string{
+			"a.yaml": "extends: [b.yaml]\n",
+			"b.yaml": "dependsOn: [c.yaml]\n",
+			"c.yaml": "extends: [a.yaml]\n",
+		}},
+	}
+	for _, tt := range tests {
+		dir := writeConfigs(t, tt.files)
+		_, err := ReadConfig(path.Join(dir, "a.yaml"))
+		if err == nil || !strings.Contains(err.Error(), "extends cycle") {
+			t.Errorf("%s: err = %v; want extends cycle", tt.name, err)
+		}
+	}
+}
+
+// TestReadConfigDiamond reads a base extended twice, which is not a cycle
+func TestReadConfigDiamond(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"base.yaml":  mergeBase,
+		"left.yaml":  "extends: [base.yaml]\nprops:\n  openstack:\n    region: qa-de-1\n",
+		"right.yaml": "extends: [base.yaml]\nprops:\n  openstack:\n    domain: monsoon3\n",
+		"top.yaml":   "extends: [left.yaml, right.yaml]\nstack: top\n",
+	})
+	c, err := ReadConfig(path.Join(dir, "top.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := c.Props.OpenstackProps; o.Region != "qa-de-1" || o.Domain != "monsoon3" {
+		t.Errorf("openstack props = %+v; want region and domain of both bases", o)
+	}
+	want := []string{"base.yaml", "left.yaml", "right.yaml", "top.yaml"}
+	for i, f := range c.Files() {
+		if path.Base(f) != want[i] {
+			t.Errorf("files = %v; want %v", c.Files(), want)
+			break
+		}
+	}
+}
+
+func TestEffectiveSources(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"base.yaml": mergeBase,
+		"top.yaml": `extends: [base.yaml]
+merge:
+  props.stack.nodes: merge
+stack: top
+props:
+  stack:
+    nodes:
+      - name: n02
+        ip: 10.0.1.2
+    tags: [b]
+`,
+	})
+	base, top := path.Join(dir, "base.yaml"), path.Join(dir, "top.yaml")
+	c, err := ReadConfig(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := c.Effective()
+	for p, want := range map[string]string{
+		"projectType":               base,
+		"stack":                     top,
+		"props.stack.nodes[0].ip":   base,
+		"props.stack.nodes[1].ip":   top,
+		"props.stack.nodes[1].name": top,
+		"props.stack.tags[0]":       top,
+	} {
+		if e.Sources[p] != want {
+			t.Errorf("source of %s = %q; want %q", p, e.Sources[p], want)
+		}
+	}
+	if _, ok := e.Sources["extends"]; ok {
+		t.Error("extends is in the effective config")
+	}
+	// the effective config reads back into the same config
+	c2, err := ConfigFromEffective(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.Hash() != c.Hash() {
+		t.Errorf("hash of the effective config %s; want %s", c2.Hash(), c.Hash())
+	}
+}
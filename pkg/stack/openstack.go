@@ -0,0 +1,192 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/sapcc/vcf-automation/pkg/settings"
+)
+
+// openstackAuthKeys are the provider settings that depend on the auth method.
+// Keys that are not set by the current method are removed from the stack, so
+// that switching e.g. from password to token does not leave stale secrets.
+var openstackAuthKeys = []string{
+	"openstack:userName",
+	"openstack:password",
+	"openstack:token",
+	"openstack:applicationCredentialId",
+	"openstack:applicationCredentialName",
+	"openstack:applicationCredentialSecret",
+	"openstack:userDomainName",
+	"openstack:projectDomainName",
+	"openstack:tenantName",
+	"openstack:cacertFile",
+}
+
+// openstackConfigOf builds the openstack provider configuration of cfg with
+// the default user domain of its project type
+func openstackConfigOf(cfg *Config, lenient bool) (auto.ConfigMap, error) {
+	project, err := cfg.Project()
+	if err != nil {
+		return nil, err
+	}
+	p := cfg.Props.OpenstackProps
+	return openstackConfig(p, project.DefaultUserDomain(p), lenient)
+}
+
+// openstackConfig builds the openstack provider configuration from p and the
+// credentials in the environment. The user domain is auth.userDomain, or
+// else defaultUserDomain; if both are empty, it is not set and the program
+// chooses it. If lenient is set, missing credentials are replaced by the
+// name of their env variable instead of failing, e.g. to compare configs
+// without credentials.
+func openstackConfig(p OpenstackProps, defaultUserDomain string, lenient bool) (auto.ConfigMap, error) {
+	if p.Region == "" {
+		return nil, fmt.Errorf("Config.Props.Openstack.Region not set")
+	}
+	if p.Domain == "" {
+		return nil, fmt.Errorf("Config.Props.Openstack.Domain not set")
+	}
+	if p.Tenant == "" {
+		return nil, fmt.Errorf("Config.Props.Openstack.Tenant not set")
+	}
+	a := OpenstackAuth{}
+	if p.Auth != nil {
+		a = *p.Auth
+	}
+	authURL := a.URL
+	if authURL == "" {
+		authURL = fmt.Sprintf("https://identity-3.%s.cloud.sap/v3", p.Region)
+	}
+	userDomain := a.UserDomain
+	if userDomain == "" {
+		userDomain = defaultUserDomain
+	}
+	projectDomain := a.ProjectDomain
+	if projectDomain == "" {
+		projectDomain = p.Domain
+	}
+	insecure := a.CACertFile == ""
+	if a.Insecure != nil {
+		insecure = *a.Insecure
+	}
+
+	m := auto.ConfigMap{
+		"openstack:authUrl":  configValue(authURL),
+		"openstack:region":   configValue(p.Region),
+		"openstack:insecure": configValue(strconv.FormatBool(insecure)),
+	}
+	if a.CACertFile != "" {
+		if _, err := os.Stat(a.CACertFile); err != nil {
+			return nil, fmt.Errorf("Config.Props.Openstack.Auth.CACertFile: %v", err)
+		}
+		m["openstack:cacertFile"] = configValue(a.CACertFile)
+	}
+
+	creds := newCredentialSet(a.Credentials)
+	creds.lenient = lenient
+	switch a.Method {
+	case "", AuthPassword:
+		username, err := creds.require("username")
+		if err != nil {
+			return nil, err
+		}
+		password, err := creds.require("password")
+		if err != nil {
+			return nil, err
+		}
+		m["openstack:userName"] = configValue(username)
+		m["openstack:password"] = configSecret(password)
+		if userDomain != "" {
+			m["openstack:userDomainName"] = configValue(userDomain)
+		}
+		m["openstack:projectDomainName"] = configValue(projectDomain)
+		m["openstack:tenantName"] = configValue(p.Tenant)
+	case AuthToken:
+		token, err := creds.require("token")
+		if err != nil {
+			return nil, err
+		}
+		m["openstack:token"] = configSecret(token)
+		m["openstack:projectDomainName"] = configValue(projectDomain)
+		m["openstack:tenantName"] = configValue(p.Tenant)
+	case AuthApplicationCredential:
+		// application credentials are scoped to their project, the provider
+		// must not be given a project or domain scope
+		secret, err := creds.require("application_credential_secret")
+		if err != nil {
+			return nil, err
+		}
+		m["openstack:applicationCredentialSecret"] = configSecret(secret)
+		if id := creds.get("application_credential_id"); id != "" {
+			m["openstack:applicationCredentialId"] = configValue(id)
+		} else if name := creds.get("application_credential_name"); name != "" {
+			username, err := creds.require("username")
+			if err != nil {
+				return nil, err
+			}
+			m["openstack:applicationCredentialName"] = configValue(name)
+			m["openstack:userName"] = configValue(username)
+			if userDomain != "" {
+				m["openstack:userDomainName"] = configValue(userDomain)
+			}
+		} else {
+			return nil, fmt.Errorf("env variable %s or %s not configured",
+				creds.env("application_credential_id"), creds.env("application_credential_name"))
+		}
+	default:
+		return nil, fmt.Errorf("auth method %q: %v", a.Method, ErrNotSupported)
+	}
+	return m, nil
+}
+
+// credentialSet is a named set of openstack credentials of the settings,
+// e.g. "" for the default set with the keys os_<field> and "lab" for the set
+// with the keys os_lab_<field>.
+type credentialSet struct {
+	name    string
+	lenient bool
+}
+
+func newCredentialSet(name string) credentialSet {
+	return credentialSet{name: strings.ToLower(strings.ReplaceAll(name, "-", "_"))}
+}
+
+func (c credentialSet) env(k string) string {
+	return strings.ToUpper(settings.EnvPrefix + "_" + settings.CredentialKey(c.name, k))
+}
+
+func (c credentialSet) get(k string) string {
+	return settings.Get().Credential(c.name, k)
+}
+
+func (c credentialSet) require(k string) (string, error) {
+	if v := c.get(k); v != "" {
+		return v, nil
+	}
+	if c.lenient {
+		return "$" + c.env(k), nil
+	}
+	return "", fmt.Errorf("env variable %s not configured", c.env(k))
+}
@@ -0,0 +1,132 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/sapcc/vcf-automation/pkg/settings"
+	"github.com/spf13/viper"
+)
+
+func setCredentials(t *testing.T, creds map[string]string) {
+	t.Helper()
+	for k, v := range creds {
+		viper.Set(k, v)
+	}
+	loadSettings(t)
+	t.Cleanup(func() {
+		for k := range creds {
+			viper.Set(k, "")
+		}
+		loadSettings(t)
+	})
+}
+
+func loadSettings(t *testing.T) {
+	t.Helper()
+	if _, err := settings.Load(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenstackConfigWithoutAuth(t *testing.T) {
+	setCredentials(t, map[string]string{"os_username": "user", "os_password": "secret"})
+	props := OpenstackProps{Region: "qa-de-1", Domain: "monsoon3", Tenant: "vcf"}
+	// the provider config written before auth became configurable
+	legacy := auto.ConfigMap{
+		"openstack:authUrl":           configValue("https://identity-3.qa-de-1.cloud.sap/v3"),
+		"openstack:region":            configValue("qa-de-1"),
+		"openstack:projectDomainName": configValue("monsoon3"),
+		"openstack:tenantName":        configValue("vcf"),
+		"openstack:userDomainName":    configValue("monsoon3"),
+		"openstack:userName":          configValue("user"),
+		"openstack:insecure":          configValue("true"),
+		"openstack:password":          configSecret("secret"),
+	}
+	// the vcf program signs in to ccadmin without a user domain
+	vcfLegacy := auto.ConfigMap{}
+	for k, v := range legacy {
+		if k != "openstack:userDomainName" {
+			vcfLegacy[k] = v
+		}
+	}
+
+	tests := []struct {
+		project ProjectType
+		want    auto.ConfigMap
+	}{
+		{ProjectEsxi, legacy},
+		{ProjectExample, legacy},
+		{ProjectVCFManagement, vcfLegacy},
+		{ProjectVCFWorkload, vcfLegacy},
+	}
+	for _, tt := range tests {
+		cfg := &Config{ProjectType: tt.project, StackName: "s", Props: Props{OpenstackProps: props}}
+		got, err := openstackConfigOf(cfg, false)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.project, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: config = %v; want %v", tt.project, got, tt.want)
+		}
+	}
+}
+
+func TestOpenstackConfigUserDomain(t *testing.T) {
+	setCredentials(t, map[string]string{
+		"os_username": "user", "os_password": "secret",
+		"os_lab_username": "labuser", "os_lab_application_credential_name": "app",
+		"os_lab_application_credential_secret": "appsecret",
+	})
+	tests := []struct {
+		name    string
+		project ProjectType
+		auth    *OpenstackAuth
+		want    string // userDomainName, "-" if not set
+	}{
+		{"vcf explicit", ProjectVCFManagement, &OpenstackAuth{UserDomain: "users"}, "users"},
+		{"vcf auth without domain", ProjectVCFManagement, &OpenstackAuth{URL: "https://keystone/v3"}, "-"},
+		{"esxi explicit", ProjectEsxi, &OpenstackAuth{UserDomain: "users"}, "users"},
+		{"esxi default", ProjectEsxi, &OpenstackAuth{}, "monsoon3"},
+		{"token", ProjectEsxi, &OpenstackAuth{Method: AuthToken, UserDomain: "users"}, "-"},
+		{"application credential name", ProjectEsxi,
+			&OpenstackAuth{Method: AuthApplicationCredential, Credentials: "lab"}, "monsoon3"},
+	}
+	for _, tt := range tests {
+		if tt.auth.Method == AuthToken {
+			setCredentials(t, map[string]string{"os_token": "token"})
+		}
+		props := OpenstackProps{Region: "qa-de-1", Domain: "monsoon3", Tenant: "vcf", Auth: tt.auth}
+		cfg := &Config{ProjectType: tt.project, StackName: "s", Props: Props{OpenstackProps: props}}
+		m, err := openstackConfigOf(cfg, false)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := "-"
+		if v, ok := m["openstack:userDomainName"]; ok {
+			got = v.Value
+		}
+		if got != tt.want {
+			t.Errorf("%s: userDomainName = %s; want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"gopkg.in/yaml.v2"
+)
+
+// SecretMask replaces the value of secret outputs that are not revealed
+const SecretMask = "[secret]"
+
+// Output formats supported by FormatOutputs
+const (
+	OutputsJSON   = "json"
+	OutputsYAML   = "yaml"
+	OutputsDotenv = "dotenv"
+	OutputsFlat   = "flat"
+)
+
+// Output is a stack output with its full value, which may be a string,
+// number, bool, list or map
+type Output struct {
+	Value  interface{} `json:"value" yaml:"value"`
+	Secret bool        `json:"secret,omitempty" yaml:"secret,omitempty"`
+}
+
+// Outputs are the outputs of a stack by name
+type Outputs map[string]Output
+
+func newOutputs(m auto.OutputMap) Outputs {
+	o := make(Outputs, len(m))
+	for k, v := range m {
+		o[k] = Output{Value: v.Value, Secret: v.Secret}
+	}
+	return o
+}
+
+// Masked returns a copy of the outputs with the values of secrets replaced
+// by SecretMask
+func (o Outputs) Masked() Outputs {
+	m := make(Outputs, len(o))
+	for k, v := range o {
+		if v.Secret {
+			v.Value = SecretMask
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// Values returns the output values by name
+func (o Outputs) Values() map[string]interface{} {
+	m := make(map[string]interface{}, len(o))
+	for k, v := range o {
+		m[k] = v.Value
+	}
+	return m
+}
+
+// FormatOutputs encodes the output values in format:
+//
+//	json    a json object of the values
+//	yaml    a yaml map of the values
+//	dotenv  one NAME="value" line per output, with the name upper cased and
+//	        structured values encoded as json
+//	flat    one path=value line per leaf value, e.g. esxi.nodes[0].name=n01
+func FormatOutputs(o Outputs, format string) ([]byte, error) {
+	values := o.Values()
+	switch format {
+	case OutputsJSON, "":
+		b, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	case OutputsYAML:
+		return yaml.Marshal(values)
+	case OutputsDotenv:
+		buf := bytes.Buffer{}
+		for _, k := range sortedKeys(values) {
+			s, err := scalarString(values[k])
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&buf, "%s=%s\n", envName(k), strconv.Quote(s))
+		}
+		return buf.Bytes(), nil
+	case OutputsFlat:
+		flat := make(map[string]interface{})
+		flatten(normalize(values), "", flat)
+		buf := bytes.Buffer{}
+		for _, k := range sortedKeys(flat) {
+			s, err := scalarString(flat[k])
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&buf, "%s=%s\n", k, s)
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("output format %q: %v", format, ErrNotSupported)
+}
+
+var envNameRe = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// envName converts an output name to an env variable name, e.g.
+// cloud-builder to CLOUD_BUILDER
+func envName(k string) string {
+	return envNameRe.ReplaceAllString(strings.ToUpper(k), "_")
+}
+
+// scalarString formats v for a single line; structured values are encoded as
+// json
+func scalarString(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case nil:
+		return "", nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	case int, int64, bool:
+		return fmt.Sprint(t), nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
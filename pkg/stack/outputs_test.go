@@ -0,0 +1,110 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"strings"
+	"testing"
+)
+
+func testOutputs() Outputs {
+	return Outputs{
+		"cloud-builder": {Value: "10.0.0.1"},
+		"password":      {Value: "s3cr3t", Secret: true},
+		"esxi": {Value: map[string]interface{}{
+			"nodes": []interface{}{
+				map[string]interface{}{"name": "n01", "cpus": float64(8)},
+			},
+		}},
+		"enabled": {Value: true},
+	}
+}
+
+func TestOutputsMasked(t *testing.T) {
+	o := testOutputs()
+	m := o.Masked()
+	if m["password"].Value != SecretMask || !m["password"].Secret {
+		t.Errorf("password = %#v; want masked secret", m["password"])
+	}
+	if m["cloud-builder"].Value != "10.0.0.1" {
+		t.Errorf("cloud-builder = %#v; want unchanged", m["cloud-builder"])
+	}
+	if o["password"].Value != "s3cr3t" {
+		t.Errorf("Masked changed the original outputs: %#v", o["password"])
+	}
+}
+
+func TestFormatOutputs(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{OutputsJSON, `{
+  "cloud-builder": "10.0.0.1",
+  "enabled": true,
+  "esxi": {
+    "nodes": [
+      {
+        "cpus": 8,
+        "name": "n01"
+      }
+    ]
+  },
+  "password": "[secret]"
+}
+`},
+		{OutputsYAML, `cloud-builder: 10.0.0.1
+enabled: true
+esxi:
+  nodes:
+  - cpus: 8
+    name: n01
+password: '[secret]'
+`},
+		{OutputsDotenv, `CLOUD_BUILDER="10.0.0.1"
+ENABLED="true"
+ESXI="{\"nodes\":[{\"cpus\":8,\"name\":\"n01\"}]}"
+PASSWORD="[secret]"
+`},
+		{OutputsFlat, `cloud-builder=10.0.0.1
+enabled=true
+esxi.nodes[0].cpus=8
+esxi.nodes[0].name=n01
+password=[secret]
+`},
+	}
+	o := testOutputs().Masked()
+	for _, tt := range tests {
+		b, err := FormatOutputs(o, tt.format)
+		if err != nil {
+			t.Errorf("%s: %v", tt.format, err)
+			continue
+		}
+		if string(b) != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.format, b, tt.want)
+		}
+	}
+}
+
+func TestFormatOutputsUnsupported(t *testing.T) {
+	_, err := FormatOutputs(testOutputs(), "toml")
+	if err == nil || !strings.HasSuffix(err.Error(), ErrNotSupported.Error()) {
+		t.Errorf("err = %v; want not supported", err)
+	}
+}
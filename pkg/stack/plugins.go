@@ -0,0 +1,284 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"github.com/sapcc/vcf-automation/pkg/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+// Statuses of a required plugin
+const (
+	// PluginOK is installed at the required version
+	PluginOK = "ok"
+	// PluginInstalled was installed at the required version by the controller
+	PluginInstalled = "installed"
+	// PluginMismatch is installed at other versions only
+	PluginMismatch = "mismatch"
+	// PluginMissing is not installed at all
+	PluginMissing = "missing"
+)
+
+// Plugin is a resource plugin a project requires, at Version (without v)
+type Plugin struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+func (p Plugin) String() string {
+	return fmt.Sprintf("%s v%s", p.Name, p.Version)
+}
+
+// PluginStatus is the status of a required plugin with the installed versions
+type PluginStatus struct {
+	Plugin
+	Status    string   `json:"status"`
+	Installed []string `json:"installed,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// CheckPlugin compares the required plugin p with the installed versions
+func CheckPlugin(p Plugin, installed []string) PluginStatus {
+	st := PluginStatus{Plugin: p, Status: PluginMissing, Installed: installed}
+	for _, v := range installed {
+		if strings.TrimPrefix(v, "v") == p.Version {
+			st.Status = PluginOK
+			return st
+		}
+	}
+	if len(installed) > 0 {
+		st.Status = PluginMismatch
+	}
+	return st
+}
+
+// PluginArchive returns the path of the release archive of plugin p for this
+// platform in the plugin cache dir, as downloaded from the pulumi releases
+func PluginArchive(cacheDir string, p Plugin) string {
+	return path.Join(cacheDir, fmt.Sprintf("pulumi-resource-%s-v%s-%s-%s.tar.gz",
+		p.Name, p.Version, runtime.GOOS, runtime.GOARCH))
+}
+
+// Backoff of the installation of a plugin after it failed
+const (
+	pluginRetryMin = time.Minute
+	pluginRetryMax = 30 * time.Minute
+)
+
+// pluginInstallTimeout bounds the installation of a plugin, which may
+// download it
+const pluginInstallTimeout = 5 * time.Minute
+
+// pluginFailure is a failed installation of a plugin, which is not retried
+// before retry
+type pluginFailure struct {
+	status  PluginStatus
+	retry   time.Time
+	backoff time.Duration
+}
+
+var (
+	// ensuredPlugins are the plugins installed at the required version, so
+	// that controllers of the same project do not check them again
+	ensuredPlugins = make(map[Plugin]PluginStatus)
+	// failedPlugins are the plugins whose installation failed, so that
+	// controllers do not retry, e.g. downloading, on every run
+	failedPlugins = make(map[Plugin]*pluginFailure)
+	// pluginLocks serialize the checks and installations of each plugin, so
+	// that a slow download only blocks the controllers waiting for the same
+	// plugin
+	pluginLocks = make(map[Plugin]*sync.Mutex)
+	// pluginMu guards the maps above; it is not held while installing
+	pluginMu sync.Mutex
+)
+
+// ensurePlugins installs the plugins the project requires, from the plugin
+// cache dir if the archive is there, or else downloads them. A required
+// plugin which is not installed at all fails. The pins are advisory
+// otherwise: the Pulumi engine loads the plugin version the program requests,
+// so a version mismatch is only logged and reported in the status of the
+// controller.
+func (c *Controller) ensurePlugins(ctx context.Context) error {
+	p, err := c.Project()
+	if err != nil {
+		return err
+	}
+	logger := log.WithFields(log.Fields{
+		"package": "stack",
+		"project": c.ProjectType,
+		"stack":   c.StackName,
+	})
+	statuses := make([]PluginStatus, 0)
+	var missing []string
+	for _, plugin := range p.Plugins() {
+		st := ensurePlugin(ctx, c.stack.Workspace(), plugin)
+		switch st.Status {
+		case PluginInstalled:
+			logger.Infof("plugin %s installed", plugin)
+		case PluginMismatch:
+			logger.Warnf("plugin %s not installed, installed versions: %s: %s",
+				plugin, strings.Join(st.Installed, ", "), st.Error)
+		case PluginMissing:
+			missing = append(missing, fmt.Sprintf("%s: %s", plugin, st.Error))
+		}
+		statuses = append(statuses, st)
+	}
+	c.stateMu.Lock()
+	c.plugins = statuses
+	c.stateMu.Unlock()
+	if len(missing) > 0 {
+		return fmt.Errorf("install plugins: %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+// Plugins returns the status of the plugins the project requires, nil before
+// the stack is initialized
+func (c *Controller) Plugins() []PluginStatus {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.plugins
+}
+
+// ensurePlugin checks the installed versions of p and installs p if it is
+// not installed at the required version. A failed installation, or one after
+// which p is still not installed at the required version, is retried after a
+// backoff, which doubles with every failure.
+func ensurePlugin(ctx context.Context, ws auto.Workspace, p Plugin) PluginStatus {
+	lock := pluginLock(p)
+	lock.Lock()
+	defer lock.Unlock()
+	pluginMu.Lock()
+	st, ensured := ensuredPlugins[p]
+	f := failedPlugins[p]
+	pluginMu.Unlock()
+	if ensured {
+		return st
+	}
+	if f != nil && time.Now().Before(f.retry) {
+		return f.status
+	}
+	installed, err := installedPlugins(ctx, ws, p.Name)
+	if err != nil {
+		return PluginStatus{Plugin: p, Status: PluginMissing, Error: err.Error()}
+	}
+	st = CheckPlugin(p, installed)
+	if st.Status != PluginOK {
+		if err := installPlugin(ctx, ws, p); err != nil {
+			st.Error = err.Error()
+			return pluginFailed(f, st)
+		}
+		if installed, err = installedPlugins(ctx, ws, p.Name); err != nil {
+			st.Error = err.Error()
+			return st
+		}
+		if st = CheckPlugin(p, installed); st.Status != PluginOK {
+			st.Error = "not listed after the installation"
+			return pluginFailed(f, st)
+		}
+		st.Status = PluginInstalled
+	}
+	pluginMu.Lock()
+	defer pluginMu.Unlock()
+	ensuredPlugins[p] = st
+	delete(failedPlugins, p)
+	return st
+}
+
+// pluginLock returns the lock of plugin p
+func pluginLock(p Plugin) *sync.Mutex {
+	pluginMu.Lock()
+	defer pluginMu.Unlock()
+	l, ok := pluginLocks[p]
+	if !ok {
+		l = &sync.Mutex{}
+		pluginLocks[p] = l
+	}
+	return l
+}
+
+// pluginFailed records the failed installation st after the previous failure
+// f, nil for the first one, and returns st with the time of the retry
+func pluginFailed(f *pluginFailure, st PluginStatus) PluginStatus {
+	backoff := pluginRetryMin
+	if f != nil {
+		backoff = f.backoff * 2
+		if backoff > pluginRetryMax {
+			backoff = pluginRetryMax
+		}
+	}
+	retry := time.Now().Add(backoff)
+	st.Error = fmt.Sprintf("%s (retry after %s)", st.Error, retry.Format(time.RFC3339))
+	pluginMu.Lock()
+	defer pluginMu.Unlock()
+	failedPlugins[st.Plugin] = &pluginFailure{status: st, retry: retry, backoff: backoff}
+	return st
+}
+
+// installedPlugins returns the installed versions of the resource plugin name
+func installedPlugins(ctx context.Context, ws auto.Workspace, name string) ([]string, error) {
+	l, err := ws.ListPlugins(ctx)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]string, 0)
+	for _, p := range l {
+		if p.Kind == workspace.ResourcePlugin && p.Name == name && p.Version != nil {
+			versions = append(versions, p.Version.String())
+		}
+	}
+	return versions, nil
+}
+
+// installPlugin installs p from its archive in the plugin cache dir, or
+// downloads it, within pluginInstallTimeout. The workspace api cannot install
+// from a file, so the pulumi cli is run in the workspace for archives.
+func installPlugin(ctx context.Context, ws auto.Workspace, p Plugin) error {
+	ctx, cancel := context.WithTimeout(ctx, pluginInstallTimeout)
+	defer cancel()
+	if dir := settings.Get().PluginCacheDir; dir != "" {
+		archive := PluginArchive(dir, p)
+		if _, err := os.Stat(archive); err == nil {
+			cmd := exec.CommandContext(ctx, "pulumi", "plugin", "install", "resource", p.Name, "v"+p.Version,
+				"--file", archive, "--non-interactive")
+			cmd.Dir = ws.WorkDir()
+			cmd.Env = os.Environ()
+			for k, v := range ws.GetEnvVars() {
+				cmd.Env = append(cmd.Env, k+"="+v)
+			}
+			if out, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("install %s: %v: %s", archive, err, strings.TrimSpace(string(out)))
+			}
+			return nil
+		}
+	}
+	return ws.InstallPlugin(ctx, p.Name, "v"+p.Version)
+}
@@ -0,0 +1,69 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckPlugin(t *testing.T) {
+	p := Plugin{Name: "openstack", Version: "3.1.0"}
+	tests := []struct {
+		installed []string
+		want      string
+	}{
+		{nil, PluginMissing},
+		{[]string{"3.1.0"}, PluginOK},
+		{[]string{"2.0.0", "v3.1.0"}, PluginOK},
+		{[]string{"3.0.0"}, PluginMismatch},
+	}
+	for _, tt := range tests {
+		if st := CheckPlugin(p, tt.installed); st.Status != tt.want {
+			t.Errorf("%v: status = %s; want %s", tt.installed, st.Status, tt.want)
+		}
+	}
+}
+
+func TestPluginFailedBackoff(t *testing.T) {
+	p := Plugin{Name: "test-backoff", Version: "1.0.0"}
+	defer func() {
+		pluginMu.Lock()
+		delete(failedPlugins, p)
+		pluginMu.Unlock()
+	}()
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute}
+	var f *pluginFailure
+	for i := 0; i < 10; i++ {
+		pluginFailed(f, PluginStatus{Plugin: p, Status: PluginMissing, Error: "download failed"})
+		pluginMu.Lock()
+		f = failedPlugins[p]
+		pluginMu.Unlock()
+		w := pluginRetryMax
+		if i < len(want) {
+			w = want[i]
+		}
+		if f.backoff != w {
+			t.Errorf("failure %d: backoff = %s; want %s", i+1, f.backoff, w)
+		}
+		if d := time.Until(f.retry); d > w || d < w-time.Minute {
+			t.Errorf("failure %d: retry in %s; want %s", i+1, d, w)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// Project implements a project type: the typed props of its configs, how its
+// stack is created and configured, and how its outputs are read. Project
+// types are registered with RegisterProject, usually in an init function of
+// their package; the controller and the server look them up by the
+// projectType of a config. Implementations embed BaseProject for the
+// optional methods.
+type Project interface {
+	// Dir is the directory of the pulumi project below the project root,
+	// which is also the project in the api paths
+	Dir() string
+	// Inline is true if the pulumi program is built into the binary
+	Inline() bool
+	// Plugins are the resource plugins the program requires, which the
+	// controller installs before the first run
+	Plugins() []Plugin
+	// MergeKeys are the fields of the props by which list items are
+	// matched when configs are merged with the strategy merge
+	MergeKeys() map[string]string
+	// NewProps returns a pointer to empty props, which the props of a
+	// config are decoded into
+	NewProps() ProjectProps
+	// DefaultUserDomain is the domain of the openstack user if the config
+	// does not set auth.userDomain; empty leaves it to the program
+	DefaultUserDomain(p OpenstackProps) string
+	// ValidateCredentials checks that the credentials the program needs
+	// besides the openstack credentials are set
+	ValidateCredentials() error
+	// InitStack creates or selects the stack in the project directory
+	InitStack(ctx context.Context, stackName, projectDir string, opts ...auto.LocalWorkspaceOption) (Stack, error)
+	// StackConfig returns the pulumi config the props set on the stack.
+	// If lenient is true, credentials missing in the environment are
+	// replaced by the name of their env variable.
+	StackConfig(props ProjectProps, lenient bool) (auto.ConfigMap, error)
+	// Configure passes the props to the stack after its config is set
+	Configure(ctx context.Context, s Stack, props ProjectProps) error
+	// DecodeOutputs converts the outputs of the stack
+	DecodeOutputs(m auto.OutputMap) Outputs
+	// Routes are the api routes of the project type below
+	// /{project}/{stack}
+	Routes() []Route
+}
+
+// ProjectProps are the typed stack props of a project type
+type ProjectProps interface {
+	Validate() error
+}
+
+// Route is an api route of a project type, e.g. cloud-builder/render
+type Route struct {
+	Method  string
+	Path    string
+	Handler RouteHandler
+}
+
+// RouteHandler handles a request to a route of the stack of controller c.
+// revealAllowed is true if the server allows revealing secrets. The body is
+// returned as json with status 200; on error, status is the http status.
+type RouteHandler func(r *http.Request, c *Controller, revealAllowed bool) (body []byte, status int, err error)
+
+// BaseProject implements the optional methods of Project: a program run from
+// the project directory without plugins, merge keys and props, whose outputs
+// are read as they are.
+type BaseProject struct{}
+
+func (BaseProject) Inline() bool                                         { return false }
+func (BaseProject) Plugins() []Plugin                                    { return nil }
+func (BaseProject) MergeKeys() map[string]string                         { return nil }
+func (BaseProject) NewProps() ProjectProps                               { return &NoProps{} }
+func (BaseProject) DefaultUserDomain(p OpenstackProps) string            { return p.Domain }
+func (BaseProject) ValidateCredentials() error                           { return nil }
+func (BaseProject) Configure(context.Context, Stack, ProjectProps) error { return nil }
+func (BaseProject) DecodeOutputs(m auto.OutputMap) Outputs               { return newOutputs(m) }
+func (BaseProject) Routes() []Route                                      { return nil }
+
+func (BaseProject) StackConfig(ProjectProps, bool) (auto.ConfigMap, error) {
+	return auto.ConfigMap{}, nil
+}
+
+// NoProps are the props of a project type without props
+type NoProps struct{}
+
+func (NoProps) Validate() error { return nil }
+
+var projects = make(map[ProjectType]Project)
+
+// RegisterProject registers the project type t. Registering a type twice
+// panics.
+func RegisterProject(t ProjectType, p Project) {
+	if _, ok := projects[t]; ok {
+		panic(fmt.Sprintf("project type %q registered twice", t))
+	}
+	projects[t] = p
+}
+
+// LookupProject returns the project type t
+func LookupProject(t ProjectType) (Project, error) {
+	p, ok := projects[t]
+	if !ok {
+		return nil, fmt.Errorf("project %q: %v", t, ErrNotSupported)
+	}
+	return p, nil
+}
+
+// ProjectTypes returns the registered project types, sorted
+func ProjectTypes() []ProjectType {
+	l := make([]ProjectType, 0, len(projects))
+	for t := range projects {
+		l = append(l, t)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+	return l
+}
+
+// ProjectPlugins returns the resource plugins required by the project types
+// in the project directory dir
+func ProjectPlugins(dir string) []Plugin {
+	seen := make(map[Plugin]bool)
+	l := make([]Plugin, 0)
+	for _, t := range ProjectTypes() {
+		if projects[t].Dir() != dir {
+			continue
+		}
+		for _, p := range projects[t].Plugins() {
+			if !seen[p] {
+				seen[p] = true
+				l = append(l, p)
+			}
+		}
+	}
+	return l
+}
+
+// IsInlineProject returns true if the program of the project in directory
+// dir is built into the binary
+func IsInlineProject(dir string) bool {
+	for _, p := range projects {
+		if p.Dir() == dir && p.Inline() {
+			return true
+		}
+	}
+	return false
+}
+
+// ProjectRoutes returns the routes of all project types, each method and
+// path once
+func ProjectRoutes() []Route {
+	seen := make(map[string]bool)
+	l := make([]Route, 0)
+	for _, t := range ProjectTypes() {
+		for _, r := range projects[t].Routes() {
+			if k := r.Method + " " + r.Path; !seen[k] {
+				seen[k] = true
+				l = append(l, r)
+			}
+		}
+	}
+	return l
+}
+
+// Project returns the project type of the config
+func (c *Config) Project() (Project, error) {
+	return LookupProject(c.ProjectType)
+}
+
+// DecodeProps decodes the stack props of the config into the typed props of
+// its project type
+func (c *Config) DecodeProps() (ProjectProps, error) {
+	p, err := c.Project()
+	if err != nil {
+		return nil, err
+	}
+	props := p.NewProps()
+	if err := UnmarshalStackProps(c.Props.StackProps, props); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+// Route returns the handler of the route of the controller's project type
+// with method and path
+func (c *Controller) Route(method, path string) (RouteHandler, bool) {
+	p, err := c.Project()
+	if err != nil {
+		return nil, false
+	}
+	for _, r := range p.Routes() {
+		if r.Method == method && r.Path == path {
+			return r.Handler, true
+		}
+	}
+	return nil, false
+}
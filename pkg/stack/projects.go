@@ -0,0 +1,151 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/sapcc/vcf-automation/pkg/settings"
+	"github.com/sapcc/vcf-automation/pkg/stack/esxi"
+	"github.com/sapcc/vcf-automation/pkg/stack/vcf"
+)
+
+// the project types built into the binary
+func init() {
+	RegisterProject(ProjectVCFManagement, vcfProject{stackType: "management"})
+	RegisterProject(ProjectVCFWorkload, vcfProject{stackType: "workload"})
+	RegisterProject(ProjectEsxi, esxiProject{})
+	RegisterProject(ProjectExample, exampleProject{})
+}
+
+// openstackPlugin is the openstack provider of all programs. Its version
+// matches the go sdk in go.mod and the python package in the Dockerfile.
+var openstackPlugin = Plugin{Name: "openstack", Version: "3.1.0"}
+
+// vcfProject is the python program of the vcf management and workload
+// domains; stackType tells the program which domain it deploys
+type vcfProject struct {
+	BaseProject
+	stackType string
+}
+
+func (vcfProject) Dir() string                  { return "vcf" }
+func (vcfProject) Plugins() []Plugin            { return []Plugin{openstackPlugin} }
+func (vcfProject) MergeKeys() map[string]string { return vcf.MergeKeys }
+func (vcfProject) NewProps() ProjectProps       { return &vcf.StackProps{} }
+
+func (vcfProject) ValidateCredentials() error {
+	if settings.Get().VMwarePassword == "" {
+		return fmt.Errorf("env variable AUTOMATION_VMWARE_PASSWORD not configured")
+	}
+	return nil
+}
+
+func (vcfProject) InitStack(ctx context.Context, stackName, projectDir string, opts ...auto.LocalWorkspaceOption) (Stack, error) {
+	s, err := vcf.InitVCFStack(ctx, stackName, projectDir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// DefaultUserDomain is empty: the vcf program signs in to the domain
+// ccadmin, unless auth.userDomain is set
+func (vcfProject) DefaultUserDomain(OpenstackProps) string {
+	return ""
+}
+
+// StackConfig returns the config of the props with the stack type and the
+// vmware password
+func (p vcfProject) StackConfig(props ProjectProps, lenient bool) (auto.ConfigMap, error) {
+	m, err := props.(*vcf.StackProps).ConfigMap()
+	if err != nil {
+		return nil, err
+	}
+	m["stackType"] = configValue(p.stackType)
+	password := settings.Get().VMwarePassword
+	if password == "" && lenient {
+		password = "$AUTOMATION_VMWARE_PASSWORD"
+	}
+	m["vmwarePassword"] = configSecret(password)
+	return m, nil
+}
+
+func (p vcfProject) Routes() []Route {
+	if p.stackType != "management" {
+		return nil
+	}
+	return []Route{{Method: http.MethodGet, Path: "cloud-builder/render", Handler: renderCloudBuilder}}
+}
+
+// renderCloudBuilder renders and validates the cloud builder payload of the
+// stack. The vmware password is masked, unless reveal=true is given and
+// allowed.
+func renderCloudBuilder(r *http.Request, c *Controller, revealAllowed bool) ([]byte, int, error) {
+	reveal := r.URL.Query().Get("reveal") == "true"
+	if reveal && !revealAllowed {
+		return nil, http.StatusForbidden, fmt.Errorf("revealing secrets requires an api token")
+	}
+	b, err := RenderCloudBuilder(c.Config, c.projectRoot, reveal)
+	if err != nil {
+		return nil, http.StatusUnprocessableEntity, err
+	}
+	return b, http.StatusOK, nil
+}
+
+// esxiProject is the inline go program of esxi nodes with nfs shares
+type esxiProject struct {
+	BaseProject
+}
+
+func (esxiProject) Dir() string                  { return "esxi" }
+func (esxiProject) Inline() bool                 { return true }
+func (esxiProject) Plugins() []Plugin            { return []Plugin{openstackPlugin} }
+func (esxiProject) MergeKeys() map[string]string { return esxi.MergeKeys }
+func (esxiProject) NewProps() ProjectProps       { return &esxi.StackProps{} }
+
+func (esxiProject) InitStack(ctx context.Context, stackName, projectDir string, opts ...auto.LocalWorkspaceOption) (Stack, error) {
+	s, err := esxi.InitEsxiStack(ctx, stackName, projectDir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Configure passes the props to the inline program, they are not set as
+// stack config
+func (esxiProject) Configure(ctx context.Context, s Stack, props ProjectProps) error {
+	return s.(*esxi.Stack).Configure(ctx, *props.(*esxi.StackProps))
+}
+
+// exampleProject is the inline go program creating a single instance
+type exampleProject struct {
+	BaseProject
+}
+
+func (exampleProject) Dir() string       { return "example-go" }
+func (exampleProject) Inline() bool      { return true }
+func (exampleProject) Plugins() []Plugin { return []Plugin{openstackPlugin} }
+
+func (exampleProject) InitStack(ctx context.Context, stackName, projectDir string, opts ...auto.LocalWorkspaceOption) (Stack, error) {
+	return InitExampleStack(ctx, stackName, projectDir, opts...)
+}
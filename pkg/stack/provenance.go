@@ -0,0 +1,252 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/sapcc/vcf-automation/pkg/version"
+	log "github.com/sirupsen/logrus"
+)
+
+// Triggers of stack operations
+const (
+	TriggerStart    = "start"
+	TriggerSchedule = "schedule"
+	TriggerReload   = "reload"
+	TriggerRollback = "rollback"
+	TriggerGit      = "git"
+	TriggerWatch    = "watch"
+	TriggerCLI      = "cli"
+	TriggerSelect   = "select"
+	TriggerUnlock   = "unlock"
+)
+
+// messagePrefix starts the message of the updates started by the controller
+const messagePrefix = "automation "
+
+// tagPrefix is the prefix of the stack tags set by the controller
+const tagPrefix = "automation:"
+
+// tagsUnsupportedRe matches the errors of backends without stack tags, e.g.
+// "stack tags not supported in --local mode"
+var tagsUnsupportedRe = regexp.MustCompile(`(?i)tags? (are |is )?not supported|unsupported`)
+
+// Trigger is what started a stack operation. Caller identifies who triggered
+// it through the API or the command line.
+type Trigger struct {
+	Name   string `json:"name"`
+	Caller string `json:"caller,omitempty"`
+	// Selection limits the operation to the selected resources
+	Selection *Selection `json:"selection,omitempty"`
+}
+
+// CLITrigger returns the trigger of operations run from the command line by
+// the current user
+func CLITrigger() Trigger {
+	return Trigger{Name: TriggerCLI, Caller: LocalCaller()}
+}
+
+// LocalCaller returns user@host of the current process
+func LocalCaller() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + host
+}
+
+// Provenance records where the config of a stack operation came from and what
+// triggered it. It is recorded as the message of the Pulumi update and as
+// stack tags.
+type Provenance struct {
+	ConfigFile string     `json:"configFile,omitempty"`
+	ConfigHash string     `json:"configHash"`
+	Version    string     `json:"version"`
+	Trigger    string     `json:"trigger"`
+	Caller     string     `json:"caller,omitempty"`
+	Commit     string     `json:"commit,omitempty"`
+	Selection  *Selection `json:"selection,omitempty"`
+}
+
+// Message returns the update message of an operation of kind
+func (p Provenance) Message(kind string) string {
+	b, _ := json.Marshal(p)
+	return messagePrefix + kind + ": " + string(b)
+}
+
+// Tags returns the stack tags of the provenance
+func (p Provenance) Tags() map[string]string {
+	return map[string]string{
+		tagPrefix + "config-file": p.ConfigFile,
+		tagPrefix + "config-hash": p.ConfigHash,
+		tagPrefix + "version":     p.Version,
+		tagPrefix + "trigger":     p.Trigger,
+		tagPrefix + "caller":      p.Caller,
+		tagPrefix + "commit":      p.Commit,
+	}
+}
+
+// ParseProvenance parses the provenance from an update message. It returns
+// nil if the update was not started by the controller.
+func ParseProvenance(msg string) *Provenance {
+	// the automation api quotes the message
+	if u, err := strconv.Unquote(msg); err == nil {
+		msg = u
+	}
+	if !strings.HasPrefix(msg, messagePrefix) {
+		return nil
+	}
+	i := strings.Index(msg, ": ")
+	if i < 0 {
+		return nil
+	}
+	p := Provenance{}
+	if err := json.Unmarshal([]byte(msg[i+2:]), &p); err != nil {
+		return nil
+	}
+	return &p
+}
+
+// SetTrigger sets the trigger of the following stack operations
+func (c *Controller) SetTrigger(t Trigger) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.trigger = t
+}
+
+// SetCommit sets the commit of the config repository the config of the
+// controller was read from, empty if it was not read from git
+func (c *Controller) SetCommit(commit string) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.commit = commit
+}
+
+// configCommit returns the commit of the config repository of the config
+func (c *Controller) configCommit() string {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.commit
+}
+
+// provenance returns the provenance of the next stack operation
+func (c *Controller) provenance() Provenance {
+	c.stateMu.Lock()
+	t := c.trigger
+	commit := c.commit
+	c.stateMu.Unlock()
+	return Provenance{
+		ConfigFile: c.Config.File(),
+		ConfigHash: c.Config.Hash(),
+		Version:    version.Get(),
+		Trigger:    t.Name,
+		Caller:     t.Caller,
+		Commit:     commit,
+	}
+}
+
+// tagStack sets the provenance tags of the stack which changed since they
+// were last set. Backends which do not support stack tags, like the local
+// backend, are detected on the first failure and not tagged again. The
+// automation API of this Pulumi version has no stack tags, so the Pulumi CLI
+// is run in the workspace.
+func (c *Controller) tagStack(ctx context.Context, p Provenance) {
+	if c.tagsUnsupported {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"package": "stack",
+		"project": c.ProjectType,
+		"stack":   c.StackName,
+	})
+	ws := c.stack.Workspace()
+	env := workspaceEnv(ws)
+	for k, v := range p.Tags() {
+		if v == "" || c.tags[k] == v {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		cmd := exec.CommandContext(ctx, "pulumi", "stack", "tag", "set", k, v,
+			"--stack", c.StackName, "--non-interactive")
+		cmd.Dir = ws.WorkDir()
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		cancel()
+		if err != nil {
+			msg := strings.TrimSpace(string(out))
+			if tagsUnsupportedRe.MatchString(msg) {
+				logger.Infof("backend does not support stack tags, provenance is recorded in the update messages only: %s", msg)
+				c.tagsUnsupported = true
+				return
+			}
+			logger.Warnf("set stack tag %s failed: %v: %s", k, err, msg)
+			return
+		}
+		if c.tags == nil {
+			c.tags = make(map[string]string)
+		}
+		c.tags[k] = v
+	}
+}
+
+// UpdateRecord is an update of the stack from the Pulumi update history with
+// the provenance recorded by the controller, nil for updates it did not start
+type UpdateRecord struct {
+	auto.UpdateSummary
+	Provenance *Provenance `json:"provenance,omitempty"`
+}
+
+// History returns the update history of the stack, newest first. pageSize
+// and page start at 1; 0 returns the complete history. The values of secret
+// config are redacted. Like GetOutputs, it does not wait for a running stack
+// operation.
+func (c *Controller) History(ctx context.Context, pageSize, page int) ([]UpdateRecord, error) {
+	if c.stack == nil {
+		return nil, fmt.Errorf("stack uninitialized")
+	}
+	h, err := c.stack.History(ctx, pageSize, page)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]UpdateRecord, 0, len(h))
+	for _, u := range h {
+		for k, v := range u.Config {
+			if v.Secret {
+				u.Config[k] = auto.ConfigValue{Value: "[secret]", Secret: true}
+			}
+		}
+		records = append(records, UpdateRecord{UpdateSummary: u, Provenance: ParseProvenance(u.Message)})
+	}
+	return records, nil
+}
@@ -0,0 +1,145 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sapcc/vcf-automation/pkg/version"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplicaHeartbeatInterval is the interval in which automation servers
+// sharing a file backend record that they are running. A replica is running
+// if its heartbeat is younger than three intervals.
+var ReplicaHeartbeatInterval = 30 * time.Second
+
+// Replica is an automation server using the backend
+type Replica struct {
+	Host    string    `json:"host"`
+	Pid     int       `json:"pid"`
+	Version string    `json:"version"`
+	Started time.Time `json:"started"`
+	Seen    time.Time `json:"seen"`
+}
+
+var started = time.Now().UTC()
+
+func selfReplica() Replica {
+	host, _ := os.Hostname()
+	return Replica{Host: host, Pid: os.Getpid(), Version: version.Get(), Started: started}
+}
+
+// replicaDir returns the directory of the heartbeats in the file backend, ""
+// for other backends
+func replicaDir() string {
+	dir := fileBackendDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, ".automation", "replicas")
+}
+
+// StartReplicaHeartbeat records the heartbeat of this server in the file
+// backend every ReplicaHeartbeatInterval until the returned stop function is
+// called, which removes it. Nothing is recorded for other backends.
+func StartReplicaHeartbeat() (stop func()) {
+	dir := replicaDir()
+	if dir == "" {
+		return func() {}
+	}
+	logger := log.WithField("package", "stack")
+	self := selfReplica()
+	p := filepath.Join(dir, fmt.Sprintf("%s-%d.json", self.Host, self.Pid))
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(ReplicaHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			self.Seen = time.Now().UTC()
+			if err := writeReplica(p, self); err != nil {
+				logger.WithError(err).Warn("write replica heartbeat failed")
+			}
+			select {
+			case <-done:
+				os.Remove(p)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func writeReplica(p string, r Replica) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// Replicas returns the running automation servers using the file backend
+func Replicas() ([]Replica, error) {
+	dir := replicaDir()
+	if dir == "" {
+		return nil, fmt.Errorf("replicas of backend %s: %v", os.Getenv("PULUMI_BACKEND_URL"), ErrNotSupported)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Replica{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	replicas := make([]Replica, 0)
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		r := Replica{}
+		if err := json.Unmarshal(b, &r); err != nil {
+			continue
+		}
+		if time.Since(r.Seen) < 3*ReplicaHeartbeatInterval {
+			replicas = append(replicas, r)
+		}
+	}
+	return replicas, nil
+}
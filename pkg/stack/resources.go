@@ -0,0 +1,235 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+// keyOutputs are the outputs of the openstack resources shown with the
+// resources, e.g. to find the resource owning an ip address
+var keyOutputs = []string{
+	"accessIpV4",
+	"accessIpV6",
+	"address",
+	"allFixedIps",
+	"cidr",
+	"deviceId",
+	"fixedIp",
+	"gatewayIp",
+	"ipAddress",
+	"macAddress",
+	"networkId",
+	"portId",
+	"subnetId",
+}
+
+// ResourceNode is a resource of the stack state with the resources whose
+// parent it is
+type ResourceNode struct {
+	URN  string `json:"urn"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+	// Instance is the name of the resource in openstack, if different
+	Instance string                 `json:"instance,omitempty"`
+	ID       string                 `json:"id,omitempty"`
+	Outputs  map[string]interface{} `json:"outputs,omitempty"`
+	Delete   bool                   `json:"delete,omitempty"`
+	Children []*ResourceNode        `json:"children,omitempty"`
+}
+
+// StackResources are the resources of a stack, e.g. of a search across
+// stacks. Error is set if the state of the stack could not be read.
+type StackResources struct {
+	Project    string          `json:"project"`
+	Stack      string          `json:"stack"`
+	ConfigFile string          `json:"config_file,omitempty"`
+	Resources  []*ResourceNode `json:"resources"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// ResourceFilter selects resources by substrings of their type, name or urn.
+// Query matches any of them, the id or a key output. Empty fields match all.
+type ResourceFilter struct {
+	Type  string
+	Name  string
+	URN   string
+	Query string
+}
+
+// ResourceTree builds the tree of the resources by their parents. Resources
+// whose parent is not in the list are roots.
+func ResourceTree(resources []apitype.ResourceV3) []*ResourceNode {
+	nodes := make(map[string]*ResourceNode, len(resources))
+	for _, r := range resources {
+		nodes[string(r.URN)] = newResourceNode(r)
+	}
+	roots := make([]*ResourceNode, 0)
+	for _, r := range resources {
+		n := nodes[string(r.URN)]
+		if p, ok := nodes[string(r.Parent)]; ok && r.Parent != "" {
+			p.Children = append(p.Children, n)
+		} else {
+			roots = append(roots, n)
+		}
+	}
+	return roots
+}
+
+func newResourceNode(r apitype.ResourceV3) *ResourceNode {
+	n := &ResourceNode{
+		URN:    string(r.URN),
+		Type:   r.Type.String(),
+		Name:   r.URN.Name().String(),
+		ID:     r.ID.String(),
+		Delete: r.Delete,
+	}
+	if name, ok := r.Outputs["name"].(string); ok && name != n.Name {
+		n.Instance = name
+	}
+	for _, k := range keyOutputs {
+		v, ok := r.Outputs[k]
+		if !ok || isSecretValue(v) || v == "" || v == nil {
+			continue
+		}
+		if n.Outputs == nil {
+			n.Outputs = make(map[string]interface{})
+		}
+		n.Outputs[k] = v
+	}
+	return n
+}
+
+// isSecretValue reports whether v is a secret of the checkpoint
+func isSecretValue(v interface{}) bool {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = m["4dabf18193072939515e22adb298388d"]
+	return ok
+}
+
+// Empty reports whether the filter matches all resources
+func (f ResourceFilter) Empty() bool {
+	return f.Type == "" && f.Name == "" && f.URN == "" && f.Query == ""
+}
+
+// Match reports whether the resource, not its children, matches the filter
+func (f ResourceFilter) Match(n *ResourceNode) bool {
+	if f.Type != "" && !containsFold(n.Type, f.Type) {
+		return false
+	}
+	if f.Name != "" && !containsFold(n.Name, f.Name) && !containsFold(n.Instance, f.Name) {
+		return false
+	}
+	if f.URN != "" && !strings.Contains(n.URN, f.URN) {
+		return false
+	}
+	if f.Query != "" {
+		fields := []string{n.URN, n.Name, n.Instance, n.ID}
+		for _, k := range sortedKeys(n.Outputs) {
+			fields = append(fields, fmt.Sprint(n.Outputs[k]))
+		}
+		for _, s := range fields {
+			if containsFold(s, f.Query) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// FilterResources returns the resources matching f with their ancestors, so
+// that the result is still a tree. Children of a match are kept only if they
+// match as well.
+func FilterResources(roots []*ResourceNode, f ResourceFilter) []*ResourceNode {
+	if f.Empty() {
+		return roots
+	}
+	res := make([]*ResourceNode, 0)
+	for _, n := range roots {
+		children := FilterResources(n.Children, f)
+		if len(children) > 0 || f.Match(n) {
+			c := *n
+			c.Children = children
+			res = append(res, &c)
+		}
+	}
+	return res
+}
+
+// CountResources returns the number of resources in the tree
+func CountResources(roots []*ResourceNode) int {
+	n := 0
+	for _, r := range roots {
+		n += 1 + CountResources(r.Children)
+	}
+	return n
+}
+
+// WriteResourceTable writes the tree as a table, with the names indented by
+// their depth in the tree
+func WriteResourceTable(w io.Writer, roots []*ResourceNode) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tID\tOUTPUTS")
+	writeResourceRows(tw, roots, "")
+	return tw.Flush()
+}
+
+func writeResourceRows(w io.Writer, nodes []*ResourceNode, indent string) {
+	for _, n := range nodes {
+		name := indent + n.Name
+		if n.Instance != "" {
+			name += " (" + n.Instance + ")"
+		}
+		if n.Delete {
+			name += " [delete]"
+		}
+		outputs := make([]string, 0, len(n.Outputs))
+		for _, k := range sortedKeys(n.Outputs) {
+			outputs = append(outputs, fmt.Sprintf("%s=%s", k, compactValue(n.Outputs[k])))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, n.Type, n.ID, strings.Join(outputs, " "))
+		writeResourceRows(w, n.Children, indent+"  ")
+	}
+}
+
+// compactValue formats lists as comma separated values
+func compactValue(v interface{}) string {
+	l, ok := v.([]interface{})
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	s := make([]string, len(l))
+	for i, e := range l {
+		s[i] = fmt.Sprint(e)
+	}
+	return strings.Join(s, ",")
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
@@ -0,0 +1,113 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/vcf-automation/pkg/runlog"
+	"github.com/sapcc/vcf-automation/pkg/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of runs
+const (
+	RunPreview = "preview"
+	RunRefresh = "refresh"
+	RunUpdate  = "update"
+	RunDestroy = "destroy"
+)
+
+var (
+	runStore     *runlog.Store
+	runStoreOnce sync.Once
+)
+
+// RunStore returns the store of the run records of the settings
+func RunStore() *runlog.Store {
+	runStoreOnce.Do(func() {
+		s := settings.Get()
+		runStore = runlog.NewStore(s.RunDir, s.RunKeep)
+	})
+	return runStore
+}
+
+// startRun starts recording a stack operation of kind
+func (c *Controller) startRun(kind string) *runlog.Recorder {
+	project, stackName := c.GetProjectStackName()
+	rec := runlog.NewRecorder(project, stackName, kind)
+	rec.SetCommit(c.configCommit())
+	return rec
+}
+
+// finishRun completes the record of a stack operation with its result err,
+// logs the failed operations and saves the record
+func (c *Controller) finishRun(rec *runlog.Recorder, err error) *runlog.Run {
+	run := rec.Finish(err)
+	logger := log.WithFields(log.Fields{
+		"package": "stack",
+		"project": run.Project,
+		"stack":   run.Stack,
+		"run":     run.ID,
+	})
+	for _, o := range run.Operations {
+		if o.Status != runlog.StatusFailed {
+			continue
+		}
+		msgs := make([]string, 0, len(o.Diagnostics))
+		for _, d := range o.Diagnostics {
+			msgs = append(msgs, d.Message)
+		}
+		logger.WithFields(log.Fields{
+			"urn":      o.URN,
+			"op":       o.Op,
+			"duration": o.Duration().String(),
+		}).Error(strings.Join(msgs, "; "))
+	}
+	if run.Status == runlog.StatusSucceeded && len(run.Changes) > 0 {
+		fields := log.Fields{}
+		for op, n := range run.Changes {
+			fields[op] = n
+		}
+		logger.WithFields(fields).Infof("%s finished in %s", run.Kind, run.End.Sub(run.Start).Round(time.Second))
+	}
+	if err := RunStore().Save(run); err != nil {
+		logger.WithError(err).Error("save run record failed")
+	}
+	return run
+}
+
+// Runs returns the records of the operations on the stack, newest first
+func (c *Controller) Runs() ([]runlog.Run, error) {
+	project, stackName := c.GetProjectStackName()
+	return RunStore().List(project, stackName)
+}
+
+// GetRun returns the record of the run id (a unique prefix or latest) with the
+// operations matching f
+func (c *Controller) GetRun(id string, f runlog.Filter) (*runlog.Run, error) {
+	project, stackName := c.GetProjectStackName()
+	run, err := RunStore().Get(project, stackName, id)
+	if err != nil {
+		return nil, err
+	}
+	return run.Filter(f), nil
+}
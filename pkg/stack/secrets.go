@@ -0,0 +1,492 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"gopkg.in/yaml.v2"
+)
+
+// Secrets providers
+const (
+	SecretsPassphrase = "passphrase"
+	SecretsKeyFile    = "keyfile"
+)
+
+// env variables read by the passphrase secrets provider of pulumi
+const (
+	passphraseEnv     = "PULUMI_CONFIG_PASSPHRASE"
+	passphraseFileEnv = "PULUMI_CONFIG_PASSPHRASE_FILE"
+)
+
+// SecretsConfig selects the key the secrets in the config and state of a
+// stack are encrypted with. Both providers use the passphrase secrets provider
+// of pulumi: passphrase reads the key from PULUMI_CONFIG_PASSPHRASE or
+// PULUMI_CONFIG_PASSPHRASE_FILE, shared by all stacks; keyfile reads the key
+// of the stack from KeyFile, which needs no key service.
+type SecretsConfig struct {
+	Provider string `json:"provider,omitempty" yaml:"provider,omitempty"`
+	KeyFile  string `json:"key_file,omitempty" yaml:"keyFile,omitempty"`
+}
+
+// Validate checks the provider and its settings
+func (s SecretsConfig) Validate() error {
+	switch s.Provider {
+	case "", SecretsPassphrase:
+		if s.KeyFile != "" {
+			return fmt.Errorf("keyFile requires provider %s", SecretsKeyFile)
+		}
+	case SecretsKeyFile:
+		if s.KeyFile == "" {
+			return fmt.Errorf("keyFile not set")
+		}
+	default:
+		return fmt.Errorf("provider %q: %v", s.Provider, ErrNotSupported)
+	}
+	return nil
+}
+
+// Key returns the key of the secrets provider
+func (s SecretsConfig) Key() (string, error) {
+	if s.Provider == SecretsKeyFile {
+		return ReadKeyFile(s.KeyFile)
+	}
+	if k := os.Getenv(passphraseEnv); k != "" {
+		return k, nil
+	}
+	if f := os.Getenv(passphraseFileEnv); f != "" {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	return "", fmt.Errorf("env variable %s not set", passphraseEnv)
+}
+
+// workspaceOptions returns the options of the workspace of the stack, which
+// pass the key of a key file to pulumi
+func (s SecretsConfig) workspaceOptions() ([]auto.LocalWorkspaceOption, error) {
+	if s.Provider != SecretsKeyFile {
+		return nil, nil
+	}
+	key, err := s.Key()
+	if err != nil {
+		return nil, fmt.Errorf("secrets key: %v", err)
+	}
+	return []auto.LocalWorkspaceOption{auto.EnvVars(map[string]string{passphraseEnv: key})}, nil
+}
+
+// ReadKeyFile reads a key from fpath; a trailing newline is dropped
+func ReadKeyFile(fpath string) (string, error) {
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimRight(string(b), "\r\n")
+	if key == "" {
+		return "", fmt.Errorf("%s: %v", fpath, ErrStringEmpty)
+	}
+	return key, nil
+}
+
+// GenerateKeyFile writes a random key to fpath, which must not exist
+func GenerateKeyFile(fpath string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := base64.StdEncoding.EncodeToString(b)
+	f, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(key + "\n"); err != nil {
+		return "", err
+	}
+	return key, f.Close()
+}
+
+// Rotation is the result of re-encrypting the secrets of a stack
+type Rotation struct {
+	// ConfigValues and StateValues count the secrets re-encrypted
+	ConfigValues int `json:"configValues"`
+	StateValues  int `json:"stateValues"`
+	// StateBackup and SettingsBackup are the backups of the state and the
+	// stack settings with the secrets under the old key
+	StateBackup    string `json:"stateBackup"`
+	SettingsBackup string `json:"settingsBackup"`
+
+	// the settings, state and key before the rotation, to undo it
+	settings *workspace.ProjectStack
+	state    apitype.UntypedDeployment
+	oldKey   string
+}
+
+// RotateSecrets re-encrypts the secrets in the stack config and the state
+// with newKey. The state and the stack settings are written to backupDir
+// first. The stack is verified to decrypt with newKey; if it does not, the
+// backups are restored. Afterwards the key of the secrets provider has to be
+// replaced by newKey.
+func (c *Controller) RotateSecrets(ctx context.Context, newKey, backupDir string) (*Rotation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stack == nil {
+		return nil, ErrStackNotInitialized
+	}
+	if newKey == "" {
+		return nil, fmt.Errorf("new key: %v", ErrStringEmpty)
+	}
+	oldKey, err := c.Config.Secrets.Key()
+	if err != nil {
+		return nil, fmt.Errorf("current key: %v", err)
+	}
+	ws := c.stack.Workspace()
+	ps, err := readStackSettings(c.stackSettingsFile())
+	if err != nil {
+		return nil, err
+	}
+	if ps.SecretsProvider != "" && ps.SecretsProvider != SecretsPassphrase {
+		return nil, fmt.Errorf("secrets provider %s: %v", ps.SecretsProvider, ErrNotSupported)
+	}
+	oldCrypter, err := passphraseCrypter(oldKey, ps.EncryptionSalt)
+	if err != nil {
+		return nil, fmt.Errorf("current key: %v", err)
+	}
+	if _, err := passphraseCrypter(newKey, ps.EncryptionSalt); err == nil {
+		return nil, fmt.Errorf("the new key is the current key")
+	}
+	newSalt, newCrypter, err := newPassphraseCrypter(newKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// back up the state and the settings under the old key
+	ws.SetEnvVar(passphraseEnv, oldKey)
+	current, err := c.stack.Export(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("backup: %v", err)
+	}
+	rot := &Rotation{settings: ps, state: current, oldKey: oldKey}
+	if rot.StateBackup, rot.SettingsBackup, err = c.backupSecrets(backupDir, current, ps); err != nil {
+		return nil, fmt.Errorf("backup: %v", err)
+	}
+
+	// re-encrypt the config and the state
+	newPs := *ps
+	newPs.EncryptionSalt = newSalt
+	newPs.Config = make(config.Map, len(ps.Config))
+	secrets := make(map[string]string)
+	for k, v := range ps.Config {
+		if newPs.Config[k], err = v.Copy(oldCrypter, newCrypter); err != nil {
+			return nil, fmt.Errorf("config %s: %v", k, err)
+		}
+		if v.Secure() {
+			if secrets[k.String()], err = v.Value(oldCrypter); err != nil {
+				return nil, fmt.Errorf("config %s: %v", k, err)
+			}
+			rot.ConfigValues++
+		}
+	}
+	d, plain, err := reencryptDeployment(current, oldCrypter, newCrypter, newSalt)
+	if err != nil {
+		return nil, fmt.Errorf("state: %v", err)
+	}
+	rot.StateValues = len(plain)
+
+	restore := func(cause error) error {
+		if err := c.undoRotation(ctx, rot); err != nil {
+			return fmt.Errorf("%v; %v; backups in %s", cause, err, backupDir)
+		}
+		return fmt.Errorf("%v; backups in %s", cause, backupDir)
+	}
+	if err := newPs.Save(c.stackSettingsFile()); err != nil {
+		return nil, restore(fmt.Errorf("save settings: %v", err))
+	}
+	ws.SetEnvVar(passphraseEnv, newKey)
+	if err := c.stack.Import(ctx, d); err != nil {
+		return nil, restore(fmt.Errorf("import state: %v", err))
+	}
+	c.dropDeployment(ctx)
+	if err := c.verifySecrets(ctx, newKey, secrets, plain); err != nil {
+		return nil, restore(fmt.Errorf("verify: %v", err))
+	}
+	return rot, nil
+}
+
+// UndoRotation restores the stack settings and the state of the stack as
+// they were before the rotation r, e.g. if the rotation of another stack
+// sharing the key failed
+func (c *Controller) UndoRotation(ctx context.Context, r *Rotation) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stack == nil {
+		return ErrStackNotInitialized
+	}
+	return c.undoRotation(ctx, r)
+}
+
+// undoRotation restores the settings and the state of r. c.mu is held.
+func (c *Controller) undoRotation(ctx context.Context, r *Rotation) error {
+	if r.settings == nil {
+		return fmt.Errorf("rotation of stack %s cannot be undone", c.StackName)
+	}
+	errs := make([]string, 0)
+	if err := r.settings.Save(c.stackSettingsFile()); err != nil {
+		errs = append(errs, fmt.Sprintf("restore settings: %v", err))
+	}
+	c.stack.Workspace().SetEnvVar(passphraseEnv, r.oldKey)
+	if err := c.stack.Import(ctx, r.state); err != nil {
+		errs = append(errs, fmt.Sprintf("restore state: %v", err))
+	}
+	c.dropDeployment(ctx)
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// RotateAllSecrets re-encrypts the secrets of the stacks of controllers cs,
+// which share the key of the passphrase provider, with newKey. If the
+// rotation of a stack fails, the stacks rotated before are restored, so that
+// all stacks keep the current key. The rotations are returned in the order
+// of cs.
+func RotateAllSecrets(ctx context.Context, cs []*Controller, newKey, backupDir string) ([]*Rotation, error) {
+	for _, c := range cs {
+		if p := c.Config.Secrets.Provider; p != "" && p != SecretsPassphrase {
+			return nil, fmt.Errorf("stack %s: secrets provider %s does not share the passphrase", c.StackName, p)
+		}
+	}
+	rots := make([]*Rotation, 0, len(cs))
+	for i, c := range cs {
+		r, err := c.RotateSecrets(ctx, newKey, backupDir)
+		if err == nil {
+			rots = append(rots, r)
+			continue
+		}
+		errs := []string{fmt.Sprintf("stack %s: %v", c.StackName, err)}
+		for j := i - 1; j >= 0; j-- {
+			if err := cs[j].UndoRotation(ctx, rots[j]); err != nil {
+				errs = append(errs, fmt.Sprintf("restore stack %s: %v; backups in %s and %s",
+					cs[j].StackName, err, rots[j].StateBackup, rots[j].SettingsBackup))
+			}
+		}
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return rots, nil
+}
+
+// stackSettingsFile returns the path of the stack settings in the workspace.
+// Workspace.StackSettings is not used, since it does not find existing
+// settings in this version of the automation api.
+func (c *Controller) stackSettingsFile() string {
+	return path.Join(c.stack.Workspace().WorkDir(), fmt.Sprintf("Pulumi.%s.yaml", c.StackName))
+}
+
+// readStackSettings reads the stack settings from fpath. Unlike
+// workspace.LoadProjectStack it does not cache them.
+func readStackSettings(fpath string) (*workspace.ProjectStack, error) {
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	ps := workspace.ProjectStack{}
+	if err := yaml.Unmarshal(b, &ps); err != nil {
+		return nil, fmt.Errorf("%s: %v", fpath, err)
+	}
+	return &ps, nil
+}
+
+// backupSecrets writes the state d and the stack settings ps to backupDir
+func (c *Controller) backupSecrets(backupDir string, d apitype.UntypedDeployment, ps *workspace.ProjectStack) (string, string, error) {
+	if err := os.MkdirAll(backupDir, 0700); err != nil {
+		return "", "", err
+	}
+	prefix := fmt.Sprintf("%s-%s-%s-rotate", c.ProjectType, c.StackName, time.Now().UTC().Format("20060102T150405Z"))
+	prefix = path.Join(backupDir, strings.ReplaceAll(prefix, "/", "-"))
+	b, err := json.MarshalIndent(d, "", "    ")
+	if err != nil {
+		return "", "", err
+	}
+	if err := WriteStateFile(prefix+".json", b); err != nil {
+		return "", "", err
+	}
+	s, err := yaml.Marshal(ps)
+	if err != nil {
+		return "", "", err
+	}
+	settingsFile := fmt.Sprintf("%s.Pulumi.%s.yaml", prefix, c.StackName)
+	if err := ioutil.WriteFile(settingsFile, s, 0600); err != nil {
+		return "", "", err
+	}
+	return prefix + ".json", settingsFile, nil
+}
+
+// verifySecrets checks that the config and the state of the stack decrypt
+// with key to the plaintexts of the secrets before the rotation
+func (c *Controller) verifySecrets(ctx context.Context, key string, configSecrets map[string]string, stateSecrets []string) error {
+	ps, err := readStackSettings(c.stackSettingsFile())
+	if err != nil {
+		return err
+	}
+	crypter, err := passphraseCrypter(key, ps.EncryptionSalt)
+	if err != nil {
+		return fmt.Errorf("settings: %v", err)
+	}
+	// pulumi decrypts the config
+	cm, err := c.stack.GetAllConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	for k, want := range configSecrets {
+		if v, ok := cm[k]; !ok || !v.Secret || v.Value != want {
+			return fmt.Errorf("config %s does not match", k)
+		}
+	}
+	d, err := c.stack.Export(ctx)
+	if err != nil {
+		return fmt.Errorf("state: %v", err)
+	}
+	_, plain, err := reencryptDeployment(d, crypter, nil, "")
+	if err != nil {
+		return fmt.Errorf("state: %v", err)
+	}
+	sort.Strings(plain)
+	want := append([]string{}, stateSecrets...)
+	sort.Strings(want)
+	if !reflect.DeepEqual(plain, want) {
+		return fmt.Errorf("state secrets do not match")
+	}
+	return nil
+}
+
+// passphraseCrypter returns the crypter of the passphrase secrets provider
+// for key and the salt of the stack settings, v1:<salt>:<encrypted check>
+func passphraseCrypter(key, salt string) (config.Crypter, error) {
+	parts := strings.SplitN(salt, ":", 3)
+	if len(parts) != 3 || parts[0] != "v1" {
+		return nil, fmt.Errorf("encryption salt: %v", ErrBadFormat)
+	}
+	b, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("encryption salt: %v", err)
+	}
+	crypter := config.NewSymmetricCrypterFromPassphrase(key, b)
+	if msg, err := crypter.DecryptValue(parts[2]); err != nil || msg != "pulumi" {
+		return nil, fmt.Errorf("incorrect key")
+	}
+	return crypter, nil
+}
+
+// newPassphraseCrypter returns a new salt and its crypter for key
+func newPassphraseCrypter(key string) (string, config.Crypter, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	crypter := config.NewSymmetricCrypterFromPassphrase(key, b)
+	msg, err := crypter.EncryptValue("pulumi")
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("v1:%s:%s", base64.StdEncoding.EncodeToString(b), msg), crypter, nil
+}
+
+// reencryptDeployment decrypts the secrets of deployment d with old and, if
+// new is set, encrypts them with new and sets salt as the state of the
+// secrets provider. It returns the new deployment and the plaintexts.
+func reencryptDeployment(d apitype.UntypedDeployment, old config.Decrypter, enc config.Encrypter, salt string) (apitype.UntypedDeployment, []string, error) {
+	dec := json.NewDecoder(bytes.NewReader(d.Deployment))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return d, nil, err
+	}
+	plain := make([]string, 0)
+	var walk func(v interface{}) error
+	walk = func(v interface{}) error {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			if t[resource.SigKey] == resource.SecretSig {
+				ct, ok := t["ciphertext"].(string)
+				if !ok {
+					return nil
+				}
+				p, err := old.DecryptValue(ct)
+				if err != nil {
+					return err
+				}
+				plain = append(plain, p)
+				if enc != nil {
+					if t["ciphertext"], err = enc.EncryptValue(p); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			for _, e := range t {
+				if err := walk(e); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for _, e := range t {
+				if err := walk(e); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(v); err != nil {
+		return d, nil, err
+	}
+	if enc == nil {
+		return d, plain, nil
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		if sp, ok := m["secrets_providers"].(map[string]interface{}); ok {
+			sp["state"] = map[string]string{"salt": salt}
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return d, nil, err
+	}
+	return apitype.UntypedDeployment{Version: d.Version, Deployment: b}, plain, nil
+}
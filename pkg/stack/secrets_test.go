@@ -0,0 +1,262 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+func setenv(t *testing.T, k, v string) {
+	t.Helper()
+	old, ok := os.LookupEnv(k)
+	if v == "" {
+		os.Unsetenv(k)
+	} else {
+		os.Setenv(k, v)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(k, old)
+		} else {
+			os.Unsetenv(k)
+		}
+	})
+}
+
+func TestSecretsConfigValidate(t *testing.T) {
+	tests := []struct {
+		s   SecretsConfig
+		err string
+	}{
+		{SecretsConfig{}, ""},
+		{SecretsConfig{Provider: SecretsPassphrase}, ""},
+		{SecretsConfig{Provider: SecretsKeyFile, KeyFile: "stack.key"}, ""},
+		{SecretsConfig{KeyFile: "stack.key"}, "keyFile requires provider keyfile"},
+		{SecretsConfig{Provider: SecretsKeyFile}, "keyFile not set"},
+		{SecretsConfig{Provider: "awskms"}, "not supported"},
+	}
+	for _, tt := range tests {
+		err := tt.s.Validate()
+		if tt.err == "" && err != nil {
+			t.Errorf("%+v: %v", tt.s, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%+v: err = %v; want %q", tt.s, err, tt.err)
+		}
+	}
+}
+
+func TestSecretsConfigKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := path.Join(dir, "stack.key")
+	if err := ioutil.WriteFile(keyFile, []byte("filekey\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	passFile := path.Join(dir, "passphrase")
+	if err := ioutil.WriteFile(passFile, []byte("passfile"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		s        SecretsConfig
+		pass     string
+		passFile string
+		key      string
+		err      string
+	}{
+		{"key file", SecretsConfig{Provider: SecretsKeyFile, KeyFile: keyFile}, "env", "", "filekey", ""},
+		{"passphrase env", SecretsConfig{}, "env", passFile, "env", ""},
+		{"passphrase file", SecretsConfig{}, "", passFile, "passfile", ""},
+		{"no passphrase", SecretsConfig{Provider: SecretsPassphrase}, "", "", "", "PULUMI_CONFIG_PASSPHRASE not set"},
+		{"missing key file", SecretsConfig{Provider: SecretsKeyFile, KeyFile: path.Join(dir, "none")}, "env", "", "", "no such file"},
+	}
+	for _, tt := range tests {
+		setenv(t, passphraseEnv, tt.pass)
+		setenv(t, passphraseFileEnv, tt.passFile)
+		key, err := tt.s.Key()
+		if tt.err == "" && (err != nil || key != tt.key) {
+			t.Errorf("%s: key = %q, %v; want %q", tt.name, key, err, tt.key)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: err = %v; want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		key     string
+		err     error
+	}{
+		{"key\n", "key", nil},
+		{"key\r\n", "key", nil},
+		{"key", "key", nil},
+		{"\n", "", ErrStringEmpty},
+	}
+	for i, tt := range tests {
+		fpath := path.Join(dir, "key")
+		if err := ioutil.WriteFile(fpath, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		key, err := ReadKeyFile(fpath)
+		if key != tt.key {
+			t.Errorf("%d: key = %q; want %q", i, key, tt.key)
+		}
+		if (err == nil) != (tt.err == nil) || (err != nil && !strings.HasSuffix(err.Error(), tt.err.Error())) {
+			t.Errorf("%d: err = %v; want %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestGenerateKeyFile(t *testing.T) {
+	fpath := path.Join(t.TempDir(), "stack.key")
+	key, err := GenerateKeyFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadKeyFile(fpath); err != nil || got != key {
+		t.Errorf("ReadKeyFile = %q, %v; want %q", got, err, key)
+	}
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v; want 0600", fi.Mode().Perm())
+	}
+	// an existing key is never overwritten
+	if _, err := GenerateKeyFile(fpath); !errors.Is(err, os.ErrExist) {
+		t.Errorf("err = %v; want %v", err, os.ErrExist)
+	}
+	if got, _ := ReadKeyFile(fpath); got != key {
+		t.Errorf("key overwritten")
+	}
+}
+
+func TestPassphraseCrypter(t *testing.T) {
+	salt, crypter, err := newPassphraseCrypter("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := crypter.EncryptValue("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := passphraseCrypter("key", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := c.DecryptValue(ct); err != nil || p != "s3cret" {
+		t.Errorf("DecryptValue = %q, %v; want %q", p, err, "s3cret")
+	}
+	if _, err := passphraseCrypter("other", salt); err == nil || err.Error() != "incorrect key" {
+		t.Errorf("wrong key: err = %v; want incorrect key", err)
+	}
+	for _, s := range []string{"", "v2:a:b", "v1:a"} {
+		if _, err := passphraseCrypter("key", s); err == nil {
+			t.Errorf("salt %q: no error", s)
+		}
+	}
+}
+
+func TestReencryptDeployment(t *testing.T) {
+	_, old, err := newPassphraseCrypter("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, enc, err := newPassphraseCrypter("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := old.EncryptValue("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := func(ct string) map[string]interface{} {
+		return map[string]interface{}{resource.SigKey: resource.SecretSig, "ciphertext": ct}
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"secrets_providers": map[string]interface{}{"type": "passphrase", "state": map[string]string{"salt": "old"}},
+		"resources": []interface{}{
+			map[string]interface{}{"outputs": map[string]interface{}{"password": secret(ct), "size": 12345678901234567}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := apitype.UntypedDeployment{Version: 3, Deployment: b}
+
+	// without an encrypter, the secrets are only decrypted
+	got, plain, err := reencryptDeployment(d, old, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plain, []string{"s3cret"}) || !reflect.DeepEqual(got, d) {
+		t.Errorf("decrypt only: %s, %v", got.Deployment, plain)
+	}
+
+	got, plain, err = reencryptDeployment(d, old, enc, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plain, []string{"s3cret"}) || got.Version != 3 {
+		t.Errorf("plain = %v, version = %d", plain, got.Version)
+	}
+	var v struct {
+		SecretsProviders struct {
+			State struct{ Salt string }
+		} `json:"secrets_providers"`
+		Resources []struct {
+			Outputs struct {
+				Password struct{ Ciphertext string }
+				Size     json.Number
+			}
+		}
+	}
+	if err := json.Unmarshal(got.Deployment, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.SecretsProviders.State.Salt != salt {
+		t.Errorf("salt = %q; want %q", v.SecretsProviders.State.Salt, salt)
+	}
+	o := v.Resources[0].Outputs
+	if p, err := enc.DecryptValue(o.Password.Ciphertext); err != nil || p != "s3cret" {
+		t.Errorf("DecryptValue = %q, %v; want %q", p, err, "s3cret")
+	}
+	if o.Size != "12345678901234567" {
+		t.Errorf("size = %s; want 12345678901234567", o.Size)
+	}
+
+	// a wrong key fails
+	if _, _, err := reencryptDeployment(d, enc, enc, salt); err == nil {
+		t.Errorf("wrong key: no error")
+	}
+}
@@ -0,0 +1,354 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/constant"
+	"github.com/sapcc/vcf-automation/pkg/runlog"
+)
+
+// Selection selects the resources of a targeted refresh or update. Targets,
+// Replace and Exclude are urns or patterns of resource names or urns, in
+// which * matches any characters. They are resolved against the resources in
+// the state of the stack, so resources which do not exist yet can't be
+// selected.
+type Selection struct {
+	// Operation is RunRefresh or RunUpdate
+	Operation string `json:"operation"`
+	// Targets are the resources to refresh or update, all if empty
+	Targets []string `json:"targets,omitempty"`
+	// Replace are the resources the update replaces; they are targeted
+	// as well if the update is targeted
+	Replace []string `json:"replace,omitempty"`
+	// Exclude are the resources left out of the targets
+	Exclude []string `json:"exclude,omitempty"`
+	// TargetDependents targets the resources depending on the targets too
+	TargetDependents bool `json:"targetDependents,omitempty"`
+}
+
+// Validate checks the operation and the options it supports
+func (s *Selection) Validate() error {
+	switch s.Operation {
+	case RunRefresh:
+		if len(s.Replace) > 0 || s.TargetDependents {
+			return fmt.Errorf("refresh does not replace resources or target dependents")
+		}
+	case RunUpdate:
+	default:
+		return fmt.Errorf("operation %q: %v", s.Operation, ErrNotSupported)
+	}
+	if len(s.Targets) == 0 && len(s.Replace) == 0 && len(s.Exclude) == 0 {
+		return fmt.Errorf("no resources selected")
+	}
+	return nil
+}
+
+// ResolvedSelection are the urns of a selection. Targets is empty if the
+// operation is not targeted.
+type ResolvedSelection struct {
+	Targets []string `json:"targets,omitempty"`
+	Replace []string `json:"replace,omitempty"`
+}
+
+// ResolveSelection resolves the patterns of s against the resources in the
+// state. A pattern matching no resource is an error. It is resolved again
+// when the operation runs, since the state might have changed.
+func (c *Controller) ResolveSelection(ctx context.Context, s *Selection) (*ResolvedSelection, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	d, err := c.Deployment(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read state: %v", err)
+	}
+	return resolveSelection(selectableURNs(d.Resources), s)
+}
+
+// resolveSelection resolves the patterns of s against urns
+func resolveSelection(urns []string, s *Selection) (*ResolvedSelection, error) {
+	var err error
+	r := &ResolvedSelection{}
+	if r.Replace, err = matchURNs(urns, s.Replace); err != nil {
+		return nil, fmt.Errorf("replace: %v", err)
+	}
+	exclude, err := matchURNs(urns, s.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("exclude: %v", err)
+	}
+	if len(s.Targets) == 0 && len(exclude) == 0 {
+		// untargeted update replacing some resources
+		return r, nil
+	}
+	targets := urns
+	if len(s.Targets) > 0 {
+		if targets, err = matchURNs(urns, s.Targets); err != nil {
+			return nil, fmt.Errorf("targets: %v", err)
+		}
+		targets = union(targets, r.Replace)
+	}
+	excluded := make(map[string]bool)
+	for _, u := range exclude {
+		excluded[u] = true
+	}
+	for _, u := range targets {
+		if !excluded[u] {
+			r.Targets = append(r.Targets, u)
+		}
+	}
+	if len(r.Targets) == 0 {
+		return nil, fmt.Errorf("all targets are excluded")
+	}
+	for _, u := range r.Replace {
+		if excluded[u] {
+			return nil, fmt.Errorf("%s is replaced and excluded", u)
+		}
+	}
+	return r, nil
+}
+
+// selectableURNs are the urns of the resources in the state, without the
+// stack and the providers
+func selectableURNs(resources []apitype.ResourceV3) []string {
+	urns := make([]string, 0, len(resources))
+	for _, r := range resources {
+		t := string(r.Type)
+		if r.Delete || t == "pulumi:pulumi:Stack" || strings.HasPrefix(t, "pulumi:providers:") {
+			continue
+		}
+		urns = append(urns, string(r.URN))
+	}
+	return urns
+}
+
+// matchURNs returns the urns matching any of the patterns. A pattern matches
+// the urn, or the name of the resource, the last part of the urn.
+func matchURNs(urns, patterns []string) ([]string, error) {
+	matched := make(map[string]bool)
+	for _, p := range patterns {
+		re, err := regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(p), `\*`, ".*") + "$")
+		if err != nil {
+			return nil, err
+		}
+		n := 0
+		for _, u := range urns {
+			name := u[strings.LastIndex(u, "::")+2:]
+			if re.MatchString(u) || re.MatchString(name) {
+				matched[u] = true
+				n++
+			}
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("%s matches no resource", p)
+		}
+	}
+	l := make([]string, 0, len(matched))
+	for u := range matched {
+		l = append(l, u)
+	}
+	sort.Strings(l)
+	return l, nil
+}
+
+func union(a, b []string) []string {
+	seen := make(map[string]bool)
+	l := make([]string, 0, len(a)+len(b))
+	for _, s := range append(append([]string{}, a...), b...) {
+		if !seen[s] {
+			seen[s] = true
+			l = append(l, s)
+		}
+	}
+	sort.Strings(l)
+	return l
+}
+
+// runSelected runs the operation of sel on the selected resources
+func (c *Controller) runSelected(ctx context.Context, sel *Selection) error {
+	switch sel.Operation {
+	case RunRefresh:
+		c.setState(StateRefreshing)
+		_, err := c.RefreshStackSelection(ctx, sel)
+		return err
+	case RunUpdate:
+		c.setState(StateUpdating)
+		_, err := c.UpdateStackSelection(ctx, sel)
+		return err
+	}
+	return fmt.Errorf("operation %q: %v", sel.Operation, ErrNotSupported)
+}
+
+// refreshSelection refreshes the resources selected by sel. c.mu is held.
+func (c *Controller) refreshSelection(ctx context.Context, sel *Selection) (auto.RefreshResult, error) {
+	r, err := c.ResolveSelection(ctx, sel)
+	if err != nil {
+		return auto.RefreshResult{}, err
+	}
+	args := []string{"refresh", "--yes", "--skip-preview"}
+	for _, u := range r.Targets {
+		args = append(args, "--target", u)
+	}
+	res := auto.RefreshResult{}
+	res.StdOut, res.StdErr, res.Summary, err = c.runSelection(ctx, RunRefresh, sel, args)
+	return res, err
+}
+
+// updateSelection updates and replaces the resources selected by sel. c.mu
+// is held.
+func (c *Controller) updateSelection(ctx context.Context, sel *Selection) (auto.UpResult, error) {
+	r, err := c.ResolveSelection(ctx, sel)
+	if err != nil {
+		return auto.UpResult{}, err
+	}
+	args := []string{"up", "--yes", "--skip-preview"}
+	for _, u := range r.Targets {
+		args = append(args, "--target", u)
+	}
+	for _, u := range r.Replace {
+		args = append(args, "--replace", u)
+	}
+	if sel.TargetDependents {
+		args = append(args, "--target-dependents")
+	}
+	res := auto.UpResult{}
+	res.StdOut, res.StdErr, res.Summary, err = c.runSelection(ctx, RunUpdate, sel, args)
+	if err != nil {
+		return res, err
+	}
+	if res.Outputs, err = c.stack.Outputs(ctx); err != nil {
+		return res, fmt.Errorf("read outputs: %v", err)
+	}
+	printStackOutputs(res.Outputs)
+	return res, nil
+}
+
+// runSelection runs the Pulumi CLI with args in the workspace of the stack
+// and records the run of kind from its event log. The automation api of this
+// Pulumi version passes --target and --replace as invalid arguments, so
+// operations on selected resources run the CLI like tagStack. Inline
+// programs are served to the CLI by an inlineServer.
+func (c *Controller) runSelection(ctx context.Context, kind string, sel *Selection, args []string) (string, string, auto.UpdateSummary, error) {
+	ws := c.stack.Workspace()
+	if program := ws.Program(); program != nil {
+		server, err := startInlineServer(program)
+		if err != nil {
+			return "", "", auto.UpdateSummary{}, fmt.Errorf("serve inline program: %v", err)
+		}
+		defer server.Close()
+		args = append(args, "--client="+server.address, "--exec-kind="+constant.ExecKindAutoInline)
+	} else {
+		args = append(args, "--exec-kind="+constant.ExecKindAutoLocal)
+	}
+	dir, err := ioutil.TempDir("", "automation-selection-")
+	if err != nil {
+		return "", "", auto.UpdateSummary{}, err
+	}
+	defer os.RemoveAll(dir)
+	eventLog := filepath.Join(dir, "eventlog.txt")
+
+	prov := c.provenance()
+	prov.Selection = sel
+	c.tagStack(ctx, prov)
+	extra, err := ws.SerializeArgsForOp(ctx, c.StackName)
+	if err != nil {
+		return "", "", auto.UpdateSummary{}, err
+	}
+	args = append(args, "--message="+prov.Message(kind), "--event-log", eventLog)
+	args = append(args, extra...)
+	args = append(args, "--stack", c.StackName, "--non-interactive")
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "pulumi", args...)
+	cmd.Dir = ws.WorkDir()
+	cmd.Env = workspaceEnv(ws)
+	cmd.Stdout = &stdout
+	if c.progress != nil {
+		cmd.Stdout = io.MultiWriter(&stdout, c.progress)
+	}
+	cmd.Stderr = &stderr
+
+	rec := c.startRun(kind)
+	err = cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("%s: %v: %s", kind, err, strings.TrimSpace(stderr.String()))
+	}
+	replayEvents(eventLog, rec)
+	c.finishRun(rec, err)
+	err = c.lockError(err)
+	if err != nil {
+		return stdout.String(), stderr.String(), auto.UpdateSummary{}, err
+	}
+	if err := ws.PostCommandCallback(ctx, c.StackName); err != nil {
+		return stdout.String(), stderr.String(), auto.UpdateSummary{}, err
+	}
+	h, err := c.stack.History(ctx, 1, 1)
+	if err != nil || len(h) == 0 {
+		return stdout.String(), stderr.String(), auto.UpdateSummary{}, fmt.Errorf("read summary: %v", err)
+	}
+	return stdout.String(), stderr.String(), h[0], nil
+}
+
+// workspaceEnv returns the environment of the Pulumi CLI run in workspace ws
+func workspaceEnv(ws auto.Workspace) []string {
+	env := os.Environ()
+	if home := ws.PulumiHome(); home != "" {
+		env = append(env, "PULUMI_HOME="+home)
+	}
+	for k, v := range ws.GetEnvVars() {
+		env = append(env, k+"="+v)
+	}
+	return env
+}
+
+// replayEvents sends the engine events of the event log file to the
+// recorder and closes its channel
+func replayEvents(path string, rec *runlog.Recorder) {
+	ch := rec.Events()
+	defer close(ch)
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		e := apitype.EngineEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		ch <- events.EngineEvent{EngineEvent: e}
+	}
+}
@@ -0,0 +1,191 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/sapcc/vcf-automation/pkg/runlog"
+)
+
+const (
+	urnN01    = "urn:pulumi:m1::vcf::openstack:compute/instanceV2:InstanceV2::n01"
+	urnN02    = "urn:pulumi:m1::vcf::openstack:compute/instanceV2:InstanceV2::n02"
+	urnVolume = "urn:pulumi:m1::vcf::openstack:blockstorage/volumeV3:VolumeV3::n01-data"
+	urnStack  = "urn:pulumi:m1::vcf::pulumi:pulumi:Stack::vcf-m1"
+	urnProv   = "urn:pulumi:m1::vcf::pulumi:providers:openstack::default"
+)
+
+func TestSelectionValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		s    Selection
+		err  string
+	}{
+		{"refresh targets", Selection{Operation: RunRefresh, Targets: []string{"n01"}}, ""},
+		{"refresh exclude", Selection{Operation: RunRefresh, Exclude: []string{"n01"}}, ""},
+		{"update replace", Selection{Operation: RunUpdate, Replace: []string{"n01"}, TargetDependents: true}, ""},
+		{"refresh replace", Selection{Operation: RunRefresh, Replace: []string{"n01"}}, "refresh does not replace"},
+		{"refresh dependents", Selection{Operation: RunRefresh, Targets: []string{"n01"}, TargetDependents: true}, "refresh does not replace"},
+		{"nothing selected", Selection{Operation: RunUpdate, TargetDependents: true}, "no resources selected"},
+		{"destroy", Selection{Operation: "destroy", Targets: []string{"n01"}}, "not supported"},
+	}
+	for _, tt := range tests {
+		err := tt.s.Validate()
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: err = %v; want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestSelectableURNs(t *testing.T) {
+	resources := []apitype.ResourceV3{
+		{URN: urnStack, Type: "pulumi:pulumi:Stack"},
+		{URN: urnProv, Type: "pulumi:providers:openstack"},
+		{URN: urnN01, Type: "openstack:compute/instanceV2:InstanceV2"},
+		{URN: urnN02, Type: "openstack:compute/instanceV2:InstanceV2", Delete: true},
+		{URN: urnVolume, Type: "openstack:blockstorage/volumeV3:VolumeV3"},
+	}
+	want := []string{urnN01, urnVolume}
+	if got := selectableURNs(resources); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestMatchURNs(t *testing.T) {
+	urns := []string{urnN01, urnN02, urnVolume}
+	tests := []struct {
+		patterns []string
+		want     []string
+		err      string
+	}{
+		{nil, []string{}, ""},
+		{[]string{"n01"}, []string{urnN01}, ""},
+		{[]string{urnN02}, []string{urnN02}, ""},
+		{[]string{"n0*"}, []string{urnVolume, urnN01, urnN02}, ""},
+		{[]string{"*::n01*"}, []string{urnVolume, urnN01}, ""},
+		{[]string{"*VolumeV3*", "n01"}, []string{urnVolume, urnN01}, ""},
+		// patterns are no regexps
+		{[]string{"n0."}, nil, "n0. matches no resource"},
+		{[]string{"n01", "n03"}, nil, "n03 matches no resource"},
+	}
+	for _, tt := range tests {
+		got, err := matchURNs(urns, tt.patterns)
+		if tt.err == "" && (err != nil || !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("%v: got %v, %v; want %v", tt.patterns, got, err, tt.want)
+		}
+		if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%v: err = %v; want %q", tt.patterns, err, tt.err)
+		}
+	}
+}
+
+func TestResolveSelection(t *testing.T) {
+	urns := []string{urnN01, urnN02, urnVolume}
+	tests := []struct {
+		name string
+		s    Selection
+		want ResolvedSelection
+		err  string
+	}{
+		{
+			name: "unknown target",
+			s:    Selection{Operation: RunRefresh, Targets: []string{"n0?", "n01"}},
+			err:  "targets: n0? matches no resource",
+		},
+		{
+			name: "targets and replace",
+			s:    Selection{Operation: RunUpdate, Targets: []string{"n01"}, Replace: []string{"n02"}},
+			want: ResolvedSelection{Targets: []string{urnN01, urnN02}, Replace: []string{urnN02}},
+		},
+		{
+			name: "untargeted replace",
+			s:    Selection{Operation: RunUpdate, Replace: []string{"n02"}},
+			want: ResolvedSelection{Replace: []string{urnN02}},
+		},
+		{
+			name: "exclude",
+			s:    Selection{Operation: RunRefresh, Exclude: []string{"*data"}},
+			want: ResolvedSelection{Targets: []string{urnN01, urnN02}, Replace: []string{}},
+		},
+		{
+			name: "targets and exclude",
+			s:    Selection{Operation: RunRefresh, Targets: []string{"n0*"}, Exclude: []string{"n01"}},
+			want: ResolvedSelection{Targets: []string{urnVolume, urnN02}, Replace: []string{}},
+		},
+		{
+			name: "all excluded",
+			s:    Selection{Operation: RunRefresh, Targets: []string{"n01"}, Exclude: []string{"n0*"}},
+			err:  "all targets are excluded",
+		},
+		{
+			name: "replaced and excluded",
+			s:    Selection{Operation: RunUpdate, Replace: []string{"n01"}, Exclude: []string{"n01"}},
+			err:  urnN01 + " is replaced and excluded",
+		},
+		{
+			name: "unknown exclude",
+			s:    Selection{Operation: RunUpdate, Exclude: []string{"n03"}},
+			err:  "exclude: n03 matches no resource",
+		},
+	}
+	for _, tt := range tests {
+		got, err := resolveSelection(urns, &tt.s)
+		if tt.err == "" && (err != nil || !reflect.DeepEqual(*got, tt.want)) {
+			t.Errorf("%s: got %+v, %v; want %+v", tt.name, got, err, tt.want)
+		}
+		if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%s: err = %v; want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestReplayEvents(t *testing.T) {
+	eventLog := path.Join(t.TempDir(), "eventlog.txt")
+	lines := []string{
+		`{"sequence":1,"timestamp":1,"preludeEvent":{"config":{}}}`,
+		`{"sequence":2,"timestamp":1,"resourcePreEvent":{"metadata":{"op":"create","urn":"` + urnN01 + `","type":"openstack:compute/instanceV2:InstanceV2","provider":""}}}`,
+		`not json`,
+		`{"sequence":3,"timestamp":2,"resOutputsEvent":{"metadata":{"op":"create","urn":"` + urnN01 + `","type":"openstack:compute/instanceV2:InstanceV2","provider":""}}}`,
+	}
+	if err := ioutil.WriteFile(eventLog, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rec := runlog.NewRecorder("vcf", "m1", RunUpdate)
+	replayEvents(eventLog, rec)
+	run := rec.Finish(nil)
+	if len(run.Operations) != 1 || run.Operations[0].URN != urnN01 || run.Operations[0].Status != runlog.StatusSucceeded {
+		t.Errorf("operations = %+v; want the creation of n01", run.Operations)
+	}
+
+	// a missing event log closes the channel too
+	rec = runlog.NewRecorder("vcf", "m1", RunUpdate)
+	replayEvents(path.Join(t.TempDir(), "none"), rec)
+	if run := rec.Finish(nil); len(run.Operations) != 0 {
+		t.Errorf("operations = %+v; want none", run.Operations)
+	}
+}
@@ -0,0 +1,226 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/sapcc/vcf-automation/pkg/settings"
+	"github.com/sapcc/vcf-automation/pkg/snapshot"
+	log "github.com/sirupsen/logrus"
+)
+
+// Operations of a ResourceChange
+const (
+	ResourceCreate = "create"
+	ResourceDelete = "delete"
+	ResourceUpdate = "update"
+)
+
+var (
+	snapshotStore     *snapshot.Store
+	snapshotStoreErr  error
+	snapshotStoreOnce sync.Once
+)
+
+// ResourceChange is the change of a resource between two deployments. Fields
+// lists the changed fields of an update, e.g. id or outputs.allFixedIps.
+type ResourceChange struct {
+	Op     string   `json:"op"`
+	URN    string   `json:"urn"`
+	Type   string   `json:"type"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+// SnapshotStore returns the snapshot store of the settings
+func SnapshotStore() (*snapshot.Store, error) {
+	snapshotStoreOnce.Do(func() {
+		s := settings.Get()
+		snapshotStore, snapshotStoreErr = snapshot.Open(context.Background(), s.SnapshotURL,
+			snapshot.Retention{Keep: s.SnapshotKeep, MaxAge: s.SnapshotMaxAge})
+	})
+	return snapshotStore, snapshotStoreErr
+}
+
+// snapshotState saves the deployment of the stack to the snapshot store. A
+// stack without resources is not saved.
+func (c *Controller) snapshotState(ctx context.Context, reason string) error {
+	store, err := SnapshotStore()
+	if err != nil {
+		return err
+	}
+	version, err := c.updateVersion(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := c.ExportState(ctx)
+	if err != nil {
+		return err
+	}
+	d, err := parseDeploymentV3(b)
+	if err != nil {
+		return err
+	}
+	if len(d.Resources) == 0 {
+		return nil
+	}
+	project, stackName := c.GetProjectStackName()
+	snap, err := store.Save(ctx, project, stackName, version, reason, b)
+	if snap == nil {
+		return err
+	}
+	logger := log.WithFields(log.Fields{"project": c.ProjectType, "stack": c.StackName})
+	if err != nil {
+		logger.WithError(err).Warn("snapshot retention failed")
+	}
+	logger.Infof("saved state snapshot %s", snap.ID)
+	return nil
+}
+
+// Snapshots lists the snapshots of the stack, newest first
+func (c *Controller) Snapshots(ctx context.Context) ([]snapshot.Snapshot, error) {
+	store, err := SnapshotStore()
+	if err != nil {
+		return nil, err
+	}
+	project, stackName := c.GetProjectStackName()
+	return store.List(ctx, project, stackName)
+}
+
+// DiffSnapshot returns the changes of the resources restoring the snapshot
+// would make to the current deployment of the stack.
+func (c *Controller) DiffSnapshot(ctx context.Context, id string) (*snapshot.Snapshot, []ResourceChange, error) {
+	snap, b, err := c.readSnapshot(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	current, err := c.ExportState(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	from, err := parseDeploymentV3(current)
+	if err != nil {
+		return nil, nil, err
+	}
+	to, err := parseDeploymentV3(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("snapshot %s: %v", snap.ID, err)
+	}
+	return snap, DiffResources(from.Resources, to.Resources), nil
+}
+
+// RestoreSnapshot imports the snapshot into the stack. The current
+// deployment is backed up to backupDir first, see ImportState; like there,
+// an error wrapping ErrStackNotStopped is returned if the controller loop
+// runs.
+func (c *Controller) RestoreSnapshot(ctx context.Context, id, backupDir string) (*snapshot.Snapshot, string, error) {
+	// refuse early instead of reading the snapshot; ImportState checks the
+	// state again while holding the locks
+	state, _ := c.State()
+	if err := c.checkStopped(state); err != nil {
+		return nil, "", err
+	}
+	snap, b, err := c.readSnapshot(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	backup, err := c.ImportState(ctx, b, backupDir)
+	return snap, backup, err
+}
+
+func (c *Controller) readSnapshot(ctx context.Context, id string) (*snapshot.Snapshot, []byte, error) {
+	if c.stack == nil {
+		return nil, nil, ErrStackNotInitialized
+	}
+	store, err := SnapshotStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	project, stackName := c.GetProjectStackName()
+	return store.Get(ctx, project, stackName, id)
+}
+
+// DiffResources compares the resources of two deployments by urn. Resources
+// only in to are created, resources only in from are deleted.
+func DiffResources(from, to []apitype.ResourceV3) []ResourceChange {
+	old := make(map[string]apitype.ResourceV3, len(from))
+	for _, r := range from {
+		old[string(r.URN)] = r
+	}
+	changes := make([]ResourceChange, 0)
+	seen := make(map[string]bool, len(to))
+	for _, r := range to {
+		urn := string(r.URN)
+		seen[urn] = true
+		o, ok := old[urn]
+		if !ok {
+			changes = append(changes, ResourceChange{Op: ResourceCreate, URN: urn, Type: r.Type.String()})
+			continue
+		}
+		if fields := changedFields(o, r); len(fields) > 0 {
+			changes = append(changes, ResourceChange{Op: ResourceUpdate, URN: urn, Type: r.Type.String(), Fields: fields})
+		}
+	}
+	for _, r := range from {
+		if !seen[string(r.URN)] {
+			changes = append(changes, ResourceChange{Op: ResourceDelete, URN: string(r.URN), Type: r.Type.String()})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].URN < changes[j].URN })
+	return changes
+}
+
+func changedFields(a, b apitype.ResourceV3) []string {
+	fields := make([]string, 0)
+	if a.ID != b.ID {
+		fields = append(fields, "id")
+	}
+	if a.Parent != b.Parent {
+		fields = append(fields, "parent")
+	}
+	if a.Delete != b.Delete {
+		fields = append(fields, "delete")
+	}
+	fields = append(fields, changedKeys("inputs", a.Inputs, b.Inputs)...)
+	fields = append(fields, changedKeys("outputs", a.Outputs, b.Outputs)...)
+	return fields
+}
+
+func changedKeys(prefix string, a, b map[string]interface{}) []string {
+	keys := make(map[string]bool)
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	changed := make([]string, 0)
+	for k := range keys {
+		if !reflect.DeepEqual(a[k], b[k]) {
+			changed = append(changed, prefix+"."+k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -22,15 +22,27 @@ import (
 	"context"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optpreview"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optrefresh"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
 )
 
 type Stack interface {
 	Workspace() auto.Workspace
-	Refresh(context.Context) error
-	Update(context.Context) (auto.UpResult, error)
+	Preview(context.Context, ...optpreview.Option) (auto.PreviewResult, error)
+	Refresh(context.Context, ...optrefresh.Option) (auto.RefreshResult, error)
+	Update(context.Context, ...optup.Option) (auto.UpResult, error)
+	Destroy(context.Context, ...optdestroy.Option) (auto.DestroyResult, error)
 	SetConfig(context.Context, string, auto.ConfigValue) error
 	SetAllConfig(context.Context, auto.ConfigMap) error
+	GetAllConfig(context.Context) (auto.ConfigMap, error)
+	RemoveAllConfig(context.Context, []string) error
 	Outputs(context.Context) (auto.OutputMap, error)
+	Export(context.Context) (apitype.UntypedDeployment, error)
+	Import(context.Context, apitype.UntypedDeployment) error
+	History(context.Context, int, int) ([]auto.UpdateSummary, error)
 
 	GetState() interface{}
 	GetError() error
@@ -21,13 +21,18 @@ package stack
 import (
 	"context"
 	"fmt"
-	"os"
 
+	"github.com/pulumi/pulumi-openstack/sdk/v3/go/openstack/compute"
 	"github.com/pulumi/pulumi/sdk/v3/go/auto"
 	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optrefresh"
 	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 )
 
+// exampleProjectName is the name of the pulumi project in Pulumi.yaml
+const exampleProjectName = "example"
+
 type ExampleStack struct {
 	*auto.Stack
 	state ExampleState
@@ -37,8 +42,11 @@ type ExampleState struct {
 	err error
 }
 
-func InitExampleStack(ctx context.Context, stackName, projectDir string) (ExampleStack, error) {
-	s, err := auto.UpsertStackLocalSource(ctx, stackName, projectDir)
+// InitExampleStack creates or selects the stack of the example program, which
+// is built into the binary.
+func InitExampleStack(ctx context.Context, stackName, projectDir string, opts ...auto.LocalWorkspaceOption) (ExampleStack, error) {
+	opts = append([]auto.LocalWorkspaceOption{auto.WorkDir(projectDir)}, opts...)
+	s, err := auto.UpsertStackInlineSource(ctx, stackName, exampleProjectName, exampleProgram, opts...)
 	if err != nil {
 		e := fmt.Errorf("failed to create/select stack: %v", err)
 		return ExampleStack{}, e
@@ -46,6 +54,27 @@ func InitExampleStack(ctx context.Context, stackName, projectDir string) (Exampl
 	return ExampleStack{Stack: &s}, nil
 }
 
+// exampleProgram creates an openstack compute instance and exports its ip
+func exampleProgram(ctx *pulumi.Context) error {
+	// Create an OpenStack resource (Compute Instance)
+	instance, err := compute.NewInstance(ctx, "test", &compute.InstanceArgs{
+		FlavorName: pulumi.String("m1.small"),
+		ImageName:  pulumi.String("ubuntu-18.04-amd64-vmware"),
+		Networks: compute.InstanceNetworkArray{
+			compute.InstanceNetworkArgs{
+				Name: pulumi.String("d067954"),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Export the IP of the instance
+	ctx.Export("InstanceIP", instance.AccessIpV4)
+	return nil
+}
+
 // Config set stack configuration
 func (s ExampleStack) Configure(ctx context.Context, cfg *Config) error {
 	// props := cfg.Props
@@ -70,19 +99,17 @@ func (s ExampleStack) GenYaml(ctx context.Context, cfg *Config) ([]byte, error)
 	return nil, fmt.Errorf("not implemented")
 }
 
-func (s ExampleStack) Refresh(ctx context.Context) error {
-	if res, err := s.Stack.Refresh(ctx); err != nil {
+func (s ExampleStack) Refresh(ctx context.Context, opts ...optrefresh.Option) (auto.RefreshResult, error) {
+	res, err := s.Stack.Refresh(ctx, opts...)
+	if err != nil {
 		s.state.err = err
-		return err
-	} else {
-		fmt.Println(res)
-		return nil
+		return auto.RefreshResult{}, err
 	}
+	return res, nil
 }
 
-func (s ExampleStack) Update(ctx context.Context) (auto.UpResult, error) {
-	stdoutStreamer := optup.ProgressStreams(os.Stdout)
-	res, err := s.Stack.Up(ctx, stdoutStreamer)
+func (s ExampleStack) Update(ctx context.Context, opts ...optup.Option) (auto.UpResult, error) {
+	res, err := s.Stack.Up(ctx, opts...)
 	if err != nil {
 		s.state.err = err
 		return auto.UpResult{}, err
@@ -90,15 +117,13 @@ func (s ExampleStack) Update(ctx context.Context) (auto.UpResult, error) {
 	return res, nil
 }
 
-func (s ExampleStack) Destroy(ctx context.Context) error {
-	stdoutStreamer := optdestroy.ProgressStreams(os.Stdout)
-	if res, err := s.Stack.Destroy(ctx, stdoutStreamer); err != nil {
+func (s ExampleStack) Destroy(ctx context.Context, opts ...optdestroy.Option) (auto.DestroyResult, error) {
+	res, err := s.Stack.Destroy(ctx, opts...)
+	if err != nil {
 		s.state.err = err
-		return err
-	} else {
-		fmt.Println(res)
-		return nil
+		return auto.DestroyResult{}, err
 	}
+	return res, nil
 }
 
 func (s ExampleStack) GetState() interface{} {
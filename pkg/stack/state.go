@@ -0,0 +1,160 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+// StateChecksum returns the sha256 checksum of an exported state
+func StateChecksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyStateChecksum compares the checksum of state b with checksum
+func VerifyStateChecksum(b []byte, checksum string) error {
+	if got := StateChecksum(b); got != strings.ToLower(checksum) {
+		return fmt.Errorf("%v: expected %s, got %s", ErrChecksumMismatch, checksum, got)
+	}
+	return nil
+}
+
+// WriteStateFile writes the state to fpath and its checksum, in the format of
+// sha256sum, to fpath.sha256
+func WriteStateFile(fpath string, b []byte) error {
+	if err := ioutil.WriteFile(fpath, b, 0600); err != nil {
+		return err
+	}
+	sum := fmt.Sprintf("%s  %s\n", StateChecksum(b), path.Base(fpath))
+	return ioutil.WriteFile(fpath+".sha256", []byte(sum), 0644)
+}
+
+// ReadStateFile reads the state from fpath and verifies it against checksum,
+// or against the checksum in fpath.sha256 if checksum is empty.
+func ReadStateFile(fpath, checksum string) ([]byte, error) {
+	b, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	if checksum == "" {
+		s, err := ioutil.ReadFile(fpath + ".sha256")
+		if err != nil {
+			return nil, fmt.Errorf("checksum of %s: %v", fpath, err)
+		}
+		fields := strings.Fields(string(s))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("checksum of %s: %v", fpath, ErrBadFormat)
+		}
+		checksum = fields[0]
+	}
+	if err := VerifyStateChecksum(b, checksum); err != nil {
+		return nil, fmt.Errorf("%s: %v", fpath, err)
+	}
+	return b, nil
+}
+
+// ExportState returns the deployment of the stack, as written by
+// `pulumi stack export`.
+func (c *Controller) ExportState(ctx context.Context) ([]byte, error) {
+	if c.stack == nil {
+		return nil, ErrStackNotInitialized
+	}
+	d, err := c.stack.Export(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(d, "", "    ")
+}
+
+// ImportState replaces the deployment of the stack with state b. The current
+// deployment is written to backupDir first; the path of the backup is
+// returned. The controller loop must not run, else an error wrapping
+// ErrStackNotStopped is returned.
+func (c *Controller) ImportState(ctx context.Context, b []byte, backupDir string) (string, error) {
+	// mu and stateMu are held for the whole import, so that neither a stack
+	// operation nor the loop runs meanwhile, see unlock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if err := c.checkStopped(c.state); err != nil {
+		return "", err
+	}
+	if c.stack == nil {
+		return "", ErrStackNotInitialized
+	}
+	d, err := parseDeployment(b)
+	if err != nil {
+		return "", err
+	}
+	current, err := c.ExportState(ctx)
+	if err != nil {
+		return "", fmt.Errorf("backup: %v", err)
+	}
+	if err := os.MkdirAll(backupDir, 0700); err != nil {
+		return "", fmt.Errorf("backup: %v", err)
+	}
+	fname := fmt.Sprintf("%s-%s-%s.json", c.ProjectType, c.StackName, time.Now().UTC().Format("20060102T150405Z"))
+	backup := path.Join(backupDir, strings.ReplaceAll(fname, "/", "-"))
+	if err := WriteStateFile(backup, current); err != nil {
+		return "", fmt.Errorf("backup: %v", err)
+	}
+	err = c.stack.Import(ctx, d)
+	c.dropDeployment(ctx)
+	return backup, err
+}
+
+// checkStopped returns an error wrapping ErrStackNotStopped unless the
+// controller loop is stopped or has never been started
+func (c *Controller) checkStopped(state string) error {
+	switch state {
+	case StateStopped, StatePending:
+		return nil
+	}
+	return fmt.Errorf("stack %s is %s: %w", c.StackName, strings.ToLower(state), ErrStackNotStopped)
+}
+
+func parseDeployment(b []byte) (apitype.UntypedDeployment, error) {
+	d := apitype.UntypedDeployment{}
+	if err := json.Unmarshal(b, &d); err != nil {
+		return d, fmt.Errorf("state: %v", err)
+	}
+	if d.Version < 1 || d.Version > apitype.DeploymentSchemaVersionCurrent {
+		return d, fmt.Errorf("state version %d: %v", d.Version, ErrNotSupported)
+	}
+	if d.Version == 3 {
+		v3 := apitype.DeploymentV3{}
+		if err := json.Unmarshal(d.Deployment, &v3); err != nil {
+			return d, fmt.Errorf("state: %v", err)
+		}
+	}
+	return d, nil
+}
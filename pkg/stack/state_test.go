@@ -0,0 +1,56 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package stack
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestImportStateRequiresStoppedLoop(t *testing.T) {
+	tests := []struct {
+		state   string
+		stopped bool
+	}{
+		{StatePending, true},
+		{StateStopped, true},
+		{StateInitializing, false},
+		{StateConfiguring, false},
+		{StateRefreshing, false},
+		{StateUpdating, false},
+		{StateIdle, false},
+		{StateFailed, false},
+	}
+	for _, tt := range tests {
+		c := &Controller{Config: &Config{StackName: "m1"}, state: tt.state}
+		_, err := c.ImportState(context.Background(), []byte("{}"), t.TempDir())
+		if stopped := !errors.Is(err, ErrStackNotStopped); stopped != tt.stopped {
+			t.Errorf("%s: err = %v; want stopped %v", tt.state, err, tt.stopped)
+		}
+	}
+}
+
+func TestRestoreSnapshotRequiresStoppedLoop(t *testing.T) {
+	c := &Controller{Config: &Config{StackName: "m1"}, state: StateUpdating}
+	_, _, err := c.RestoreSnapshot(context.Background(), "latest", t.TempDir())
+	if !errors.Is(err, ErrStackNotStopped) {
+		t.Errorf("err = %v; want ErrStackNotStopped", err)
+	}
+}
@@ -18,6 +18,47 @@
 
 package stack
 
+import (
+	"fmt"
+)
+
+// ValidateConfig checks the project type, the openstack props and the stack
+// props of cfg without accessing openstack or the stack.
+func ValidateConfig(cfg *Config) error {
+	o := cfg.Props.OpenstackProps
+	if o.Region == "" {
+		return fmt.Errorf("Config.Props.Openstack.Region not set")
+	}
+	if o.Domain == "" {
+		return fmt.Errorf("Config.Props.Openstack.Domain not set")
+	}
+	if o.Tenant == "" {
+		return fmt.Errorf("Config.Props.Openstack.Tenant not set")
+	}
+	if cfg.StackName == "" {
+		return fmt.Errorf("Config.Stack not set")
+	}
+	props, err := cfg.DecodeProps()
+	if err != nil {
+		return err
+	}
+	return props.Validate()
+}
+
+// ValidateCredentials checks that the credentials used by the stack of cfg
+// are set in the environment: the openstack credentials and the credentials
+// of its project type, e.g. the vmware password of vcf stacks.
+func ValidateCredentials(cfg *Config) error {
+	if _, err := openstackConfigOf(cfg, false); err != nil {
+		return err
+	}
+	p, err := cfg.Project()
+	if err != nil {
+		return err
+	}
+	return p.ValidateCredentials()
+}
+
 // "github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
 // "github.com/spf13/viper"
 
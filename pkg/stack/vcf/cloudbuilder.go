@@ -0,0 +1,175 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package vcf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// CloudBuilderTemplate is the path of the cloud builder template relative to
+// the vcf project directory
+const CloudBuilderTemplate = "scripts/cloud-builder.json.tpl"
+
+// RenderCloudBuilder renders the cloud builder payload from the jinja template
+// tmpl, as the vcf program does after deploying a management stack.
+func RenderCloudBuilder(tmpl string, p StackProps, region, vmwarePassword string) ([]byte, error) {
+	t, err := parseJinja("cloud-builder", tmpl)
+	if err != nil {
+		return nil, err
+	}
+	m, err := p.ConfigMap()
+	if err != nil {
+		return nil, err
+	}
+	// the vcf program renders the template from the json config values
+	data := map[string]interface{}{
+		"vmware_password": vmwarePassword,
+		"region":          region,
+	}
+	vars := map[string]string{
+		"esxi_servers":       "esxiNodes",
+		"management_network": "managementNetwork",
+		"nsxt":               "nsxt",
+		"nsxt_managers":      "nsxtManagers",
+		"sddc_manager":       "sddcManager",
+		"vcenter":            "vcenter",
+	}
+	for name, key := range vars {
+		var v interface{} = map[string]interface{}{}
+		if c, ok := m[key]; ok {
+			if err := json.Unmarshal([]byte(c.Value), &v); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+		}
+		data[name] = v
+	}
+	buf := bytes.Buffer{}
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// cloudBuilderSpec is the part of the cloud builder payload filled in from
+// the stack config
+type cloudBuilderSpec struct {
+	SDDCManagerSpec struct {
+		IPAddress string `json:"ipAddress"`
+		Hostname  string `json:"hostname"`
+	} `json:"sddcManagerSpec"`
+	DNSSpec struct {
+		Domain string `json:"domain"`
+	} `json:"dnsSpec"`
+	NetworkSpecs []struct {
+		NetworkType string `json:"networkType"`
+		Subnet      string `json:"subnet"`
+		Gateway     string `json:"gateway"`
+	} `json:"networkSpecs"`
+	NsxtSpec struct {
+		NsxtManagers []struct {
+			Hostname string `json:"hostname"`
+			IP       string `json:"ip"`
+		} `json:"nsxtManagers"`
+		Vip     string `json:"vip"`
+		VipFqdn string `json:"vipFqdn"`
+	} `json:"nsxtSpec"`
+	VCenterSpec struct {
+		VCenterIP       string `json:"vcenterIp"`
+		VCenterHostname string `json:"vcenterHostname"`
+	} `json:"vcenterSpec"`
+	HostSpecs []struct {
+		Hostname         string `json:"hostname"`
+		IPAddressPrivate struct {
+			IPAddress string `json:"ipAddress"`
+			CIDR      string `json:"cidr"`
+			Gateway   string `json:"gateway"`
+		} `json:"ipAddressPrivate"`
+	} `json:"hostSpecs"`
+}
+
+// ValidateCloudBuilder checks that the payload is valid json and that the
+// values filled in from the stack config are set and well-formed. All
+// problems are reported at once.
+func ValidateCloudBuilder(b []byte) error {
+	spec := cloudBuilderSpec{}
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return fmt.Errorf("cloud builder payload: %v", err)
+	}
+	errs := make([]string, 0)
+	required := func(field, v string) {
+		if v == "" {
+			errs = append(errs, field+" not set")
+		}
+	}
+	ip := func(field, v string) {
+		if net.ParseIP(v) == nil {
+			errs = append(errs, fmt.Sprintf("%s: invalid ip address %q", field, v))
+		}
+	}
+	ip("sddcManagerSpec.ipAddress", spec.SDDCManagerSpec.IPAddress)
+	required("sddcManagerSpec.hostname", spec.SDDCManagerSpec.Hostname)
+	required("dnsSpec.domain", spec.DNSSpec.Domain)
+	ip("nsxtSpec.vip", spec.NsxtSpec.Vip)
+	required("nsxtSpec.vipFqdn", spec.NsxtSpec.VipFqdn)
+	if len(spec.NsxtSpec.NsxtManagers) == 0 {
+		errs = append(errs, "nsxtSpec.nsxtManagers empty")
+	}
+	for i, m := range spec.NsxtSpec.NsxtManagers {
+		required(fmt.Sprintf("nsxtSpec.nsxtManagers[%d].hostname", i), m.Hostname)
+		ip(fmt.Sprintf("nsxtSpec.nsxtManagers[%d].ip", i), m.IP)
+	}
+	ip("vcenterSpec.vcenterIp", spec.VCenterSpec.VCenterIP)
+	required("vcenterSpec.vcenterHostname", spec.VCenterSpec.VCenterHostname)
+
+	var mgmt *net.IPNet
+	for i, n := range spec.NetworkSpecs {
+		_, subnet, err := net.ParseCIDR(n.Subnet)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("networkSpecs[%d].subnet: %v", i, err))
+		} else if n.NetworkType == "MANAGEMENT" {
+			mgmt = subnet
+		}
+		ip(fmt.Sprintf("networkSpecs[%d].gateway", i), n.Gateway)
+	}
+	if len(spec.HostSpecs) == 0 {
+		errs = append(errs, "hostSpecs empty")
+	}
+	seen := make(map[string]bool)
+	for i, h := range spec.HostSpecs {
+		field := fmt.Sprintf("hostSpecs[%d]", i)
+		required(field+".hostname", h.Hostname)
+		addr := h.IPAddressPrivate.IPAddress
+		ip(field+".ipAddressPrivate.ipAddress", addr)
+		if seen[addr] {
+			errs = append(errs, fmt.Sprintf("%s.ipAddressPrivate.ipAddress: duplicate address %s", field, addr))
+		}
+		seen[addr] = true
+		if mgmt != nil && net.ParseIP(addr) != nil && !mgmt.Contains(net.ParseIP(addr)) {
+			errs = append(errs, fmt.Sprintf("%s.ipAddressPrivate.ipAddress: %s not in management network %s", field, addr, mgmt))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cloud builder payload: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
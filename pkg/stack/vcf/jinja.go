@@ -0,0 +1,138 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package vcf
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+var (
+	jinjaTagRe  = regexp.MustCompile(`(?s)\{([{%])(-?)\s*(.*?)\s*(-?)[}%]\}`)
+	jinjaForRe  = regexp.MustCompile(`^for\s+(\w+)\s+in\s+(.+)$`)
+	jinjaPathRe = regexp.MustCompile(`^[A-Za-z_]\w*(\.\w+)*$`)
+)
+
+// jinjaLoop is an open for loop while translating a template
+type jinjaLoop struct {
+	index string
+	item  string
+	list  string
+}
+
+// parseJinja translates the subset of jinja used by the templates of the
+// python projects into a go template: variables with attribute access, for
+// loops with loop.index and loop.last, if/else and whitespace control.
+func parseJinja(name, src string) (*template.Template, error) {
+	var loops []jinjaLoop
+	var err error
+	out := jinjaTagRe.ReplaceAllStringFunc(src, func(tag string) string {
+		if err != nil {
+			return ""
+		}
+		m := jinjaTagRe.FindStringSubmatch(tag)
+		kind, ltrim, body, rtrim := m[1], m[2], m[3], m[4]
+		var action string
+		if kind == "{" {
+			action, err = jinjaExpr(body, loops)
+		} else {
+			action, err = jinjaStatement(body, &loops)
+		}
+		if ltrim != "" {
+			ltrim = "- "
+		}
+		if rtrim != "" {
+			rtrim = " -"
+		}
+		return "{{" + ltrim + action + rtrim + "}}"
+	})
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %v", name, err)
+	}
+	if len(loops) > 0 {
+		return nil, fmt.Errorf("template %s: for without endfor", name)
+	}
+	return template.New(name).Funcs(template.FuncMap{
+		"inc":  func(i int) int { return i + 1 },
+		"last": func(i int, list interface{}) bool { return i == reflect.ValueOf(list).Len()-1 },
+	}).Parse(out)
+}
+
+func jinjaStatement(s string, loops *[]jinjaLoop) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "for "):
+		m := jinjaForRe.FindStringSubmatch(s)
+		if m == nil {
+			return "", fmt.Errorf("unsupported statement %q", s)
+		}
+		list, err := jinjaExpr(m[2], *loops)
+		if err != nil {
+			return "", err
+		}
+		l := jinjaLoop{index: fmt.Sprintf("$i%d", len(*loops)), item: m[1], list: list}
+		*loops = append(*loops, l)
+		return fmt.Sprintf("range %s, $%s := %s", l.index, l.item, l.list), nil
+	case s == "endfor":
+		if len(*loops) == 0 {
+			return "", fmt.Errorf("endfor without for")
+		}
+		*loops = (*loops)[:len(*loops)-1]
+		return "end", nil
+	case strings.HasPrefix(s, "if "):
+		e, err := jinjaExpr(strings.TrimPrefix(s, "if "), *loops)
+		return "if " + e, err
+	case s == "else":
+		return "else", nil
+	case s == "endif":
+		return "end", nil
+	}
+	return "", fmt.Errorf("unsupported statement %q", s)
+}
+
+// jinjaExpr translates a variable path; loop variables refer to the
+// innermost loop
+func jinjaExpr(s string, loops []jinjaLoop) (string, error) {
+	if !jinjaPathRe.MatchString(s) {
+		return "", fmt.Errorf("unsupported expression %q", s)
+	}
+	parts := strings.SplitN(s, ".", 2)
+	if parts[0] == "loop" && len(loops) > 0 {
+		l := loops[len(loops)-1]
+		switch s {
+		case "loop.index":
+			return fmt.Sprintf("(inc %s)", l.index), nil
+		case "loop.index0":
+			return l.index, nil
+		case "loop.first":
+			return fmt.Sprintf("(eq %s 0)", l.index), nil
+		case "loop.last":
+			return fmt.Sprintf("(last %s %s)", l.index, l.list), nil
+		}
+		return "", fmt.Errorf("unsupported expression %q", s)
+	}
+	for i := len(loops) - 1; i >= 0; i-- {
+		if loops[i].item == parts[0] {
+			return "$" + s, nil
+		}
+	}
+	return "$." + s, nil
+}
@@ -22,11 +22,24 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 
-	"github.com/imdario/mergo"
 	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optrefresh"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
 )
 
+// MergeKeys are the fields by which list items of StackProps are matched
+// when a config merges a list into the configs it extends with the strategy
+// merge.
+var MergeKeys = map[string]string{
+	"esxiNodes":       "name",
+	"shares":          "shareName",
+	"nsxtManagers":    "hostname",
+	"privateNetworks": "networkName",
+	"reservedIPs":     "ip",
+}
+
 type Stack struct {
 	auto.Stack
 	state StackState
@@ -99,6 +112,24 @@ type KeypairFile struct {
 	PrivateKey string `json:"private_key,omitempty" yaml:"privateKey"`
 }
 
+// Key pair files used by the vcf program if keypairFile is not configured
+const (
+	DefaultPublicKeyFile  = "/pulumi/automation/etc/.ssh/id_rsa.pub"
+	DefaultPrivateKeyFile = "/pulumi/automation/etc/.ssh/id_rsa"
+)
+
+// Files returns the public and the private key file the vcf program reads
+func (k KeypairFile) Files() (public, private string) {
+	public, private = k.PublicKey, k.PrivateKey
+	if public == "" {
+		public = DefaultPublicKeyFile
+	}
+	if private == "" {
+		private = DefaultPrivateKeyFile
+	}
+	return
+}
+
 type PrivateNetwork struct {
 	NetworkName   string `yaml:"networkName" json:"name,omitempty"`
 	CIDR          string `yaml:"cidr" json:"cidr,omitempty"`
@@ -149,94 +180,177 @@ type VCenter struct {
 	Hostname string `yaml:"hostname" json:"hostname,omitempty"`
 }
 
-func InitVCFStack(ctx context.Context, stackName, projectDir string) (*Stack, error) {
-	s, err := auto.UpsertStackLocalSource(ctx, stackName, projectDir)
+// Validate checks that the props hold the settings required by the vcf
+// program and that addresses are well-formed.
+func (p StackProps) Validate() error {
+	if p.ExternalNetwork.Name == "" && p.ExternalNetwork.ID == "" {
+		return fmt.Errorf("Config.Props.Stack.ExternalNetwork not set")
+	}
+	if p.ManagementNetwork.NetworkName == "" {
+		return fmt.Errorf("Config.Props.Stack.ManagementNetwork.NetworkName not set")
+	}
+	if p.DeploymentNetwork.NetworkName == "" {
+		return fmt.Errorf("Config.Props.Stack.DeploymentNetwork.NetworkName not set")
+	}
+	if (p.HelperVM == HelperVM{}) {
+		return fmt.Errorf("Config.Props.Stack.HelperVM not set")
+	}
+	if p.PublicRouter == "" {
+		return fmt.Errorf("Config.Props.Stack.PublicRouter not set")
+	}
+	if p.DNSZoneName == "" {
+		return fmt.Errorf("Config.Props.Stack.DNSZoneName not set")
+	}
+	if p.ReverseDNSZoneName == "" {
+		return fmt.Errorf("Config.Props.Stack.ReverseDNSZoneName not set")
+	}
+	if len(p.EsxiNodes) > 0 && (p.EsxiServerImage == "" || p.EsxiServerFlavor == "") {
+		return fmt.Errorf("Config.Props.Stack.EsxiServerImage and EsxiServerFlavor required by esxi nodes")
+	}
+	cidrs := map[string]string{
+		"ManagementNetwork.SubnetCidr": p.ManagementNetwork.SubnetCidr,
+		"DeploymentNetwork.CIDR":       p.DeploymentNetwork.CIDR,
+	}
+	for _, n := range p.PrivateNetworks {
+		cidrs["PrivateNetworks."+n.NetworkName+".CIDR"] = n.CIDR
+	}
+	for field, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); cidr != "" && err != nil {
+			return fmt.Errorf("Config.Props.Stack.%s: %v", field, err)
+		}
+	}
+	ips := map[string]string{
+		"ManagementNetwork.SubnetGateway": p.ManagementNetwork.SubnetGateway,
+		"DeploymentNetwork.Gateway":       p.DeploymentNetwork.Gateway,
+		"HelperVM.IP":                     p.HelperVM.IP,
+		"HelperVsanWiteness.IP":           p.HelperVsanWiteness.IP,
+		"SDDCManager.IP":                  p.SDDCManager.IP,
+		"VCenter.IP":                      p.VCenter.IP,
+		"Nsxt.IP":                         p.Nsxt.IP,
+	}
+	for _, m := range p.NsxtManagers {
+		ips["NsxtManagers."+m.Hostname+".IP"] = m.IP
+	}
+	for _, r := range p.ReservedIPs {
+		ips["ReservedIPs."+r.Hostname+".IP"] = r.IP
+	}
+	names := make(map[string]bool)
+	for _, n := range p.EsxiNodes {
+		if n.Name == "" {
+			return fmt.Errorf("Config.Props.Stack.EsxiNodes: node without name")
+		}
+		if names[n.Name] {
+			return fmt.Errorf("Config.Props.Stack.EsxiNodes: duplicate node %s", n.Name)
+		}
+		names[n.Name] = true
+		ips["EsxiNodes."+n.Name+".IP"] = n.IP
+	}
+	for field, ip := range ips {
+		if ip != "" && net.ParseIP(ip) == nil {
+			return fmt.Errorf("Config.Props.Stack.%s: invalid ip address %q", field, ip)
+		}
+	}
+	return nil
+}
+
+func InitVCFStack(ctx context.Context, stackName, projectDir string, opts ...auto.LocalWorkspaceOption) (*Stack, error) {
+	s, err := auto.UpsertStackLocalSource(ctx, stackName, projectDir, opts...)
 	if err != nil {
 		return nil, err
 	}
 	return &Stack{s, StackState{}}, nil
 }
 
-func (s *Stack) Configure(ctx context.Context, props ...StackProps) error {
-	p := props[0]
-	for _, q := range props[1:] {
-		mergo.Merge(&p, q)
+func (s *Stack) Configure(ctx context.Context, p StackProps) error {
+	m, err := p.ConfigMap()
+	if err != nil {
+		return err
+	}
+	return s.SetAllConfig(ctx, m)
+}
+
+// ConfigMap returns the stack config that Configure sets for p. The addresses
+// of nsx-t, vcenter and sddc manager are added to the reserved ips.
+func (p StackProps) ConfigMap() (auto.ConfigMap, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
 	}
+	m := auto.ConfigMap{}
 	if (p.ExternalNetwork != ExternalNetwork{}) {
 		if en, err := json.Marshal(p.ExternalNetwork); err != nil {
-			return err
+			return nil, err
 		} else {
-			s.SetConfig(ctx, "externalNetwork", auto.ConfigValue{Value: string(en)})
+			m["externalNetwork"] = auto.ConfigValue{Value: string(en)}
 		}
 	}
 	if (p.ManagementNetwork != MgmtNetwork{}) {
 		if mn, err := json.Marshal(p.ManagementNetwork); err != nil {
-			return err
+			return nil, err
 		} else {
-			s.SetConfig(ctx, "managementNetwork", auto.ConfigValue{Value: string(mn)})
+			m["managementNetwork"] = auto.ConfigValue{Value: string(mn)}
 		}
 	}
 	if (p.DeploymentNetwork != DeploymentNetwork{}) {
 		if dn, err := json.Marshal(p.DeploymentNetwork); err != nil {
-			return err
+			return nil, err
 		} else {
-			s.SetConfig(ctx, "deploymentNetwork", auto.ConfigValue{Value: string(dn)})
+			m["deploymentNetwork"] = auto.ConfigValue{Value: string(dn)}
 		}
 	}
 	if (p.HelperVM != HelperVM{}) {
 		if n, err := json.Marshal(p.HelperVM); err != nil {
-			return err
+			return nil, err
 		} else {
-			s.SetConfig(ctx, "helperVM", auto.ConfigValue{Value: string(n)})
+			m["helperVM"] = auto.ConfigValue{Value: string(n)}
 		}
 	}
 	if (p.HelperVsanWiteness != HelperVsanWiteness{}) {
 		if n, err := json.Marshal(p.HelperVsanWiteness); err != nil {
-			return err
+			return nil, err
 		} else {
-			s.SetConfig(ctx, "helperVsanWiteness", auto.ConfigValue{Value: string(n)})
+			m["helperVsanWiteness"] = auto.ConfigValue{Value: string(n)}
 		}
 	}
 	if p.DNSZoneName != "" {
-		s.SetConfig(ctx, "dnsZoneName", auto.ConfigValue{Value: p.DNSZoneName})
+		m["dnsZoneName"] = auto.ConfigValue{Value: p.DNSZoneName}
 	}
 	if p.ReverseDNSZoneName != "" {
-		s.SetConfig(ctx, "reverseDnsZoneName", auto.ConfigValue{Value: p.ReverseDNSZoneName})
+		m["reverseDnsZoneName"] = auto.ConfigValue{Value: p.ReverseDNSZoneName}
 	}
 	if p.PublicRouter != "" {
-		s.SetConfig(ctx, "publicRouter", auto.ConfigValue{Value: p.PublicRouter})
+		m["publicRouter"] = auto.ConfigValue{Value: p.PublicRouter}
 	}
 	if p.KeypairFile.PublicKey != "" {
-		s.SetConfig(ctx, "publicKeyFile", auto.ConfigValue{Value: p.KeypairFile.PublicKey})
+		m["publicKeyFile"] = auto.ConfigValue{Value: p.KeypairFile.PublicKey}
 	}
 	if p.KeypairFile.PrivateKey != "" {
-		s.SetConfig(ctx, "privateKeyFile", auto.ConfigValue{Value: p.KeypairFile.PrivateKey})
+		m["privateKeyFile"] = auto.ConfigValue{Value: p.KeypairFile.PrivateKey}
 	}
 	if p.PrivateNetworks != nil {
 		if pn, err := json.Marshal(p.PrivateNetworks); err != nil {
-			return err
+			return nil, err
 		} else {
-			s.SetConfig(ctx, "privateNetworks", auto.ConfigValue{Value: string(pn)})
+			m["privateNetworks"] = auto.ConfigValue{Value: string(pn)}
 		}
 	}
 	if p.EsxiNodes != nil {
 		if n, err := json.Marshal(p.EsxiNodes); err != nil {
-			return err
+			return nil, err
 		} else {
-			s.SetConfig(ctx, "esxiNodes", auto.ConfigValue{Value: string(n)})
+			m["esxiNodes"] = auto.ConfigValue{Value: string(n)}
 		}
 	}
 	if p.EsxiServerImage != "" {
-		s.SetConfig(ctx, "esxiServerImage", auto.ConfigValue{Value: p.EsxiServerImage})
+		m["esxiServerImage"] = auto.ConfigValue{Value: p.EsxiServerImage}
 	}
 	if p.EsxiServerFlavor != "" {
-		s.SetConfig(ctx, "esxiServerFlavor", auto.ConfigValue{Value: p.EsxiServerFlavor})
+		m["esxiServerFlavor"] = auto.ConfigValue{Value: p.EsxiServerFlavor}
 	}
 	if p.Shares != nil {
 		if n, err := json.Marshal(p.Shares); err != nil {
-			return err
+			return nil, err
 		} else {
-			s.SetConfig(ctx, "shares", auto.ConfigValue{Value: string(n)})
+			m["shares"] = auto.ConfigValue{Value: string(n)}
 		}
 	}
 
@@ -246,9 +360,9 @@ func (s *Stack) Configure(ctx context.Context, props ...StackProps) error {
 	}
 	if (p.Nsxt != Nsxt{}) {
 		if n, err := json.Marshal(p.Nsxt); err != nil {
-			return err
+			return nil, err
 		} else {
-			s.SetConfig(ctx, "nsxt", auto.ConfigValue{Value: string(n)})
+			m["nsxt"] = auto.ConfigValue{Value: string(n)}
 			p.ReservedIPs = append(p.ReservedIPs, ReservedIP{
 				Hostname: p.Nsxt.Hostname,
 				IP:       p.Nsxt.IP,
@@ -257,9 +371,9 @@ func (s *Stack) Configure(ctx context.Context, props ...StackProps) error {
 	}
 	if p.NsxtManagers != nil {
 		if n, err := json.Marshal(p.NsxtManagers); err != nil {
-			return err
+			return nil, err
 		} else {
-			s.SetConfig(ctx, "nsxtManagers", auto.ConfigValue{Value: string(n)})
+			m["nsxtManagers"] = auto.ConfigValue{Value: string(n)}
 			for _, m := range p.NsxtManagers {
 				p.ReservedIPs = append(p.ReservedIPs, ReservedIP{
 					Hostname: m.Hostname,
@@ -270,9 +384,9 @@ func (s *Stack) Configure(ctx context.Context, props ...StackProps) error {
 	}
 	if (p.SDDCManager != SDDCManager{}) {
 		if n, err := json.Marshal(p.SDDCManager); err != nil {
-			return err
+			return nil, err
 		} else {
-			s.SetConfig(ctx, "sddcManager", auto.ConfigValue{Value: string(n)})
+			m["sddcManager"] = auto.ConfigValue{Value: string(n)}
 			p.ReservedIPs = append(p.ReservedIPs, ReservedIP{
 				Hostname: p.SDDCManager.Hostname,
 				IP:       p.SDDCManager.IP,
@@ -281,9 +395,9 @@ func (s *Stack) Configure(ctx context.Context, props ...StackProps) error {
 	}
 	if (p.VCenter != VCenter{}) {
 		if n, err := json.Marshal(p.VCenter); err != nil {
-			return err
+			return nil, err
 		} else {
-			s.SetConfig(ctx, "vcenter", auto.ConfigValue{Value: string(n)})
+			m["vcenter"] = auto.ConfigValue{Value: string(n)}
 			p.ReservedIPs = append(p.ReservedIPs, ReservedIP{
 				Hostname: p.VCenter.Hostname,
 				IP:       p.VCenter.IP,
@@ -292,25 +406,25 @@ func (s *Stack) Configure(ctx context.Context, props ...StackProps) error {
 	}
 	if len(p.ReservedIPs) > 0 {
 		if n, err := json.Marshal(p.ReservedIPs); err != nil {
-			return err
+			return nil, err
 		} else {
-			s.SetConfig(ctx, "reservedIPs", auto.ConfigValue{Value: string(n)})
+			m["reservedIPs"] = auto.ConfigValue{Value: string(n)}
 		}
 	}
-	return nil
+	return m, nil
 }
 
-func (s *Stack) Refresh(ctx context.Context) error {
-	_, err := s.Stack.Refresh(ctx)
+func (s *Stack) Refresh(ctx context.Context, opts ...optrefresh.Option) (auto.RefreshResult, error) {
+	res, err := s.Stack.Refresh(ctx, opts...)
 	if err != nil {
 		s.state.err = err
-		return err
+		return auto.RefreshResult{}, err
 	}
-	return nil
+	return res, nil
 }
 
-func (s *Stack) Update(ctx context.Context) (auto.UpResult, error) {
-	res, err := s.Stack.Up(ctx)
+func (s *Stack) Update(ctx context.Context, opts ...optup.Option) (auto.UpResult, error) {
+	res, err := s.Stack.Up(ctx, opts...)
 	if err != nil {
 		s.state.err = err
 		return auto.UpResult{}, err
@@ -318,17 +432,6 @@ func (s *Stack) Update(ctx context.Context) (auto.UpResult, error) {
 	return res, nil
 }
 
-func (s *Stack) Outputs(ctx context.Context) (auto.OutputMap, error) {
-	o, err := s.Stack.Outputs(ctx)
-	if err != nil {
-		return nil, err
-	}
-	if _, ok := o["cloud-builder"]; ok {
-		delete(o, "cloud-builder")
-	}
-	return o, nil
-}
-
 //
 func (s *Stack) GetOutput(ctx context.Context, key string) (string, error) {
 	o, err := s.Stack.Outputs(ctx)
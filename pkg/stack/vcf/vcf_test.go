@@ -0,0 +1,81 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package vcf
+
+import (
+	"strings"
+	"testing"
+)
+
+func validProps() StackProps {
+	return StackProps{
+		EsxiServerImage:    "esxi-7",
+		EsxiServerFlavor:   "esxi.large",
+		EsxiNodes:          []EsxiNode{{Name: "n01", IP: "10.0.0.11"}, {Name: "n02", IP: "10.0.0.12"}},
+		ExternalNetwork:    ExternalNetwork{Name: "FloatingIP-external"},
+		ManagementNetwork:  MgmtNetwork{NetworkName: "mgmt", SubnetCidr: "10.0.0.0/24", SubnetGateway: "10.0.0.1"},
+		DeploymentNetwork:  DeploymentNetwork{NetworkName: "deploy", CIDR: "10.0.1.0/24", Gateway: "10.0.1.1"},
+		PrivateNetworks:    []PrivateNetwork{{NetworkName: "vmotion", CIDR: "10.0.2.0/24"}},
+		HelperVM:           HelperVM{ImageName: "ubuntu", IP: "10.0.1.10"},
+		PublicRouter:       "router",
+		DNSZoneName:        "vcf.example.com",
+		ReverseDNSZoneName: "0.0.10.in-addr.arpa",
+		NsxtManagers:       []NsxtManager{{Hostname: "nsxt-01", IP: "10.0.0.6"}},
+		ReservedIPs:        []ReservedIP{{Hostname: "dns", IP: "10.0.0.2"}},
+	}
+}
+
+func TestStackPropsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(p *StackProps)
+		err    string
+	}{
+		{"valid", func(p *StackProps) {}, ""},
+		{"external network by id", func(p *StackProps) { p.ExternalNetwork = ExternalNetwork{ID: "id"} }, ""},
+		{"no external network", func(p *StackProps) { p.ExternalNetwork = ExternalNetwork{} }, "ExternalNetwork not set"},
+		{"no management network", func(p *StackProps) { p.ManagementNetwork.NetworkName = "" }, "ManagementNetwork.NetworkName not set"},
+		{"no deployment network", func(p *StackProps) { p.DeploymentNetwork.NetworkName = "" }, "DeploymentNetwork.NetworkName not set"},
+		{"no helper vm", func(p *StackProps) { p.HelperVM = HelperVM{} }, "HelperVM not set"},
+		{"no public router", func(p *StackProps) { p.PublicRouter = "" }, "PublicRouter not set"},
+		{"no dns zone", func(p *StackProps) { p.DNSZoneName = "" }, "DNSZoneName not set"},
+		{"no reverse dns zone", func(p *StackProps) { p.ReverseDNSZoneName = "" }, "ReverseDNSZoneName not set"},
+		{"nodes without image", func(p *StackProps) { p.EsxiServerImage = "" }, "EsxiServerImage and EsxiServerFlavor required"},
+		{"no nodes without image", func(p *StackProps) { p.EsxiServerImage, p.EsxiNodes = "", nil }, ""},
+		{"invalid cidr", func(p *StackProps) { p.ManagementNetwork.SubnetCidr = "10.0.0.0/33" }, "ManagementNetwork.SubnetCidr"},
+		{"invalid private cidr", func(p *StackProps) { p.PrivateNetworks[0].CIDR = "10.0.2.0" }, "PrivateNetworks.vmotion.CIDR"},
+		{"invalid gateway", func(p *StackProps) { p.DeploymentNetwork.Gateway = "10.0.1" }, "DeploymentNetwork.Gateway: invalid ip address"},
+		{"invalid nsxt manager ip", func(p *StackProps) { p.NsxtManagers[0].IP = "x" }, "NsxtManagers.nsxt-01.IP"},
+		{"invalid reserved ip", func(p *StackProps) { p.ReservedIPs[0].IP = "10.0.0.256" }, "ReservedIPs.dns.IP"},
+		{"invalid node ip", func(p *StackProps) { p.EsxiNodes[1].IP = "n02" }, "EsxiNodes.n02.IP"},
+		{"node without name", func(p *StackProps) { p.EsxiNodes[0].Name = "" }, "node without name"},
+		{"duplicate node", func(p *StackProps) { p.EsxiNodes[1].Name = "n01" }, "duplicate node n01"},
+	}
+	for _, tt := range tests {
+		p := validProps()
+		tt.modify(&p)
+		err := p.Validate()
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: err = %v; want %q", tt.name, err, tt.err)
+		}
+	}
+}
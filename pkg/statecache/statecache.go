@@ -0,0 +1,131 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+// Package statecache stores exported stack deployments by update version in a
+// blob bucket, a local directory or an S3-compatible object store.
+package statecache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/s3blob"
+	"gocloud.dev/gcerrors"
+)
+
+// Cache holds one deployment per stack, the one of the latest update version
+// that was read.
+type Cache struct {
+	bucket *blob.Bucket
+	url    string
+}
+
+// Open opens the cache at the bucket url, e.g. file:///var/cache/state or
+// s3://bucket?endpoint=http://minio:9000&region=us-east-1&s3ForcePathStyle=true.
+// The directory of a file url is created if it does not exist. S3
+// credentials are read from the AWS_* environment variables.
+func Open(ctx context.Context, bucketURL string) (*Cache, error) {
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("state cache: %v", err)
+	}
+	if u.Scheme == "file" {
+		if err := os.MkdirAll(u.Path, 0700); err != nil {
+			return nil, fmt.Errorf("state cache: %v", err)
+		}
+	}
+	b, err := blob.OpenBucket(ctx, bucketURL)
+	if err != nil {
+		return nil, fmt.Errorf("state cache %s: %v", bucketURL, err)
+	}
+	return &Cache{bucket: b, url: bucketURL}, nil
+}
+
+// URL returns the url the cache was opened with
+func (c *Cache) URL() string {
+	return c.url
+}
+
+// Get returns the deployment of the stack at the update version. ok is false
+// if it is not cached.
+func (c *Cache) Get(ctx context.Context, project, stack string, version int) (b []byte, ok bool, err error) {
+	b, err = c.bucket.ReadAll(ctx, key(project, stack, version))
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// Put stores the deployment of the stack at the update version and removes
+// the deployments of other versions.
+func (c *Cache) Put(ctx context.Context, project, stack string, version int, b []byte) error {
+	k := key(project, stack, version)
+	if err := c.bucket.WriteAll(ctx, k, b, &blob.WriterOptions{ContentType: "application/json"}); err != nil {
+		return err
+	}
+	return c.drop(ctx, project, stack, k)
+}
+
+// Drop removes all deployments of the stack, e.g. after its state was
+// replaced without a new update version
+func (c *Cache) Drop(ctx context.Context, project, stack string) error {
+	return c.drop(ctx, project, stack, "")
+}
+
+func (c *Cache) drop(ctx context.Context, project, stack, keep string) error {
+	it := c.bucket.List(&blob.ListOptions{Prefix: prefix(project, stack)})
+	for {
+		o, err := it.Next(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if o.Key == keep || !strings.HasSuffix(o.Key, ".json") {
+			continue
+		}
+		if err := c.bucket.Delete(ctx, o.Key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return err
+		}
+	}
+}
+
+// Close closes the bucket
+func (c *Cache) Close() error {
+	return c.bucket.Close()
+}
+
+func prefix(project, stack string) string {
+	return path.Join(project, stack) + "/"
+}
+
+func key(project, stack string, version int) string {
+	return prefix(project, stack) + strconv.Itoa(version) + ".json"
+}
@@ -0,0 +1,297 @@
+/******************************************************************************
+*
+*  Copyright 2021 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package statecache
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCache runs Get, Put and Drop against the cache c
+func testCache(t *testing.T, c *Cache) {
+	ctx := context.Background()
+	get := func(project, stack string, version int) (string, bool) {
+		t.Helper()
+		b, ok, err := c.Get(ctx, project, stack, version)
+		if err != nil {
+			t.Fatalf("Get(%s, %s, %d): %v", project, stack, version, err)
+		}
+		return string(b), ok
+	}
+	put := func(project, stack string, version int, b string) {
+		t.Helper()
+		if err := c.Put(ctx, project, stack, version, []byte(b)); err != nil {
+			t.Fatalf("Put(%s, %s, %d): %v", project, stack, version, err)
+		}
+	}
+
+	if _, ok := get("vcf", "m1", 1); ok {
+		t.Fatal("Get of empty cache: want not cached")
+	}
+	put("vcf", "m1", 1, `{"v":1}`)
+	put("vcf", "m10", 1, `{"other":1}`)
+	if b, ok := get("vcf", "m1", 1); !ok || b != `{"v":1}` {
+		t.Errorf("Get(1) = %q, %t; want cached", b, ok)
+	}
+
+	// a new version evicts the older one, but not the ones of other stacks
+	// or files which are no deployments
+	if err := c.bucket.WriteAll(ctx, "vcf/m1/README", []byte("x"), nil); err != nil {
+		t.Fatal(err)
+	}
+	put("vcf", "m1", 2, `{"v":2}`)
+	if _, ok := get("vcf", "m1", 1); ok {
+		t.Error("Get(1) after Put(2): want evicted")
+	}
+	if b, ok := get("vcf", "m1", 2); !ok || b != `{"v":2}` {
+		t.Errorf("Get(2) = %q, %t; want cached", b, ok)
+	}
+	if b, ok := get("vcf", "m10", 1); !ok || b != `{"other":1}` {
+		t.Errorf("Get of other stack = %q, %t; want cached", b, ok)
+	}
+	if ok, err := c.bucket.Exists(ctx, "vcf/m1/README"); err != nil || !ok {
+		t.Errorf("non-deployment file removed: %t, %v", ok, err)
+	}
+
+	// putting the same version again keeps it
+	put("vcf", "m1", 2, `{"v":2,"again":true}`)
+	if b, ok := get("vcf", "m1", 2); !ok || b != `{"v":2,"again":true}` {
+		t.Errorf("Get(2) after second Put = %q, %t", b, ok)
+	}
+
+	if err := c.Drop(ctx, "vcf", "m1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := get("vcf", "m1", 2); ok {
+		t.Error("Get(2) after Drop: want dropped")
+	}
+	if _, ok := get("vcf", "m10", 1); !ok {
+		t.Error("Drop removed the deployment of another stack")
+	}
+	// dropping an uncached stack is no error
+	if err := c.Drop(ctx, "vcf", "missing"); err != nil {
+		t.Errorf("Drop of uncached stack: %v", err)
+	}
+}
+
+func TestFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Open creates the directory
+	u := "file://" + path.Join(dir, "cache")
+	c, err := Open(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.URL() != u {
+		t.Errorf("URL() = %s; want %s", c.URL(), u)
+	}
+	testCache(t, c)
+	if _, err := os.Stat(path.Join(dir, "cache", "vcf", "m10", "1.json")); err != nil {
+		t.Errorf("deployment file: %v", err)
+	}
+}
+
+func TestS3Cache(t *testing.T) {
+	s3 := &fakeS3{bucket: "state", objects: make(map[string][]byte)}
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+	setenv(t, "AWS_ACCESS_KEY_ID", "test")
+	setenv(t, "AWS_SECRET_ACCESS_KEY", "test")
+	u := "s3://state?" + url.Values{
+		"endpoint":         {srv.URL},
+		"region":           {"us-east-1"},
+		"s3ForcePathStyle": {"true"},
+		"disableSSL":       {"true"},
+	}.Encode()
+	c, err := Open(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testCache(t, c)
+	if _, ok := s3.object("vcf/m10/1.json"); !ok {
+		t.Error("deployment not stored in the bucket")
+	}
+}
+
+// TestS3CacheEndpoint runs against the S3-compatible bucket url in
+// $STATECACHE_TEST_S3_URL, e.g. a MinIO server, with the credentials in
+// the AWS_* environment variables. The bucket must exist.
+func TestS3CacheEndpoint(t *testing.T) {
+	u := os.Getenv("STATECACHE_TEST_S3_URL")
+	if u == "" {
+		t.Skip("STATECACHE_TEST_S3_URL not set")
+	}
+	c, err := Open(context.Background(), u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer c.Drop(context.Background(), "vcf", "m10")
+	testCache(t, c)
+}
+
+func setenv(t *testing.T, k, v string) {
+	old, ok := os.LookupEnv(k)
+	os.Setenv(k, v)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(k, old)
+		} else {
+			os.Unsetenv(k)
+		}
+	})
+}
+
+// fakeS3 serves the object requests of a single bucket with path style
+// addressing: put, get, head, delete and list (v2).
+type fakeS3 struct {
+	bucket  string
+	objects map[string][]byte
+	mu      sync.Mutex
+}
+
+func (f *fakeS3) object(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.objects[key]
+	return b, ok
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if p[0] != f.bucket {
+		s3Error(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if len(p) == 1 || p[1] == "" {
+		if r.Method != http.MethodGet {
+			s3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+			return
+		}
+		f.list(w, r)
+		return
+	}
+	key := p[1]
+	switch r.Method {
+	case http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			s3Error(w, r, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[key] = b
+		w.Header().Set("ETag", etag(b))
+	case http.MethodGet, http.MethodHead:
+		b, ok := f.objects[key]
+		if !ok {
+			s3Error(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(b))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type s3ListResult struct {
+	XMLName     xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	MaxKeys     int
+	IsTruncated bool
+	Contents    []s3Object
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	res := s3ListResult{Name: f.bucket, Prefix: prefix, MaxKeys: 1000}
+	keys := make([]string, 0)
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		res.Contents = append(res.Contents, s3Object{
+			Key:          k,
+			LastModified: time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         etag(f.objects[k]),
+			Size:         len(f.objects[k]),
+			StorageClass: "STANDARD",
+		})
+	}
+	res.KeyCount = len(res.Contents)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(res)
+}
+
+func s3Error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+	}
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
@@ -16,14 +16,24 @@
 *
 ******************************************************************************/
 
-package main
+// Package version holds the version of the automation binary, set at build
+// time with
+//
+//	go build -ldflags "-X github.com/sapcc/vcf-automation/pkg/version.Version=<version>"
+package version
 
-import (
-	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
-)
+import "runtime/debug"
 
-func main() {
-	pulumi.Run(func(ctx *pulumi.Context) error {
-		return newEsxiStack(ctx)
-	})
+// Version of the binary; without ldflags the module version, or dev
+var Version = ""
+
+// Get returns the version of the binary
+func Get() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
 }
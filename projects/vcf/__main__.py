@@ -16,29 +16,37 @@ stack_type = config.require("stackType")
 ###################################################################################
 openstack_config = pulumi.Config("openstack")
 auth_url = openstack_config.require("authUrl")
-region = openstack_config.require("region")
-user_name = openstack_config.require("userName")
-password = openstack_config.require_secret("password")
-provider_cloud_admin = Provider(
-    "cloud_admin",
-    user_name=user_name,
-    password=password,
-    auth_url=auth_url,
-    insecure=True,
-    project_domain_name="ccadmin",
-    user_domain_name="ccadmin",
-    tenant_name="cloud_admin",
-)
-provider_ccadmin_master = Provider(
-    "ccadmin_master",
-    user_name=user_name,
-    password=password,
-    auth_url=auth_url,
-    insecure=True,
-    project_domain_name="ccadmin",
-    user_domain_name="ccadmin",
-    tenant_name="master",
-)
+insecure = openstack_config.get_bool("insecure")
+cacert_file = openstack_config.get("cacertFile")
+
+# the automation sets either a token (auth method token), or user name and
+# password (auth method password). The user signs in to the projects
+# cloud_admin and master of the domain ccadmin.
+token = openstack_config.get_secret("token")
+if token is not None:
+    credentials = dict(token=token)
+else:
+    credentials = dict(
+        user_name=openstack_config.require("userName"),
+        password=openstack_config.require_secret("password"),
+        user_domain_name=openstack_config.get("userDomainName") or "ccadmin",
+    )
+
+
+def ccadmin_provider(name, tenant_name):
+    return Provider(
+        name,
+        auth_url=auth_url,
+        insecure=True if insecure is None else insecure,
+        cacert_file=cacert_file,
+        project_domain_name="ccadmin",
+        tenant_name=tenant_name,
+        **credentials,
+    )
+
+
+provider_cloud_admin = ccadmin_provider("cloud_admin", "cloud_admin")
+provider_ccadmin_master = ccadmin_provider("ccadmin_master", "master")
 
 ###################################################################################
 # provision